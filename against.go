@@ -0,0 +1,164 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Content cataloged here that another catalog has too, like an archive disk's.
+// Paths and Roots are where it is here, and Others and OtherRoots where it is
+// in the other catalog.
+type AgainstDupe struct {
+	Algo       string
+	Hash       string
+	Size       int64
+	Paths      []string
+	Roots      []string
+	Others     []string
+	OtherRoots []string
+}
+
+// The content as the fields of a "dupes-against" event
+func (d *AgainstDupe) Fields() Fields {
+	return Fields{
+		"algo":        d.Algo,
+		"hash":        d.Hash,
+		"size":        d.Size,
+		"paths":       d.Paths,
+		"roots":       d.Roots,
+		"others":      d.Others,
+		"other_roots": d.OtherRoots,
+	}
+}
+
+// The current files here, each content together, leaving out empty files as
+// Dupes does
+var againstQuery string = `
+	select f.algo, f.hash, r.root, f.path, f.size from files f
+	join roots r on r.id = f.root_id
+	where f.size is not 0
+	order by f.algo, f.hash, f.path, r.root
+	`
+
+// Lists the contents cataloged here that other has cataloged too, under any
+// of its roots. The catalogs aren't merged, and other is only read. Contents
+// only compare when the same algorithm hashed them in both.
+func (c *Catalog) DupesAgainst(other *Catalog) ([]*AgainstDupe, error) {
+	rows, err := c.Db.Query(againstQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	local := make([]*AgainstDupe, 0)
+	var cur *AgainstDupe
+	for rows.Next() {
+		var algo, hash, root, path string
+		var size sql.NullInt64
+		err = rows.Scan(&algo, &hash, &root, &path, &size)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if cur == nil || cur.Algo != algo || cur.Hash != hash {
+			cur = &AgainstDupe{Algo: algo, Hash: hash}
+			local = append(local, cur)
+		}
+		if size.Valid {
+			cur.Size = size.Int64
+		}
+
+		// Overlapping roots catalog the same path twice
+		if len(cur.Paths) > 0 && cur.Paths[len(cur.Paths)-1] == path {
+			continue
+		}
+		cur.Paths = append(cur.Paths, path)
+		cur.Roots = append(cur.Roots, root)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	found := make([]*AgainstDupe, 0)
+	for _, d := range local {
+		if c.stopped() {
+			return nil, ErrInterrupted
+		}
+
+		err = other.otherCopies(d)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(d.Others) > 0 {
+			found = append(found, d)
+		}
+	}
+
+	return found, nil
+}
+
+// Fills in where this catalog has d's content
+func (c *Catalog) otherCopies(d *AgainstDupe) error {
+	rows, err := c.Db.Query(`
+		select distinct r.root, f.path from files f
+		join roots r on r.id = f.root_id
+		where f.hash = ? and f.algo = ?
+		order by f.path, r.root
+		`, d.Hash, d.Algo)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root, path string
+		err = rows.Scan(&root, &path)
+		if err != nil {
+			return err
+		}
+
+		if len(d.Others) > 0 && d.Others[len(d.Others)-1] == path {
+			continue
+		}
+		d.Others = append(d.Others, path)
+		d.OtherRoots = append(d.OtherRoots, root)
+	}
+
+	return rows.Err()
+}
+
+// Prints the files cataloged here whose content other already has, with
+// where it has it, and how much of what is here that adds up to
+func (c *Catalog) ReportDupesAgainst(other *Catalog) error {
+	dupes, err := c.DupesAgainst(other)
+	if err != nil {
+		return err
+	}
+
+	name := other.Opts.CatalogPath
+	var files, bytes int64
+	for _, d := range dupes {
+		var text strings.Builder
+		fmt.Fprintf(&text, "%s (%s): %s, %d here and %d in %s\n", d.Hash, d.Algo, c.Out.Size(d.Size), len(d.Paths), len(d.Others), name)
+		for _, path := range d.Paths {
+			fmt.Fprintf(&text, "\t%s\n", path)
+		}
+		for _, path := range d.Others {
+			fmt.Fprintf(&text, "\t= %s\n", path)
+		}
+
+		c.Out.Print("dupes-against", d.Fields(), "%s", text.String())
+
+		files += int64(len(d.Paths))
+		bytes += d.Size * int64(len(d.Paths))
+	}
+
+	c.Out.Print("dupes-against-summary", Fields{"catalog": name, "sets": len(dupes), "files": files, "bytes": bytes},
+		"%d files (%s) cataloged here, in %d sets, already exist in %s\n", files, c.Out.Size(bytes), len(dupes), name)
+
+	return nil
+}
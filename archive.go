@@ -0,0 +1,308 @@
+package leibniz
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Files inside archives scanned with -archives are cataloged under the
+// archive's path, this separator and their path in the archive, like
+// /backups/old.tar.gz!/home/user/file.txt
+const ArchiveSeparator = "!/"
+
+// The archives -archives descends into, by extension
+var archiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func isArchive(p string) bool {
+	lower := strings.ToLower(p)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits the path of a file inside an archive into the archive's path and the
+// file's path in it. ok is false for the paths of ordinary files.
+func SplitArchivePath(p string) (archive, member string, ok bool) {
+	i := strings.Index(p, ArchiveSeparator)
+	for i >= 0 {
+		if isArchive(p[:i]) {
+			return p[:i], p[i+len(ArchiveSeparator):], true
+		}
+
+		next := strings.Index(p[i+1:], ArchiveSeparator)
+		if next < 0 {
+			break
+		}
+		i += 1 + next
+	}
+
+	return "", "", false
+}
+
+// Lstats a cataloged path. Files inside archives are there as long as their
+// archive is, since the archive's next scan catches any that went. Objects in
+// buckets aren't looked up one by one, so they are always there, with no
+// info; prune -unseen drops the ones a scan no longer lists.
+func lstatCataloged(p string) (os.FileInfo, error) {
+	if IsS3Root(p) {
+		return nil, nil
+	}
+
+	if archive, _, ok := SplitArchivePath(p); ok {
+		return os.Lstat(archive)
+	}
+
+	return os.Lstat(p)
+}
+
+// Calls fn with each regular file in the zip or tar archive at p, giving its
+// path in the archive and a reader for its contents, in the order the archive
+// stores them
+func walkArchive(p string, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	if strings.HasSuffix(strings.ToLower(p), ".zip") {
+		z, err := zip.OpenReader(p)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+
+		for _, f := range z.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+
+			err = fn(f.Name, f.FileInfo(), r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if lower := strings.ToLower(p); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		err = fn(h.Name, h.FileInfo(), t)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The member's path inside the archive, as the catalog keeps it
+func archiveMemberPath(archive, name string) string {
+	return archive + ArchiveSeparator + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Members up to this size are read into memory to be hashed, and larger ones
+// into a temporary file, since the hashes need to read at offsets
+const archiveSpoolMemory = 32 << 20
+
+// Copies a member out of its archive where it can be read at any offset,
+// returning a function that cleans up after it
+func spoolMember(r io.Reader, size int64) (io.ReaderAt, func(), error) {
+	if size <= archiveSpoolMemory {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return bytes.NewReader(data), func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "leibniz-member-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return tmp, cleanup, nil
+}
+
+// Catalogs the files inside the archive at realpath as if they were files
+// under it. Archives inside archives aren't opened.
+func (c *Catalog) catalogArchive(rootId int64, realpath string) error {
+	err := walkArchive(realpath, func(name string, info os.FileInfo, r io.Reader) error {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		member := archiveMemberPath(realpath, name)
+		if c.Opts.Excludes.Match(member) || !c.walkable(info, member) {
+			c.Out.Verbosity("excluded", Fields{"path": member}, "Skipping %s\n", member)
+			c.Stats.Excluded++
+			return nil
+		}
+		c.Stats.discovered(info.Size())
+
+		if c.Opts.Incremental {
+			unchanged, err := c.Unchanged(rootId, member, info.ModTime(), info.Size())
+			if err != nil {
+				return err
+			}
+
+			if unchanged {
+				c.Out.Verbosity("unchanged", Fields{"path": member}, "Unchanged %s\n", member)
+				c.Stats.done(&c.Stats.Unchanged, info.Size())
+				return c.Seen(rootId, member, info.Size())
+			}
+		}
+
+		data, cleanup, err := spoolMember(r, info.Size())
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		mime, err := SniffType(data)
+		if err != nil {
+			return err
+		}
+
+		if len(c.Opts.Types) > 0 && !c.typeWanted(mime) {
+			c.Out.Verbosity("excluded", Fields{"path": member, "size": info.Size(), "type": mime}, "Skipping %s (%s)\n", member, mime)
+			c.Stats.done(&c.Stats.Excluded, info.Size())
+			return nil
+		}
+
+		c.Out.Event("hashing", Fields{"path": member, "size": info.Size()})
+		hashes, err := HashAll(append([]string{c.Opts.Hash}, c.extraHashes()...), c.hashReader(data), info)
+		if err != nil {
+			return err
+		}
+
+		hash := hashes[c.Opts.Hash]
+		_, err = c.CatalogHash(rootId, &Entry{Path: member, Algo: c.Opts.Hash, Hash: hash, Mtime: info.ModTime(), Size: info.Size(), Hashes: hashes, Mime: mime, OnDisk: -1})
+		if err != nil {
+			return err
+		}
+
+		c.Out.Verbosity("cataloged", Fields{"path": member, "algo": c.Opts.Hash, "hash": hash}, "Cataloged %s: %s\n", member, hash)
+		c.Stats.done(&c.Stats.Hashed, info.Size())
+		c.Stats.HashedBytes += info.Size()
+		c.showProgress(false)
+
+		return nil
+	})
+	if err == ErrInterrupted {
+		return err
+	}
+	if err != nil {
+		return c.recordError(rootId, realpath, "archive", err)
+	}
+
+	return nil
+}
+
+// Tags the files inside an unchanged archive with the scan in progress,
+// without opening it
+func (c *Catalog) seenArchive(rootId int64, realpath string) error {
+	if c.scan == nil {
+		return nil
+	}
+
+	prefix := realpath + ArchiveSeparator
+	res, err := c.queryer().Exec(`update files set scan_id=? where root_id=? and substr(path, 1, length(?))=?`, c.scan.id, rootId, prefix, prefix)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	c.scan.files += n
+
+	return nil
+}
+
+// Stops walkArchive once the member sought is found
+var errMemberFound = errors.New("found")
+
+// Rehashes a file inside an archive for verify
+func rehashMember(algo, archive, member string) (string, os.FileInfo, error) {
+	var hash string
+	var found os.FileInfo
+	want := archiveMemberPath(archive, member)
+	err := walkArchive(archive, func(name string, info os.FileInfo, r io.Reader) error {
+		if archiveMemberPath(archive, name) != want {
+			return nil
+		}
+
+		data, cleanup, err := spoolMember(r, info.Size())
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		hash, err = HashContent(algo, data, info)
+		if err != nil {
+			return err
+		}
+		found = info
+
+		return errMemberFound
+	})
+	if err == errMemberFound {
+		err = nil
+	} else if err == nil {
+		err = &os.PathError{Op: "open", Path: archive + ArchiveSeparator + member, Err: os.ErrNotExist}
+	}
+
+	return hash, found, err
+}
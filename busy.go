@@ -0,0 +1,35 @@
+package leibniz
+
+import (
+	"strings"
+	"time"
+)
+
+// How many more times a write that finds the catalog busy for all of
+// -busy-timeout is tried, each after twice as long a pause as the last
+const busyRetries = 4
+
+// Calls fn until it doesn't fail because another process is writing to the
+// catalog, or busyRetries run out. A scan's batch can hold the catalog for
+// longer than a busy timeout when its files are big.
+func retryBusy(fn func() error) error {
+	pause := time.Second
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isBusy(err) || i == busyRetries {
+			return err
+		}
+
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// Whether err is SQLite finding the catalog locked by another connection.
+// SQLITE_BUSY and SQLITE_LOCKED read the same with either driver, which
+// the error types don't.
+func isBusy(err error) bool {
+	msg := err.Error()
+
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
@@ -0,0 +1,167 @@
+package leibniz
+
+// What a root holds. Reclaimable only counts copies under the root itself.
+type RootStats struct {
+	Root        string
+	Files       int64
+	Bytes       int64
+	Hashes      int64 // Distinct contents
+	Reclaimable int64
+	Scans       int64
+	LastScan    *Scan // Nil if it was never scanned
+}
+
+// When the root was last scanned, for reports
+func (r *RootStats) lastScanned(o *Output) string {
+	s := r.LastScan
+	if s == nil {
+		return "never scanned"
+	}
+
+	last := "last scanned " + o.Time(s.Started)
+	if s.Finished.IsZero() {
+		last += ", unfinished"
+	}
+
+	return last
+}
+
+// Totals for the whole catalog, from the files currently cataloged under
+// every root
+type CatalogStats struct {
+	Files       int64
+	Bytes       int64
+	Hashes      int64
+	DupeSets    int64
+	DupeFiles   int64 // Copies that could go, one of each set staying
+	Reclaimable int64 // What deduplicating every set would free, as Wasted counts it
+	Scans       int64
+	Roots       []*RootStats
+}
+
+var rootStatsQuery string = `
+	select r.root, count(f.id), coalesce(sum(f.size), 0), count(distinct f.algo || ':' || f.hash),
+		(select count(*) from scans s where s.root_id = r.id)
+	from roots r
+	left join files f on f.root_id = r.id
+	group by r.id
+	order by r.root
+	`
+
+// What each root holds and when it was last scanned, sorted by root. Leaves
+// Reclaimable zero, since only working out every duplicate tells it.
+func (c *Catalog) RootsStats() ([]*RootStats, error) {
+	roots := make([]*RootStats, 0)
+	byRoot := make(map[string]*RootStats)
+
+	rows, err := c.Db.Query(rootStatsQuery)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		r := &RootStats{}
+		err = rows.Scan(&r.Root, &r.Files, &r.Bytes, &r.Hashes, &r.Scans)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		roots = append(roots, r)
+		byRoot[r.Root] = r
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scans, err := c.Scans("")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range scans {
+		if r, ok := byRoot[s.Root]; ok {
+			r.LastScan = s
+		}
+	}
+
+	return roots, nil
+}
+
+// Sums up the catalog: its files and contents, the duplicates among them and
+// the space deduplicating them would free, overall and for each root, and
+// when each root was last scanned
+func (c *Catalog) CatalogStats() (*CatalogStats, error) {
+	roots, err := c.RootsStats()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CatalogStats{Roots: roots}
+	byRoot := make(map[string]*RootStats)
+	for _, r := range roots {
+		byRoot[r.Root] = r
+		stats.Files += r.Files
+		stats.Bytes += r.Bytes
+		stats.Scans += r.Scans
+	}
+
+	err = c.Db.QueryRow(`
+		select count(distinct algo || ':' || hash) from files
+		`).Scan(&stats.Hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := c.Dupes()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		stats.DupeSets++
+		stats.DupeFiles += int64(g.Inodes - 1)
+		stats.Reclaimable += g.Wasted()
+
+		for _, sub := range (DupeScope{WithinRoot: true}).apply(g) {
+			if r, ok := byRoot[sub.Roots[0]]; ok {
+				r.Reclaimable += sub.Wasted()
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// Prints the totals, headed by the space that could be reclaimed, and then
+// each root
+func (c *Catalog) ReportCatalogStats(stats *CatalogStats) {
+	c.Out.Print("stats", Fields{
+		"files":       stats.Files,
+		"bytes":       stats.Bytes,
+		"hashes":      stats.Hashes,
+		"dupe_sets":   stats.DupeSets,
+		"dupe_files":  stats.DupeFiles,
+		"reclaimable": stats.Reclaimable,
+		"roots":       len(stats.Roots),
+		"scans":       stats.Scans,
+	}, "%s reclaimable from %d duplicate files in %d sets\n%d files, %s, %d distinct contents, under %d roots, in %d scans\n",
+		c.Out.Size(stats.Reclaimable), stats.DupeFiles, stats.DupeSets, stats.Files, c.Out.Size(stats.Bytes), stats.Hashes, len(stats.Roots), stats.Scans)
+
+	for _, r := range stats.Roots {
+		fields := Fields{
+			"root":        r.Root,
+			"files":       r.Files,
+			"bytes":       r.Bytes,
+			"hashes":      r.Hashes,
+			"reclaimable": r.Reclaimable,
+			"scans":       r.Scans,
+		}
+
+		last := r.lastScanned(c.Out)
+		if r.LastScan != nil {
+			fields["last_scan"] = r.LastScan.Fields()
+		}
+
+		c.Out.Print("root-stats", fields, "%s: %d files, %s, %d distinct, %s reclaimable within it; %d scans, %s\n",
+			r.Root, r.Files, c.Out.Size(r.Bytes), r.Hashes, c.Out.Size(r.Reclaimable), r.Scans, last)
+	}
+}
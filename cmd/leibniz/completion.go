@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/imipolexg/leibniz"
+)
+
+// Commands made of a command and a subcommand of it
+var subcommands = map[string]map[string]commandFunc{
+	"report": reports,
+	"roots":  rootCommands,
+	"root":   rootCommands,
+}
+
+// Commands, or commands and subcommands, whose arguments are cataloged roots
+var rootArgs = map[string]bool{
+	"rm-root":      true,
+	"diff":         true,
+	"roots info":   true,
+	"roots rm":     true,
+	"roots rename": true,
+	"roots move":   true,
+	"root rename":  true,
+	"root move":    true,
+}
+
+// What the completions offer after a command, or after a command and one of
+// its subcommands
+type completion struct {
+	name    string // Like "scan" or "report usage"
+	summary string
+	flags   []*flag.Flag
+	subs    []string // The subcommands, for a command that has them
+	roots   bool     // Whether its arguments are roots
+}
+
+// The flags a command defines, without running it
+func commandFlags(cmd commandFunc) (flags []*flag.Flag) {
+	set, _ := cmd()
+	set.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+
+	return flags
+}
+
+func completions() []*completion {
+	all := make([]*completion, 0, len(commands))
+	for _, cmd := range commands {
+		// Only ever run by leibniz itself
+		if cmd.Name == "remote" {
+			continue
+		}
+
+		c := &completion{name: cmd.Name, summary: cmd.Summary, roots: rootArgs[cmd.Name]}
+		all = append(all, c)
+
+		subs := subcommands[cmd.Name]
+		if subs == nil {
+			c.flags = commandFlags(cmd.Run)
+			continue
+		}
+
+		for name := range subs {
+			c.subs = append(c.subs, name)
+		}
+		sort.Strings(c.subs)
+
+		for _, name := range c.subs {
+			full := cmd.Name + " " + name
+			all = append(all, &completion{name: full, flags: commandFlags(subs[name]), roots: rootArgs[full]})
+		}
+	}
+
+	return all
+}
+
+// The first sentence of a flag's usage, short enough to show beside it
+func flagSummary(f *flag.Flag) string {
+	usage, _, _ := strings.Cut(f.Usage, ". ")
+	return usage
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func flagNames(flags []*flag.Flag) string {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "-" + f.Name
+	}
+
+	return strings.Join(names, " ")
+}
+
+// Quotes s for the shells, inside single quotes
+func singleQuoted(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeBashCompletion(w io.Writer, all []*completion) {
+	var names []string
+	for _, c := range all {
+		if !strings.Contains(c.name, " ") {
+			names = append(names, c.name)
+		}
+	}
+
+	fmt.Fprintf(w, "# leibniz completion for bash: source it from ~/.bashrc\n")
+	fmt.Fprintf(w, "_leibniz() {\n")
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} cmd=${COMP_WORDS[1]} words= roots=\n")
+	fmt.Fprintf(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", singleQuoted(strings.Join(names, " ")))
+	fmt.Fprintf(w, "\t\treturn\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tcase \"$cmd\" in\n")
+	fmt.Fprintf(w, "\t%s)\n", strings.Join(sortedKeys(subcommands), "|"))
+	fmt.Fprintf(w, "\t\tif [ \"$COMP_CWORD\" -eq 2 ]; then\n")
+	fmt.Fprintf(w, "\t\t\tcase \"$cmd\" in\n")
+	for _, c := range all {
+		if len(c.subs) > 0 {
+			fmt.Fprintf(w, "\t\t\t%s) COMPREPLY=($(compgen -W %s -- \"$cur\")) ;;\n", c.name, singleQuoted(strings.Join(c.subs, " ")))
+		}
+	}
+	fmt.Fprintf(w, "\t\t\tesac\n")
+	fmt.Fprintf(w, "\t\t\treturn\n")
+	fmt.Fprintf(w, "\t\tfi\n")
+	fmt.Fprintf(w, "\t\tcmd=\"$cmd ${COMP_WORDS[2]}\"\n")
+	fmt.Fprintf(w, "\t\t;;\n")
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tcase \"$cmd\" in\n")
+	for _, c := range all {
+		if len(c.subs) > 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\t%s)\n", singleQuoted(c.name))
+		fmt.Fprintf(w, "\t\twords=%s\n", singleQuoted(flagNames(c.flags)))
+		if c.roots {
+			fmt.Fprintf(w, "\t\troots=1\n")
+		}
+		fmt.Fprintf(w, "\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tif [ \"$prev\" = -root ] || { [ -n \"$roots\" ] && [[ $cur != -* ]]; }; then\n")
+	fmt.Fprintf(w, "\t\tlocal IFS=$'\\n'\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W \"$(leibniz completion -roots 2>/dev/null)\" -- \"$cur\"))\n")
+	fmt.Fprintf(w, "\telif [[ $cur == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -o default -F _leibniz leibniz\n")
+}
+
+// Quotes an item of _describe, whose colons separate the item from its
+// description
+func describeItem(name, description string) string {
+	return singleQuoted(strings.ReplaceAll(name, ":", `\:`) + ":" + description)
+}
+
+func writeZshCompletion(w io.Writer, all []*completion) {
+	fmt.Fprintf(w, "#compdef leibniz\n")
+	fmt.Fprintf(w, "# leibniz completion for zsh: save it as _leibniz in a directory on $fpath\n")
+	fmt.Fprintf(w, "_leibniz() {\n")
+	fmt.Fprintf(w, "\tlocal -a items\n")
+	fmt.Fprintf(w, "\tlocal cmd=${words[2]} roots=\n")
+	fmt.Fprintf(w, "\tif (( CURRENT == 2 )); then\n")
+	fmt.Fprintf(w, "\t\titems=(\n")
+	for _, c := range all {
+		if !strings.Contains(c.name, " ") {
+			fmt.Fprintf(w, "\t\t\t%s\n", describeItem(c.name, c.summary))
+		}
+	}
+	fmt.Fprintf(w, "\t\t)\n")
+	fmt.Fprintf(w, "\t\t_describe command items\n")
+	fmt.Fprintf(w, "\t\treturn\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tcase $cmd in\n")
+	fmt.Fprintf(w, "\t%s)\n", strings.Join(sortedKeys(subcommands), "|"))
+	fmt.Fprintf(w, "\t\tif (( CURRENT == 3 )); then\n")
+	fmt.Fprintf(w, "\t\t\tcase $cmd in\n")
+	for _, c := range all {
+		if len(c.subs) > 0 {
+			fmt.Fprintf(w, "\t\t\t%s) compadd -- %s ;;\n", c.name, strings.Join(c.subs, " "))
+		}
+	}
+	fmt.Fprintf(w, "\t\t\tesac\n")
+	fmt.Fprintf(w, "\t\t\treturn\n")
+	fmt.Fprintf(w, "\t\tfi\n")
+	fmt.Fprintf(w, "\t\tcmd=\"$cmd ${words[3]}\"\n")
+	fmt.Fprintf(w, "\t\t;;\n")
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tcase $cmd in\n")
+	for _, c := range all {
+		if len(c.subs) > 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\t%s)\n", singleQuoted(c.name))
+		fmt.Fprintf(w, "\t\titems=(\n")
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "\t\t\t%s\n", describeItem("-"+f.Name, flagSummary(f)))
+		}
+		fmt.Fprintf(w, "\t\t)\n")
+		if c.roots {
+			fmt.Fprintf(w, "\t\troots=1\n")
+		}
+		fmt.Fprintf(w, "\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tif [[ ${words[CURRENT-1]} == -root ]] || [[ -n $roots && $PREFIX != -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tcompadd -- ${(f)\"$(leibniz completion -roots 2>/dev/null)\"}\n")
+	fmt.Fprintf(w, "\t\t_files\n")
+	fmt.Fprintf(w, "\telif [[ $PREFIX == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\t_describe option items\n")
+	fmt.Fprintf(w, "\telse\n")
+	fmt.Fprintf(w, "\t\t_files\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "}\n")
+	// Autoloaded from $fpath the file runs as _leibniz the first time, and
+	// sourced it only defines it
+	fmt.Fprintf(w, "if [ \"$funcstack[1]\" = _leibniz ]; then\n")
+	fmt.Fprintf(w, "\t_leibniz \"$@\"\n")
+	fmt.Fprintf(w, "else\n")
+	fmt.Fprintf(w, "\tcompdef _leibniz leibniz\n")
+	fmt.Fprintf(w, "fi\n")
+}
+
+func writeFishCompletion(w io.Writer, all []*completion) {
+	fmt.Fprintf(w, "# leibniz completion for fish: save it as ~/.config/fish/completions/leibniz.fish\n")
+	for _, c := range all {
+		if !strings.Contains(c.name, " ") {
+			fmt.Fprintf(w, "complete -c leibniz -f -n __fish_use_subcommand -a %s -d %s\n", c.name, singleQuoted(c.summary))
+		}
+	}
+
+	for _, c := range all {
+		cmd, sub, nested := strings.Cut(c.name, " ")
+		cond := "__fish_seen_subcommand_from " + cmd
+		if nested {
+			cond += "; and __fish_seen_subcommand_from " + sub
+		}
+
+		if len(c.subs) > 0 {
+			fmt.Fprintf(w, "complete -c leibniz -f -n %s -a %s\n", singleQuoted(cond+"; and not __fish_seen_subcommand_from "+strings.Join(c.subs, " ")), singleQuoted(strings.Join(c.subs, " ")))
+			continue
+		}
+
+		if c.roots {
+			fmt.Fprintf(w, "complete -c leibniz -n %s -a '(leibniz completion -roots 2>/dev/null)'\n", singleQuoted(cond))
+		}
+		for _, f := range c.flags {
+			arg := ""
+			switch {
+			case f.Name == "root":
+				arg = " -r -a '(leibniz completion -roots 2>/dev/null)'"
+			case !isBoolFlag(f):
+				arg = " -r"
+			}
+			fmt.Fprintf(w, "complete -c leibniz -n %s -o %s%s -d %s\n", singleQuoted(cond), f.Name, arg, singleQuoted(flagSummary(f)))
+		}
+	}
+}
+
+func sortedKeys(m map[string]map[string]commandFunc) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+var completionWriters = map[string]func(io.Writer, []*completion){
+	"bash": writeBashCompletion,
+	"zsh":  writeZshCompletion,
+	"fish": writeFishCompletion,
+}
+
+func completionCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "completion", "bash|zsh|fish")
+	roots := flags.Bool("roots", false, "Print the roots of the catalog, one a line, which the completions run to offer them")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		if *roots {
+			return printRootNames(opts, flags)
+		}
+
+		if flags.NArg() != 1 || completionWriters[flags.Arg(0)] == nil {
+			flags.Usage()
+			return fmt.Errorf("completion needs one of bash, zsh, fish")
+		}
+
+		completionWriters[flags.Arg(0)](os.Stdout, completions())
+
+		return nil
+	}
+}
+
+// Cheap enough to run on every tab: nothing is printed, and no catalog is
+// created, when there is none yet
+func printRootNames(opts *leibniz.Options, flags *flag.FlagSet) error {
+	err := validate(opts, flags)
+	if err != nil {
+		return err
+	}
+
+	if leibniz.IsRemoteCatalog(opts.CatalogPath) {
+		return nil
+	}
+	if _, err := os.Stat(opts.CatalogPath); err != nil {
+		return nil
+	}
+
+	opts.Reporting = true
+	catalog, err := leibniz.OpenCatalog(opts)
+	if err != nil {
+		return err
+	}
+	defer catalog.Db.Close()
+
+	roots, err := catalog.Roots()
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		fmt.Println(root)
+	}
+
+	return nil
+}
@@ -0,0 +1,2515 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"github.com/imipolexg/leibniz"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defines a command's flags on a flag set of its own and returns it, along
+// with what parses args into it and runs the command. Completion only needs
+// the flags, so it never calls the second.
+type commandFunc func() (*flag.FlagSet, func(args []string) error)
+
+type Command struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     commandFunc
+}
+
+var commands []*Command
+
+// The settings every flag set starts from, read from -config or the default
+// config file
+var config = &leibniz.Config{}
+
+func init() {
+	commands = []*Command{
+		{"scan", "[-root dir]... [dir...]", "Catalog all files under one or more roots", scanCommand},
+		{"watch", "[-root dir]", "Catalog a root and keep it up to date as files change", watchCommand},
+		{"daemon", "-every interval|-schedule spec [-root dir]... [dir...]", "Rescan roots on a schedule to keep the catalog fresh", daemonCommand},
+		{"serve", "[-listen addr]", "Serve the catalog over HTTP for lookups, duplicate lists and scans", serveCommand},
+		{"dupes", "[-paranoid] [-by-dir [-full]] [-within-root | -across-roots | -between rootA rootB] [-emit-script -keep policy | -interactive] | -against catalog", "Report files in the catalog that share the same hash", dupesCommand},
+		{"similar", "[-root dir] [-distance bits]", "Find resized and re-exported copies of images scanned with -similarity", similarCommand},
+		{"dedup", "-hardlink|-reflink [-dry-run] [-paranoid] [-trash dir|none]", "Make duplicate files share storage with one copy", dedupCommand},
+		{"trash", "[-operation id] [-trash dir] file...", "Move files to the trash, journaling them so undo can put them back", trashCommand},
+		{"undo", "[operation | log]", "Undo an operation that trashed or replaced files, or list the ones that can be", undoCommand},
+		{"prune", "[-root dir]", "Remove files that no longer exist on disk from the catalog", pruneCommand},
+		{"verify", "[-root dir]", "Rehash cataloged files and report any that changed without their mtime changing", verifyCommand},
+		{"query", "expression", "List cataloged files that match an expression like \"path ~ '\\.mp4$' and mtime < 2020-01-01\"", queryCommand},
+		{"import", "-root dir [-algo name] manifest...", "Catalog the files listed in md5sum, sha256sum or hashdeep manifests", importCommand},
+		{"coverage", "[-root dir] [-dir dir] listing...", "Report cataloged files missing from backups listed by rclone lsjson or restic ls --json", coverageCommand},
+		{"stats", "", "Sum up the catalog: files, duplicates, the space they waste, and each root", statsCommand},
+		{"report", "usage|stale [options]", "Report what takes up space, or hasn't been touched in years, from the catalog alone", reportCommand},
+		{"export", "[-format csv|jsonl|parquet] [-o file]", "Export every row of the catalog's files table for analysis elsewhere", exportCommand},
+		{"errors", "[-root dir] [-scan id]", "List the files and directories a scan couldn't read", errorsCommand},
+		{"scans", "[-root dir]", "List the scans recorded in the catalog", scansCommand},
+		{"diff", "rootA rootB | -from scan [-to scan]", "Report files added, removed, modified and moved between two roots or scans", diffCommand},
+		{"links", "[-root dir] [-broken]", "List the symbolic links recorded by scan -symlinks record", linksCommand},
+		{"lookup", "hash|file...", "List every cataloged copy of a file, or of the content with a hash, under any root", lookupCommand},
+		{"where", "hash|file...", "List the volumes, mounted or not, that hold copies of a file or of the content with a hash", whereCommand},
+		{"history", "file...", "List the contents a path was cataloged with, current and earlier, and when each was first seen", historyCommand},
+		{"explain-filter", "[-root dir]... path...", "Tell whether a scan would catalog a path, and which exclude, ignore rule or other filter decides it", explainFilterCommand},
+		{"hash", "[-sum] file... | -c manifest...", "Print the hashes of files without cataloging them, or check them against a manifest", hashCommand},
+		{"rm-root", "root...", "Remove roots and all of their files from the catalog", rmRootCommand},
+		{"roots", "list | info root... | rm root...", "List the cataloged roots with their size and last scan, show one in detail, or remove some", rootCommand},
+		{"volumes", "", "List the volume each root is on, and whether it is mounted", volumesCommand},
+		{"root", "rename|move old new", "Re-point a root, and everything cataloged under it, at the path it has moved to", rootCommand},
+		{"compact", "[-history]", "Delete orphaned rows, rebuild indexes and shrink the catalog file", compactCommand},
+		{"seal", "[-key secret] [-o file] | -keygen path", "Write a digest of the catalog's contents, optionally signed", sealCommand},
+		{"attest", "[-pub key] seal", "Check that the catalog still matches a seal", attestCommand},
+		{"sync", "[-pull] catalog", "Merge two catalogs both ways by root and path, the newest mtime winning", syncCommand},
+		{"merge", "-o catalog catalog...", "Combine several catalogs into a new one, one root for each path and the newest mtime winning", mergeCommand},
+		{"split", "-root dir... -o catalog", "Copy roots, and everything cataloged under them, into a new catalog of their own", splitCommand},
+		{"completion", "bash|zsh|fish", "Print shell completions for leibniz's commands, their flags and the cataloged roots", completionCommand},
+		{"remote", "", "Serve the catalog over stdin and stdout, for leibniz on another host using it as ssh://host/path", remoteCommand},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", filepath.Base(os.Args[0]))
+}
+
+// Every command gets a flag set with the options shared by all of them
+func flagSet(o *leibniz.Options, name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options] %s\n", filepath.Base(os.Args[0]), name, args)
+		flags.PrintDefaults()
+	}
+
+	// The config was checked when it was loaded, so this can't fail
+	config.Apply(o)
+
+	// Read by main before any command runs
+	flags.String("config", leibniz.DefaultConfigPath(), "Read settings from this TOML file. Flags override them")
+	flags.String("profile", "", "Use the settings of this profile in the config as well")
+
+	flags.StringVar(&o.CatalogPath, "catalog", o.CatalogPath, "Path to the catalog file, or ssh://[user@]host/path for one on another host")
+	flags.BoolVar(&o.Verbose, "verbose", o.Verbose, "Be chattier")
+	flags.BoolVar(&o.JSON, "json", o.JSON, "Write output as JSON lines")
+	flags.BoolVar(&o.Bytes, "bytes", o.Bytes, "Print sizes as byte counts instead of KiB, MiB and GiB")
+	flags.BoolVar(&o.ISO, "iso", o.ISO, "Print times in ISO 8601 alone, without how long ago they were")
+	flags.StringVar(&o.JournalMode, "journal-mode", o.JournalMode, "SQLite journal mode for the catalog. Use delete on network filesystems")
+	flags.StringVar(&o.Synchronous, "synchronous", o.Synchronous, "SQLite synchronous setting for the catalog")
+	flags.IntVar(&o.CacheSize, "cache-size", o.CacheSize, "SQLite page cache size in MiB")
+	flags.DurationVar(&o.BusyTimeout, "busy-timeout", o.BusyTimeout, "How long to wait for another leibniz writing to the catalog, like 1m, before trying again")
+	flags.StringVar(&o.LogFormat, "log-format", o.LogFormat, "Log with timestamps and levels instead of printing, as "+strings.Join(leibniz.LogFormats, " or "))
+	flags.StringVar(&o.LogLevel, "log-level", o.LogLevel, "Least severe records to log: "+strings.Join(leibniz.LogLevels, ", ")+". Defaults to info, or debug with -verbose")
+	flags.StringVar(&o.LogFile, "log-file", o.LogFile, "Append the log to this file instead of stdout. Implies -log-format text unless given")
+
+	return flags
+}
+
+// For commands that only read the catalog, so they can run against one on
+// read-only media or owned by someone else
+func readOnlyFlag(o *leibniz.Options, flags *flag.FlagSet) {
+	flags.BoolVar(&o.ReadOnly, "ro", o.ReadOnly, "Open the catalog read-only. It must already be at this leibniz's schema version")
+}
+
+// For commands that never write to the catalog, which open it read-only
+// whenever it is already at this leibniz's schema version, so they neither
+// wait for a scan nor hold one up
+func reportFlags(o *leibniz.Options, flags *flag.FlagSet) {
+	o.Reporting = true
+	readOnlyFlag(o, flags)
+}
+
+// For commands that act on duplicates
+func paranoidFlag(o *leibniz.Options, flags *flag.FlagSet) {
+	flags.BoolVar(&o.Paranoid, "paranoid", o.Paranoid, "Compare copies byte for byte before reporting or acting on them, splitting sets whose hashes collide, and record the ones found identical")
+}
+
+// For commands that remove or replace files
+func trashFlag(o *leibniz.Options, flags *flag.FlagSet) {
+	flags.StringVar(&o.Trash, "trash", o.Trash, "Move files that are removed or replaced into this directory instead of the OS trash, or "+leibniz.TrashNone+" to not keep them")
+}
+
+// Opens the undo log an operation journals to: the one given, or one named
+// after the operation next to the catalog. A new operation's log mustn't
+// exist yet, so that two runs never share one by accident.
+func openJournal(opts *leibniz.Options, undoLog, operation string, isNew bool) (*os.File, string, error) {
+	if undoLog == "" && leibniz.IsRemoteCatalog(opts.CatalogPath) {
+		return nil, "", fmt.Errorf("give -undo-log with a remote catalog, since the log can't go next to it")
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if undoLog == "" {
+		undoLog = leibniz.JournalPath(opts.CatalogPath, operation)
+		if isNew {
+			flag |= os.O_EXCL
+		}
+	}
+
+	log, err := os.OpenFile(undoLog, flag, 0644)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return log, undoLog, nil
+}
+
+// Directories given with a repeatable flag
+type rootsFlag []string
+
+func (r *rootsFlag) String() string {
+	return strings.Join(*r, ", ")
+}
+
+func (r *rootsFlag) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func scanFlags(o *leibniz.Options, flags *flag.FlagSet) {
+	flags.Var(o.Excludes, "exclude", "Exclude paths that match this regex. Excludes are tested before includes")
+	flags.Var(leibniz.GlobFlag{Regexps: o.Excludes}, "exclude-glob", "Exclude paths that match this glob, where ** matches any number of directories, like '**/node_modules/**'")
+	flags.Var(o.Includes, "include", "Include paths that match this regex")
+	flags.Var(&o.MinSize, "min-size", "Skip files smaller than this, like 1 or 10K")
+	flags.Var(&o.MaxSize, "max-size", "Skip files larger than this, like 4G")
+	flags.DurationVar(&o.MinAge, "min-age", o.MinAge, "Skip files modified more recently than this, like 10m, since they may still be being written")
+	flags.DurationVar(&o.MtimeTolerance, "mtime-tolerance", o.MtimeTolerance, "Take mtimes this close together as the same, like 2s for FAT, when telling whether a file changed")
+	flags.IntVar(&o.MaxDepth, "max-depth", o.MaxDepth, "Only go this many directories deep under each root, 1 for only the files directly in it")
+	flags.Int64Var(&o.MaxFiles, "max-files", o.MaxFiles, "Stop each root's scan after this many files")
+	flags.Var(&o.MaxBytes, "max-bytes", "Stop each root's scan before the files dealt with add up to more than this, like 10G")
+	flags.DurationVar(&o.MaxDuration, "max-duration", o.MaxDuration, "Stop each root's scan once it has run this long, like 1h, after the file being hashed")
+	flags.StringVar(&o.Order, "order", o.Order, "Walk breadth first (bfs) or depth first (dfs), taking each directory's entries by name")
+	flags.IntVar(&o.DirBatch, "readdir-batch", o.DirBatch, "Read directories this many entries at a time, each batch in order of names, or 0 to read each whole")
+	flags.BoolVar(&o.Enumerate, "enumerate", o.Enumerate, "List every file before hashing any, so progress shows how far along the scan is")
+	flags.StringVar(&o.OrderBy, "order-by", o.OrderBy, "Enumerate first, then hash files in this order: "+strings.Join(leibniz.HashOrders, ", "))
+	flags.BoolVar(&o.OneFileSystem, "one-file-system", o.OneFileSystem, "Don't descend into directories on other filesystems than the root's, like find -xdev")
+	flags.BoolVar(&o.SpecialFS, "special-fs", o.SpecialFS, "Also walk /proc, /sys, /dev, /run, FUSE mounts and other pseudo filesystems, which are skipped otherwise")
+	flags.BoolVar(&o.MarkVolume, "mark-volume", o.MarkVolume, "Write a "+leibniz.VolumeMarker+" file to the top of a volume that has no filesystem UUID, so its roots are recognised wherever it mounts")
+	flags.Var(&o.BandwidthLimit, "bwlimit", "Read files no faster than this many bytes a second, like 50M")
+	flags.BoolVar(&o.Nice, "nice", o.Nice, "Scan at the lowest CPU and I/O priority, pausing while the load average is above the number of CPUs")
+	flags.BoolVar(&o.Similarity, "similarity", o.Similarity, "Also store a perceptual hash of each JPEG, PNG and GIF image, for the similar command")
+	flags.BoolVar(&o.Metadata, "metadata", o.Metadata, "Also store when images and videos were taken, their camera, dimensions, duration and codec, for queries")
+	flags.BoolVar(&o.Owner, "owner", o.Owner, "Also store each file's uid, gid and permission bits, for queries")
+	flags.BoolVar(&o.Xattrs, "xattrs", o.Xattrs, "Also store each file's extended attributes")
+	flags.BoolVar(&o.S3ETags, "s3-etags", o.S3ETags, "With -hash md5, take the MD5 ETags of objects in s3:// roots as their digests instead of reading them")
+	flags.BoolVar(&o.Archives, "archives", o.Archives, "Also catalog the files inside .zip, .tar and .tar.gz archives, as archive"+leibniz.ArchiveSeparator+"path")
+	flags.Var(&o.ExtraHashes, "extra-hashes", "Also hash with these algorithms, comma separated, in the same read of each file")
+	flags.Var(&o.Types, "type", "Only catalog files whose sniffed content type matches one of these patterns, like image/*; patterns starting with ! skip types instead")
+	flags.BoolVar(&o.IgnoreFiles, "ignore-files", o.IgnoreFiles, "Skip paths matched by "+leibniz.IgnoreFileName+" files, which use .gitignore syntax")
+	flags.StringVar(&o.GlobalIgnore, "global-ignore", o.GlobalIgnore, "An ignore file applied to every root")
+	flags.StringVar(&o.Symlinks, "symlinks", o.Symlinks, "What to do with symbolic links: "+strings.Join(leibniz.SymlinkModes, ", "))
+	flags.BoolVar(&o.Incremental, "incremental", o.Incremental, "Skip files already cataloged with the same path, mtime and size")
+	flags.BoolVar(&o.FastDirs, "fast-dirs", o.FastDirs, "Don't read directories whose mtime and number of entries are the same as at the last scan, taking the files in them to be unchanged. Best with -incremental")
+	flags.IntVar(&o.FullEvery, "full-every", o.FullEvery, "With -fast-dirs, read every directory anyway every this many scans of a root, to catch files changed in place, or 0 for never")
+	flags.BoolVar(&o.HashCache, "hash-cache", o.HashCache, "Reuse the hashes of files hashed before with the same device, inode, size and mtime, under any path or root")
+	flags.IntVar(&o.BatchSize, "batch", o.BatchSize, "Commit to the catalog every this many files")
+	flags.BoolVar(&o.Prune, "prune", o.Prune, "After scanning, remove files under the root that no longer exist")
+	flags.BoolVar(&o.KeepHistory, "keep-history", o.KeepHistory, "Keep the earlier hashes of files that changed, for the history command and diff -from, rather than only the current ones")
+	flags.BoolVar(&o.DetectMoves, "moves", o.DetectMoves, "Repoint files whose content reappears at a new path instead of cataloging them again")
+	flags.BoolVar(&o.Progress, "progress", isTerminal(os.Stderr), "Show scan progress on stderr")
+	hashFlag(o, flags)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func hashFlag(o *leibniz.Options, flags *flag.FlagSet) {
+	flags.StringVar(&o.Hash, "hash", o.Hash, "Hash algorithm: "+strings.Join(leibniz.Hashers(), ", "))
+	flags.Var((*leibniz.SizeFlag)(&o.Sampling.Threshold), "sample-threshold", "With the sampled xxhash, hash files smaller than this in full, like 1M")
+	flags.Var((*leibniz.SizeFlag)(&o.Sampling.Size), "sample-size", "With the sampled xxhash, read this much of the file for each sample, like 4K")
+	flags.IntVar(&o.Sampling.Count, "samples", o.Sampling.Count, "With the sampled xxhash, take this many samples, from the start to the end of the file")
+}
+
+func validate(o *leibniz.Options, flags *flag.FlagSet) error {
+	if o.CatalogPath == "" {
+		flags.Usage()
+		return fmt.Errorf("no catalog given")
+	}
+
+	o.ApplySampling()
+	err := o.Validate()
+	if err != nil {
+		flags.Usage()
+		return err
+	}
+
+	if o.BatchSize < 1 {
+		o.BatchSize = 1
+	}
+
+	return nil
+}
+
+// The options for each of roots that the config has settings of its own for:
+// those settings on top of the rest of the config, and the flags in args on
+// top of both, parsed again with the flag set newFlags makes
+func rootOptions(roots, args []string, newFlags func(*leibniz.Options, *rootsFlag) *flag.FlagSet) (map[string]*leibniz.Options, error) {
+	general := config
+	defer func() { config = general }()
+
+	perRoot := make(map[string]*leibniz.Options)
+	for _, root := range roots {
+		config = general.ForRoot(root)
+		if config == general {
+			continue
+		}
+
+		opts := leibniz.DefaultOptions()
+		flags := newFlags(opts, &rootsFlag{})
+		flags.Parse(args)
+		err := validate(opts, flags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", root, err)
+		}
+		perRoot[root] = opts
+	}
+
+	return perRoot, nil
+}
+
+func scanFlagSet(opts *leibniz.Options, roots *rootsFlag) *flag.FlagSet {
+	flags := flagSet(opts, "scan", "[-root dir]... [dir...]")
+	flags.Var(roots, "root", "Catalog all files in this directory, or under this s3://bucket/prefix. Repeat it, or list directories after the flags, to catalog several")
+	flags.StringVar(&opts.FilesFrom, "files-from", "", "Catalog only the files listed in this file, or on stdin for -, one a line, instead of walking the root")
+	flags.BoolVar(&opts.FilesFromNul, "null", false, "With -files-from, paths are separated by NULs, as find -print0 and fd -0 write them")
+	flags.BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "Only walk the roots, printing what would be cataloged and what is skipped and why, without hashing or writing to the catalog")
+	scanFlags(opts, flags)
+
+	return flags
+}
+
+func scanCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	var roots rootsFlag
+	flags := scanFlagSet(opts, &roots)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		roots = append(roots, flags.Args()...)
+		if len(roots) == 0 {
+			roots = append(roots, config.Roots...)
+		}
+		if len(roots) == 0 && opts.Root != "" {
+			roots = append(roots, opts.Root)
+		}
+
+		if len(roots) == 0 {
+			flags.Usage()
+			return fmt.Errorf("no root given")
+		}
+
+		// The list can only be read once
+		if opts.FilesFrom != "" && len(roots) > 1 {
+			return fmt.Errorf("-files-from takes a single root, which the files listed must be under")
+		}
+
+		// Check every root before scanning any, so a typo in the last one doesn't
+		// leave the run half done
+		err = checkRoots(roots)
+		if err != nil {
+			return err
+		}
+
+		perRoot, err := rootOptions(roots, args, scanFlagSet)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		catalog.Stop = interrupts()
+		catalog.RootOpts = perRoot
+
+		for _, re := range *opts.Excludes {
+			catalog.Out.Print("excluding", leibniz.Fields{"regex": re.String()}, "Excluding: %s\n", re.String())
+		}
+
+		for _, root := range roots {
+			catalog.SetRoot(root)
+			if len(roots) > 1 {
+				catalog.Out.Print("scan", leibniz.Fields{"root": root}, "Cataloging %s\n", root)
+			} else {
+				catalog.Out.Verbosity("scan", leibniz.Fields{"root": root}, "Cataloging %s\n", root)
+			}
+
+			err = catalog.Run()
+			catalog.ReportStats()
+			if err != nil {
+				return err
+			}
+
+			if catalog.Opts.Prune && !catalog.Opts.DryRun {
+				err = catalog.ReportPrune(root, false)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// A channel closed on SIGINT or SIGTERM, so scans can commit what they have
+// and stop. A second signal exits right away.
+func interrupts() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintf(os.Stderr, "Stopping; interrupt again to quit right away\n")
+		close(stop)
+		<-signals
+		os.Exit(130)
+	}()
+
+	return stop
+}
+
+// Roots are kept as absolute paths, except buckets
+func absRoot(root string) (string, error) {
+	if leibniz.IsS3Root(root) {
+		return strings.TrimSuffix(root, "/"), nil
+	}
+
+	return filepath.Abs(root)
+}
+
+// Makes roots absolute, making sure each is a directory
+func checkRoots(roots []string) (err error) {
+	for i, root := range roots {
+		if leibniz.IsS3Root(root) {
+			roots[i] = strings.TrimSuffix(root, "/")
+			err = leibniz.CheckS3Root(roots[i])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		roots[i], err = filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(roots[i])
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", roots[i])
+		}
+	}
+
+	return nil
+}
+
+func watchCommand() (*flag.FlagSet, func(args []string) error) {
+	var settle time.Duration
+	newFlags := func(opts *leibniz.Options, _ *rootsFlag) *flag.FlagSet {
+		opts.Incremental = true
+		flags := flagSet(opts, "watch", "[-root dir]")
+		flags.StringVar(&opts.Root, "root", opts.Root, "Catalog all files in this directory")
+		scanFlags(opts, flags)
+		flags.DurationVar(&settle, "settle", 2*time.Second, "Wait until a file has been left alone this long before hashing it")
+
+		return flags
+	}
+
+	opts := leibniz.DefaultOptions()
+	flags := newFlags(opts, nil)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if opts.Root == "" {
+			flags.Usage()
+			return fmt.Errorf("no root given")
+		}
+
+		opts.Root, err = filepath.Abs(opts.Root)
+		if err != nil {
+			return err
+		}
+
+		perRoot, err := rootOptions([]string{opts.Root}, args, newFlags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		stop := interrupts()
+		catalog.Stop = stop
+		catalog.RootOpts = perRoot
+		catalog.SetRoot(opts.Root)
+
+		return catalog.Watch(settle, stop)
+	}
+}
+
+func daemonCommand() (*flag.FlagSet, func(args []string) error) {
+	var every time.Duration
+	var spec, logTo, metrics string
+	var now bool
+	newFlags := func(opts *leibniz.Options, roots *rootsFlag) *flag.FlagSet {
+		opts.Incremental = true
+		flags := flagSet(opts, "daemon", "-every interval|-schedule spec [-root dir]... [dir...]")
+		flags.Var(roots, "root", "Catalog all files in this directory, or under this s3://bucket/prefix. Repeat it, or list directories after the flags, to catalog several")
+		scanFlags(opts, flags)
+		flags.DurationVar(&every, "every", 0, "Scan this often, like 30m or 6h")
+		flags.StringVar(&spec, "schedule", "", "Scan at the times of this cron spec, like \"30 3 * * *\" or @daily")
+		flags.BoolVar(&now, "now", false, "Also scan as soon as the daemon starts")
+		flags.StringVar(&logTo, "log", "auto", "Where to log: stdout, syslog, or auto for stdout under systemd and syslog otherwise")
+		flags.StringVar(&metrics, "metrics", "", "Serve Prometheus metrics at /metrics on this address, like :9184")
+
+		return flags
+	}
+
+	opts := leibniz.DefaultOptions()
+	var roots rootsFlag
+	flags := newFlags(opts, &roots)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		// Nobody is watching a daemon's terminal
+		opts.Progress = false
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		var schedule leibniz.Schedule
+		switch {
+		case every > 0 && spec != "":
+			return fmt.Errorf("-every and -schedule can't be used together")
+		case every > 0:
+			schedule = leibniz.Every(every)
+		case spec != "":
+			schedule, err = leibniz.ParseCron(spec)
+			if err != nil {
+				return err
+			}
+		default:
+			flags.Usage()
+			return fmt.Errorf("no -every or -schedule given")
+		}
+
+		roots = append(roots, flags.Args()...)
+		if len(roots) == 0 {
+			roots = append(roots, config.Roots...)
+		}
+		if len(roots) == 0 {
+			flags.Usage()
+			return fmt.Errorf("no root given")
+		}
+
+		err = checkRoots(roots)
+		if err != nil {
+			return err
+		}
+
+		perRoot, err := rootOptions(roots, args, newFlags)
+		if err != nil {
+			return err
+		}
+		for _, o := range perRoot {
+			o.Progress = false
+		}
+
+		// journald already collects what a systemd service writes, and says so
+		// through JOURNAL_STREAM. A -log-file is where to log.
+		switch logTo {
+		case "auto":
+			if os.Getenv("JOURNAL_STREAM") != "" || opts.LogFile != "" {
+				logTo = "stdout"
+			} else {
+				logTo = "syslog"
+			}
+		case "stdout", "syslog":
+		default:
+			return fmt.Errorf("-log must be stdout, syslog or auto, not %q", logTo)
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		if logTo == "syslog" {
+			catalog.Out.W, err = syslogWriter()
+			if err != nil {
+				return fmt.Errorf("can't log to syslog, try -log stdout: %s", err)
+			}
+			if catalog.Out.Log != nil {
+				catalog.Out.Log = leibniz.NewLogger(catalog.Out.W, opts)
+			}
+		}
+
+		if metrics != "" {
+			listener, err := net.Listen("tcp", metrics)
+			if err != nil {
+				return err
+			}
+
+			catalog.Metrics = leibniz.NewMetrics()
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", leibniz.MetricsHandler(catalog))
+			go http.Serve(listener, mux)
+		}
+
+		stop := interrupts()
+		catalog.Stop = stop
+		catalog.RootOpts = perRoot
+
+		// Under systemd, with Type=notify, the daemon says when it is up, what it
+		// is doing for systemctl status, and with WatchdogSec, that it is alive
+		catalog.Out.Hook = func(event string, fields leibniz.Fields) {
+			switch event {
+			case "scan":
+				leibniz.SdNotify(fmt.Sprintf("STATUS=Cataloging %s", fields["root"]))
+			case "daemon-next":
+				leibniz.SdNotify(fmt.Sprintf("STATUS=Next scan at %s", fields["time"].(time.Time).Format(time.RFC3339)))
+			}
+		}
+		if interval := leibniz.WatchdogInterval(); interval > 0 {
+			go func() {
+				for range time.Tick(interval) {
+					leibniz.SdNotify("WATCHDOG=1")
+				}
+			}()
+		}
+		leibniz.SdNotify("READY=1")
+		defer leibniz.SdNotify("STOPPING=1")
+
+		return catalog.Daemon(roots, schedule, now, stop)
+	}
+}
+
+func serveCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	opts.Incremental = true
+	flags := flagSet(opts, "serve", "[-listen addr]")
+	readOnlyFlag(opts, flags)
+	scanFlags(opts, flags)
+	listen := flags.String("listen", "127.0.0.1:8787", "Address to serve the HTTP API on")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		opts.Progress = false
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		catalog.Out.Print("serving", leibniz.Fields{"listen": *listen}, "Serving %s on %s\n", opts.CatalogPath, *listen)
+
+		return http.ListenAndServe(*listen, leibniz.NewServer(catalog))
+	}
+}
+
+func dupesCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "dupes", "[-paranoid] [-by-dir [-full]] [-within-root | -across-roots | -between rootA rootB] [-emit-script -keep policy | -interactive] | -against catalog")
+	readOnlyFlag(opts, flags)
+	byDir := flags.Bool("by-dir", false, "Sum up duplicates by directory instead of listing each set")
+	full := flags.Bool("full", false, "With -by-dir, only list directories whose every file has a copy elsewhere")
+	var scope leibniz.DupeScope
+	flags.BoolVar(&scope.WithinRoot, "within-root", false, "Only count copies under the same root as duplicates")
+	flags.BoolVar(&scope.AcrossRoots, "across-roots", false, "Only list sets with copies under more than one root")
+	between := flags.Bool("between", false, "Only list copies under the two roots given as arguments, in sets that have copies under both")
+	against := flags.String("against", "", "List the files here whose content this other catalog already has, under any of its roots, without merging the two")
+	emitScript := flags.Bool("emit-script", false, "Write a shell script that removes all but one copy of each set instead of listing them")
+	interactive := flags.Bool("interactive", false, "Go through the sets one at a time, marking copies to keep, remove or hard link, then write the script doing it")
+	keep := flags.String("keep", "", "With -emit-script, the copy to keep: newest, oldest, shortest-path or in-root=dir. With -interactive, what to start from")
+	remove := flags.String("remove-with", "", "With -emit-script or -interactive, the command that removes a copy, like rm or gio trash. Defaults to leibniz trash, so that undo can put them back")
+	paranoidFlag(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		scopes := 0
+		for _, set := range []bool{scope.WithinRoot, scope.AcrossRoots, *between} {
+			if set {
+				scopes++
+			}
+		}
+		if scopes > 1 || (scopes > 0 && *byDir) {
+			flags.Usage()
+			return fmt.Errorf("-within-root, -across-roots, -between and -by-dir can't be combined")
+		}
+
+		var policy *leibniz.KeepPolicy
+		if (*emitScript && *keep == "") || (*keep != "" && !*emitScript && !*interactive) || ((*emitScript || *interactive) && *byDir) || (*emitScript && *interactive) {
+			flags.Usage()
+			return fmt.Errorf("-emit-script needs -keep, and neither it nor -interactive can be combined with -by-dir or each other")
+		}
+		if *keep != "" {
+			policy, err = leibniz.ParseKeepPolicy(*keep)
+			if err != nil {
+				return err
+			}
+
+			if policy.Root != "" {
+				policy.Root, err = absRoot(policy.Root)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if *against != "" && (scopes > 0 || *byDir || *emitScript || *interactive || opts.Paranoid) {
+			flags.Usage()
+			return fmt.Errorf("-against can't be combined with other options of dupes")
+		}
+
+		if *between {
+			if flags.NArg() != 2 {
+				flags.Usage()
+				return fmt.Errorf("-between needs two roots")
+			}
+
+			for i, root := range flags.Args() {
+				scope.Between[i], err = absRoot(root)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		if *against != "" {
+			// Opening one that isn't there would create it
+			if _, err := os.Stat(*against); err != nil && !leibniz.IsRemoteCatalog(*against) {
+				return err
+			}
+
+			otherOpts := *opts
+			otherOpts.CatalogPath = *against
+			otherOpts.ReadOnly = false
+			otherOpts.Reporting = true
+			other, err := leibniz.OpenCatalog(&otherOpts)
+			if err != nil {
+				return err
+			}
+			defer other.Db.Close()
+
+			catalog.Stop = interrupts()
+			return catalog.ReportDupesAgainst(other)
+		}
+
+		if *byDir {
+			return catalog.ReportDirDupes(*full)
+		}
+
+		// Only a written script removes anything
+		if *remove == "" && (*emitScript || *interactive) {
+			*remove, err = leibniz.TrashCommand(opts.CatalogPath, leibniz.NewOperationId("dupes"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if *emitScript {
+			return catalog.EmitDupesScript(scope, policy, *remove)
+		}
+
+		if *interactive {
+			return catalog.ResolveDupes(scope, policy, *remove, os.Stdin, os.Stderr)
+		}
+
+		return catalog.ReportDupes(scope)
+	}
+}
+
+func dedupCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "dedup", "-hardlink|-reflink [-dry-run] [-paranoid] [-trash dir|none]")
+	hardlink := flags.Bool("hardlink", false, "Replace duplicates with hard links to a canonical copy, after comparing them byte for byte")
+	reflink := flags.Bool("reflink", false, "Replace duplicates with clones of a canonical copy that share its extents (btrfs, XFS, APFS)")
+	dryRun := flags.Bool("dry-run", false, "Report what would be done without changing anything")
+	undoLog := flags.String("undo-log", "", "Where to log replacements. Defaults to a file next to the catalog named after the operation")
+	undo := flags.String("undo", "", "Undo the replacements recorded in this log, as undo does")
+	trashFlag(opts, flags)
+	paranoidFlag(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		given := 0
+		method := ""
+		if *hardlink {
+			given++
+			method = leibniz.DedupHardlink
+		}
+		if *reflink {
+			given++
+			method = leibniz.DedupReflink
+		}
+		if *undo != "" {
+			given++
+		}
+		if given != 1 {
+			flags.Usage()
+			return fmt.Errorf("give one of -hardlink, -reflink or -undo")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		if *undo != "" {
+			return catalog.UndoJournal(*undo)
+		}
+
+		if *dryRun {
+			return catalog.Dedup(method, true, ioutil.Discard)
+		}
+
+		if opts.Trash != "" && opts.Trash != leibniz.TrashNone {
+			opts.Trash, err = filepath.Abs(opts.Trash)
+			if err != nil {
+				return err
+			}
+		}
+
+		operation := leibniz.NewOperationId("dedup")
+		log, name, err := openJournal(opts, *undoLog, operation, true)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+
+		fmt.Fprintf(os.Stderr, "Logging replacements to %s, undo with: %s undo %s\n", name, filepath.Base(os.Args[0]), operation)
+		if opts.Trash != leibniz.TrashNone {
+			fmt.Fprintf(os.Stderr, "The replaced copies go to the trash, and take up space until it is emptied\n")
+		}
+
+		return catalog.Dedup(method, false, log)
+	}
+}
+
+func trashCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "trash", "[-operation id] [-trash dir] file...")
+	operation := flags.String("operation", "", "Journal to this operation, so that one undo puts back files trashed by several runs. Defaults to a new one")
+	undoLog := flags.String("undo-log", "", "Where to journal the files trashed. Defaults to a file next to the catalog named after the operation")
+	trashFlag(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return fmt.Errorf("no files given")
+		}
+
+		if opts.Trash == leibniz.TrashNone {
+			return fmt.Errorf("trash can't do without a trash")
+		}
+
+		if opts.Trash != "" {
+			opts.Trash, err = filepath.Abs(opts.Trash)
+			if err != nil {
+				return err
+			}
+		}
+
+		paths := make([]string, flags.NArg())
+		for i, p := range flags.Args() {
+			paths[i], err = filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		isNew := *operation == ""
+		if isNew {
+			*operation = leibniz.NewOperationId(leibniz.OpTrash)
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		log, _, err := openJournal(opts, *undoLog, *operation, isNew)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+
+		return catalog.Trash(paths, log)
+	}
+}
+
+func undoCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "undo", "[operation | log]")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() > 1 {
+			flags.Usage()
+			return fmt.Errorf("give one operation at a time")
+		}
+
+		if flags.NArg() == 0 {
+			ops, err := leibniz.Operations(opts.CatalogPath)
+			if err != nil {
+				return err
+			}
+
+			for _, op := range ops {
+				fmt.Println(op)
+			}
+			return nil
+		}
+
+		name := flags.Arg(0)
+		if _, err := os.Stat(name); os.IsNotExist(err) && !leibniz.IsRemoteCatalog(opts.CatalogPath) {
+			name = leibniz.JournalPath(opts.CatalogPath, name)
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.UndoJournal(name)
+	}
+}
+
+func pruneCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "prune", "[-root dir]")
+	root := flags.String("root", "", "Only prune files under this root")
+	unseen := flags.Bool("unseen", false, "Prune files the last finished scan of their root didn't see, without checking the disk")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportPrune(*root, *unseen)
+	}
+}
+
+func verifyCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "verify", "[-root dir]")
+	readOnlyFlag(opts, flags)
+	root := flags.String("root", "", "Only verify files under this root")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportVerify(*root)
+	}
+}
+
+func queryCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "query", "expression")
+	reportFlags(opts, flags)
+	usage := flags.Usage
+	flags.Usage = func() {
+		usage()
+		fmt.Fprintf(os.Stderr, "\nExpressions compare fields with = != < <= > >=, or match them against\n")
+		fmt.Fprintf(os.Stderr, "regular expressions with ~ and !~, joined with and, or, not and parentheses.\n")
+		fmt.Fprintf(os.Stderr, "Fields: %s\n", strings.Join(leibniz.QueryFields(), ", "))
+	}
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportQuery(strings.Join(flags.Args(), " "))
+	}
+}
+
+func importCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "import", "-root dir [-algo name] manifest...")
+	flags.StringVar(&opts.Root, "root", "", "Catalog the files under this root. Relative paths in the manifests are relative to it")
+	algo := flags.String("algo", "", "Algorithm the manifests' digests were made with, one of "+strings.Join(leibniz.ManifestAlgorithms, ", ")+". Worked out from the manifest by default")
+	flags.IntVar(&opts.BatchSize, "batch", opts.BatchSize, "Commit to the catalog every this many files")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if opts.Root == "" || flags.NArg() == 0 {
+			flags.Usage()
+			return fmt.Errorf("import needs -root and at least one manifest")
+		}
+
+		opts.Root, err = filepath.Abs(opts.Root)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		for _, name := range flags.Args() {
+			manifest, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+
+			n, err := catalog.Import(opts.Root, manifest, *algo)
+			manifest.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+
+			catalog.Out.Print("import", leibniz.Fields{"manifest": name, "root": opts.Root, "files": n}, "Imported %d files from %s into %s\n", n, name, opts.Root)
+		}
+
+		return nil
+	}
+}
+
+func coverageCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "coverage", "[-root dir] [-dir dir] listing...")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only check files under this root")
+	dir := flags.String("dir", "", "Relative paths in the listings are relative to this directory, as rclone lists them. Defaults to -root")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return fmt.Errorf("coverage needs at least one listing")
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		if *dir == "" {
+			*dir = *root
+		} else {
+			*dir, err = absRoot(*dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		backup := leibniz.NewBackup()
+		for _, name := range flags.Args() {
+			listing, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+
+			n, err := backup.Read(listing, *dir)
+			listing.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+
+			catalog.Out.Verbosity("listing", leibniz.Fields{"listing": name, "files": n}, "Read %d files from %s\n", n, name)
+		}
+
+		result, err := catalog.Coverage(*root, backup)
+		if err != nil {
+			return err
+		}
+
+		return catalog.ReportCoverage(result)
+	}
+}
+
+func statsCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "stats", "")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		stats, err := catalog.CatalogStats()
+		if err != nil {
+			return err
+		}
+
+		catalog.ReportCatalogStats(stats)
+
+		return nil
+	}
+}
+
+// The reports report runs, by name
+var reports = map[string]commandFunc{
+	"usage": usageReport,
+	"stale": staleReport,
+}
+
+// Only a name for the reports, so it has no flags of its own
+func reportCommand() (*flag.FlagSet, func(args []string) error) {
+	return nil, func(args []string) error {
+		return runSubcommand("report", reports, args)
+	}
+}
+
+// Runs the subcommand of name that args start with
+func runSubcommand(name string, subs map[string]commandFunc, args []string) error {
+	if len(args) == 0 || subs[args[0]] == nil {
+		names := make([]string, 0, len(subs))
+		for sub := range subs {
+			names = append(names, sub)
+		}
+		sort.Strings(names)
+
+		return fmt.Errorf("%s needs one of %s", name, strings.Join(names, ", "))
+	}
+
+	_, run := subs[args[0]]()
+
+	return run(args[1:])
+}
+
+func usageReport() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "report usage", "[-root dir] [-n count] [-depth levels]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only sum up files under this root")
+	n := flags.Int("n", 20, "How many files, extensions and directories to list, or 0 for all")
+	depth := flags.Int("depth", 3, "How many levels of directories under each root to sum up, or 0 for all")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		report, err := catalog.Usage(*root, *n, *depth)
+		if err != nil {
+			return err
+		}
+
+		catalog.ReportUsage(report)
+
+		return nil
+	}
+}
+
+func staleReport() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "report stale", "[-root dir] [-older-than age] [-depth levels]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only look at files under this root")
+	olderThan := flags.String("older-than", "2y", "List files not modified for this long, like 2y, 26w, 180d or 720h")
+	depth := flags.Int("depth", 0, "Group files by their directory this many levels under their root, or by their own directory for 0")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		age, err := leibniz.ParseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		before := time.Now().Add(-age)
+		dirs, err := catalog.Stale(*root, before, *depth)
+		if err != nil {
+			return err
+		}
+
+		catalog.ReportStale(dirs, before)
+
+		return nil
+	}
+}
+
+func exportCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "export", "[-format csv|jsonl|parquet] [-o file]")
+	reportFlags(opts, flags)
+	format := flags.String("format", "", "One of "+strings.Join(leibniz.ExportFormats, ", ")+". Defaults to the output file's extension, or csv")
+	output := flags.String("o", "-", "File to write to, or - for stdout")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *format == "" {
+			*format = "csv"
+			switch strings.ToLower(filepath.Ext(*output)) {
+			case ".jsonl", ".json":
+				*format = "jsonl"
+			case ".parquet":
+				*format = "parquet"
+			}
+		}
+
+		valid := false
+		for _, f := range leibniz.ExportFormats {
+			valid = valid || f == *format
+		}
+		if !valid {
+			return fmt.Errorf("unknown export format %q", *format)
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		if *output == "-" {
+			_, err = catalog.Export(os.Stdout, *format)
+			return err
+		}
+
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		rows, err := catalog.Export(f, *format)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Exported %d rows to %s\n", rows, *output)
+
+		return nil
+	}
+}
+
+func errorsCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "errors", "[-root dir] [-scan id]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "List the errors of this root's latest scan")
+	scanId := flags.Int64("scan", 0, "List the errors of this scan. Defaults to the latest scan")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		errs, err := catalog.Errors(*root, *scanId)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range errs {
+			fields := leibniz.Fields{"scan": e.ScanId, "root": e.Root, "path": e.Path, "op": e.Op, "kind": e.Kind, "error": e.Err, "time": e.Time}
+			catalog.Out.Print("error", fields, "%s\t%s\t%s\n", e.Kind, e.Op, e.Err)
+		}
+
+		return nil
+	}
+}
+
+func scansCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "scans", "[-root dir]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only list scans of this root")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		scans, err := catalog.Scans(*root)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range scans {
+			finished := "unfinished"
+			if !s.Finished.IsZero() {
+				finished = catalog.Out.Time(s.Finished)
+			}
+
+			catalog.Out.Print("scan", s.Fields(), "%d\t%s\t%s\t%s\t%d files\n", s.Id, s.Root, catalog.Out.Time(s.Started), finished, s.Files)
+		}
+
+		return nil
+	}
+}
+
+func diffCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "diff", "rootA rootB | -from scan [-to scan]")
+	reportFlags(opts, flags)
+	from := flags.Int64("from", 0, "Compare the root of this scan as it was then")
+	to := flags.Int64("to", 0, "... with how it was at this scan. Defaults to its latest scan")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if (*from == 0) == (flags.NArg() == 0) || (flags.NArg() != 0 && flags.NArg() != 2) {
+			flags.Usage()
+			return fmt.Errorf("give either two roots or -from")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		var changes []*leibniz.Change
+		if *from != 0 {
+			changes, err = catalog.DiffScans(*from, *to)
+		} else {
+			var a, b string
+			a, err = absRoot(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+
+			b, err = absRoot(flags.Arg(1))
+			if err != nil {
+				return err
+			}
+
+			changes, err = catalog.DiffRoots(a, b)
+		}
+		if err != nil {
+			return err
+		}
+
+		return catalog.ReportDiff(changes)
+	}
+}
+
+func linksCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "links", "[-root dir] [-broken]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only list links under this root")
+	broken := flags.Bool("broken", false, "Only list links whose target doesn't exist")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		links, err := catalog.Links(*root)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range links {
+			isBroken := l.Broken()
+			if *broken && !isBroken {
+				continue
+			}
+
+			marker := ""
+			if isBroken {
+				marker = " (broken)"
+			}
+
+			catalog.Out.Print("link", leibniz.Fields{"path": l.Path, "target": l.Target, "broken": isBroken}, "%s -> %s%s\n", l.Path, l.Target, marker)
+		}
+
+		return nil
+	}
+}
+
+func lookupCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "lookup", "hash|file...")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no hash or file given")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		// Look everything up before failing on what wasn't found
+		var missing error
+		for _, what := range flags.Args() {
+			err = catalog.ReportLookup(what)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				missing = fmt.Errorf("not everything was found")
+			}
+		}
+
+		return missing
+	}
+}
+
+func whereCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "where", "hash|file...")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no hash or file given")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		var missing error
+		for _, what := range flags.Args() {
+			err = catalog.ReportWhere(what)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				missing = fmt.Errorf("not everything was found")
+			}
+		}
+
+		return missing
+	}
+}
+
+func historyCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "history", "file...")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no file given")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		var missing error
+		for _, path := range flags.Args() {
+			err = catalog.ReportHistory(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				missing = fmt.Errorf("not everything was found")
+			}
+		}
+
+		return missing
+	}
+}
+
+func explainFilterFlagSet(opts *leibniz.Options, roots *rootsFlag) *flag.FlagSet {
+	flags := flagSet(opts, "explain-filter", "[-root dir]... path...")
+	flags.Var(roots, "root", "The root a scan would walk. Repeat it for several, and each path is taken to be under the innermost one holding it")
+	scanFlags(opts, flags)
+
+	return flags
+}
+
+func explainFilterCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	var roots rootsFlag
+	flags := explainFilterFlagSet(opts, &roots)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no path given")
+		}
+
+		if len(roots) == 0 {
+			roots = append(roots, config.Roots...)
+		}
+		if len(roots) == 0 && opts.Root != "" {
+			roots = append(roots, opts.Root)
+		}
+		if len(roots) == 0 {
+			flags.Usage()
+			return fmt.Errorf("no root given")
+		}
+
+		err = checkRoots(roots)
+		if err != nil {
+			return err
+		}
+
+		perRoot, err := rootOptions(roots, args, explainFilterFlagSet)
+		if err != nil {
+			return err
+		}
+
+		// Only the filters are needed, so the catalog isn't written to, or even
+		// created
+		opts.DryRun = true
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		catalog.RootOpts = perRoot
+
+		var failed error
+		for _, path := range flags.Args() {
+			abs, err := filepath.Abs(path)
+			if err == nil {
+				catalog.SetRoot(innermostRoot(roots, abs))
+				err = catalog.ReportExplainFilter(abs)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				failed = fmt.Errorf("not every path could be explained")
+			}
+		}
+
+		return failed
+	}
+}
+
+// The root that holds p most closely, or the first if none holds it
+func innermostRoot(roots []string, p string) string {
+	best := roots[0]
+	found := false
+	for _, root := range roots {
+		holds := p == root || strings.HasPrefix(p, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+		if holds && (!found || len(root) > len(best)) {
+			best, found = root, true
+		}
+	}
+
+	return best
+}
+
+// Checks the manifests named on the command line. Their digests are taken to
+// be by -hash only if it is given, and otherwise by whatever their lengths
+// or tags say.
+func checkManifests(opts *leibniz.Options, flags *flag.FlagSet, out *leibniz.Output) error {
+	algo := ""
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "hash" || f.Name == "algo" {
+			algo = opts.Hash
+		}
+	})
+
+	var checked, failed int
+	for _, name := range flags.Args() {
+		manifest := os.Stdin
+		if name != "-" {
+			var err error
+			manifest, err = os.Open(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		n, bad, err := leibniz.CheckManifest(manifest, algo, out)
+		manifest.Close()
+		checked += n
+		failed += bad
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files did not match", failed, checked)
+	}
+
+	return nil
+}
+
+func hashCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "hash", "[-sum] file... | -c manifest...")
+	hashFlag(opts, flags)
+	flags.StringVar(&opts.Hash, "algo", opts.Hash, "The same as -hash")
+	sum := flags.Bool("sum", false, "Write lines of the hash and path, as sha256sum and xxhsum do")
+	check := flags.Bool("c", false, "Read manifests written by -sum, sha256sum, xxhsum and the like, and check the files they list; - reads stdin")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no files given")
+		}
+
+		out := leibniz.NewOutput(os.Stdout, opts)
+		if *check {
+			return checkManifests(opts, flags, out)
+		}
+
+		for _, file := range flags.Args() {
+			hash, err := leibniz.HashFile(opts.Hash, file)
+			if err != nil {
+				return err
+			}
+
+			if *sum {
+				out.Print("hash", leibniz.Fields{"path": file, "algo": opts.Hash, "hash": hash}, "%s\n", leibniz.SumLine(hash, file))
+				continue
+			}
+
+			// The smart hash is a uint64, so also show it the way it always has been
+			text := hash
+			if leibniz.IsSampled(opts.Hash) {
+				sum, err := strconv.ParseUint(hash, 16, 64)
+				if err != nil {
+					return err
+				}
+				text = fmt.Sprintf("%v (%s)", sum, hash)
+			}
+
+			fields := leibniz.Fields{"path": file, "algo": opts.Hash, "hash": hash}
+			if flags.NArg() > 1 {
+				out.Print("hash", fields, "%s: %s\n", file, text)
+			} else {
+				out.Print("hash", fields, "%s\n", text)
+			}
+		}
+
+		return nil
+	}
+}
+
+func similarCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "similar", "[-root dir] [-distance bits]")
+	reportFlags(opts, flags)
+	root := flags.String("root", "", "Only compare images under this root")
+	distance := flags.Int("distance", leibniz.DefaultSimilarity, "How many of the 64 bits two images' hashes may differ by")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *distance < 0 || *distance > 64 {
+			return fmt.Errorf("-distance must be between 0 and 64")
+		}
+
+		if *root != "" {
+			*root, err = absRoot(*root)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportSimilar(*root, *distance)
+	}
+}
+
+func rmRootCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "rm-root", "root...")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no roots given")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		for _, root := range flags.Args() {
+			absroot, err := absRoot(root)
+			if err != nil {
+				return err
+			}
+
+			removed, err := catalog.RemoveRoot(absroot)
+			if err != nil {
+				return err
+			}
+
+			catalog.Out.Print("removed-root", leibniz.Fields{"root": absroot, "files": removed}, "Removed %s (%d files)\n", absroot, removed)
+		}
+
+		return nil
+	}
+}
+
+// The subcommands of root and roots, which are the same command, by name
+var rootCommands = map[string]commandFunc{
+	"list":   listRootsCommand,
+	"info":   rootInfoCommand,
+	"rm":     rmRootCommand,
+	"rename": renameRootCommand,
+	"move":   renameRootCommand,
+}
+
+// Only a name for the subcommands of root and roots, so it has no flags of
+// its own
+func rootCommand() (*flag.FlagSet, func(args []string) error) {
+	return nil, func(args []string) error {
+		return runSubcommand("roots", rootCommands, args)
+	}
+}
+
+func listRootsCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "roots list", "")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		roots, err := catalog.RootsStats()
+		if err != nil {
+			return err
+		}
+
+		catalog.ReportRoots(roots)
+
+		return nil
+	}
+}
+
+func rootInfoCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "roots info", "root...")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("no roots given")
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		for _, root := range flags.Args() {
+			root, err = absRoot(root)
+			if err != nil {
+				return err
+			}
+
+			info, err := catalog.RootInfo(root)
+			if err != nil {
+				return err
+			}
+
+			catalog.ReportRootInfo(info)
+		}
+
+		return nil
+	}
+}
+
+// Lists the volume each root is on, and whether it is mounted now
+func volumesCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "volumes", "")
+	reportFlags(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportVolumes()
+	}
+}
+
+// Renaming and moving are the same to the catalog: the files are where they
+// were, under another path
+func renameRootCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "root rename", "old new")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() != 2 {
+			flags.Usage()
+			return fmt.Errorf("root rename needs the old and the new path")
+		}
+
+		old, err := absRoot(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		// The files have to be there already, or the next scan would find nothing
+		// and prune would drop them all
+		roots := []string{flags.Arg(1)}
+		err = checkRoots(roots)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		moved, err := catalog.RenameRoot(old, roots[0])
+		if err != nil {
+			return err
+		}
+
+		catalog.Out.Print("renamed-root", leibniz.Fields{"root": old, "to": roots[0], "files": moved}, "Renamed %s -> %s (%d files)\n", old, roots[0], moved)
+
+		return nil
+	}
+}
+
+func compactCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "compact", "[-history]")
+	history := flags.Bool("history", false, "Also delete the earlier contents kept by -keep-history and the errors of all but each root's latest scan")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportCompact(*history)
+	}
+}
+
+func sealCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "seal", "[-key secret] [-o file] | -keygen path")
+	readOnlyFlag(opts, flags)
+	key := flags.String("key", "", "Sign the seal with this secret key")
+	keygen := flags.String("keygen", "", "Write a new secret key to this path and its public key next to it, then exit")
+	output := flags.String("o", "-", "File to write the seal to, or - for stdout")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if *keygen != "" {
+			err = leibniz.GenerateSealKey(*keygen)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "Wrote %s and %s.pub\n", *keygen, *keygen)
+			return nil
+		}
+
+		var secret ed25519.PrivateKey
+		if *key != "" {
+			secret, err = leibniz.ReadSecretKey(*key)
+			if err != nil {
+				return err
+			}
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		seal, err := catalog.Seal(secret)
+		if err != nil {
+			return err
+		}
+
+		if *output == "-" {
+			_, err = seal.WriteTo(os.Stdout)
+			return err
+		}
+
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		_, err = seal.WriteTo(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		return err
+	}
+}
+
+func attestCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "attest", "[-pub key] seal")
+	readOnlyFlag(opts, flags)
+	pub := flags.String("pub", "", "Require the seal to be signed by the secret half of this public key")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return fmt.Errorf("give one seal to check")
+		}
+
+		var public ed25519.PublicKey
+		if *pub != "" {
+			public, err = leibniz.ReadPublicKey(*pub)
+			if err != nil {
+				return err
+			}
+		}
+
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		seal, err := leibniz.ReadSeal(f)
+		if err != nil {
+			return err
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.Attest(seal, public)
+	}
+}
+
+func syncCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "sync", "[-pull] catalog")
+	pull := flags.Bool("pull", false, "Only copy from the other catalog into this one, leaving the other as it is")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return fmt.Errorf("give one catalog to sync with")
+		}
+
+		otherOpts := *opts
+		otherOpts.CatalogPath = flags.Arg(0)
+		otherOpts.ReadOnly = *pull
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		other, err := leibniz.OpenCatalog(&otherOpts)
+		if err != nil {
+			return err
+		}
+		defer other.Db.Close()
+
+		return catalog.ReportSync(other, !*pull)
+	}
+}
+
+func mergeCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "merge", "-o catalog catalog...")
+	out := flags.String("o", "", "The catalog to create with everything in the others")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		if *out == "" || flags.NArg() < 1 {
+			flags.Usage()
+			return fmt.Errorf("give the catalogs to merge and -o for the one to create")
+		}
+
+		// Merging into an existing catalog is what sync -pull is for
+		if leibniz.IsRemoteCatalog(*out) {
+			return fmt.Errorf("-o has to be a catalog on this host")
+		}
+		if _, err := os.Stat(*out); err == nil {
+			return fmt.Errorf("%s already exists; use sync -pull to merge into a catalog", *out)
+		}
+
+		opts.CatalogPath = *out
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		sources := make([]*leibniz.Catalog, 0, flags.NArg())
+		for _, path := range flags.Args() {
+			if _, err := os.Stat(path); err != nil && !leibniz.IsRemoteCatalog(path) {
+				return err
+			}
+
+			fromOpts := *opts
+			fromOpts.CatalogPath = path
+			fromOpts.Reporting = true
+			from, err := leibniz.OpenCatalog(&fromOpts)
+			if err != nil {
+				return err
+			}
+			defer from.Db.Close()
+
+			sources = append(sources, from)
+		}
+
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		return catalog.ReportMerge(sources)
+	}
+}
+
+func splitCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "split", "-root dir... -o catalog")
+	roots := &rootsFlag{}
+	flags.Var(roots, "root", "Copy this root. Repeat it to copy several")
+	out := flags.String("o", "", "The catalog to create with the roots")
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		if *out == "" || len(*roots) == 0 || flags.NArg() > 0 {
+			flags.Usage()
+			return fmt.Errorf("give the roots to copy with -root and -o for the catalog to create")
+		}
+
+		if leibniz.IsRemoteCatalog(*out) {
+			return fmt.Errorf("-o has to be a catalog on this host")
+		}
+		if _, err := os.Stat(*out); err == nil {
+			return fmt.Errorf("%s already exists; use sync -pull to copy into a catalog", *out)
+		}
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		// The roots needn't exist on this host, only in the catalog
+		for i, root := range *roots {
+			(*roots)[i], err = absRoot(root)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := os.Stat(opts.CatalogPath); err != nil && !leibniz.IsRemoteCatalog(opts.CatalogPath) {
+			return err
+		}
+
+		opts.Reporting = true
+		catalog, err := leibniz.OpenCatalog(opts)
+		if err != nil {
+			return err
+		}
+		defer catalog.Db.Close()
+
+		// Before creating the new catalog, so a typo leaves nothing behind
+		cataloged, err := catalog.Roots()
+		if err != nil {
+			return err
+		}
+		for _, root := range *roots {
+			i := sort.SearchStrings(cataloged, root)
+			if i == len(cataloged) || cataloged[i] != root {
+				return fmt.Errorf("%s isn't a root of %s", root, opts.CatalogPath)
+			}
+		}
+
+		outOpts := *opts
+		outOpts.CatalogPath = *out
+		outOpts.Reporting = false
+		split, err := leibniz.OpenCatalog(&outOpts)
+		if err != nil {
+			return err
+		}
+		defer split.Db.Close()
+
+		return split.ReportSplit(catalog, *roots)
+	}
+}
+
+// Run over ssh by leibniz on another host, never by hand
+func remoteCommand() (*flag.FlagSet, func(args []string) error) {
+	opts := leibniz.DefaultOptions()
+	flags := flagSet(opts, "remote", "")
+	readOnlyFlag(opts, flags)
+
+	return flags, func(args []string) error {
+		flags.Parse(args)
+
+		err := validate(opts, flags)
+		if err != nil {
+			return err
+		}
+
+		if leibniz.IsRemoteCatalog(opts.CatalogPath) {
+			return fmt.Errorf("the catalog must be on this host")
+		}
+
+		return leibniz.ServeRemote(opts, os.Stdin, os.Stdout)
+	}
+}
+
+// Reads the config named by -config in args, or the default one if it
+// exists, and picks the profile named by -profile
+func loadConfig(args []string) error {
+	file, given := leibniz.DefaultConfigPath(), false
+	var profile string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "config" && name != "profile") {
+			continue
+		}
+
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if name == "profile" {
+			profile = value
+		} else {
+			file, given = value, true
+		}
+	}
+
+	if file == "" && profile == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(file); os.IsNotExist(err) && !given {
+		if profile != "" {
+			return fmt.Errorf("no profile %q; there is no config at %s", profile, file)
+		}
+		return nil
+	}
+
+	cfg, err := leibniz.LoadConfig(file)
+	if err == nil && profile != "" {
+		cfg, err = cfg.Profile(profile)
+	}
+	if err != nil {
+		return err
+	}
+	config = cfg
+
+	return nil
+}
+
+func main() {
+	args := os.Args[1:]
+
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Bare flags are the old interface, which only knew how to scan
+	if len(args[0]) > 0 && args[0][0] == '-' && args[0] != "-h" && args[0] != "-help" {
+		args = append([]string{"scan"}, args...)
+	}
+
+	for _, cmd := range commands {
+		if cmd.Name != args[0] {
+			continue
+		}
+
+		err := loadConfig(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), err)
+			os.Exit(1)
+		}
+
+		_, run := cmd.Run()
+		err = run(args[1:])
+		if err == leibniz.ErrInterrupted {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), err)
+			os.Exit(130)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	usage()
+	if args[0] != "-h" && args[0] != "-help" && args[0] != "help" {
+		os.Exit(2)
+	}
+}
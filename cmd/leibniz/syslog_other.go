@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func syslogWriter() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog isn't available on this system")
+}
@@ -0,0 +1,135 @@
+package leibniz
+
+import (
+	"os"
+)
+
+// What Compact removed, by table, and the size of the catalog on disk before
+// and after, counting its write-ahead log
+type Compaction struct {
+	Removed map[string]int64
+	Before  int64
+	After   int64
+}
+
+// Rows that belong to nothing any more. Deleting files cleans up after itself
+// through triggers, but catalogs from before the triggers, or edited by hand,
+// can still have them.
+var orphanStmts = []struct {
+	table string
+	stmt  string
+}{
+	{"files", `delete from files where root_id not in (select id from roots)`},
+	{"scans", `delete from scans where root_id not in (select id from roots)`},
+	{"links", `delete from links where root_id not in (select id from roots)`},
+	{"dirs", `delete from dirs where root_id not in (select id from roots)`},
+	{"file_history", `delete from file_history where root_id not in (select id from roots)`},
+	{"errors", `delete from errors where root_id not in (select id from roots) or scan_id not in (select id from scans)`},
+	{"file_hashes", `delete from file_hashes where file_id not in (select id from files)`},
+	{"metadata", `delete from metadata where file_id not in (select id from files)`},
+	{"xattrs", `delete from xattrs where file_id not in (select id from files)`},
+	{"hash_cache", `delete from hash_cache where not exists (select 1 from files f where f.dev = hash_cache.dev and f.inode = hash_cache.inode)`},
+}
+
+// Every scan keeps the errors it ran into, and with -keep-history the earlier
+// contents of the files it found changed. Dropping history keeps only the
+// current contents, and the errors of each root's latest scan.
+var historyStmts = []struct {
+	table string
+	stmt  string
+}{
+	{"file_history", `delete from file_history`},
+	{"errors", `delete from errors where scan_id not in (select max(id) from scans group by root_id)`},
+}
+
+// Deletes orphaned rows, and the kept contents of changed files and errors of
+// earlier scans too if history is set, then rebuilds the indexes, refreshes the query planner's statistics and
+// rewrites the catalog file without its free pages
+func (c *Catalog) Compact(history bool) (*Compaction, error) {
+	result := &Compaction{Removed: make(map[string]int64), Before: c.diskSize()}
+
+	stmts := orphanStmts
+	if history {
+		stmts = append(historyStmts, orphanStmts...)
+	}
+
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stmts {
+		res, err := tx.Exec(s.stmt)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		result.Removed[s.table] += n
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	// VACUUM can't run inside a transaction
+	for _, stmt := range []string{`reindex`, `analyze`, `vacuum`} {
+		_, err = c.Db.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	result.After = c.diskSize()
+
+	return result, nil
+}
+
+// The bytes the catalog takes on disk, with its write-ahead log. Remote
+// catalogs can't be stat'ed, so they count their pages instead.
+func (c *Catalog) diskSize() int64 {
+	var size int64
+	if IsRemoteCatalog(c.Opts.CatalogPath) {
+		c.Db.QueryRow(`select page_count * page_size from pragma_page_count(), pragma_page_size()`).Scan(&size)
+		return size
+	}
+
+	for _, p := range []string{c.Opts.CatalogPath, c.Opts.CatalogPath + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+func (c *Catalog) ReportCompact(history bool) error {
+	result, err := c.Compact(history)
+	if err != nil {
+		return err
+	}
+
+	var removed int64
+	fields := Fields{"before": result.Before, "after": result.After}
+	for table, n := range result.Removed {
+		removed += n
+		if n > 0 {
+			fields[table] = n
+		}
+	}
+
+	c.Out.Print("compact", fields, "Removed %d rows; the catalog went from %s to %s\n", removed, c.Out.Size(result.Before), c.Out.Size(result.After))
+
+	return nil
+}
@@ -0,0 +1,397 @@
+package leibniz
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings read from a TOML file, so long lists of excludes and the like don't
+// have to be typed on every run. Keys are named after the flags, with
+// underscores for dashes, and flags given on the command line win:
+//
+//	catalog = "/srv/leibniz/catalog"
+//	roots = ["/srv/media", "/home"]
+//	exclude = ['/\.cache/', '\.tmp$']
+//	hash = "blake3"
+//
+// Named profiles hold settings of their own in the same keys, used on top of
+// the others by -profile:
+//
+//	[profile.photos]
+//	roots = ["/home/me/Pictures"]
+//	type = ["image/*", "video/*"]
+//
+// Settings for a particular root go in a table named after it, and are used on
+// top of the others whenever that root is scanned:
+//
+//	[root."/archive"]
+//	hash = "sha256"
+type Config struct {
+	Catalog      string   `toml:"catalog"`
+	Roots        []string `toml:"roots"`
+	Exclude      []string `toml:"exclude"`
+	ExcludeGlob  []string `toml:"exclude_glob"`
+	Include      []string `toml:"include"`
+	Hash         string   `toml:"hash"`
+	ExtraHashes  []string `toml:"extra_hashes"`
+	SampleAbove  string   `toml:"sample_threshold"`
+	SampleSize   string   `toml:"sample_size"`
+	Samples      int      `toml:"samples"`
+	Types        []string `toml:"type"`
+	MinSize      string   `toml:"min_size"`
+	MaxSize      string   `toml:"max_size"`
+	MinAge       string   `toml:"min_age"`
+	MtimeTol     string   `toml:"mtime_tolerance"`
+	MaxDepth     int      `toml:"max_depth"`
+	MaxFiles     int64    `toml:"max_files"`
+	MaxBytes     string   `toml:"max_bytes"`
+	MaxDuration  string   `toml:"max_duration"`
+	BWLimit      string   `toml:"bwlimit"`
+	Nice         *bool    `toml:"nice"`
+	Bytes        *bool    `toml:"bytes"`
+	ISO          *bool    `toml:"iso"`
+	Symlinks     string   `toml:"symlinks"`
+	Order        string   `toml:"order"`
+	DirBatch     int      `toml:"readdir_batch"`
+	Enumerate    *bool    `toml:"enumerate"`
+	OrderBy      string   `toml:"order_by"`
+	IgnoreFiles  *bool    `toml:"ignore_files"`
+	GlobalIgnore string   `toml:"global_ignore"`
+	Incremental  *bool    `toml:"incremental"`
+	FastDirs     *bool    `toml:"fast_dirs"`
+	FullEvery    int      `toml:"full_every"`
+	Prune        *bool    `toml:"prune"`
+	Moves        *bool    `toml:"moves"`
+	Similarity   *bool    `toml:"similarity"`
+	Metadata     *bool    `toml:"metadata"`
+	Owner        *bool    `toml:"owner"`
+	Xattrs       *bool    `toml:"xattrs"`
+	Archives     *bool    `toml:"archives"`
+	S3ETags      *bool    `toml:"s3_etags"`
+	Trash        string   `toml:"trash"`
+	HashCache    *bool    `toml:"hash_cache"`
+	Paranoid     *bool    `toml:"paranoid"`
+	KeepHistory  *bool    `toml:"keep_history"`
+	OneFS        *bool    `toml:"one_file_system"`
+	MarkVolume   *bool    `toml:"mark_volume"`
+	SpecialFS    *bool    `toml:"special_fs"`
+	Batch        int      `toml:"batch"`
+	JournalMode  string   `toml:"journal_mode"`
+	Synchronous  string   `toml:"synchronous"`
+	CacheSize    int      `toml:"cache_size"`
+	BusyTimeout  string   `toml:"busy_timeout"`
+	LogFormat    string   `toml:"log_format"`
+	LogLevel     string   `toml:"log_level"`
+	LogFile      string   `toml:"log_file"`
+
+	Profiles map[string]*Config `toml:"profile"`
+	PerRoot  map[string]*Config `toml:"root"`
+
+	// The config a profile came from, whose settings go first
+	base *Config
+}
+
+// Where the config is read from when -config isn't given
+func DefaultConfigPath() string {
+	home := homeDir()
+	if home == "" {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "leibniz", "config.toml")
+}
+
+// Reads the config at path. Unknown keys are refused, since a misspelt one
+// would otherwise be silently ignored, and so are values the flags would
+// refuse.
+func LoadConfig(file string) (*Config, error) {
+	cfg := &Config{}
+	meta, err := toml.DecodeFile(file, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		return nil, fmt.Errorf("%s: unknown settings %s", file, strings.Join(keys, ", "))
+	}
+
+	cfg.expandPaths()
+	err = cfg.Apply(DefaultOptions())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	err = cfg.loadPerRoot()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	for name, profile := range cfg.Profiles {
+		if len(profile.Profiles) > 0 {
+			return nil, fmt.Errorf("%s: profile %s has profiles of its own", file, name)
+		}
+
+		profile.expandPaths()
+		profile.base = cfg
+		err = profile.Apply(DefaultOptions())
+		if err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %s", file, name, err)
+		}
+
+		err = profile.loadPerRoot()
+		if err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %s", file, name, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Keys the settings for each root by its path as scans are given it, and
+// checks they can be used
+func (cfg *Config) loadPerRoot() error {
+	perRoot := make(map[string]*Config, len(cfg.PerRoot))
+	for root, settings := range cfg.PerRoot {
+		if len(settings.Roots) > 0 || len(settings.Profiles) > 0 || len(settings.PerRoot) > 0 || settings.Catalog != "" {
+			return fmt.Errorf("root %s can only have scan settings", root)
+		}
+
+		settings.expandPaths()
+		settings.base = cfg
+		err := settings.Apply(DefaultOptions())
+		if err != nil {
+			return fmt.Errorf("root %s: %s", root, err)
+		}
+
+		root = expandHome(root)
+		if IsS3Root(root) {
+			root = strings.TrimSuffix(root, "/")
+		} else {
+			root = filepath.Clean(root)
+		}
+		perRoot[root] = settings
+	}
+	cfg.PerRoot = perRoot
+
+	return nil
+}
+
+// The config with its settings for root on top, or the config itself if it
+// has none. A profile's settings for the root win over the config's.
+func (cfg *Config) ForRoot(root string) *Config {
+	for c := cfg; c != nil; c = c.base {
+		if settings, ok := c.PerRoot[root]; ok {
+			forRoot := *settings
+			forRoot.base = cfg
+			return &forRoot
+		}
+	}
+
+	return cfg
+}
+
+// The config with the named profile's settings on top. Its roots replace the
+// config's, if it has any.
+func (cfg *Config) Profile(name string) (*Config, error) {
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(cfg.Profiles))
+		for n := range cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no profile %q; the config has no profiles", name)
+		}
+		return nil, fmt.Errorf("no profile %q; the profiles are %s", name, strings.Join(names, ", "))
+	}
+
+	if len(profile.Roots) == 0 {
+		profile.Roots = cfg.Roots
+	}
+
+	return profile, nil
+}
+
+// Paths can start with ~, as they would in a shell
+func (cfg *Config) expandPaths() {
+	for _, p := range []*string{&cfg.Catalog, &cfg.GlobalIgnore, &cfg.LogFile, &cfg.Trash} {
+		*p = expandHome(*p)
+	}
+	for i := range cfg.Roots {
+		cfg.Roots[i] = expandHome(cfg.Roots[i])
+	}
+}
+
+func expandHome(p string) string {
+	home := homeDir()
+	if home != "" && (p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator))) {
+		return filepath.Join(home, p[1:])
+	}
+
+	return p
+}
+
+// Sets the options the config gives. Lists like exclude are added to what o
+// already has.
+func (cfg *Config) Apply(o *Options) error {
+	if cfg.base != nil {
+		err := cfg.base.Apply(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	set := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	setBool := func(dst *bool, value *bool) {
+		if value != nil {
+			*dst = *value
+		}
+	}
+	setInt := func(dst *int, value int) {
+		if value != 0 {
+			*dst = value
+		}
+	}
+
+	set(&o.CatalogPath, cfg.Catalog)
+	set(&o.Hash, cfg.Hash)
+	set(&o.Symlinks, cfg.Symlinks)
+	set(&o.Order, cfg.Order)
+	set(&o.OrderBy, cfg.OrderBy)
+	set(&o.GlobalIgnore, cfg.GlobalIgnore)
+	set(&o.JournalMode, cfg.JournalMode)
+	set(&o.Synchronous, cfg.Synchronous)
+	set(&o.LogFormat, cfg.LogFormat)
+	set(&o.LogLevel, cfg.LogLevel)
+	set(&o.LogFile, cfg.LogFile)
+	set(&o.Trash, cfg.Trash)
+	setBool(&o.IgnoreFiles, cfg.IgnoreFiles)
+	setBool(&o.Incremental, cfg.Incremental)
+	setBool(&o.FastDirs, cfg.FastDirs)
+	setBool(&o.Prune, cfg.Prune)
+	setBool(&o.DetectMoves, cfg.Moves)
+	setBool(&o.Similarity, cfg.Similarity)
+	setBool(&o.Metadata, cfg.Metadata)
+	setBool(&o.Owner, cfg.Owner)
+	setBool(&o.Xattrs, cfg.Xattrs)
+	setBool(&o.Archives, cfg.Archives)
+	setBool(&o.S3ETags, cfg.S3ETags)
+	setBool(&o.HashCache, cfg.HashCache)
+	setBool(&o.Paranoid, cfg.Paranoid)
+	setBool(&o.KeepHistory, cfg.KeepHistory)
+	setBool(&o.OneFileSystem, cfg.OneFS)
+	setBool(&o.MarkVolume, cfg.MarkVolume)
+	setBool(&o.SpecialFS, cfg.SpecialFS)
+	setBool(&o.Enumerate, cfg.Enumerate)
+	setBool(&o.Nice, cfg.Nice)
+	setBool(&o.Bytes, cfg.Bytes)
+	setBool(&o.ISO, cfg.ISO)
+	setInt(&o.BatchSize, cfg.Batch)
+	setInt(&o.CacheSize, cfg.CacheSize)
+	setInt(&o.MaxDepth, cfg.MaxDepth)
+	setInt(&o.DirBatch, cfg.DirBatch)
+	setInt(&o.FullEvery, cfg.FullEvery)
+	setInt(&o.Sampling.Count, cfg.Samples)
+	if cfg.MaxFiles != 0 {
+		o.MaxFiles = cfg.MaxFiles
+	}
+
+	for _, re := range cfg.Exclude {
+		if err := o.Excludes.Set(re); err != nil {
+			return fmt.Errorf("exclude %q: %s", re, err)
+		}
+	}
+	for _, glob := range cfg.ExcludeGlob {
+		if err := (GlobFlag{o.Excludes}).Set(glob); err != nil {
+			return fmt.Errorf("exclude_glob %q: %s", glob, err)
+		}
+	}
+	for _, re := range cfg.Include {
+		if err := o.Includes.Set(re); err != nil {
+			return fmt.Errorf("include %q: %s", re, err)
+		}
+	}
+	for _, algo := range cfg.ExtraHashes {
+		o.ExtraHashes.Set(algo)
+	}
+	for _, pattern := range cfg.Types {
+		o.Types.Set(pattern)
+	}
+
+	if cfg.MinSize != "" {
+		if err := o.MinSize.Set(cfg.MinSize); err != nil {
+			return fmt.Errorf("min_size: %s", err)
+		}
+	}
+	if cfg.MaxSize != "" {
+		if err := o.MaxSize.Set(cfg.MaxSize); err != nil {
+			return fmt.Errorf("max_size: %s", err)
+		}
+	}
+	if cfg.MaxBytes != "" {
+		if err := o.MaxBytes.Set(cfg.MaxBytes); err != nil {
+			return fmt.Errorf("max_bytes: %s", err)
+		}
+	}
+	if cfg.SampleAbove != "" {
+		if err := (*SizeFlag)(&o.Sampling.Threshold).Set(cfg.SampleAbove); err != nil {
+			return fmt.Errorf("sample_threshold: %s", err)
+		}
+	}
+	if cfg.SampleSize != "" {
+		if err := (*SizeFlag)(&o.Sampling.Size).Set(cfg.SampleSize); err != nil {
+			return fmt.Errorf("sample_size: %s", err)
+		}
+	}
+	if cfg.MinAge != "" {
+		age, err := time.ParseDuration(cfg.MinAge)
+		if err != nil {
+			return fmt.Errorf("min_age: %s", err)
+		}
+		o.MinAge = age
+	}
+	if cfg.MtimeTol != "" {
+		tolerance, err := time.ParseDuration(cfg.MtimeTol)
+		if err != nil {
+			return fmt.Errorf("mtime_tolerance: %s", err)
+		}
+		o.MtimeTolerance = tolerance
+	}
+	if cfg.MaxDuration != "" {
+		duration, err := time.ParseDuration(cfg.MaxDuration)
+		if err != nil {
+			return fmt.Errorf("max_duration: %s", err)
+		}
+		o.MaxDuration = duration
+	}
+	if cfg.BusyTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.BusyTimeout)
+		if err != nil {
+			return fmt.Errorf("busy_timeout: %s", err)
+		}
+		o.BusyTimeout = timeout
+	}
+	if cfg.BWLimit != "" {
+		if err := o.BandwidthLimit.Set(cfg.BWLimit); err != nil {
+			return fmt.Errorf("bwlimit: %s", err)
+		}
+	}
+
+	return o.Validate()
+}
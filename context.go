@@ -0,0 +1,72 @@
+package leibniz
+
+import (
+	"context"
+	"io"
+)
+
+// Runs fn with the catalog stopped when ctx is done, as well as when Stop is
+// closed. When it was ctx that stopped it, its error is returned rather than
+// ErrInterrupted, so callers can tell a deadline from an interrupt.
+func (c *Catalog) withContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	outer := c.Stop
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		// A nil outer Stop is never closed, so only ctx counts
+		select {
+		case <-ctx.Done():
+		case <-outer:
+		case <-done:
+			return
+		}
+		close(stop)
+	}()
+
+	c.Stop = stop
+	err := fn()
+	c.Stop = outer
+	close(done)
+
+	if err == ErrInterrupted && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Like Run, but stopped when ctx is done, leaving the scan unfinished with
+// what was cataloged so far committed
+func (c *Catalog) RunContext(ctx context.Context) error {
+	return c.withContext(ctx, c.Run)
+}
+
+// Like Verify, but stopped between files when ctx is done
+func (c *Catalog) VerifyContext(ctx context.Context, root string, fn func(*Verification) error) error {
+	return c.withContext(ctx, func() error { return c.Verify(root, fn) })
+}
+
+// Like Dedup, but stopped between copies when ctx is done. Copies already
+// replaced stay replaced, and are in the undo log.
+func (c *Catalog) DedupContext(ctx context.Context, method string, dryRun bool, undo io.Writer) error {
+	return c.withContext(ctx, func() error { return c.Dedup(method, dryRun, undo) })
+}
+
+// Like Export, but stopped between rows when ctx is done, having written
+// only some of them
+func (c *Catalog) ExportContext(ctx context.Context, w io.Writer, format string) (int64, error) {
+	var count int64
+	err := c.withContext(ctx, func() (err error) {
+		count, err = c.Export(w, format)
+		return err
+	})
+
+	return count, err
+}
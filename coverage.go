@@ -0,0 +1,298 @@
+package leibniz
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Why a cataloged file isn't covered by a backup
+const (
+	NotBackedUp = "missing" // Nothing in the backup has its path or content
+	Outdated    = "changed" // The backup has its path, but with other content or an older version
+)
+
+// A file in a backup listing. Size is -1 when the listing doesn't know it,
+// and Hashes only holds the algorithms leibniz also computes.
+type BackupFile struct {
+	Path   string
+	Size   int64
+	Mtime  time.Time
+	Hashes map[string]string
+}
+
+// The files of one or more backup listings, by path and by content
+type Backup struct {
+	Files  int64
+	paths  map[string]*BackupFile
+	hashes map[entry]bool
+}
+
+func NewBackup() *Backup {
+	return &Backup{paths: make(map[string]*BackupFile), hashes: make(map[entry]bool)}
+}
+
+// rclone lsjson -R writes a JSON array of these, with --hash adding Hashes
+type rcloneEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	Hashes  map[string]string
+}
+
+// restic ls --json writes the snapshot and then one of these per line
+type resticNode struct {
+	Type  string    `json:"type"`
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// Adds the files listed by rclone lsjson or restic ls --json, telling them
+// apart by the listing's first character. Relative paths are taken relative
+// to dir, which is how rclone lists them. Returns how many files it added.
+func (b *Backup) Read(r io.Reader, dir string) (int64, error) {
+	br := bufio.NewReader(r)
+	first, err := firstByte(br)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	add := func(f *BackupFile) {
+		if !path.IsAbs(f.Path) && !filepath.IsAbs(f.Path) {
+			f.Path = filepath.Join(dir, filepath.FromSlash(f.Path))
+		}
+
+		hashes := make(map[string]string)
+		for algo, hash := range f.Hashes {
+			algo = strings.ToLower(algo)
+			if hash != "" && ValidHash(algo) {
+				hashes[algo] = strings.ToLower(hash)
+				b.hashes[entry{algo, hashes[algo]}] = true
+			}
+		}
+		f.Hashes = hashes
+
+		b.paths[f.Path] = f
+		n++
+	}
+
+	dec := json.NewDecoder(br)
+	switch first {
+	case '[':
+		_, err = dec.Token()
+		if err != nil {
+			return n, err
+		}
+
+		for dec.More() {
+			var e rcloneEntry
+			err = dec.Decode(&e)
+			if err != nil {
+				return n, err
+			}
+
+			if !e.IsDir {
+				add(&BackupFile{Path: e.Path, Size: e.Size, Mtime: e.ModTime, Hashes: e.Hashes})
+			}
+		}
+	case '{':
+		for {
+			var node resticNode
+			err = dec.Decode(&node)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+
+			// The snapshot has no type
+			if node.Type == "file" {
+				add(&BackupFile{Path: node.Path, Size: node.Size, Mtime: node.Mtime})
+			}
+		}
+	default:
+		return 0, fmt.Errorf("not the output of rclone lsjson or restic ls --json")
+	}
+
+	b.Files += n
+
+	return n, nil
+}
+
+func firstByte(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if !strings.ContainsRune(" \t\r\n", rune(c)) {
+			return c, r.UnreadByte()
+		}
+	}
+}
+
+// A cataloged file that isn't in the backup
+type Uncovered struct {
+	Path   string
+	Size   int64
+	Status string
+}
+
+// What Coverage found
+type CoverageResult struct {
+	Files          int64 // Cataloged files it looked at
+	Bytes          int64
+	Uncovered      []*Uncovered
+	UncoveredBytes int64
+}
+
+// A cataloged file and every hash the catalog has of it
+type coveredFile struct {
+	path   string
+	size   sql.NullInt64
+	mtime  time.Time
+	hashes []entry
+}
+
+// Reports which files currently cataloged under root, or under every root if
+// it is empty, the backup doesn't have. A file is covered when the backup has
+// it at the same path, or has its content anywhere. At the same path, a hash
+// by an algorithm both sides have decides it, and otherwise the backup's copy
+// must have the same size and be no older. Listings without hashes can't find
+// files that were moved since the backup.
+func (c *Catalog) Coverage(root string, b *Backup) (*CoverageResult, error) {
+	rows, err := c.Db.Query(`
+		select f.id, f.path, f.size, f.mtime, f.algo, f.hash from files f
+		join roots r on r.id = f.root_id
+		where (? = '' or r.root = ?)
+		order by f.path
+		`, root, root)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*coveredFile, 0)
+	byId := make(map[int64]*coveredFile)
+	for rows.Next() {
+		var id int64
+		f := &coveredFile{}
+		var e entry
+		err = rows.Scan(&id, &f.path, &f.size, &f.mtime, &e.algo, &e.hash)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		f.hashes = append(f.hashes, e)
+		files = append(files, f)
+		byId[id] = f
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = c.Db.Query(`select file_id, algo, hash from file_hashes`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var e entry
+		err = rows.Scan(&id, &e.algo, &e.hash)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if f, ok := byId[id]; ok {
+			f.hashes = append(f.hashes, e)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &CoverageResult{Uncovered: make([]*Uncovered, 0)}
+	for _, f := range files {
+		result.Files++
+		result.Bytes += f.size.Int64
+
+		status := b.cover(f)
+		if status == "" {
+			continue
+		}
+
+		result.Uncovered = append(result.Uncovered, &Uncovered{Path: f.path, Size: f.size.Int64, Status: status})
+		result.UncoveredBytes += f.size.Int64
+	}
+
+	return result, nil
+}
+
+// Why the backup doesn't cover f, or "" if it does
+func (b *Backup) cover(f *coveredFile) string {
+	status := NotBackedUp
+	if backedUp, ok := b.paths[f.path]; ok {
+		if b.samePath(f, backedUp) {
+			return ""
+		}
+		status = Outdated
+	}
+
+	for _, e := range f.hashes {
+		if b.hashes[e] {
+			return ""
+		}
+	}
+
+	return status
+}
+
+func (b *Backup) samePath(f *coveredFile, backedUp *BackupFile) bool {
+	for _, e := range f.hashes {
+		if hash, ok := backedUp.Hashes[e.algo]; ok {
+			return hash == e.hash
+		}
+	}
+
+	if f.size.Valid && backedUp.Size >= 0 && f.size.Int64 != backedUp.Size {
+		return false
+	}
+
+	// Backends that don't keep mtimes to the nanosecond round them
+	return backedUp.Mtime.IsZero() || !backedUp.Mtime.Before(f.mtime.Add(-time.Second))
+}
+
+// Prints the files the backup doesn't cover and how much of the catalog it
+// does, and returns an error if it misses any so that scripts can tell
+func (c *Catalog) ReportCoverage(result *CoverageResult) error {
+	for _, u := range result.Uncovered {
+		c.Out.Print("uncovered", Fields{"path": u.Path, "size": u.Size, "status": u.Status}, "%s %s\n", u.Status, u.Path)
+	}
+
+	covered := result.Files - int64(len(result.Uncovered))
+	c.Out.Print("coverage", Fields{"files": result.Files, "bytes": result.Bytes, "covered": covered, "uncovered": len(result.Uncovered), "uncovered_bytes": result.UncoveredBytes},
+		"%d of %d files are backed up, leaving %d files of %s uncovered\n", covered, result.Files, len(result.Uncovered), c.Out.Size(result.UncoveredBytes))
+
+	if len(result.Uncovered) > 0 {
+		return fmt.Errorf("%d files not backed up", len(result.Uncovered))
+	}
+
+	return nil
+}
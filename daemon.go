@@ -0,0 +1,65 @@
+package leibniz
+
+import (
+	"fmt"
+	"time"
+)
+
+// Scans each of roots whenever schedule says to, and right away too if now
+// is set, until stop is closed. A scan that fails is reported and tried again
+// at the next scheduled time rather than stopping the daemon. Scans are only
+// interrupted when Stop is closed as well.
+func (c *Catalog) Daemon(roots []string, schedule Schedule, now bool, stop <-chan struct{}) error {
+	next := time.Now()
+	if !now {
+		next = schedule.Next(next)
+	}
+
+	for {
+		if next.IsZero() {
+			return fmt.Errorf("the schedule never fires")
+		}
+
+		c.Out.Print("daemon-next", Fields{"time": next}, "Next scan at %s\n", c.Out.Time(next))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		c.scanRoots(roots)
+		if c.stopped() {
+			return nil
+		}
+		next = schedule.Next(time.Now())
+	}
+}
+
+// Scans each of roots in turn, reporting the ones that fail and going on with
+// the rest. Returns the last failure, if any.
+func (c *Catalog) scanRoots(roots []string) error {
+	var failed error
+	for _, root := range roots {
+		c.SetRoot(root)
+		c.Out.Print("scan", Fields{"root": root}, "Cataloging %s\n", root)
+
+		err := c.runMetered()
+		c.ReportStats()
+		if err == nil && c.Opts.Prune {
+			err = c.ReportPrune(root, false)
+		}
+
+		if err == ErrInterrupted {
+			return failed
+		}
+		if err != nil {
+			c.Out.Print("scan-error", Fields{"root": root, "error": err}, "Scanning %s failed: %s\n", root, err)
+			failed = err
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,419 @@
+package leibniz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A file dedup replaced or trash removed, as recorded in the undo log. Path's
+// content was the same as Canonical's, so undoing a replacement only needs the
+// metadata Path had, but the file itself is in the trash at Trashed unless
+// trashing was turned off.
+type UndoRecord struct {
+	Op        string      `json:"op"`
+	Path      string      `json:"path"`
+	Canonical string      `json:"canonical,omitempty"`
+	Trashed   string      `json:"trashed,omitempty"`
+	Mode      os.FileMode `json:"mode"`
+	Uid       int         `json:"uid"`
+	Gid       int         `json:"gid"`
+	HasOwner  bool        `json:"has_owner"`
+	Mtime     time.Time   `json:"mtime"`
+	Time      time.Time   `json:"time"`
+}
+
+// Reports whether two files have exactly the same content
+func SameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+
+	ra := bufio.NewReaderSize(fa, 1<<20)
+	rb := bufio.NewReaderSize(fb, 1<<20)
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// Picks the copy the others will be linked to: one of the files that
+// already has the most of the group's paths linked to it, so as few paths as
+// possible change.
+func canonicalCopy(paths []string) (string, map[string]os.FileInfo) {
+	infos := make(map[string]os.FileInfo)
+	links := make(map[inodeKey]int)
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos[p] = info
+
+		if dev, inode, _, ok := fileId(info); ok {
+			links[inodeKey{dev, inode}]++
+		}
+	}
+
+	canonical := ""
+	best := 0
+	for _, p := range paths {
+		info, ok := infos[p]
+		if !ok {
+			continue
+		}
+
+		n := 1
+		if dev, inode, _, ok := fileId(info); ok {
+			n = links[inodeKey{dev, inode}]
+		}
+
+		if n > best {
+			canonical, best = p, n
+		}
+	}
+
+	return canonical, infos
+}
+
+// Ways dedup can make duplicate copies share storage
+const (
+	DedupHardlink = "hardlink"
+	DedupReflink  = "reflink"
+)
+
+// Reported when the filesystem can't clone files
+var ErrReflinkUnsupported = errors.New("the filesystem doesn't support reflinks; use -hardlink instead")
+
+// Makes duplicate copies share storage with a canonical copy, after
+// confirming byte for byte that they are identical. method is DedupHardlink
+// to replace them with hard links, or DedupReflink to replace them with clones
+// that share extents but stay separate files with their own metadata. Every
+// replacement is written to undo as a JSON line. With dryRun nothing is
+// changed, but contents are still compared so the report is accurate.
+func (c *Catalog) Dedup(method string, dryRun bool, undo io.Writer) error {
+	if method != DedupHardlink && method != DedupReflink {
+		return fmt.Errorf("unknown dedup method %q", method)
+	}
+
+	groups, err := c.Dupes()
+	if err != nil {
+		return err
+	}
+
+	verb := map[string]string{DedupHardlink: "Linked", DedupReflink: "Cloned"}[method]
+	if dryRun {
+		verb = map[string]string{DedupHardlink: "Would link", DedupReflink: "Would clone"}[method]
+	}
+
+	var replaced, saved int64
+	for _, group := range groups {
+		canonical, infos := canonicalCopy(group.Paths)
+		if canonical == "" {
+			continue
+		}
+		cinfo := infos[canonical]
+		cdev, _, _, _ := fileId(cinfo)
+		var cid int64
+		for i, p := range group.Paths {
+			if p == canonical {
+				cid = group.fileIds[i]
+			}
+		}
+
+		for i, p := range group.Paths {
+			if c.stopped() {
+				return ErrInterrupted
+			}
+
+			info, ok := infos[p]
+			if !ok || p == canonical || os.SameFile(info, cinfo) {
+				continue
+			}
+
+			if dev, _, _, ok := fileId(info); ok && dev != cdev {
+				c.Out.Verbosity("dedup-skip", Fields{"path": p, "canonical": canonical, "reason": "different filesystem"}, "Skipping %s: not on the same filesystem as %s\n", p, canonical)
+				continue
+			}
+
+			same, err := SameContent(canonical, p)
+			if err != nil {
+				c.Out.Print("dedup-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+				continue
+			}
+
+			if !same {
+				c.Out.Print("dedup-skip", Fields{"path": p, "canonical": canonical, "reason": "content differs"}, "Skipping %s: content differs from %s despite the same hash\n", p, canonical)
+				continue
+			}
+
+			if !dryRun {
+				err = c.recordVerified(cid, group.fileIds[i])
+				if err != nil {
+					return err
+				}
+			}
+
+			if !dryRun {
+				err = c.replaceCopy(method, canonical, p, info, undo)
+				if err == ErrReflinkUnsupported {
+					return fmt.Errorf("%s: %s", p, err)
+				}
+				if err != nil {
+					c.Out.Print("dedup-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+					continue
+				}
+
+				err = c.updateInode(p)
+				if err != nil {
+					return err
+				}
+			}
+
+			c.Out.Print("dedup", Fields{"path": p, "canonical": canonical, "method": method, "bytes": info.Size(), "dry_run": dryRun}, "%s %s -> %s\n", verb, p, canonical)
+			replaced++
+			saved += info.Size()
+		}
+	}
+
+	c.Out.Print("dedup-summary", Fields{"method": method, "replaced": replaced, "bytes": saved, "dry_run": dryRun}, "%s %d files, saving %s\n", verb, replaced, c.Out.Size(saved))
+
+	return nil
+}
+
+// Swaps a hard link to, or a clone of, canonical in for p in one rename, so p
+// never goes missing, and logs what p was. Clones keep p's metadata. Unless
+// Options.Trash is TrashNone, p is linked into the trash first, so the rename
+// leaves the original file there.
+func (c *Catalog) replaceCopy(method, canonical, p string, info os.FileInfo, undo io.Writer) error {
+	record := UndoRecord{Op: method, Path: p, Canonical: canonical, Mode: info.Mode(), Mtime: info.ModTime(), Time: time.Now()}
+	record.Uid, record.Gid, record.HasOwner = fileOwner(info)
+
+	tmp := filepath.Join(filepath.Dir(p), fmt.Sprintf(".leibniz-%s-%d", method, time.Now().UnixNano()))
+	var err error
+	if method == DedupHardlink {
+		err = os.Link(canonical, tmp)
+	} else {
+		err = cloneFile(canonical, tmp)
+		if err == nil {
+			err = applyMetadata(tmp, record)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if c.Opts.Trash != TrashNone {
+		record.Trashed, err = c.trash(p, true)
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("couldn't trash it: %s", err)
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = undo.Write(append(line, '\n'))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if record.Trashed != "" {
+			os.Remove(record.Trashed)
+			removeTrashInfo(record.Trashed)
+		}
+		return fmt.Errorf("couldn't write the undo log: %s", err)
+	}
+
+	err = os.Rename(tmp, p)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Records the device and inode a path has on disk now
+func (c *Catalog) updateInode(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil
+	}
+
+	dev, inode, _, ok := fileId(info)
+	if !ok {
+		return nil
+	}
+
+	_, err = c.Db.Exec(`update files set dev=?, inode=? where path=?`, int64(dev), int64(inode), p)
+
+	return err
+}
+
+// Gives a file the mode, owner and mtime in record
+func applyMetadata(path string, record UndoRecord) error {
+	err := os.Chmod(path, record.Mode.Perm())
+	if err == nil && record.HasOwner {
+		err = os.Lchown(path, record.Uid, record.Gid)
+	}
+	if err == nil {
+		err = os.Chtimes(path, time.Now(), record.Mtime)
+	}
+
+	return err
+}
+
+// Undoes the operations in an undo log. Trashed files are moved back where
+// they were, and replaced ones without a copy in the trash get a copy of the
+// content again with the metadata they had before. Trashed files aren't
+// cataloged again until their root is scanned.
+func (c *Catalog) Undo(log io.Reader) error {
+	scanner := bufio.NewScanner(log)
+	var restored, failed int
+	for scanner.Scan() {
+		var record UndoRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return err
+		}
+
+		// Put back by an earlier undo that didn't get through the rest, unless
+		// the copy is still the link to the canonical one and the trash was
+		// emptied since
+		if record.Trashed != "" {
+			_, trashErr := os.Lstat(record.Trashed)
+			if info, err := os.Lstat(record.Path); err == nil && os.IsNotExist(trashErr) {
+				if cinfo, err := os.Lstat(record.Canonical); record.Canonical != "" && err == nil && os.SameFile(info, cinfo) {
+					c.Out.Print("undo-error", Fields{"path": record.Path, "error": "the trashed original is gone"}, "%s: can't be restored, the trashed original is gone\n", record.Path)
+					failed++
+					continue
+				}
+
+				restored++
+				continue
+			}
+		}
+
+		if record.Trashed != "" {
+			err = restoreTrashed(record.Trashed, record.Path, record.Op != OpTrash)
+		} else {
+			err = restoreCopy(record)
+		}
+		if err != nil {
+			c.Out.Print("undo-error", Fields{"path": record.Path, "error": err}, "%s: %s\n", record.Path, err)
+			failed++
+			continue
+		}
+
+		err = c.updateInode(record.Path)
+		if err != nil {
+			return err
+		}
+
+		c.Out.Verbosity("undo", Fields{"path": record.Path}, "Restored %s\n", record.Path)
+		restored++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.Out.Print("undo-summary", Fields{"restored": restored, "failed": failed}, "Restored %d files\n", restored)
+
+	if failed > 0 {
+		return fmt.Errorf("%d files not restored", failed)
+	}
+
+	return nil
+}
+
+// Undoes the operation journaled at path, then renames the journal to
+// path.undone, so it is neither listed nor undone twice
+func (c *Catalog) UndoJournal(path string) error {
+	log, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	err = c.Undo(log)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, path+".undone")
+}
+
+func restoreCopy(record UndoRecord) error {
+	src, err := os.Open(record.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filepath.Join(filepath.Dir(record.Path), fmt.Sprintf(".leibniz-undo-%d", time.Now().UnixNano()))
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, record.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = applyMetadata(tmp, record)
+	}
+	if err == nil {
+		err = os.Rename(tmp, record.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package leibniz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A catalog in a temporary directory with root scanned into it, printing
+// nothing, and trashing into a directory of its own
+func scannedCatalog(t *testing.T, root string) *Catalog {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Root = root
+	opts.CatalogPath = filepath.Join(dir, "catalog.db")
+	opts.GlobalIgnore = ""
+	opts.Trash = filepath.Join(dir, "trash")
+
+	c, err := OpenCatalog(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Db.Close() })
+	c.Out.W = io.Discard
+
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func writeFile(t *testing.T, path, content string, mtime time.Time) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0640)
+	}
+	if err == nil {
+		err = os.Chtimes(path, mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	big := strings.Repeat("x", 200*1024)
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"", "", true},
+		{"hello", "hello", true},
+		{"hello", "world", false},
+		{"hello", "hello!", false},
+		{big, big, true},
+		{big, big[:len(big)-1] + "y", false},
+		{big, big + "x", false},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		writeFile(t, a, test.a, time.Now())
+		writeFile(t, b, test.b, time.Now())
+
+		same, err := SameContent(a, b)
+		if err != nil || same != test.same {
+			t.Errorf("%d: SameContent = %v, %v, want %v", i, same, err, test.same)
+		}
+	}
+
+	if _, err := SameContent(filepath.Join(dir, "a"), filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("SameContent of a missing file didn't fail")
+	}
+}
+
+func TestDedupUndo(t *testing.T) {
+	tests := []struct {
+		name  string
+		trash string
+	}{
+		{"trash", ""},
+		{"no trash", TrashNone},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		canonical, copy := filepath.Join(root, "a"), filepath.Join(root, "sub", "b")
+		mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		writeFile(t, canonical, "same content", mtime)
+		writeFile(t, copy, "same content", mtime.Add(time.Hour))
+		err := os.Chmod(copy, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := scannedCatalog(t, root)
+		if test.trash != "" {
+			c.Opts.Trash = test.trash
+		}
+
+		var journal bytes.Buffer
+		err = c.Dedup(DedupHardlink, false, &journal)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		a, errA := os.Stat(canonical)
+		b, errB := os.Stat(copy)
+		if errA != nil || errB != nil || !os.SameFile(a, b) {
+			t.Fatalf("%s: %s wasn't linked to %s", test.name, copy, canonical)
+		}
+
+		err = c.Undo(&journal)
+		if err != nil {
+			t.Fatalf("%s: undo: %s", test.name, err)
+		}
+
+		a, errA = os.Stat(canonical)
+		b, errB = os.Stat(copy)
+		if errA != nil || errB != nil {
+			t.Fatalf("%s: undo lost a file: %v %v", test.name, errA, errB)
+		}
+		if os.SameFile(a, b) {
+			t.Errorf("%s: %s is still linked to %s after undo", test.name, copy, canonical)
+		}
+		if b.Mode().Perm() != 0600 || !b.ModTime().Equal(mtime.Add(time.Hour)) {
+			t.Errorf("%s: undo left %s with mode %s and mtime %s", test.name, copy, b.Mode().Perm(), b.ModTime())
+		}
+		if a.Mode().Perm() != 0640 || !a.ModTime().Equal(mtime) {
+			t.Errorf("%s: undo changed %s to mode %s and mtime %s", test.name, canonical, a.Mode().Perm(), a.ModTime())
+		}
+		if same, err := SameContent(canonical, copy); !same || err != nil {
+			t.Errorf("%s: undo left %s with other content: %v", test.name, copy, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	Added    = "added"
+	Removed  = "removed"
+	Modified = "modified"
+	Moved    = "moved"
+)
+
+// A difference between two sets of files. Paths are relative to the root
+// they were cataloged under, and From is only set for moves.
+type Change struct {
+	Status  string
+	Path    string
+	From    string
+	OldHash string
+	NewHash string
+}
+
+type entry struct {
+	algo string
+	hash string
+}
+
+// Compares the files currently cataloged under two roots, as when checking
+// that a mirror matches its source. Files are matched by their path relative
+// to each root.
+func (c *Catalog) DiffRoots(from, to string) ([]*Change, error) {
+	old, err := c.rootState(from)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := c.rootState(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffStates(old, cur), nil
+}
+
+// Compares the files under a root as they were at two of its scans. If to is
+// zero, the root's latest scan is used.
+func (c *Catalog) DiffScans(from, to int64) ([]*Change, error) {
+	var fromRoot, toRoot int64
+	err := c.Db.QueryRow(`select root_id from scans where id=?`, from).Scan(&fromRoot)
+	if err == nil && to == 0 {
+		err = c.Db.QueryRow(`select max(id) from scans where root_id=?`, fromRoot).Scan(&to)
+	}
+	if err == nil {
+		err = c.Db.QueryRow(`select root_id from scans where id=?`, to).Scan(&toRoot)
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no such scan")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fromRoot != toRoot {
+		return nil, fmt.Errorf("scans %d and %d are of different roots", from, to)
+	}
+
+	old, err := c.scanState(fromRoot, from)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := c.scanState(toRoot, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffStates(old, cur), nil
+}
+
+func (c *Catalog) rootState(root string) (map[string]entry, error) {
+	var rootId int64
+	err := c.Db.QueryRow(`select id from roots where root=?`, root).Scan(&rootId)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s is not a root in this catalog", root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.state(root, `
+		select path, algo, hash from files
+		where root_id=?
+		`, rootId)
+}
+
+// A file was present at a scan if the scan falls between the one that
+// cataloged it as it is and the last one to see it. Rows from before scans
+// were recorded have no scan ids, and were never present at any scan. A file
+// that changed since is only known as it was if -keep-history kept it, and
+// otherwise wasn't present at the scans before the change.
+func (c *Catalog) scanState(rootId, scanId int64) (map[string]entry, error) {
+	var root string
+	err := c.Db.QueryRow(`select root from roots where id=?`, rootId).Scan(&root)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.state(root, `
+		select path, algo, hash from (
+			select path, algo, hash, first_scan_id, scan_id from files where root_id=?
+			union all
+			select path, algo, hash, first_scan_id, scan_id from file_history where root_id=?
+		)
+		where coalesce(first_scan_id, 0) <= ? and scan_id >= ?
+		`, rootId, rootId, scanId, scanId)
+}
+
+func (c *Catalog) state(root, query string, args ...interface{}) (map[string]entry, error) {
+	rows, err := c.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefix := dirPrefix(root)
+	state := make(map[string]entry)
+	for rows.Next() {
+		var path string
+		var e entry
+		err = rows.Scan(&path, &e.algo, &e.hash)
+		if err != nil {
+			return nil, err
+		}
+
+		state[strings.TrimPrefix(path, prefix)] = e
+	}
+
+	return state, rows.Err()
+}
+
+// A removed path and an added path with the same hash are reported as a
+// single move.
+func diffStates(old, cur map[string]entry) []*Change {
+	changes := make([]*Change, 0)
+	removed := make(map[entry][]string)
+	added := make([]string, 0)
+
+	for path, e := range old {
+		n, ok := cur[path]
+		switch {
+		case !ok:
+			removed[e] = append(removed[e], path)
+		case n != e:
+			changes = append(changes, &Change{Status: Modified, Path: path, OldHash: e.hash, NewHash: n.hash})
+		}
+	}
+
+	for path := range cur {
+		if _, ok := old[path]; !ok {
+			added = append(added, path)
+		}
+	}
+
+	for _, paths := range removed {
+		sort.Strings(paths)
+	}
+	sort.Strings(added)
+
+	for _, path := range added {
+		e := cur[path]
+		if from := removed[e]; len(from) > 0 {
+			// Among identical files, one with the same name is the likelier source
+			i := 0
+			for j, p := range from {
+				if filepath.Base(p) == filepath.Base(path) {
+					i = j
+					break
+				}
+			}
+
+			changes = append(changes, &Change{Status: Moved, Path: path, From: from[i], OldHash: e.hash, NewHash: e.hash})
+			removed[e] = append(from[:i:i], from[i+1:]...)
+			continue
+		}
+
+		changes = append(changes, &Change{Status: Added, Path: path, NewHash: e.hash})
+	}
+
+	for e, paths := range removed {
+		for _, path := range paths {
+			changes = append(changes, &Change{Status: Removed, Path: path, OldHash: e.hash})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+var statusLetters = map[string]string{Added: "A", Removed: "D", Modified: "M", Moved: "R"}
+
+// Prints changes the way git status --short would, and returns an error if
+// there were any so that scripts can tell a mirror doesn't match
+func (c *Catalog) ReportDiff(changes []*Change) error {
+	counts := make(map[string]int)
+	for _, ch := range changes {
+		counts[ch.Status]++
+
+		fields := Fields{"status": ch.Status, "path": ch.Path}
+		if ch.OldHash != "" {
+			fields["old_hash"] = ch.OldHash
+		}
+		if ch.NewHash != "" {
+			fields["new_hash"] = ch.NewHash
+		}
+
+		switch ch.Status {
+		case Moved:
+			fields["from"] = ch.From
+			c.Out.Print("diff", fields, "R %s -> %s\n", ch.From, ch.Path)
+		default:
+			c.Out.Print("diff", fields, "%s %s\n", statusLetters[ch.Status], ch.Path)
+		}
+	}
+
+	c.Out.Print("diff-summary", Fields{
+		Added:    counts[Added],
+		Removed:  counts[Removed],
+		Modified: counts[Modified],
+		Moved:    counts[Moved],
+	}, "%d added, %d removed, %d modified, %d moved\n", counts[Added], counts[Removed], counts[Modified], counts[Moved])
+
+	if len(changes) > 0 {
+		return fmt.Errorf("%d differences", len(changes))
+	}
+
+	return nil
+}
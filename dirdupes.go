@@ -0,0 +1,175 @@
+package leibniz
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+)
+
+// The files cataloged under a directory, at any depth, and how many of them
+// have a copy somewhere outside it. When every file does, the directory can
+// be deleted without losing any content.
+type DirSummary struct {
+	Dir             string
+	Files           int64
+	Bytes           int64
+	Duplicated      int64
+	DuplicatedBytes int64
+}
+
+func (d *DirSummary) Full() bool {
+	return d.Files > 0 && d.Duplicated == d.Files
+}
+
+var dirFilesQuery string = `
+	select r.root, f.path, f.size from files f
+	join roots r on r.id = f.root_id
+	`
+
+// The directories from path's parent up to root
+func ancestors(root, path string) []string {
+	dirs := make([]string, 0)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root || dir == filepath.Dir(dir) || len(dir) < len(root) {
+			return dirs
+		}
+	}
+}
+
+// Sums up the duplicates under every cataloged directory that has any,
+// largest duplicated size first
+func (c *Catalog) DirDupes() ([]*DirSummary, error) {
+	rows, err := c.Db.Query(dirFilesQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]*DirSummary)
+	for rows.Next() {
+		var root, path string
+		var size sql.NullInt64
+		err = rows.Scan(&root, &path, &size)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		for _, dir := range ancestors(root, path) {
+			d, ok := dirs[dir]
+			if !ok {
+				d = &DirSummary{Dir: dir}
+				dirs[dir] = d
+			}
+			d.Files++
+			d.Bytes += size.Int64
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups, err := c.Dupes()
+	if err != nil {
+		return nil, err
+	}
+
+	// A file is duplicated outside a directory when some of its group's
+	// paths aren't under that directory
+	for _, group := range groups {
+		under := make(map[string]int64)
+		for _, path := range group.Paths {
+			for dir := filepath.Dir(path); dirs[dir] != nil; dir = filepath.Dir(dir) {
+				under[dir]++
+				if dir == filepath.Dir(dir) {
+					break
+				}
+			}
+		}
+
+		for dir, n := range under {
+			if n < int64(len(group.Paths)) {
+				dirs[dir].Duplicated += n
+				dirs[dir].DuplicatedBytes += n * group.Size
+			}
+		}
+	}
+
+	summaries := make([]*DirSummary, 0)
+	for _, d := range dirs {
+		if d.Duplicated > 0 {
+			summaries = append(summaries, d)
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.DuplicatedBytes != b.DuplicatedBytes {
+			return a.DuplicatedBytes > b.DuplicatedBytes
+		}
+		return a.Dir < b.Dir
+	})
+
+	return summaries, nil
+}
+
+// Prints the directories holding duplicates. With full, only directories
+// whose every file has a copy elsewhere are printed, and not those under
+// another such directory, since deleting that one covers them.
+func (c *Catalog) ReportDirDupes(full bool) error {
+	summaries, err := c.DirDupes()
+	if err != nil {
+		return err
+	}
+
+	fullDirs := make(map[string]bool)
+	for _, d := range summaries {
+		if d.Full() {
+			fullDirs[d.Dir] = true
+		}
+	}
+
+	var shown int
+	for _, d := range summaries {
+		if full {
+			if !d.Full() {
+				continue
+			}
+
+			if coveredBy(fullDirs, d.Dir) {
+				continue
+			}
+		}
+
+		marker := ""
+		if d.Full() {
+			marker = " (fully duplicated)"
+		}
+
+		c.Out.Print("dir-dupes", Fields{
+			"dir":              d.Dir,
+			"files":            d.Files,
+			"bytes":            d.Bytes,
+			"duplicated":       d.Duplicated,
+			"duplicated_bytes": d.DuplicatedBytes,
+			"full":             d.Full(),
+		}, "%s: %d of %d files (%s of %s) duplicated elsewhere%s\n", d.Dir, d.Duplicated, d.Files, c.Out.Size(d.DuplicatedBytes), c.Out.Size(d.Bytes), marker)
+		shown++
+	}
+
+	c.Out.Verbosity("dir-dupes-summary", Fields{"dirs": shown}, "%d directories\n", shown)
+
+	return nil
+}
+
+// Whether any directory above dir is in dirs
+func coveredBy(dirs map[string]bool, dir string) bool {
+	for parent := filepath.Dir(dir); parent != dir; dir, parent = parent, filepath.Dir(parent) {
+		if dirs[parent] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,273 @@
+package leibniz
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// With -fast-dirs, a scan remembers the mtime and number of entries of every
+// directory it reads, and the next takes a directory whose mtime and number of
+// entries are the same to hold the same files. Only the names and types in it
+// are read, to count them and find its subdirectories, which are checked in
+// turn, and the rows of its files are tagged as seen without looking at them.
+//
+// Adding, removing or renaming an entry changes a directory's mtime, but
+// writing to a file in it doesn't, so every -full-every'th scan reads
+// everything anyway. So does a scan whose filters differ from the last one's,
+// since a directory's files held the same then may not pass them the same now.
+type dirState struct {
+	mtime   time.Time
+	entries int
+	failed  bool // Something in it couldn't be read, so the next scan has to try again
+}
+
+// Decides whether the scan just started goes by the directories the last ones
+// read, and records that it does
+func (c *Catalog) startFastDirs(rootId int64) error {
+	if !c.Opts.FastDirs {
+		return nil
+	}
+	c.dirStates = make(map[string]dirState)
+
+	filters, err := c.scanFilters()
+	if err != nil {
+		return err
+	}
+	_, err = c.Db.Exec(`update scans set filters=? where id=?`, filters, c.scan.id)
+	if err != nil {
+		return err
+	}
+
+	// The scans since the last one that read everything, whether any
+	// directories are stored to go by, and the filters of the last scan
+	var fast int
+	var known bool
+	var last sql.NullString
+	err = c.Db.QueryRow(`
+		select count(*), exists (select 1 from dirs where root_id=?),
+		(select filters from scans where root_id=? and finished is not null order by id desc limit 1)
+		from scans where root_id=? and finished is not null
+		and id > coalesce((select max(id) from scans where root_id=? and finished is not null and not coalesce(fast, 0)), 0)
+		`, rootId, rootId, rootId, rootId).Scan(&fast, &known, &last)
+	if err != nil || !known {
+		return err
+	}
+
+	if last.String != filters {
+		c.Out.Verbosity("full-scan", Fields{"root": c.Opts.Root, "filters": filters}, "Reading every directory, since the filters differ from the last scan's\n")
+		return nil
+	}
+
+	if c.Opts.FullEvery > 0 && fast+1 >= c.Opts.FullEvery {
+		c.Out.Verbosity("full-scan", Fields{"root": c.Opts.Root, "fast_scans": fast}, "Reading every directory, %d scans after the last that did\n", fast)
+		return nil
+	}
+
+	c.fastDirs = true
+	_, err = c.Db.Exec(`update scans set fast=1 where id=?`, c.scan.id)
+
+	return err
+}
+
+// The options that decide which files a scan catalogs and what it keeps of
+// them, along with the global ignore file's content, as one string
+func (c *Catalog) scanFilters() (string, error) {
+	o := c.Opts
+	var globalIgnore []byte
+	if o.GlobalIgnore != "" {
+		content, err := os.ReadFile(o.GlobalIgnore)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		sum := sha256.Sum256(content)
+		globalIgnore = sum[:]
+	}
+
+	return fmt.Sprintf("exclude=%q include=%q ignore-files=%v global-ignore=%q:%x symlinks=%s min-size=%d max-size=%d min-age=%s type=%q max-depth=%d one-file-system=%v special-fs=%v archives=%v hash=%s extra-hashes=%q similarity=%v metadata=%v owner=%v xattrs=%v",
+		o.Excludes.String(), o.Includes.String(), o.IgnoreFiles, o.GlobalIgnore, globalIgnore, o.Symlinks, o.MinSize, o.MaxSize, o.MinAge, o.Types.String(),
+		o.MaxDepth, o.OneFileSystem, o.SpecialFS, o.Archives, o.Hash, o.ExtraHashes.String(), o.Similarity, o.Metadata, o.Owner, o.Xattrs), nil
+}
+
+// Notes that a scan read all of dir, so the next can go by it
+func (c *Catalog) readDir(dir string, info os.FileInfo, entries int) {
+	if c.dirStates != nil && !c.dirStates[dir].failed {
+		c.dirStates[dir] = dirState{mtime: utc(info.ModTime()), entries: entries}
+	}
+}
+
+// Notes that the scan couldn't read path, or left it out for a reason that
+// can change without its directory changing, so that neither it nor the
+// directory it is in is gone by next time. Something inside an archive
+// unsettles the archive.
+func (c *Catalog) unsettleDir(path string) {
+	if archive, _, ok := SplitArchivePath(path); ok {
+		path = archive
+	}
+
+	if c.dirStates != nil {
+		c.dirStates[path] = dirState{failed: true}
+		c.dirStates[filepath.Dir(path)] = dirState{failed: true}
+	}
+}
+
+// Stores the directories a finished scan read. One that read everything
+// replaces what was stored, so directories that are gone go too.
+func (c *Catalog) saveDirs(rootId int64) error {
+	if c.dirStates == nil {
+		return nil
+	}
+
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if !c.fastDirs {
+		_, err = tx.Exec(`delete from dirs where root_id=?`, rootId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare(`insert or replace into dirs (root_id, path, mtime, entries) values (?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for dir, state := range c.dirStates {
+		if state.failed {
+			continue
+		}
+
+		_, err = stmt.Exec(rootId, dir, state.mtime, state.entries)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	c.dirStates = nil
+
+	return tx.Commit()
+}
+
+// If dir has the mtime and number of entries the last scan to read it found,
+// returns its subdirectories, in order of names. Any doubt, like an entry that
+// can't be read, or a link when links aren't skipped, means it has to be read.
+func (c *Catalog) unchangedDir(rootId int64, dir string, info os.FileInfo) ([]os.FileInfo, bool, error) {
+	var mtime time.Time
+	var entries int
+	err := c.queryer().QueryRow(`select mtime, entries from dirs where root_id=? and path=?`, rootId, dir).Scan(&mtime, &entries)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !c.sameMtime(mtime, info.ModTime()) {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, false, nil
+	}
+	defer f.Close()
+
+	subdirs := make([]os.FileInfo, 0)
+	count := 0
+	for {
+		batch, err := f.ReadDir(c.Opts.DirBatch)
+		count += len(batch)
+		for _, entry := range batch {
+			if entry.Type()&os.ModeSymlink != 0 && c.Opts.Symlinks != SymlinksSkip {
+				return nil, false, nil
+			}
+			if !entry.IsDir() {
+				continue
+			}
+
+			sub, err := entry.Info()
+			if err != nil {
+				return nil, false, nil
+			}
+			subdirs = append(subdirs, sub)
+		}
+
+		if err == io.EOF || err == nil && c.Opts.DirBatch <= 0 {
+			break
+		}
+		if err != nil {
+			return nil, false, nil
+		}
+	}
+
+	if count != entries {
+		return nil, false, nil
+	}
+
+	sort.Slice(subdirs, func(i, j int) bool {
+		return subdirs[i].Name() < subdirs[j].Name()
+	})
+
+	return subdirs, true, nil
+}
+
+// Tags the rows of the files directly in dir, and of what is inside archives
+// there, as seen by the scan, counting them as unchanged
+func (c *Catalog) seenDir(rootId int64, dir string) error {
+	// A path whose first separator is the one ending ArchiveSeparator is of
+	// something inside an archive in dir
+	sep := string(filepath.Separator)
+
+	// Everything under dir sorts from its prefix up to the prefix with the
+	// separator that ends it bumped to the next character, which path_idx finds
+	// without going through the rest of the root
+	prefix := dirPrefix(dir)
+	end := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+	rows, err := c.queryer().Query(`
+		update files set scan_id=? where root_id=? and path >= ? and path < ?
+		and (instr(substr(path, length(?) + 1), ?) = 0 or instr(substr(path, length(?) + 1), ?) = instr(substr(path, length(?) + 1), ?) + 1)
+		returning coalesce(size, 0)
+		`, c.scan.id, rootId, prefix, end, prefix, sep, prefix, sep, prefix, ArchiveSeparator)
+	if err != nil {
+		return err
+	}
+
+	files := 0
+	for rows.Next() {
+		var size int64
+		err = rows.Scan(&size)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		c.Stats.discovered(size)
+		c.Stats.done(&c.Stats.Unchanged, size)
+		c.sawFile()
+		files++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	c.Out.Verbosity("unchanged-dir", Fields{"path": dir, "files": files}, "Unchanged directory %s (%d files)\n", dir, files)
+
+	if c.batch != nil {
+		c.batch.pending += files
+		return c.flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package leibniz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFastDirsFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		skipped string // The file the narrower filters leave out
+		narrow  func(o *Options, root string)
+		widen   func(o *Options, root string)
+	}{
+		{"exclude", "small",
+			func(o *Options, root string) { o.Excludes.Set("small$") },
+			func(o *Options, root string) { o.Excludes = &RegexFlag{} }},
+		{"include", "small",
+			func(o *Options, root string) { o.Includes.Set("big$") },
+			func(o *Options, root string) { o.Includes = &RegexFlag{} }},
+		{"min size", "small",
+			func(o *Options, root string) { o.MinSize = 1024 },
+			func(o *Options, root string) { o.MinSize = 0 }},
+		{"max size", "big",
+			func(o *Options, root string) { o.MaxSize = 1024 },
+			func(o *Options, root string) { o.MaxSize = 0 }},
+		{"type", "small",
+			func(o *Options, root string) { o.Types = ListFlag{"!text/*"} },
+			func(o *Options, root string) { o.Types = nil }},
+		{"ignore files", "small",
+			func(o *Options, root string) { o.IgnoreFiles = true },
+			func(o *Options, root string) { o.IgnoreFiles = false }},
+		{"global ignore", "big",
+			func(o *Options, root string) {
+				o.GlobalIgnore = filepath.Join(root, "..", "ignore")
+				writeFile(t, o.GlobalIgnore, "big\n", time.Now())
+			},
+			func(o *Options, root string) { writeFile(t, o.GlobalIgnore, "", time.Now()) }},
+	}
+
+	for _, test := range tests {
+		// Nothing is cataloged before the scan with the narrower filters
+		root := filepath.Join(t.TempDir(), "root")
+		err := os.MkdirAll(root, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := scannedCatalog(t, root)
+		writeFile(t, filepath.Join(root, "sub", "small"), "hello", time.Now())
+		writeFile(t, filepath.Join(root, "sub", "big"), strings.Repeat("\x00", 4096), time.Now())
+		writeFile(t, filepath.Join(root, "sub", IgnoreFileName), "small\n", time.Now())
+
+		c.Opts.FastDirs = true
+		c.Opts.Incremental = true
+		c.Opts.IgnoreFiles = false
+		for _, change := range []func(o *Options, root string){test.narrow, test.widen} {
+			change(c.Opts, root)
+			c.SetRoot(root)
+			err = c.Run()
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+
+		var cataloged bool
+		skipped := filepath.Join(root, "sub", test.skipped)
+		err = c.Db.QueryRow(`select exists (select 1 from files where path=? and scan_id=(select max(id) from scans))`, skipped).Scan(&cataloged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cataloged {
+			t.Errorf("%s: %s wasn't cataloged once the filters no longer left it out", test.name, test.skipped)
+		}
+	}
+}
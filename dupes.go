@@ -0,0 +1,325 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A set of distinct paths in the catalog that share a hash. Roots holds the
+// root each path was cataloged under. Inodes counts the distinct files behind
+// the paths, which is fewer than the paths when some are hard links to each
+// other. Verified is set once the copies have been compared byte for byte.
+type DupeGroup struct {
+	Algo     string
+	Hash     string
+	Paths    []string
+	Roots    []string
+	Size     int64
+	Inodes   int
+	Verified bool
+
+	// The device and inode of each path, zero where they aren't known
+	ids []inodeKey
+
+	// The catalog row of each path
+	fileIds []int64
+
+	// The mtime each path was cataloged with
+	mtimes []time.Time
+}
+
+// The space that would be recovered by keeping only one copy. Size comes from
+// the catalog, or from disk for catalogs that predate the size column, so it
+// is zero if it isn't known. Hard links already share their space, so they
+// don't waste any.
+func (g *DupeGroup) Wasted() int64 {
+	return g.Size * int64(g.Inodes-1)
+}
+
+// The group as the fields of a "dupes" event
+func (g *DupeGroup) Fields() Fields {
+	return Fields{
+		"algo":     g.Algo,
+		"hash":     g.Hash,
+		"size":     g.Size,
+		"wasted":   g.Wasted(),
+		"paths":    g.Paths,
+		"roots":    g.Roots,
+		"inodes":   g.Inodes,
+		"verified": g.Verified,
+	}
+}
+
+// Whether some of the paths are already hard links to the same file
+func (g *DupeGroup) Hardlinked() bool {
+	return g.Inodes < len(g.Paths)
+}
+
+func (g *DupeGroup) add(root, path string, id inodeKey, mtime time.Time, fileId int64) {
+	g.Paths = append(g.Paths, path)
+	g.Roots = append(g.Roots, root)
+	g.ids = append(g.ids, id)
+	g.mtimes = append(g.mtimes, mtime)
+	g.fileIds = append(g.fileIds, fileId)
+
+	if id != (inodeKey{}) {
+		for _, seen := range g.ids[:len(g.ids)-1] {
+			if seen == id {
+				return
+			}
+		}
+	}
+	g.Inodes++
+}
+
+// The group made of only the paths keep accepts, or nil if fewer than two are
+// left
+func (g *DupeGroup) subset(keep func(i int) bool) *DupeGroup {
+	sub := &DupeGroup{Algo: g.Algo, Hash: g.Hash, Size: g.Size, Verified: g.Verified}
+	for i := range g.Paths {
+		if keep(i) {
+			sub.add(g.Roots[i], g.Paths[i], g.ids[i], g.mtimes[i], g.fileIds[i])
+		}
+	}
+
+	if len(sub.Paths) < 2 {
+		return nil
+	}
+
+	return sub
+}
+
+// Which duplicates to report. The zero value reports every set.
+type DupeScope struct {
+	// Only copies under the same root count as duplicates of each other
+	WithinRoot bool
+
+	// Only sets with copies under more than one root
+	AcrossRoots bool
+
+	// Only copies under these two roots, in sets that have copies under both
+	Between [2]string
+}
+
+func (s DupeScope) String() string {
+	switch {
+	case s.WithinRoot:
+		return "within each root"
+	case s.AcrossRoots:
+		return "across roots"
+	case s.Between[0] != "":
+		return fmt.Sprintf("between %s and %s", s.Between[0], s.Between[1])
+	default:
+		return ""
+	}
+}
+
+// Applies the scope to a set, which may split it into one per root or drop
+// it altogether
+func (s DupeScope) apply(g *DupeGroup) []*DupeGroup {
+	switch {
+	case s.WithinRoot:
+		roots := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, root := range g.Roots {
+			if !seen[root] {
+				seen[root] = true
+				roots = append(roots, root)
+			}
+		}
+
+		groups := make([]*DupeGroup, 0)
+		for _, root := range roots {
+			if sub := g.subset(func(i int) bool { return g.Roots[i] == root }); sub != nil {
+				groups = append(groups, sub)
+			}
+		}
+		return groups
+	case s.AcrossRoots:
+		for _, root := range g.Roots[1:] {
+			if root != g.Roots[0] {
+				return []*DupeGroup{g}
+			}
+		}
+		return nil
+	case s.Between[0] != "":
+		var inA, inB bool
+		for _, root := range g.Roots {
+			inA = inA || root == s.Between[0]
+			inB = inB || root == s.Between[1]
+		}
+		if !inA || !inB {
+			return nil
+		}
+
+		sub := g.subset(func(i int) bool { return g.Roots[i] == s.Between[0] || g.Roots[i] == s.Between[1] })
+		return []*DupeGroup{sub}
+	default:
+		return []*DupeGroup{g}
+	}
+}
+
+// Hashes are only comparable when the same algorithm produced them. Empty
+// files all share a digest, but removing them frees nothing, and they are
+// often there for their names alone, so they are never duplicates.
+var dupesQuery string = `
+	select f.id, f.algo, f.hash, r.root, f.path, f.dev, f.inode, f.size, f.mtime from files f
+	join roots r on r.id = f.root_id
+	join (select algo, hash from files where size is not 0 group by algo, hash having count(distinct path) > 1) d
+	on f.algo = d.algo and f.hash = d.hash
+	order by f.algo, f.hash, f.path, r.root
+	`
+
+func (c *Catalog) Dupes() ([]*DupeGroup, error) {
+	return c.ScopedDupes(DupeScope{})
+}
+
+// Lists the sets of duplicates that fall within scope
+func (c *Catalog) ScopedDupes(scope DupeScope) ([]*DupeGroup, error) {
+	for _, root := range scope.Between {
+		if root == "" {
+			continue
+		}
+
+		var known int
+		err := c.Db.QueryRow(`select count(*) from roots where root=?`, root).Scan(&known)
+		if err != nil {
+			return nil, err
+		}
+		if known == 0 {
+			return nil, fmt.Errorf("%s isn't a cataloged root", root)
+		}
+	}
+
+	rows, err := c.Db.Query(dupesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make([]*DupeGroup, 0)
+	var cur *DupeGroup
+	for rows.Next() {
+		var fileId int64
+		var algo, hash, root, path string
+		var dev, inode, size sql.NullInt64
+		var mtime time.Time
+		err = rows.Scan(&fileId, &algo, &hash, &root, &path, &dev, &inode, &size, &mtime)
+		if err != nil {
+			return nil, err
+		}
+
+		if cur == nil || cur.Algo != algo || cur.Hash != hash {
+			cur = &DupeGroup{Algo: algo, Hash: hash}
+			all = append(all, cur)
+		}
+
+		if size.Valid {
+			cur.Size = size.Int64
+		}
+
+		// Overlapping roots catalog the same path twice
+		if len(cur.Paths) > 0 && cur.Paths[len(cur.Paths)-1] == path {
+			continue
+		}
+
+		var id inodeKey
+		if dev.Valid && inode.Valid {
+			id = inodeKey{uint64(dev.Int64), uint64(inode.Int64)}
+		}
+		cur.add(root, path, id, mtime, fileId)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := make([]*DupeGroup, 0)
+	for _, group := range all {
+		if len(group.Paths) > 1 {
+			groups = append(groups, scope.apply(group)...)
+		}
+	}
+
+	for _, group := range groups {
+		if group.Size > 0 {
+			continue
+		}
+
+		for _, path := range group.Paths {
+			info, err := os.Stat(path)
+			if err == nil {
+				group.Size = info.Size()
+				break
+			}
+		}
+	}
+
+	if c.Opts.Paranoid {
+		return c.confirmDupes(groups)
+	}
+
+	return groups, nil
+}
+
+func (c *Catalog) ReportDupes(scope DupeScope) error {
+	groups, err := c.ScopedDupes(scope)
+	if err != nil {
+		return err
+	}
+
+	var total, covered, coveredBytes int64
+	for _, group := range groups {
+		linked := ""
+		if group.Hardlinked() {
+			linked = fmt.Sprintf(" (%d distinct files, the rest hard links)", group.Inodes)
+		}
+		verified := ""
+		if group.Verified {
+			verified = ", compared byte for byte"
+		}
+
+		text := fmt.Sprintf("%s (%s): %d copies%s of %s, %s wasted%s\n", group.Hash, group.Algo, len(group.Paths), linked, c.Out.Size(group.Size), c.Out.Size(group.Wasted()), verified)
+		for _, path := range group.Paths {
+			text += fmt.Sprintf("\t%s\n", path)
+		}
+
+		c.Out.Print("dupes", group.Fields(), "%s", text)
+
+		total += group.Wasted()
+
+		// Copies under the first root that the second root also has, counting
+		// hard links to the same file once
+		if scope.Between[0] != "" {
+			seen := make(map[inodeKey]bool)
+			for i, root := range group.Roots {
+				if root != scope.Between[0] {
+					continue
+				}
+
+				id := group.ids[i]
+				if id != (inodeKey{}) && seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				covered++
+				coveredBytes += group.Size
+			}
+		}
+	}
+
+	in := ""
+	if scope.String() != "" {
+		in = " " + scope.String()
+	}
+	c.Out.Print("dupes-summary", Fields{"sets": len(groups), "wasted": total, "scope": scope.String()}, "%d duplicate sets%s, %s wasted\n", len(groups), in, c.Out.Size(total))
+
+	if scope.Between[0] != "" {
+		c.Out.Print("dupes-between", Fields{"root": scope.Between[0], "other": scope.Between[1], "files": covered, "bytes": coveredBytes}, "%d files (%s) under %s also exist under %s\n", covered, c.Out.Size(coveredBytes), scope.Between[0], scope.Between[1])
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package leibniz
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Which copy of each set of duplicates a script keeps
+const (
+	KeepNewest       = "newest"        // The one with the latest mtime
+	KeepOldest       = "oldest"        // The one with the earliest mtime
+	KeepShortestPath = "shortest-path" // The one with the fewest directories above it, then the shortest name
+	KeepInRoot       = "in-root"       // One under the given root, leaving sets without one alone
+)
+
+var KeepPolicies = []string{KeepNewest, KeepOldest, KeepShortestPath, KeepInRoot}
+
+// A policy for choosing the copy to keep. Root is the root in-root keeps a
+// copy under.
+type KeepPolicy struct {
+	Policy string
+	Root   string
+}
+
+// Parses newest, oldest, shortest-path or in-root=dir
+func ParseKeepPolicy(s string) (*KeepPolicy, error) {
+	policy, root, _ := strings.Cut(s, "=")
+	if !oneOf(policy, KeepPolicies) {
+		return nil, fmt.Errorf("unknown keep policy %q, expected one of %s", policy, strings.Join(KeepPolicies, ", "))
+	}
+
+	if (policy == KeepInRoot) != (root != "") {
+		return nil, fmt.Errorf("give the root to keep copies under as in-root=dir, and only with in-root")
+	}
+
+	return &KeepPolicy{Policy: policy, Root: root}, nil
+}
+
+func (k *KeepPolicy) String() string {
+	if k.Policy == KeepInRoot {
+		return k.Policy + "=" + k.Root
+	}
+
+	return k.Policy
+}
+
+// The index of the path in the group to keep, or -1 if the policy keeps none
+// of them. Ties go to the path that sorts first.
+func (k *KeepPolicy) choose(g *DupeGroup) int {
+	depth := func(p string) int {
+		return strings.Count(filepath.ToSlash(p), "/")
+	}
+
+	better := func(i, j int) bool {
+		switch k.Policy {
+		case KeepNewest:
+			return g.mtimes[i].After(g.mtimes[j])
+		case KeepOldest:
+			return g.mtimes[i].Before(g.mtimes[j])
+		default:
+			if depth(g.Paths[i]) != depth(g.Paths[j]) {
+				return depth(g.Paths[i]) < depth(g.Paths[j])
+			}
+			return len(g.Paths[i]) < len(g.Paths[j])
+		}
+	}
+
+	keep := -1
+	for i := range g.Paths {
+		if k.Policy == KeepInRoot && g.Roots[i] != k.Root {
+			continue
+		}
+
+		if keep < 0 || better(i, keep) {
+			keep = i
+		}
+	}
+
+	return keep
+}
+
+// What a script does with a copy of a set of duplicates
+const (
+	ActionKeep   = "keep"
+	ActionRemove = "remove"
+	ActionLink   = "link" // Replace it with a hard link to the first copy kept
+)
+
+// A set of duplicates and what to do with each of its copies
+type Resolution struct {
+	Group   *DupeGroup
+	Actions []string
+}
+
+// Keeps every copy
+func keepAll(g *DupeGroup) *Resolution {
+	r := &Resolution{Group: g, Actions: make([]string, len(g.Paths))}
+	for i := range r.Actions {
+		r.Actions[i] = ActionKeep
+	}
+
+	return r
+}
+
+// Keeps the copy the policy chooses and removes the rest
+func (k *KeepPolicy) resolve(g *DupeGroup) *Resolution {
+	r := keepAll(g)
+	keep := k.choose(g)
+	if keep < 0 {
+		return r
+	}
+
+	for i := range r.Actions {
+		if i != keep {
+			r.Actions[i] = ActionRemove
+		}
+	}
+
+	return r
+}
+
+// The copy that stays as it is and that others are linked to, or -1 if every
+// copy is to go, which a script never does
+func (r *Resolution) kept() int {
+	for i, action := range r.Actions {
+		if action == ActionKeep {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Writes a shell script that removes all but one copy of each set of
+// duplicates, chosen by policy, with remove, like rm or trash-put. Nothing is
+// removed by leibniz itself, so the script can be read and edited first.
+func (c *Catalog) EmitDupesScript(scope DupeScope, policy *KeepPolicy, remove string) error {
+	err := c.checkKeepRoot(policy)
+	if err != nil {
+		return err
+	}
+
+	groups, err := c.ScopedDupes(scope)
+	if err != nil {
+		return err
+	}
+
+	resolutions := make([]*Resolution, len(groups))
+	for i, g := range groups {
+		resolutions[i] = policy.resolve(g)
+	}
+
+	return writeDupesScript(c.Out, "-emit-script -keep "+policy.String(), resolutions, remove)
+}
+
+func (c *Catalog) checkKeepRoot(policy *KeepPolicy) error {
+	if policy == nil || policy.Policy != KeepInRoot {
+		return nil
+	}
+
+	var known int
+	err := c.Db.QueryRow(`select count(*) from roots where root=?`, policy.Root).Scan(&known)
+	if err != nil {
+		return err
+	}
+	if known == 0 {
+		return fmt.Errorf("%s isn't a cataloged root", policy.Root)
+	}
+
+	return nil
+}
+
+// Whether s has characters a line of a script can't hold as they are: a
+// newline would end a comment and run the rest, and /bin/sh has no quoting
+// that spells control characters out
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// s as a comment of a script can hold it, escaped Go style if it has control
+// characters
+func scriptComment(s string) string {
+	if hasControl(s) {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// Writes the script carrying out resolutions. Links are only made after cmp
+// finds the copies still identical. Paths that are hard links to the kept
+// copy recover no space, and files inside archives or buckets can't be
+// removed one by one, so their lines are left commented out, as are sets with
+// no copy kept and lines with control characters in their paths.
+func writeDupesScript(o *Output, how string, resolutions []*Resolution, remove string) error {
+	w := o.W
+	_, err := fmt.Fprintf(w, "#!/bin/sh\n# Written by leibniz dupes %s on %s\n# Check every line before running it\nset -e\n", scriptComment(how), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	var files, bytes int64
+	for _, r := range resolutions {
+		g := r.Group
+		keep := r.kept()
+		freed := make(map[inodeKey]bool)
+
+		fmt.Fprintf(w, "\n# %s (%s): %d copies of %s\n", scriptComment(g.Hash), scriptComment(g.Algo), len(g.Paths), o.Size(g.Size))
+		if keep < 0 {
+			fmt.Fprintf(w, "# no copy kept, leaving them all\n")
+			continue
+		}
+
+		for i, p := range g.Paths {
+			var line string
+			switch r.Actions[i] {
+			case ActionRemove:
+				line = remove + " -- " + shellQuote(p)
+			case ActionLink:
+				line = "cmp -s -- " + shellQuote(g.Paths[keep]) + " " + shellQuote(p) + " && ln -f -- " + shellQuote(g.Paths[keep]) + " " + shellQuote(p)
+			default:
+				fmt.Fprintf(w, "# keep %s\n", scriptComment(shellQuote(p)))
+				continue
+			}
+
+			switch {
+			case hasControl(line):
+				fmt.Fprintf(w, "# control characters in the name: %s\n", scriptComment(line))
+			case g.ids[i] != (inodeKey{}) && g.ids[i] == g.ids[keep]:
+				fmt.Fprintf(w, "# hard link to the kept copy: %s\n", line)
+			case IsS3Root(p):
+				fmt.Fprintf(w, "# in a bucket: %s\n", line)
+			default:
+				if _, _, ok := SplitArchivePath(p); ok {
+					fmt.Fprintf(w, "# in an archive: %s\n", line)
+					continue
+				}
+
+				fmt.Fprintf(w, "%s\n", line)
+				files++
+				if g.ids[i] == (inodeKey{}) || !freed[g.ids[i]] {
+					freed[g.ids[i]] = true
+					bytes += g.Size
+				}
+			}
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "\n# %d files of %d duplicate sets, %s\n", files, len(resolutions), o.Size(bytes))
+
+	return err
+}
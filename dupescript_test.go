@@ -0,0 +1,148 @@
+package leibniz
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDupesScriptHostileNames(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the script with")
+	}
+
+	// Each command the names try to run touches this file
+	const marker = "pwned"
+	tests := []struct {
+		kept    string // The copy the shortest path keeps, at the top of the root
+		copy    string // The other copy, in a subdirectory
+		archive bool   // Whether the other copy is inside a zip rather than a file
+		removed bool   // Whether the script removes the other copy
+	}{
+		{"a", "plain", false, true},
+		{"a", "it's", false, true},
+		{"a", "$(touch " + marker + ")", false, true},
+		{"a", "`touch " + marker + "`", false, true},
+		{"a", "-rf", false, true},
+		{"a", "x\ntouch " + marker + " #", false, false},
+		{"a", "x'\ntouch " + marker + " #", false, false},
+		{"a", "x\rtouch " + marker, false, false},
+		{"x\ntouch " + marker + " #", "plain", false, true},
+		{"a", "x\ntouch " + marker + " #", true, false},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		kept, copy := filepath.Join(root, test.kept), filepath.Join(root, "sub", test.copy)
+		writeFile(t, kept, "same", time.Now())
+		if test.archive {
+			writeZip(t, filepath.Join(root, "sub", "a.zip"), test.copy, "same")
+		} else {
+			writeFile(t, copy, "same", time.Now())
+		}
+
+		c := scannedCatalog(t, root)
+		if test.archive {
+			c.Opts.Archives = true
+			err := c.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var script bytes.Buffer
+		c.Out.W = &script
+		err := c.EmitDupesScript(DupeScope{}, &KeepPolicy{Policy: KeepShortestPath}, "rm -f")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkScript(t, root, script.String(), marker)
+		if _, err := os.Lstat(kept); err != nil {
+			t.Errorf("%q: the script removed the kept copy", test.kept)
+		}
+		if !test.archive {
+			_, err := os.Lstat(copy)
+			if removed := os.IsNotExist(err); removed != test.removed {
+				t.Errorf("%q: removed = %v, want %v:\n%s", test.copy, removed, test.removed, script.String())
+			}
+		}
+	}
+}
+
+// A root whose own name would run a command, as the kept copies' root
+func TestDupesScriptHostileRoot(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the script with")
+	}
+
+	const marker = "pwned"
+	root := filepath.Join(t.TempDir(), "r\ntouch "+marker+" #")
+	writeFile(t, filepath.Join(root, "a"), "same", time.Now())
+	writeFile(t, filepath.Join(root, "b"), "same", time.Now())
+
+	c := scannedCatalog(t, root)
+	var script bytes.Buffer
+	c.Out.W = &script
+	err := c.EmitDupesScript(DupeScope{}, &KeepPolicy{Policy: KeepInRoot, Root: root}, "rm -f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkScript(t, t.TempDir(), script.String(), marker)
+	for _, name := range []string{"a", "b"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+			t.Errorf("the script removed %s though its path has a newline", name)
+		}
+	}
+}
+
+// Runs script in dir, failing if it touches marker there or has a line
+// running a command out of a name
+func checkScript(t *testing.T, dir, script, marker string) {
+	sh := exec.Command("sh", "-c", script)
+	sh.Dir = dir
+	if out, err := sh.CombinedOutput(); err != nil {
+		t.Errorf("the script failed: %s\n%s", err, out)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, marker)); err == nil {
+		t.Errorf("the script ran a command from a name:\n%s", script)
+	}
+
+	for _, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, "touch "+marker) && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "rm -f -- ") {
+			t.Errorf("a name runs as a line of its own: %q", line)
+		}
+	}
+}
+
+func writeZip(t *testing.T, path, name, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	w, err := z.Create(name)
+	if err == nil {
+		_, err = w.Write([]byte(content))
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
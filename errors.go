@@ -0,0 +1,141 @@
+package leibniz
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A file or directory a scan couldn't read. Such errors don't stop the scan;
+// they are recorded in the errors table against the scan that hit them.
+type ScanError struct {
+	ScanId int64
+	Root   string
+	Path   string
+	Op     string
+	Kind   string
+	Err    string
+	Time   time.Time
+}
+
+// The kinds of error a scan records
+const (
+	ErrorPermission = "permission"
+	ErrorVanished   = "vanished"
+	ErrorLoop       = "loop"
+	ErrorIO         = "io"
+	ErrorUnstable   = "unstable"
+	ErrorOther      = "other"
+)
+
+// A file that changed while it was being hashed, so its hash may match
+// neither what it was nor what it is
+var ErrUnstable = errors.New("changed while being hashed")
+
+func ErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrUnstable):
+		return ErrorUnstable
+	case errors.Is(err, fs.ErrPermission):
+		return ErrorPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrorVanished
+	case errors.Is(err, syscall.ELOOP):
+		return ErrorLoop
+	case errors.Is(err, syscall.EIO):
+		return ErrorIO
+	default:
+		return ErrorOther
+	}
+}
+
+// Records that op failed on path and reports it, so the scan can carry on.
+// Only a failure to record it is returned.
+func (c *Catalog) recordError(rootId int64, path, op string, err error) error {
+	kind := ErrorKind(err)
+	msg := err.Error()
+	if !strings.Contains(msg, path) {
+		msg = path + ": " + msg
+	}
+
+	c.Stats.Errors++
+	c.Stats.ErrorKinds[kind]++
+	c.unsettleDir(path)
+	c.Out.Print("error", Fields{"path": path, "op": op, "kind": kind, "error": msg}, "Error: %s\n", msg)
+	if c.Opts.DryRun {
+		return nil
+	}
+
+	_, dbErr := c.queryer().Exec(`insert into errors (scan_id, root_id, path, op, kind, error, time) values (?, ?, ?, ?, ?, ?, ?)`,
+		c.scanId(), rootId, path, op, kind, msg, time.Now())
+	if dbErr != nil {
+		return dbErr
+	}
+
+	if c.batch != nil {
+		c.batch.pending++
+		return c.flush()
+	}
+
+	return nil
+}
+
+// Lists the errors recorded by a scan. A scanId of zero means the latest scan
+// of root, or the latest scan of any root if root is empty.
+func (c *Catalog) Errors(root string, scanId int64) ([]*ScanError, error) {
+	if scanId == 0 {
+		err := c.Db.QueryRow(`
+			select coalesce(max(s.id), 0) from scans s
+			join roots r on r.id = s.root_id
+			where ? = '' or r.root = ?
+			`, root, root).Scan(&scanId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := c.Db.Query(`
+		select e.scan_id, r.root, e.path, e.op, e.kind, e.error, e.time from errors e
+		join roots r on r.id = e.root_id
+		where e.scan_id = ?
+		order by e.id
+		`, scanId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	errs := make([]*ScanError, 0)
+	for rows.Next() {
+		e := &ScanError{}
+		err = rows.Scan(&e.ScanId, &e.Root, &e.Path, &e.Op, &e.Kind, &e.Err, &e.Time)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, e)
+	}
+
+	return errs, rows.Err()
+}
+
+// Summarizes the errors of the scan in progress by kind, like
+// "2 permission, 1 vanished"
+func (s *ScanStats) errorSummary() string {
+	kinds := make([]string, 0, len(s.ErrorKinds))
+	for kind := range s.ErrorKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", s.ErrorKinds[kind], kind)
+	}
+
+	return strings.Join(parts, ", ")
+}
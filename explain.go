@@ -0,0 +1,230 @@
+package leibniz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Why a scan of the root would catalog a path or pass over it
+type FilterExplanation struct {
+	Path     string
+	Included bool
+	Dir      bool   // Whether Path is a directory, which is walked into rather than cataloged
+	At       string // What the reason is about: Path, or a directory above it the walk doesn't enter
+	Reason   string // Starting with a verb, like "matches the exclude pattern ^/tmp/"
+}
+
+// The explanation as the fields of an "explain-filter" event
+func (e *FilterExplanation) Fields() Fields {
+	return Fields{"path": e.Path, "included": e.Included, "dir": e.Dir, "at": e.At, "reason": e.Reason}
+}
+
+func skippedAt(p, at, format string, args ...interface{}) *FilterExplanation {
+	return &FilterExplanation{Path: p, At: at, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Works out what a scan of Opts.Root would do with p, going through the
+// filters in the order the walk does, from the top of the root down to p, and
+// returns the one that rules it out, if any does. The path has to exist, since
+// what applies to it can depend on what it is.
+func (c *Catalog) ExplainFilter(p string) (*FilterExplanation, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := c.explain(abs, info)
+	if e != nil {
+		e.Dir = info.IsDir()
+	}
+
+	return e, err
+}
+
+func (c *Catalog) explain(abs string, info os.FileInfo) (*FilterExplanation, error) {
+	root := c.Opts.Root
+	if abs == root {
+		return &FilterExplanation{Path: abs, Included: info.IsDir(), At: abs, Reason: "is the root"}, nil
+	}
+	if !underDir(abs, root) {
+		return skippedAt(abs, abs, "isn't under the root %s", root), nil
+	}
+
+	var rootDev uint64
+	var sameDevOnly bool
+	if c.Opts.OneFileSystem {
+		if rootInfo, err := os.Stat(root); err == nil {
+			rootDev, _, _, sameDevOnly = fileId(rootInfo)
+		}
+	}
+
+	// A negated ignore pattern that matches the path itself, which is worth
+	// telling about when nothing else rules it out
+	kept := ""
+
+	parts := strings.Split(strings.TrimPrefix(abs, dirPrefix(root)), string(filepath.Separator))
+	cur := root
+	for depth, part := range parts {
+		dir := cur
+		cur = filepath.Join(cur, part)
+
+		if c.Opts.MaxDepth > 0 && depth >= c.Opts.MaxDepth {
+			return skippedAt(abs, dir, "is %d directories deep, as deep as -max-depth %d goes", depth, c.Opts.MaxDepth), nil
+		}
+
+		entry := info
+		if cur != abs {
+			var err error
+			entry, err = os.Lstat(cur)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if re := c.Opts.Excludes.matching(cur); re != nil {
+			return skippedAt(abs, cur, "matches the exclude pattern %s", re), nil
+		}
+		if re := c.Opts.Excludes.matching(cur + "/"); entry.IsDir() && re != nil {
+			return skippedAt(abs, cur+"/", "matches the exclude pattern %s", re), nil
+		}
+
+		ignores, err := c.ignoresFor(dir)
+		if err != nil {
+			return nil, err
+		}
+		if f, rule := ignores.deciding(cur, entry.IsDir()); rule != nil {
+			source := f.source
+			if source == "" {
+				source = filepath.Join(f.Base, IgnoreFileName)
+			}
+			if !rule.negate {
+				return skippedAt(abs, cur, "is ignored by %q on line %d of %s", rule.pattern, rule.line, source), nil
+			}
+			if cur == abs {
+				kept = fmt.Sprintf("is kept by %q on line %d of %s", rule.pattern, rule.line, source)
+			}
+		}
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			switch c.Opts.Symlinks {
+			case SymlinksRecord:
+				return skippedAt(abs, cur, "is a symbolic link, which -symlinks record catalogs as a link"), nil
+			case SymlinksSkip:
+				return skippedAt(abs, cur, "is a symbolic link, which -symlinks skip passes over"), nil
+			}
+
+			entry, err = os.Stat(cur)
+			if err != nil {
+				return skippedAt(abs, cur, "is a broken symbolic link: %s", err), nil
+			}
+		}
+
+		if entry.IsDir() && !c.Opts.SpecialFS {
+			if fstype := c.pseudoFS(cur); fstype != "" {
+				return skippedAt(abs, cur, "is a pseudo filesystem (%s), which only -special-fs walks", fstype), nil
+			}
+		}
+
+		if entry.IsDir() && sameDevOnly {
+			if dev, _, _, ok := fileId(entry); ok && dev != rootDev {
+				return skippedAt(abs, cur, "is on another filesystem than the root, which -one-file-system doesn't enter"), nil
+			}
+		}
+
+		if cur != abs {
+			continue
+		}
+
+		if entry.IsDir() {
+			if c.Opts.MaxDepth > 0 && depth+1 >= c.Opts.MaxDepth {
+				return skippedAt(abs, abs, "is %d directories deep, as deep as -max-depth %d goes", depth+1, c.Opts.MaxDepth), nil
+			}
+
+			reason := "is a directory nothing keeps the walk out of"
+			if kept != "" {
+				reason = kept
+			}
+
+			return &FilterExplanation{Path: abs, Included: true, At: abs, Reason: reason}, nil
+		}
+
+		e, err := c.explainFile(abs, entry)
+		if e != nil && e.Included && kept != "" {
+			e.Reason = kept + ", and " + e.Reason
+		}
+
+		return e, err
+	}
+
+	return nil, fmt.Errorf("%s is a directory above the root", abs)
+}
+
+// The part of ExplainFilter for a file the walk comes to
+func (c *Catalog) explainFile(p string, info os.FileInfo) (*FilterExplanation, error) {
+	switch {
+	case !info.Mode().IsRegular():
+		return skippedAt(p, p, "isn't a regular file"), nil
+	case info.Name() == VolumeMarker:
+		return skippedAt(p, p, "is the marker -mark-volume leaves"), nil
+	case info.Size() < int64(c.Opts.MinSize):
+		return skippedAt(p, p, "is %s, smaller than -min-size %s", c.Out.Size(info.Size()), c.Out.Size(int64(c.Opts.MinSize))), nil
+	case !c.sizeWanted(info.Size()):
+		return skippedAt(p, p, "is %s, larger than -max-size %s", c.Out.Size(info.Size()), c.Out.Size(int64(c.Opts.MaxSize))), nil
+	case !c.ageWanted(info.ModTime()):
+		return skippedAt(p, p, "was modified at %s, less than -min-age %s ago", c.Out.Time(info.ModTime()), c.Opts.MinAge), nil
+	}
+
+	reason := "passes every filter"
+	if len(*c.Opts.Includes) > 0 {
+		re := c.Opts.Includes.matching(p)
+		if re == nil {
+			return skippedAt(p, p, "matches no -include pattern"), nil
+		}
+		reason = fmt.Sprintf("matches -include %s", re)
+	}
+
+	if len(c.Opts.Types) > 0 {
+		mime, err := sniffFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !c.typeWanted(mime) {
+			return skippedAt(p, p, "is %s, which -type %s leaves out", mime, strings.Join(c.Opts.Types, ",")), nil
+		}
+		reason += ", and is " + mime
+	}
+
+	return &FilterExplanation{Path: p, Included: true, At: p, Reason: reason}, nil
+}
+
+// Prints what a scan would do with p and why
+func (c *Catalog) ReportExplainFilter(p string) error {
+	e, err := c.ExplainFilter(p)
+	if err != nil {
+		return err
+	}
+
+	verdict := "skipped"
+	switch {
+	case e.Included && e.Dir:
+		verdict = "walked"
+	case e.Included:
+		verdict = "cataloged"
+	}
+
+	if e.At == e.Path {
+		c.Out.Print("explain-filter", e.Fields(), "%s: %s, it %s\n", e.Path, verdict, e.Reason)
+	} else {
+		c.Out.Print("explain-filter", e.Fields(), "%s: %s, since %s %s\n", e.Path, verdict, e.At, e.Reason)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package leibniz
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"strconv"
+	"time"
+)
+
+// The formats Export can write
+var ExportFormats = []string{"csv", "jsonl", "parquet"}
+
+// A row of the files table with its root resolved, as exported. Columns that
+// older catalogs didn't record are nil.
+type ExportRow struct {
+	Id          int64     `json:"id" parquet:"id"`
+	Root        string    `json:"root" parquet:"root,dict"`
+	Path        string    `json:"path" parquet:"path"`
+	Algo        string    `json:"algo" parquet:"algo,dict"`
+	Hash        string    `json:"hash" parquet:"hash"`
+	Mtime       time.Time `json:"mtime" parquet:"mtime,timestamp(nanosecond)"`
+	Size        *int64    `json:"size" parquet:"size,optional"`
+	ScanId      *int64    `json:"scan_id" parquet:"scan_id,optional"`
+	FirstScanId *int64    `json:"first_scan_id" parquet:"first_scan_id,optional"`
+	Dev         *int64    `json:"dev" parquet:"dev,optional"`
+	Inode       *int64    `json:"inode" parquet:"inode,optional"`
+}
+
+var exportQuery string = `
+	select f.id, r.root, f.path, f.algo, f.hash, f.mtime, f.size, f.scan_id, f.first_scan_id, f.dev, f.inode
+	from files f join roots r on r.id = f.root_id
+	order by f.id
+	`
+
+func nullable(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+
+	return &n.Int64
+}
+
+// Calls fn with every row of the files table, oldest first. Rows are
+// streamed, so the catalog never has to fit in memory.
+func (c *Catalog) ExportRows(fn func(*ExportRow) error) error {
+	rows, err := c.Db.Query(exportQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		var row ExportRow
+		var size, scanId, firstScanId, dev, inode sql.NullInt64
+		err = rows.Scan(&row.Id, &row.Root, &row.Path, &row.Algo, &row.Hash, &row.Mtime, &size, &scanId, &firstScanId, &dev, &inode)
+		if err != nil {
+			return err
+		}
+		row.Size = nullable(size)
+		row.ScanId, row.FirstScanId = nullable(scanId), nullable(firstScanId)
+		row.Dev, row.Inode = nullable(dev), nullable(inode)
+
+		err = fn(&row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Writes the whole files table to w in one of ExportFormats, and returns how
+// many rows it wrote
+func (c *Catalog) Export(w io.Writer, format string) (int64, error) {
+	var count int64
+	switch format {
+	case "csv":
+		out := csv.NewWriter(w)
+		err := out.Write([]string{"id", "root", "path", "algo", "hash", "mtime", "size", "scan_id", "first_scan_id", "dev", "inode"})
+		if err != nil {
+			return 0, err
+		}
+
+		field := func(n *int64) string {
+			if n == nil {
+				return ""
+			}
+			return strconv.FormatInt(*n, 10)
+		}
+
+		err = c.ExportRows(func(r *ExportRow) error {
+			count++
+			return out.Write([]string{strconv.FormatInt(r.Id, 10), r.Root, r.Path, r.Algo, r.Hash, r.Mtime.Format(time.RFC3339Nano), field(r.Size), field(r.ScanId), field(r.FirstScanId), field(r.Dev), field(r.Inode)})
+		})
+		if err != nil {
+			return count, err
+		}
+
+		out.Flush()
+		return count, out.Error()
+
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		err := c.ExportRows(func(r *ExportRow) error {
+			count++
+			return enc.Encode(r)
+		})
+		return count, err
+
+	case "parquet":
+		out := parquet.NewGenericWriter[ExportRow](w)
+		rows := make([]ExportRow, 0, 1024)
+		err := c.ExportRows(func(r *ExportRow) error {
+			count++
+			rows = append(rows, *r)
+			if len(rows) < cap(rows) {
+				return nil
+			}
+
+			_, err := out.Write(rows)
+			rows = rows[:0]
+			return err
+		})
+		if err == nil && len(rows) > 0 {
+			_, err = out.Write(rows)
+		}
+		if err != nil {
+			return count, err
+		}
+
+		return count, out.Close()
+	}
+
+	return 0, fmt.Errorf("unknown export format %q", format)
+}
@@ -0,0 +1,133 @@
+package leibniz
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Splits a list of paths on NULs, as find -print0 and fd -0 write them
+func splitNul(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// Catalogs the files listed in Opts.FilesFrom, one a line or NUL separated
+// with Opts.FilesFromNul, instead of walking root. Relative paths are taken
+// relative to the working directory, as find and fd write them, and must lead
+// under root. Directories aren't descended into, and ignore files don't
+// apply, since the list already is the selection; the other filters do.
+func (c *Catalog) walkList(rootId int64, root string) error {
+	var r io.Reader = os.Stdin
+	if c.Opts.FilesFrom != "-" {
+		f, err := os.Open(c.Opts.FilesFrom)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	if c.Opts.FilesFromNul {
+		lines.Split(splitNul)
+	}
+
+	files := make([]WalkerContext, 0)
+	for lines.Scan() {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		p := lines.Text()
+		if !c.Opts.FilesFromNul {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p == "" {
+			continue
+		}
+
+		realpath, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+
+		if !underDir(realpath, filepath.Clean(root)) {
+			err = c.recordError(rootId, realpath, "list", fmt.Errorf("%s isn't under %s", realpath, root))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Lstat(realpath)
+		if err != nil {
+			err = c.recordError(rootId, realpath, "stat", err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = c.walkLink(rootId, realpath, info)
+			if err != nil {
+				err = c.recordError(rootId, realpath, "readlink", err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if info == nil {
+				continue
+			}
+		}
+
+		if info.IsDir() {
+			c.Out.Verbosity("excluded", Fields{"path": realpath}, "Skipping %s (a directory)\n", realpath)
+			continue
+		}
+
+		if c.excluded(realpath, false) || !c.walkable(info, realpath) {
+			c.Out.Verbosity("excluded", Fields{"path": realpath}, "Skipping %s\n", realpath)
+			c.Stats.Excluded++
+			continue
+		}
+		c.Stats.discovered(info.Size())
+
+		walked := WalkerContext{info, filepath.Dir(realpath)}
+		if c.enumerating() {
+			files = append(files, walked)
+			c.showProgress(false)
+			continue
+		}
+
+		err = c.walkFile(rootId, walked)
+		if err != nil {
+			return err
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return fmt.Errorf("reading %s: %s", c.Opts.FilesFrom, err)
+	}
+
+	if !c.enumerating() {
+		return nil
+	}
+
+	return c.walkEnumerated(files, func(f WalkerContext) error {
+		return c.walkFile(rootId, f)
+	})
+}
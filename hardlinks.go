@@ -0,0 +1,42 @@
+package leibniz
+
+import (
+	"os"
+)
+
+type inodeKey struct {
+	dev   uint64
+	inode uint64
+}
+
+// Only files with more than one link are remembered, since those are the
+// only ones the walk can come across twice
+func (c *Catalog) rememberInode(info os.FileInfo, hashes map[string]string) {
+	dev, inode, nlink, ok := fileId(info)
+	if !ok || nlink < 2 {
+		return
+	}
+
+	if c.inodes == nil {
+		c.inodes = make(map[inodeKey]map[string]string)
+	}
+
+	c.inodes[inodeKey{dev, inode}] = hashes
+}
+
+// The hashes of the file info describes, if it was hashed earlier in this
+// scan through another link
+func (c *Catalog) hashedInode(info os.FileInfo) (map[string]string, bool) {
+	if c.inodes == nil {
+		return nil, false
+	}
+
+	dev, inode, nlink, ok := fileId(info)
+	if !ok || nlink < 2 {
+		return nil, false
+	}
+
+	hashes, ok := c.inodes[inodeKey{dev, inode}]
+
+	return hashes, ok
+}
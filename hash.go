@@ -0,0 +1,322 @@
+package leibniz
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/OneOfOne/xxhash"
+	"hash"
+	"io"
+	"lukechampine.com/blake3"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A hash engine. Hash reads whatever it needs of a file through r, whose size
+// is info.Size(), and returns the raw digest. The catalog stores the digest as
+// hex next to the engine's name, so hashes from different engines are never
+// compared.
+type Hasher interface {
+	Name() string
+	Hash(r io.ReaderAt, info os.FileInfo) ([]byte, error)
+}
+
+var hashers = make(map[string]Hasher)
+
+// Makes h available to -hash, manifests and verify under its name. Engines
+// are registered from init functions; registering a name twice panics.
+func RegisterHasher(h Hasher) {
+	if _, ok := hashers[h.Name()]; ok {
+		panic(fmt.Sprintf("hash engine %q registered twice", h.Name()))
+	}
+
+	hashers[h.Name()] = h
+}
+
+// Finds the engine by name, which can also be the sampled xxhash with other
+// sampling than the default, named as SampleParams.Algo names it
+func LookupHasher(name string) (Hasher, bool) {
+	if h, ok := hashers[name]; ok {
+		return h, true
+	}
+
+	if p, ok := parseSampled(name); ok {
+		return sampleHasher{p}, true
+	}
+
+	return nil, false
+}
+
+// The names of the registered engines, sorted
+func Hashers() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// The sampled xxhash computed by SmartHash. It is fast, but only samples large
+// files, so it isn't collision resistant.
+const DefaultHash = "xxhash"
+
+func ValidHash(algo string) bool {
+	_, ok := LookupHasher(algo)
+	return ok
+}
+
+// The algorithms manifests imported from other tools can use
+var ManifestAlgorithms = []string{"md5", "sha1", "sha256", "sha512", "blake3", "xxhash-full"}
+
+// Engines that read a file front to back can also implement Streamer, so that
+// several of them are computed in a single read of the file
+type Streamer interface {
+	Hasher
+	NewHash() hash.Hash
+}
+
+// Hashes the whole file with a hash.Hash from the standard library's mold
+type streamHasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (s streamHasher) Name() string {
+	return s.name
+}
+
+func (s streamHasher) NewHash() hash.Hash {
+	return s.new()
+}
+
+func (s streamHasher) Hash(r io.ReaderAt, info os.FileInfo) ([]byte, error) {
+	h := s.new()
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// How the sampled xxhash samples a file. Files smaller than Threshold, or
+// than Count samples, are hashed in full; larger ones by Count samples of
+// Size bytes, the first at the start of the file, the last at its end and the
+// rest spread evenly between.
+type SampleParams struct {
+	Threshold int64
+	Size      int64
+	Count     int
+}
+
+// The sampling SmartHash has always done: three 1 KiB samples of files over
+// 512 KiB
+var DefaultSampling = SampleParams{SmartHashThreshold, 1024, 3}
+
+func (p SampleParams) Validate() error {
+	if p.Count < 2 || p.Size < 1 {
+		return fmt.Errorf("sampling takes at least two samples of at least a byte")
+	}
+
+	if p.Threshold < int64(p.Count)*p.Size {
+		return fmt.Errorf("the sampling threshold %d is smaller than the %d bytes sampled", p.Threshold, int64(p.Count)*p.Size)
+	}
+
+	return nil
+}
+
+// The name of the sampled xxhash with this sampling. The default sampling is
+// plain DefaultHash; any other records its parameters in the name, so that
+// digests are only ever compared with ones sampled the same way.
+func (p SampleParams) Algo() string {
+	if p == DefaultSampling {
+		return DefaultHash
+	}
+
+	return fmt.Sprintf("%s:%d:%d:%d", DefaultHash, p.Threshold, p.Size, p.Count)
+}
+
+// Reads back the sampling from a name made by Algo
+func parseSampled(algo string) (SampleParams, bool) {
+	var p SampleParams
+	if !strings.HasPrefix(algo, DefaultHash+":") {
+		return p, false
+	}
+
+	n, err := fmt.Sscanf(algo[len(DefaultHash)+1:], "%d:%d:%d", &p.Threshold, &p.Size, &p.Count)
+	if err != nil || n != 3 || p.Validate() != nil || p.Algo() != algo {
+		return p, false
+	}
+
+	return p, true
+}
+
+// Whether algo is the sampled xxhash, with any sampling
+func IsSampled(algo string) bool {
+	_, ok := parseSampled(algo)
+	return algo == DefaultHash || ok
+}
+
+// SmartHash, which samples files over a threshold
+type sampleHasher struct {
+	params SampleParams
+}
+
+func (s sampleHasher) Name() string {
+	return s.params.Algo()
+}
+
+func (s sampleHasher) Hash(r io.ReaderAt, info os.FileInfo) ([]byte, error) {
+	sum, err := s.params.Hash(r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return binary.BigEndian.AppendUint64(nil, sum), nil
+}
+
+func init() {
+	RegisterHasher(sampleHasher{DefaultSampling})
+	RegisterHasher(streamHasher{"xxhash-full", func() hash.Hash { return xxhash.New64() }})
+	RegisterHasher(streamHasher{"sha256", sha256.New})
+	RegisterHasher(streamHasher{"blake3", func() hash.Hash { return blake3.New(32, nil) }})
+	RegisterHasher(streamHasher{"md5", md5.New})
+	RegisterHasher(streamHasher{"sha1", sha1.New})
+	RegisterHasher(streamHasher{"sha512", sha512.New})
+}
+
+func lookupHasher(algo string) (Hasher, error) {
+	h, ok := LookupHasher(algo)
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, expected one of %s", algo, strings.Join(Hashers(), ", "))
+	}
+
+	return h, nil
+}
+
+// A digest as the catalog stores it: lower case hex, two digits a byte, so
+// every digest by an algorithm is the same width
+func hexDigest(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+// The digits of a digest by the sampled xxhash, a 64 bit number
+const sampledDigits = 16
+
+// The sampled xxhash used to be written as a plain number in hex, without
+// leading zeros. Pads a digest by algo written that way to its full width,
+// and leaves any other as it is.
+func padDigest(algo, digest string) string {
+	if IsSampled(algo) && len(digest) < sampledDigits {
+		return strings.Repeat("0", sampledDigits-len(digest)) + digest
+	}
+
+	return digest
+}
+
+// A digest by algo as it was written before padDigest, without leading zeros
+// for the sampled xxhash
+func legacyDigest(algo, digest string) string {
+	if !IsSampled(algo) {
+		return digest
+	}
+
+	if digest = strings.TrimLeft(digest, "0"); digest == "" {
+		return "0"
+	}
+
+	return digest
+}
+
+// Hashes file with the named engine, returning the digest as hex
+func HashContent(algo string, file io.ReaderAt, info os.FileInfo) (string, error) {
+	h, err := lookupHasher(algo)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size() == 0 {
+		return emptyDigest(h, info)
+	}
+
+	sum, err := h.Hash(file, info)
+	if err != nil {
+		return "", err
+	}
+
+	return hexDigest(sum), nil
+}
+
+// Hashes file with each of the named engines, returning their hex digests by
+// name. The engines that stream share one read of the file; the rest, like
+// the sampled xxhash, read what they need on their own. An empty file isn't
+// read at all.
+func HashAll(algos []string, file io.ReaderAt, info os.FileInfo) (map[string]string, error) {
+	digests := make(map[string]string, len(algos))
+	streams := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, algo := range algos {
+		h, err := lookupHasher(algo)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Size() == 0 {
+			digests[algo], err = emptyDigest(h, info)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if s, ok := h.(Streamer); ok {
+			if _, dup := streams[algo]; !dup {
+				streams[algo] = s.NewHash()
+				writers = append(writers, streams[algo])
+			}
+			continue
+		}
+
+		sum, err := h.Hash(file, info)
+		if err != nil {
+			return nil, err
+		}
+		digests[algo] = hexDigest(sum)
+	}
+
+	if len(writers) > 0 {
+		_, err := io.Copy(io.MultiWriter(writers...), io.NewSectionReader(file, 0, info.Size()))
+		if err != nil {
+			return nil, err
+		}
+
+		for algo, h := range streams {
+			digests[algo] = hexDigest(h.Sum(nil))
+		}
+	}
+
+	return digests, nil
+}
+
+// Hashes the file at path with the named algorithm
+func HashFile(algo, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	return HashContent(algo, f, finfo)
+}
@@ -0,0 +1,74 @@
+package leibniz
+
+import (
+	"os"
+	"time"
+)
+
+// The hash cache keeps the hashes of every file read by its device and inode,
+// so that a file met again under another path or root, through a bind mount
+// or a hard link made since, isn't read again while its size and mtime stay
+// the same. Unlike the files table it outlives the paths it was hashed
+// under, until compact drops the inodes no cataloged file has any more.
+
+// The hashes by each of algos of the file info describes, if they are cached
+func (c *Catalog) cachedHashes(info os.FileInfo, algos []string) (map[string]string, bool) {
+	if !c.Opts.HashCache {
+		return nil, false
+	}
+
+	dev, inode, _, ok := fileId(info)
+	if !ok {
+		return nil, false
+	}
+
+	rows, err := c.queryer().Query(`select algo, hash, size, mtime from hash_cache where dev=? and inode=?`, int64(dev), int64(inode))
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var algo, hash string
+		var size int64
+		var mtime time.Time
+		if rows.Scan(&algo, &hash, &size, &mtime) != nil {
+			return nil, false
+		}
+
+		if size == info.Size() && c.sameMtime(mtime, info.ModTime()) {
+			hashes[algo] = hash
+		}
+	}
+
+	for _, algo := range algos {
+		if _, ok := hashes[algo]; !ok {
+			return nil, false
+		}
+	}
+
+	return hashes, rows.Err() == nil
+}
+
+// Caches the hashes of the file info describes
+func (c *Catalog) cacheHashes(info os.FileInfo, hashes map[string]string) error {
+	if !c.Opts.HashCache {
+		return nil
+	}
+
+	dev, inode, _, ok := fileId(info)
+	if !ok {
+		return nil
+	}
+
+	for algo, hash := range hashes {
+		_, err := c.queryer().Exec(`insert or replace into hash_cache (dev, inode, size, mtime, algo, hash) values (?, ?, ?, ?, ?, ?)`,
+			int64(dev), int64(inode), info.Size(), utc(info.ModTime()), algo, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Before a scan with -keep-history catalogs a file's new content over its row,
+// the row as it was is copied to file_history, along with the scan that found
+// it replaced. Rows whose content is the same are left alone.
+var keepHistoryStmt string = `
+	insert into file_history (root_id, path, algo, hash, mtime, size, first_scan_id, scan_id, replaced_scan_id)
+	select root_id, path, algo, hash, mtime, size, first_scan_id, scan_id, ?
+	from files where root_id=? and path=? and (hash is not ? or algo is not ? or mtime is not ?)
+	`
+
+// Keeps what was cataloged at e.Path before, if it differs from e and
+// -keep-history is set
+func (c *Catalog) keepHistory(rootId int64, e *Entry) error {
+	if !c.Opts.KeepHistory {
+		return nil
+	}
+
+	_, err := c.queryer().Exec(keepHistoryStmt, c.scanId(), rootId, e.Path, e.Hash, e.Algo, utc(e.Mtime))
+
+	return err
+}
+
+// A content a path held: the current one, or one that a scan with
+// -keep-history found replaced
+type Version struct {
+	Record
+	FirstScan int64     // The scan that cataloged this content, or zero from before scans were recorded
+	Since     time.Time // When FirstScan started, zero if it isn't known
+	Replaced  int64     // The scan that found it replaced, or zero for the current content
+}
+
+// The version as the fields of a "version" event
+func (v *Version) Fields() Fields {
+	fields := v.Record.Fields()
+	fields["first_scan"] = v.FirstScan
+	fields["current"] = v.Replaced == 0
+	if !v.Since.IsZero() {
+		fields["since"] = v.Since
+	}
+	if v.Replaced != 0 {
+		fields["replaced"] = v.Replaced
+	}
+
+	return fields
+}
+
+// The contents cataloged at path under any root, the current ones first and
+// then the ones they replaced, latest first
+func (c *Catalog) History(path string) ([]*Version, error) {
+	rows, err := c.Db.Query(`
+		select r.root, v.path, v.algo, v.hash, v.mtime, v.size, v.scan_id, v.first_scan_id, v.replaced, s.started from (
+			select root_id, path, algo, hash, mtime, size, scan_id, first_scan_id, null as replaced, id, 1 as current
+			from files where path = ?
+			union all
+			select root_id, path, algo, hash, mtime, size, scan_id, first_scan_id, replaced_scan_id, id, 0
+			from file_history where path = ?
+		) v
+		join roots r on r.id = v.root_id
+		left join scans s on s.id = v.first_scan_id
+		order by v.current desc, v.id desc
+		`, path, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]*Version, 0)
+	for rows.Next() {
+		var v Version
+		var size, scanId, firstScanId, replaced sql.NullInt64
+		var since sql.NullTime
+		err = rows.Scan(&v.Root, &v.Path, &v.Algo, &v.Hash, &v.Mtime, &size, &scanId, &firstScanId, &replaced, &since)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Size = -1
+		if size.Valid {
+			v.Size = size.Int64
+		}
+		v.ScanId = scanId.Int64
+		v.FirstScan = firstScanId.Int64
+		v.Replaced = replaced.Int64
+		v.Since = since.Time
+		versions = append(versions, &v)
+	}
+
+	return versions, rows.Err()
+}
+
+// Prints the contents cataloged at path, the current one first, and when each
+// was cataloged. Returns an error if path was never cataloged, so that scripts
+// can tell.
+func (c *Catalog) ReportHistory(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	versions, err := c.History(abs)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s is not cataloged", path)
+	}
+
+	c.Out.Print("history", Fields{"path": abs, "versions": len(versions)}, "%s\n", abs)
+	for _, v := range versions {
+		since := "before scans were recorded"
+		if v.FirstScan != 0 {
+			since = fmt.Sprintf("since scan %d", v.FirstScan)
+			if !v.Since.IsZero() {
+				since += ", " + c.Out.Time(v.Since)
+			}
+		}
+
+		state := "current"
+		if v.Replaced != 0 {
+			state = fmt.Sprintf("replaced by scan %d", v.Replaced)
+		}
+
+		c.Out.Print("version", v.Fields(), "  %s (%s), %s, modified %s, %s, %s\n",
+			v.Hash, v.Algo, c.Out.Size(v.Size), c.Out.Time(v.Mtime), since, state)
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package leibniz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The name of the per-directory ignore files the walker reads
+const IgnoreFileName = ".leibnizignore"
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	pattern string // As it was written
+	line    int
+}
+
+// A set of gitignore-style patterns. Patterns are relative to Base, the
+// directory holding the ignore file, and later patterns override earlier
+// ones.
+type IgnoreFile struct {
+	Base   string
+	rules  []ignoreRule
+	source string // The file it was read from, if any
+}
+
+func ParseIgnore(base string, r io.Reader) (*IgnoreFile, error) {
+	f := &IgnoreFile{Base: base}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule := ignoreRule{pattern: line, line: lineNo}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		re, err := ignorePatternRegexp(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %s", line, err)
+		}
+		rule.re = re
+
+		f.rules = append(f.rules, rule)
+	}
+
+	return f, scanner.Err()
+}
+
+// Reads an ignore file, returning nil if there isn't one at file
+func ReadIgnoreFile(base, file string) (*IgnoreFile, error) {
+	r, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := ParseIgnore(base, r)
+	if f != nil {
+		f.source = file
+	}
+
+	return f, err
+}
+
+// Patterns containing a slash other than a trailing one are anchored to the
+// base directory. The rest match a name at any depth.
+func ignorePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+
+	if strings.Contains(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "/")
+		re.WriteString("^")
+	} else {
+		re.WriteString("^(?:.*/)?")
+	}
+	writeGlob(&re, pattern)
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+// Translates an -exclude-glob pattern, matched against whole paths. Patterns
+// starting with / are anchored to the filesystem root, and the rest match at
+// any depth, so *.tmp and **/node_modules/** both work. A pattern that matches
+// a directory's path with a trailing slash prunes the whole directory.
+func GlobRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+
+	if strings.HasPrefix(pattern, "/") || strings.HasPrefix(pattern, "**") {
+		re.WriteString("^")
+	} else {
+		re.WriteString("^(?:.*/)?")
+	}
+	writeGlob(&re, pattern)
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+// Writes the regexp for a glob, where ** matches across slashes and * and ?
+// don't
+func writeGlob(re *strings.Builder, pattern string) {
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "**":
+			re.WriteString(".*")
+			i++
+		case ch == '*':
+			re.WriteString("[^/]*")
+		case ch == '?':
+			re.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+}
+
+// Reports whether any pattern matched p, and if so whether the last one to
+// match ignores it
+func (f *IgnoreFile) Match(p string, isDir bool) (matched bool, ignored bool) {
+	rule := f.lastMatch(p, isDir)
+
+	return rule != nil, rule != nil && !rule.negate
+}
+
+// The last pattern to match p, which decides it, or nil if none does
+func (f *IgnoreFile) lastMatch(p string, isDir bool) *ignoreRule {
+	if !strings.HasPrefix(p, dirPrefix(f.Base)) {
+		return nil
+	}
+	rel := filepath.ToSlash(p[len(dirPrefix(f.Base)):])
+
+	var last *ignoreRule
+	for i, rule := range f.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.re.MatchString(rel) {
+			last = &f.rules[i]
+		}
+	}
+
+	return last
+}
+
+// The ignore files that apply in a directory, outermost first, so that the
+// ones nearer a path take precedence
+type ignoreChain []*IgnoreFile
+
+func (chain ignoreChain) Ignored(p string, isDir bool) bool {
+	_, rule := chain.deciding(p, isDir)
+
+	return rule != nil && !rule.negate
+}
+
+// The pattern that decides whether p is ignored and the file it is in, or
+// nil if no pattern matches p
+func (chain ignoreChain) deciding(p string, isDir bool) (*IgnoreFile, *ignoreRule) {
+	var file *IgnoreFile
+	var rule *ignoreRule
+	for _, f := range chain {
+		if r := f.lastMatch(p, isDir); r != nil {
+			file, rule = f, r
+		}
+	}
+
+	return file, rule
+}
+
+// Extends chain with dir's own ignore file, if it has one
+func (c *Catalog) descendIgnores(chain ignoreChain, dir string) (ignoreChain, error) {
+	if !c.Opts.IgnoreFiles {
+		return chain, nil
+	}
+
+	f, err := ReadIgnoreFile(dir, filepath.Join(dir, IgnoreFileName))
+	if err != nil || f == nil {
+		return chain, err
+	}
+
+	extended := make(ignoreChain, len(chain), len(chain)+1)
+	copy(extended, chain)
+
+	return append(extended, f), nil
+}
+
+// The ignore files that apply in dir, which must be under the root: the
+// global one, then those of every directory from the root down to dir
+func (c *Catalog) ignoresFor(dir string) (ignoreChain, error) {
+	chain := make(ignoreChain, 0)
+	root := c.Opts.Root
+
+	if c.Opts.GlobalIgnore != "" {
+		f, err := ReadIgnoreFile(root, c.Opts.GlobalIgnore)
+		if err != nil {
+			return nil, err
+		}
+
+		if f != nil {
+			chain = append(chain, f)
+		}
+	}
+
+	if !underDir(dir, root) {
+		return chain, nil
+	}
+
+	var err error
+	chain, err = c.descendIgnores(chain, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == root {
+		return chain, nil
+	}
+
+	rel := strings.TrimPrefix(dir, dirPrefix(root))
+	cur := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+
+		cur = filepath.Join(cur, part)
+		chain, err = c.descendIgnores(chain, cur)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,215 @@
+package leibniz
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreFile(t *testing.T) {
+	tests := []struct {
+		patterns string
+		path     string
+		isDir    bool
+		matched  bool
+		ignored  bool
+	}{
+		{"*.tmp", "a.tmp", false, true, true},
+		{"*.tmp", "deep/down/a.tmp", false, true, true},
+		{"*.tmp", "a.tmpx", false, false, false},
+		{"*.tmp\n!keep.tmp", "keep.tmp", false, true, false},
+		{"!keep.tmp\n*.tmp", "keep.tmp", false, true, true},
+		{"build/", "build", true, true, true},
+		{"build/", "build", false, false, false},
+		{"build/", "src/build", true, true, true},
+		{"/build", "build", false, true, true},
+		{"/build", "src/build", false, false, false},
+		{"src/*.go", "src/a.go", false, true, true},
+		{"src/*.go", "src/sub/a.go", false, false, false},
+		{"src/*.go", "other/src/a.go", false, false, false},
+		{"src/**/*.go", "src/a/b/c.go", false, true, true},
+		{"a?c", "abc", false, true, true},
+		{"a?c", "a/c", false, false, false},
+		{"[ab].txt", "b.txt", false, true, true},
+		{"[!ab].txt", "b.txt", false, false, false},
+		{"[!ab].txt", "c.txt", false, true, true},
+		{"# comment", "# comment", false, false, false},
+		{`\#hash`, "#hash", false, true, true},
+		{`\!bang`, "!bang", false, true, true},
+		{"trailing   ", "trailing", false, true, true},
+		{"\r\n*.tmp\r\n", "a.tmp", false, true, true},
+
+		// Regexp syntax in patterns is taken literally
+		{"a.b", "axb", false, false, false},
+		{"a.b", "a.b", false, true, true},
+		{"(x)+", "(x)+", false, true, true},
+		{"(x)+", "xx", false, false, false},
+		{"^$|x", "^$|x", false, true, true},
+		{"a{2}", "a{2}", false, true, true},
+		{"[", "[", false, true, true},
+		{"[z", "[z", false, true, true},
+		{`[\]`, `\`, false, true, true},
+		{`\*`, "*", false, true, true},
+		{`\*`, "a", false, false, false},
+		{`a\`, `a\`, false, true, true},
+		{"*", "a\nb", false, true, true},
+	}
+
+	base := filepath.FromSlash("/base")
+	for _, test := range tests {
+		f, err := ParseIgnore(base, strings.NewReader(test.patterns))
+		if err != nil {
+			t.Errorf("%q: %s", test.patterns, err)
+			continue
+		}
+
+		p := filepath.Join(base, filepath.FromSlash(test.path))
+		matched, ignored := f.Match(p, test.isDir)
+		if matched != test.matched || ignored != test.ignored {
+			t.Errorf("%q matching %q (dir %v) = %v, %v, want %v, %v", test.patterns, test.path, test.isDir, matched, ignored, test.matched, test.ignored)
+		}
+	}
+}
+
+func TestIgnoreFileOutsideBase(t *testing.T) {
+	f, err := ParseIgnore(filepath.FromSlash("/base"), strings.NewReader("*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/other/a", "/basement/a", "/"} {
+		if matched, _ := f.Match(filepath.FromSlash(p), false); matched {
+			t.Errorf("%s matched an ignore file in /base", p)
+		}
+	}
+}
+
+func TestIgnoreChain(t *testing.T) {
+	outer, err := ParseIgnore(filepath.FromSlash("/base"), strings.NewReader("*.log\n!keep/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ParseIgnore(filepath.FromSlash("/base/sub"), strings.NewReader("!important.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := ignoreChain{outer, inner}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/base/a.log", false, true},
+		{"/base/sub/a.log", false, true},
+		{"/base/sub/important.log", false, false},
+		{"/base/important.log", false, true},
+		{"/base/keep", true, false},
+		{"/base/a.txt", false, false},
+	}
+
+	for _, test := range tests {
+		if ignored := chain.Ignored(filepath.FromSlash(test.path), test.isDir); ignored != test.ignored {
+			t.Errorf("%s ignored = %v, want %v", test.path, ignored, test.ignored)
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"*.tmp", "/a/b.tmp", true},
+		{"*.tmp", "/b.tmp", true},
+		{"*.tmp", "/a/b.tmpx", false},
+		{"*.tmp", "/a.tmp/b", false},
+		{"/cache/", "/cache/", true},
+		{"/cache/", "/home/cache/", false},
+		{"cache/", "/home/cache/", true},
+		{"/home/*/cache", "/home/me/cache", true},
+		{"/home/*/cache", "/home/me/x/cache", false},
+		{"/home/**/cache", "/home/cache", true},
+		{"/home/**/cache", "/home/me/x/cache", true},
+		{"**/node_modules/**", "/src/node_modules/", true},
+		{"**/node_modules/**", "/src/node_modules/a/b.js", true},
+		{"**/node_modules/**", "/src/node_modules", false},
+		{"**/node_modules/**", "/src/not_node_modules/a", false},
+		{"/a/**", "/a/b/c", true},
+		{"/a/**", "/ab/c", false},
+		{"file?.txt", "/x/file1.txt", true},
+		{"file?.txt", "/x/file/.txt", false},
+		{"file?.txt", "/x/file10.txt", false},
+		{"[abc].txt", "/b.txt", true},
+		{"[abc].txt", "/d.txt", false},
+		{"[!abc].txt", "/d.txt", true},
+		{"[!abc].txt", "/a.txt", false},
+		{"[a-c].txt", "/b.txt", true},
+
+		// Regexp syntax in globs is taken literally
+		{"a.b", "/axb", false},
+		{"a.b", "/a.b", true},
+		{"(x|y)+", "/x", false},
+		{"(x|y)+", "/(x|y)+", true},
+		{"^a$", "/^a$", true},
+		{"a{1,2}", "/a{1,2}", true},
+		{"a{1,2}", "/aa", false},
+		{"$HOME", "/$HOME", true},
+		{"[", "/[", true},
+		{"a[b", "/a[b", true},
+		{`\*`, "/*", true},
+		{`\*`, "/a", false},
+		{`\[a]`, "/[a]", true},
+		{`\[a]`, "/a", false},
+		{`a\`, `/a\`, true},
+		{`[\]`, `/\`, true},
+		{"*", "/a\nb", true},
+		{"a\nb", "/a\nb", true},
+		{"a\nb", "/a", false},
+	}
+
+	for _, test := range tests {
+		re, err := GlobRegexp(test.glob)
+		if err != nil {
+			t.Errorf("GlobRegexp(%q): %s", test.glob, err)
+			continue
+		}
+		if match := re.MatchString(test.path); match != test.match {
+			t.Errorf("%q matching %q = %v, want %v (regexp %s)", test.glob, test.path, match, test.match, re)
+		}
+	}
+}
+
+func TestGlobFlag(t *testing.T) {
+	excludes := &RegexFlag{}
+	flag := GlobFlag{Regexps: excludes}
+	for _, glob := range []string{"*.tmp", "**/.git/**"} {
+		if err := flag.Set(glob); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"/a/b.tmp", false, true},
+		{"/a/b.txt", false, false},
+		{"/repo/.git", true, true},
+		{"/repo/.git", false, false},
+		{"/repo/.github", true, false},
+	}
+
+	c := &Catalog{Opts: &Options{Excludes: excludes}}
+	for _, test := range tests {
+		if excluded := c.excluded(test.path, test.isDir); excluded != test.excluded {
+			t.Errorf("%s (dir %v) excluded = %v, want %v", test.path, test.isDir, excluded, test.excluded)
+		}
+	}
+
+	if err := flag.Set("[z-a]"); err == nil {
+		t.Errorf("took a glob with a class that can't match")
+	}
+}
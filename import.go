@@ -0,0 +1,249 @@
+package leibniz
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file listed in a manifest written by another tool. Size is -1 unless
+// the manifest records it.
+type ManifestEntry struct {
+	Path string
+	Algo string
+	Hash string
+	Size int64
+}
+
+// md5sum and friends only write the digest, so its length is all there is to
+// go on. 64 hex digits could also be blake3, which takes an explicit algo.
+var digestAlgos = map[int]string{16: "xxhash-full", 32: "md5", 40: "sha1", 64: "sha256", 128: "sha512"}
+
+// The names --tag manifests give algorithms that leibniz calls otherwise
+var tagAlgos = map[string]string{"xxh64": "xxhash-full"}
+
+// The strongest algorithm wins when a hashdeep manifest has several
+var hashdeepPreference = []string{"sha512", "sha256", "blake3", "sha1", "md5"}
+
+// Reads a manifest in the format of md5sum, sha1sum, sha256sum or sha512sum
+// (plain or --tag), b3sum, or hashdeep, calling fn for each file it lists.
+// algo names the algorithm the digests were made with; when it is empty it is
+// worked out from the manifest.
+func ReadManifest(r io.Reader, algo string, fn func(*ManifestEntry) error) error {
+	if algo != "" && !ValidHash(algo) {
+		return fmt.Errorf("unknown manifest algorithm %q, expected one of %s", algo, strings.Join(Hashers(), ", "))
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var hashdeep []string
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if lineNo == 1 && strings.HasPrefix(line, "%%%% HASHDEEP") {
+			hashdeep = []string{}
+			continue
+		}
+
+		var e *ManifestEntry
+		var err error
+		switch {
+		case hashdeep != nil && strings.HasPrefix(line, "%%%%"):
+			hashdeep = strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "%%%%")), ",")
+			continue
+		case hashdeep != nil && strings.HasPrefix(line, "#"):
+			continue
+		case hashdeep != nil:
+			e, err = parseHashdeepLine(line, hashdeep, algo)
+		default:
+			e, err = parseSumLine(line, algo)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNo, err)
+		}
+
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func checkDigest(algo, digest string) (string, error) {
+	digest = padDigest(algo, strings.ToLower(digest))
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", fmt.Errorf("%q isn't a hex digest", digest)
+	}
+
+	if algo == "" {
+		algo = digestAlgos[len(digest)]
+		if algo == "" {
+			return "", fmt.Errorf("can't tell which algorithm made a %d digit digest", len(digest))
+		}
+	}
+
+	return digest, nil
+}
+
+// Parses `digest  path`, `digest *path` or `ALGO (path) = digest`. GNU tools
+// escape paths containing newlines or backslashes and mark the line with a
+// leading backslash, in either format. An algorithm name has no spaces, which
+// tells a tagged line from a path with " (" in it.
+func parseSumLine(line, algo string) (*ManifestEntry, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	unescape := func(path string) string {
+		if !escaped {
+			return path
+		}
+		return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(path)
+	}
+
+	if open := strings.Index(line, " ("); open > 0 && !strings.Contains(line[:open], " ") && strings.Contains(line, ") = ") {
+		close := strings.LastIndex(line, ") = ")
+		tagAlgo := strings.ToLower(strings.ReplaceAll(line[:open], "-", ""))
+		if name, ok := tagAlgos[tagAlgo]; ok {
+			tagAlgo = name
+		}
+		if algo == "" {
+			algo = tagAlgo
+		}
+		if !oneOf(algo, ManifestAlgorithms) {
+			return nil, fmt.Errorf("unknown algorithm %q", line[:open])
+		}
+
+		digest, err := checkDigest(algo, line[close+4:])
+		if err != nil {
+			return nil, err
+		}
+
+		return &ManifestEntry{Path: unescape(line[open+2 : close]), Algo: algo, Hash: digest, Size: -1}, nil
+	}
+
+	sep := strings.Index(line, " ")
+	if sep < 0 || sep+2 >= len(line) {
+		return nil, fmt.Errorf("expected a digest and a path")
+	}
+
+	digest, err := checkDigest(algo, line[:sep])
+	if err != nil {
+		return nil, err
+	}
+	if algo == "" {
+		algo = digestAlgos[len(digest)]
+	}
+
+	// The second separator character is a space for text mode or * for binary
+	return &ManifestEntry{Path: unescape(line[sep+2:]), Algo: algo, Hash: digest, Size: -1}, nil
+}
+
+// Parses a hashdeep row, whose columns are named by the %%%% header, like
+// size,md5,sha256,filename. The filename comes last and may contain commas.
+func parseHashdeepLine(line string, columns []string, algo string) (*ManifestEntry, error) {
+	if len(columns) == 0 || columns[len(columns)-1] != "filename" {
+		return nil, fmt.Errorf("hashdeep manifest has no column header")
+	}
+
+	fields := strings.SplitN(line, ",", len(columns))
+	if len(fields) != len(columns) {
+		return nil, fmt.Errorf("expected %d columns, found %d", len(columns), len(fields))
+	}
+
+	size := int64(-1)
+	for i, col := range columns {
+		if col == "size" {
+			n, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q isn't a size", fields[i])
+			}
+			size = n
+		}
+	}
+
+	want := []string{algo}
+	if algo == "" {
+		want = hashdeepPreference
+	}
+
+	for _, a := range want {
+		for i, col := range columns {
+			if col != a {
+				continue
+			}
+
+			digest, err := checkDigest(a, fields[i])
+			if err != nil {
+				return nil, err
+			}
+
+			return &ManifestEntry{Path: fields[len(fields)-1], Algo: a, Hash: digest, Size: size}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s column", strings.Join(want, " or "))
+}
+
+// Catalogs the files listed in a manifest under root, as one scan of it.
+// Relative paths are taken relative to root. Manifests don't record mtimes, so
+// imported files have none; verify compares them with the disk by content
+// alone. Returns how many files were imported.
+func (c *Catalog) Import(root string, manifest io.Reader, algo string) (n int64, err error) {
+	rootId, err := c.EnsureRootId(root)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.startScan(rootId)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		commitErr := c.commit()
+		if err == nil {
+			err = commitErr
+		}
+		if err == nil {
+			err = c.finishScan()
+		}
+	}()
+
+	err = ReadManifest(manifest, algo, func(e *ManifestEntry) error {
+		p := filepath.FromSlash(e.Path)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+
+		_, err := c.CatalogHash(rootId, &Entry{Path: filepath.Clean(p), Algo: e.Algo, Hash: e.Hash, Mtime: time.Time{}, Size: e.Size, OnDisk: -1})
+		if err != nil {
+			return err
+		}
+
+		n++
+		c.Out.Verbosity("imported", Fields{"path": p, "algo": e.Algo, "hash": e.Hash}, "%s %s\n", e.Hash, p)
+
+		return nil
+	})
+
+	return n, err
+}
@@ -0,0 +1,88 @@
+package leibniz
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	emptyMd5    = "d41d8cd98f00b204e9800998ecf8427e"
+	emptySha1   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		algo     string
+		manifest string
+		entries  []ManifestEntry
+	}{
+		{"md5sum", "", emptyMd5 + "  a.txt\n", []ManifestEntry{{"a.txt", "md5", emptyMd5, -1}}},
+		{"binary", "", emptySha1 + " *dir/b.bin\r\n", []ManifestEntry{{"dir/b.bin", "sha1", emptySha1, -1}}},
+		{"upper case", "", strings.ToUpper(emptyMd5) + "  a\n", []ManifestEntry{{"a", "md5", emptyMd5, -1}}},
+		{"blank lines", "", "\n  \n" + emptyMd5 + "  a\n\n", []ManifestEntry{{"a", "md5", emptyMd5, -1}}},
+		{"explicit algo", "blake3", emptySha256 + "  a\n", []ManifestEntry{{"a", "blake3", emptySha256, -1}}},
+		{"spaces in name", "", emptyMd5 + "   leading and trailing  \n", []ManifestEntry{{" leading and trailing  ", "md5", emptyMd5, -1}}},
+		{"parenthesis in name", "", emptyMd5 + "  a (1) = b\n", []ManifestEntry{{"a (1) = b", "md5", emptyMd5, -1}}},
+		{"escaped", "", `\` + emptyMd5 + `  a\nb\\c\rd` + "\n", []ManifestEntry{{"a\nb\\c\rd", "md5", emptyMd5, -1}}},
+		{"backslash without escaping", "", emptyMd5 + `  a\nb` + "\n", []ManifestEntry{{`a\nb`, "md5", emptyMd5, -1}}},
+		{"tag", "", "SHA256 (a b.txt) = " + emptySha256 + "\n", []ManifestEntry{{"a b.txt", "sha256", emptySha256, -1}}},
+		{"tag with dash", "", "SHA-1 (a) = " + emptySha1 + "\n", []ManifestEntry{{"a", "sha1", emptySha1, -1}}},
+		{"tag xxh64", "", "XXH64 (a) = 00000000000000ff\n", []ManifestEntry{{"a", "xxhash-full", "00000000000000ff", -1}}},
+		{"tag with ) = in name", "", "MD5 (a) = b) = " + emptyMd5 + "\n", []ManifestEntry{{"a) = b", "md5", emptyMd5, -1}}},
+		{"escaped tag", "", `\MD5 (a\nb) = ` + emptyMd5 + "\n", []ManifestEntry{{"a\nb", "md5", emptyMd5, -1}}},
+		{"hashdeep", "",
+			"%%%% HASHDEEP-1.0\n%%%% size,md5,sha256,filename\n## comment\n0," + emptyMd5 + "," + emptySha256 + ",/a,b,c\n",
+			[]ManifestEntry{{"/a,b,c", "sha256", emptySha256, 0}}},
+		{"hashdeep algo", "md5",
+			"%%%% HASHDEEP-1.0\n%%%% size,md5,sha256,filename\n12," + emptyMd5 + "," + emptySha256 + ",a\n",
+			[]ManifestEntry{{"a", "md5", emptyMd5, 12}}},
+	}
+
+	for _, test := range tests {
+		var entries []ManifestEntry
+		err := ReadManifest(strings.NewReader(test.manifest), test.algo, func(e *ManifestEntry) error {
+			entries = append(entries, *e)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("%s: read %#v, want %#v", test.name, entries, test.entries)
+		}
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		algo     string
+		manifest string
+		err      string
+	}{
+		{"unknown algo", "crc32", emptyMd5 + "  a\n", "unknown manifest algorithm"},
+		{"no path", "", emptyMd5 + "\n", "line 1: expected a digest and a path"},
+		{"empty path", "", emptyMd5 + "  \n", "line 1: expected a digest and a path"},
+		{"not hex", "", "not-a-digest  a\n", "isn't a hex digest"},
+		{"odd length", "", "abc  a\n", "isn't a hex digest"},
+		{"unknown length", "", "abcd  a\n", "can't tell which algorithm made a 4 digit digest"},
+		{"unknown tag", "", "CRC32 (a) = " + emptyMd5 + "\n", `unknown algorithm "CRC32"`},
+		{"bad tag digest", "", "MD5 (a) = $(rm -rf /)\n", "isn't a hex digest"},
+		{"second line", "", emptyMd5 + "  a\nbogus\n", "line 2:"},
+		{"hashdeep without header", "", "%%%% HASHDEEP-1.0\n0," + emptyMd5 + ",a\n", "no column header"},
+		{"hashdeep short row", "", "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n0\n", "expected 3 columns, found 1"},
+		{"hashdeep size", "", "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\nlots," + emptyMd5 + ",a\n", `"lots" isn't a size`},
+		{"hashdeep missing algo", "sha1", "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n0," + emptyMd5 + ",a\n", "no sha1 column"},
+	}
+
+	for _, test := range tests {
+		err := ReadManifest(strings.NewReader(test.manifest), test.algo, func(e *ManifestEntry) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package leibniz
+
+import (
+	"os"
+	"syscall"
+)
+
+// The device and inode numbers of a file, and how many hard links it has
+func fileId(info os.FileInfo) (dev, inode, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+
+	return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink), true
+}
+
+// How many bytes the file takes up on disk, which is less than its size when
+// it has holes or is compressed
+func fileAllocated(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return int64(st.Blocks) * 512, true
+}
+
+// The owner of a file
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package leibniz
+
+import (
+	"os"
+)
+
+// FileInfo doesn't carry file ids on Windows, so hard links aren't detected
+func fileId(info os.FileInfo) (dev, inode, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
+
+func fileAllocated(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,62 @@
+package leibniz
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// What a scan returns when it was stopped by closing Catalog.Stop
+var ErrInterrupted = errors.New("interrupted")
+
+// What the walk returns when it stops at -max-files, -max-bytes or
+// -max-duration. Run counts the scan as stopped rather than failed, with
+// Stats.Limited set.
+var ErrLimitReached = errors.New("limit reached")
+
+// Whether cataloging another file of size would go over -max-files or
+// -max-bytes, or the scan has run for -max-duration
+func (c *Catalog) limitReached(size int64) bool {
+	if c.Opts.MaxFiles > 0 && c.Stats.Done() >= c.Opts.MaxFiles {
+		return true
+	}
+
+	if c.Opts.MaxDuration > 0 && time.Since(c.Stats.Started) >= c.Opts.MaxDuration {
+		return true
+	}
+
+	return c.Opts.MaxBytes > 0 && c.Stats.DoneBytes+size > int64(c.Opts.MaxBytes)
+}
+
+// Whether Stop has been closed
+func (c *Catalog) stopped() bool {
+	select {
+	case <-c.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// A file being hashed, which stops giving bytes once the scan is stopped, so
+// an interrupt doesn't wait for a big file to be read to the end
+type interruptibleReader struct {
+	r io.ReaderAt
+	c *Catalog
+}
+
+func (r interruptibleReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.c.stopped() {
+		return 0, ErrInterrupted
+	}
+
+	return r.r.ReadAt(p, off)
+}
+
+// Moves what the write-ahead log holds into the catalog file and empties the
+// log, so an interrupted scan doesn't leave its work only in the WAL. Catalogs
+// in other journal modes have nothing to do.
+func (c *Catalog) checkpoint() error {
+	_, err := c.Db.Exec(`pragma wal_checkpoint(truncate)`)
+	return err
+}
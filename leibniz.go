@@ -1,277 +1,1641 @@
-package main
+// Package leibniz catalogs the files under a set of roots into a SQLite
+// database, keyed by a fast content hash, so duplicates and changes can be
+// found later without crawling the filesystem again. The leibniz command in
+// cmd/leibniz is a thin wrapper around it.
+package leibniz
 
 import (
 	"bytes"
 	"database/sql"
 	"encoding/binary"
-	"flag"
 	"fmt"
 	"github.com/OneOfOne/xxhash"
-	_ "github.com/mattn/go-sqlite3"
 	"io"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var createDbStmt string = `
-	create table roots (id integer not null primary key, root text);
-	create table files (id integer not null primary key, root_id integer, hash text, path string, mtime datetime);
+type RegexFlag []*regexp.Regexp
+
+func (e *RegexFlag) String() string {
+	var parts []string
+	if e == nil {
+		return ""
+	}
+
+	for _, re := range *e {
+		parts = append(parts, re.String())
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (e *RegexFlag) Set(value string) error {
+	excludeRe, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+
+	*e = append(*e, excludeRe)
+
+	return nil
+}
+
+func (e *RegexFlag) Match(s string) bool {
+	return e.matching(s) != nil
+}
+
+// The first of the regexps to match s, or nil if none does
+func (e *RegexFlag) matching(s string) *regexp.Regexp {
+	for _, re := range *e {
+		if re.MatchString(s) {
+			return re
+		}
+	}
+
+	return nil
+}
+
+// A flag adding globs to a RegexFlag, as the regexps GlobRegexp translates
+// them to
+type GlobFlag struct {
+	Regexps *RegexFlag
+}
+
+func (g GlobFlag) String() string {
+	if g.Regexps == nil {
+		return ""
+	}
+
+	return g.Regexps.String()
+}
+
+func (g GlobFlag) Set(value string) error {
+	re, err := GlobRegexp(value)
+	if err != nil {
+		return err
+	}
+
+	*g.Regexps = append(*g.Regexps, re)
+
+	return nil
+}
+
+// A size in bytes that can be given with a unit, like 10K or 4G
+type SizeFlag int64
+
+func (s *SizeFlag) String() string {
+	if s == nil {
+		return "0"
+	}
+
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *SizeFlag) Set(value string) error {
+	n, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*s = SizeFlag(n)
+
+	return nil
+}
+
+// A list of values, given comma separated or by repeating the flag
+type ListFlag []string
+
+func (h *ListFlag) String() string {
+	if h == nil {
+		return ""
+	}
+
+	return strings.Join(*h, ",")
+}
+
+func (h *ListFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && !oneOf(item, *h) {
+			*h = append(*h, item)
+		}
+	}
+
+	return nil
+}
+
+type Options struct {
+	Root           string
+	CatalogPath    string
+	Excludes       *RegexFlag
+	Includes       *RegexFlag
+	Verbose        bool
+	Incremental    bool
+	FastDirs       bool // Take directories whose mtime and number of entries haven't changed since the last scan to hold the same files, without reading them
+	FullEvery      int  // With FastDirs, read everything anyway every this many scans of a root, or zero for never
+	BatchSize      int
+	Prune          bool
+	JSON           bool
+	Bytes          bool // Print sizes as byte counts rather than in KiB, MiB and up
+	ISO            bool // Print times in ISO 8601 alone, without how long ago they were
+	Hash           string
+	DetectMoves    bool
+	JournalMode    string
+	Synchronous    string
+	CacheSize      int           // In MiB
+	BusyTimeout    time.Duration // How long to wait for another process to finish writing to the catalog
+	Reporting      bool          // Only reads, so a catalog already at the current schema is opened read-only
+	Progress       bool
+	IgnoreFiles    bool   // Whether to read .leibnizignore files
+	GlobalIgnore   string // An ignore file that applies to every root
+	Symlinks       string // One of SymlinkModes
+	MinSize        SizeFlag
+	MaxSize        SizeFlag      // Zero for no limit
+	ExtraHashes    ListFlag      // Computed alongside Hash and kept in file_hashes
+	Similarity     bool          // Whether to compute perceptual hashes of images
+	Metadata       bool          // Whether to read EXIF and video metadata
+	Types          ListFlag      // Content type patterns like image/* or !video/*
+	Owner          bool          // Whether to record owners and permission bits
+	Xattrs         bool          // Whether to record extended attributes
+	ReadOnly       bool          // Open the catalog read-only, without upgrading it
+	LogFormat      string        // One of LogFormats to log instead of printing, or empty
+	LogLevel       string        // One of LogLevels
+	LogFile        string        // Where to log, appending, instead of stdout
+	BandwidthLimit SizeFlag      // Bytes a second to read files at, or zero for no limit
+	MinAge         time.Duration // Skip files modified more recently than this
+	MtimeTolerance time.Duration // How far apart mtimes can be and still count as the same
+	Nice           bool          // Whether to scan at low priority, pausing while the load is high
+	Archives       bool          // Whether to catalog the files inside zip and tar archives too
+	S3ETags        bool          // Take MD5 ETags as the md5 digests of objects in s3:// roots
+	Trash          string        // Where removed and replaced files go: a directory, the OS trash if empty, or TrashNone
+	HashCache      bool          // Reuse the hashes of files met before with the same device, inode, size and mtime
+	MaxDepth       int           // How many directories deep under the root to go, or zero for no limit
+	MaxFiles       int64         // Stop the scan after this many files, or zero for no limit
+	MaxBytes       SizeFlag      // Stop the scan before files adding up to more than this, or zero for no limit
+	MaxDuration    time.Duration // Stop the scan once it has run this long, or zero for no limit
+	OneFileSystem  bool          // Don't descend into directories on other filesystems than the root's
+	SpecialFS      bool          // Walk /proc, /sys, /dev, /run, FUSE and other pseudo filesystems too
+	MarkVolume     bool          // Write a marker to the top of volumes without a filesystem UUID, so they are known wherever they mount
+	DryRun         bool          // Walk and filter, printing what a scan would catalog, without hashing or writing anything
+	Order          string        // One of WalkOrders
+	DirBatch       int           // Directory entries to read at a time, or zero for whole directories
+	FilesFrom      string        // Catalog the files listed in this file, or stdin for -, instead of walking the root
+	FilesFromNul   bool          // The paths in FilesFrom are separated by NULs rather than newlines
+	Enumerate      bool          // Walk everything before hashing anything, so progress knows how much there is
+	OrderBy        string        // Hash enumerated files in one of HashOrders rather than in walk order, or "" for walk order
+	Sampling       SampleParams  // How the sampled xxhash samples files, applied by ApplySampling
+	Paranoid       bool          // Compare duplicates byte for byte before reporting or acting on them
+	KeepHistory    bool          // Keep the earlier contents of changed files in file_history rather than only the current one
+}
+
+func DefaultOptions() *Options {
+	home := homeDir()
+
+	options := &Options{
+		Root:        home,
+		CatalogPath: filepath.Join(home, ".leibniz-catalog"),
+		Excludes:    &RegexFlag{},
+		Includes:    &RegexFlag{},
+		BatchSize:   1000,
+		Hash:        DefaultHash,
+		DetectMoves: true,
+		JournalMode: "wal",
+		Synchronous: "normal",
+		CacheSize:   64,
+		BusyTimeout: 30 * time.Second,
+		IgnoreFiles: true,
+		Symlinks:    SymlinksSkip,
+		Order:       WalkBFS,
+		DirBatch:    10000,
+		FullEvery:   10,
+		HashCache:   true,
+		Sampling:    DefaultSampling,
+	}
+
+	if home != "" {
+		options.GlobalIgnore = filepath.Join(home, ".config", "leibniz", "ignore")
+	}
+
+	return options
+}
+
+// Names the sampled xxhash in Hash and ExtraHashes after Sampling, so that it
+// is cataloged under a name of its own when it doesn't sample the default way.
+// Call it once the options are all set.
+func (o *Options) ApplySampling() {
+	if o.Hash == DefaultHash {
+		o.Hash = o.Sampling.Algo()
+	}
+
+	for i, algo := range o.ExtraHashes {
+		if algo == DefaultHash {
+			o.ExtraHashes[i] = o.Sampling.Algo()
+		}
+	}
+}
+
+// Checks the options that have to be one of a set of choices
+func (o *Options) Validate() error {
+	if err := o.Sampling.Validate(); err != nil {
+		return err
+	}
+
+	if !ValidHash(o.Hash) {
+		return fmt.Errorf("unknown hash algorithm %q, expected one of %s", o.Hash, strings.Join(Hashers(), ", "))
+	}
+
+	for _, algo := range o.ExtraHashes {
+		if !ValidHash(algo) {
+			return fmt.Errorf("unknown hash algorithm %q, expected one of %s", algo, strings.Join(Hashers(), ", "))
+		}
+	}
+
+	if !oneOf(o.Symlinks, SymlinkModes) {
+		return fmt.Errorf("unknown symlink mode %q", o.Symlinks)
+	}
+
+	if !oneOf(o.Order, WalkOrders) {
+		return fmt.Errorf("unknown walk order %q, expected one of %s", o.Order, strings.Join(WalkOrders, ", "))
+	}
+
+	if o.OrderBy != "" && !oneOf(o.OrderBy, HashOrders) {
+		return fmt.Errorf("unknown order %q, expected one of %s", o.OrderBy, strings.Join(HashOrders, ", "))
+	}
+
+	if o.LogFormat != "" && !oneOf(o.LogFormat, LogFormats) {
+		return fmt.Errorf("unknown log format %q, expected one of %s", o.LogFormat, strings.Join(LogFormats, ", "))
+	}
+
+	if o.LogLevel != "" && !oneOf(strings.ToLower(o.LogLevel), LogLevels) {
+		return fmt.Errorf("unknown log level %q, expected one of %s", o.LogLevel, strings.Join(LogLevels, ", "))
+	}
+
+	if err := validTypes(o.Types); err != nil {
+		return err
+	}
+
+	if o.S3ETags && o.Hash != "md5" {
+		return fmt.Errorf("S3 ETags are MD5 digests, so they need -hash md5")
+	}
+
+	if o.MaxDepth < 0 || o.MaxFiles < 0 || o.DirBatch < 0 || o.FullEvery < 0 || o.MaxDuration < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	if o.MaxSize > 0 && o.MinSize > o.MaxSize {
+		return fmt.Errorf("the minimum size %d is larger than the maximum %d", o.MinSize, o.MaxSize)
+	}
+
+	_, err := catalogDSN(o)
+
+	return err
+}
+
+type Catalog struct {
+	Db    *sql.DB
+	Opts  *Options
+	Out   *Output
+	Stats *ScanStats
+	batch *batch
+	scan  *scan
+
+	// Closing Stop interrupts a scan between files, or while one is being
+	// read. What was cataloged so far is committed, and the scan is left
+	// unfinished. Verify, Dedup and Export stop between files as well. The
+	// Context variants of them close it when their context is done.
+	Stop <-chan struct{}
+
+	// Counts the scans of a daemon or server, for MetricsHandler, if set
+	Metrics *Metrics
+
+	// The types of the mounted filesystems, by mount point, read once
+	mounts map[string]string
+
+	// Directories the walk has entered, when following links
+	walkedDirs []string
+
+	// Hashes of files with several hard links, so they are only read once
+	inodes map[inodeKey]map[string]string
+
+	// For -fast-dirs: whether the scan goes by the directories earlier ones
+	// read, and the directories this one has read
+	fastDirs  bool
+	dirStates map[string]dirState
+
+	// For -bwlimit and -nice
+	throttle    *throttle
+	loadChecked time.Time
+
+	// Options to scan particular roots with instead of the ones the catalog
+	// was opened with, like the config's settings for them. SetRoot switches
+	// between them.
+	RootOpts map[string]*Options
+	openOpts *Options
+}
+
+// Points Opts at root, to scan it next, with its own RootOpts if it has any
+// and the options the catalog was opened with otherwise
+func (c *Catalog) SetRoot(root string) {
+	if c.openOpts == nil {
+		c.openOpts = c.Opts
+	}
+
+	opts, ok := c.RootOpts[root]
+	if !ok {
+		opts = c.openOpts
+	}
+	opts.Root = root
+	c.Opts = opts
+}
+
+// Scans write through a transaction that is committed every Opts.BatchSize
+// inserts, so a crash loses at most the last batch.
+type batch struct {
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	lookup  *sql.Stmt
+	seen    *sql.Stmt
+	pending int
+}
+
+func (c *Catalog) begin() error {
+	var tx *sql.Tx
+	err := retryBusy(func() (err error) {
+		tx, err = c.Db.Begin()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	insert, err := tx.Prepare(insertFileStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	lookup, err := tx.Prepare(lookupFileStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	seen, err := tx.Prepare(seenStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	c.batch = &batch{tx, insert, lookup, seen, 0}
+
+	return nil
+}
+
+func (c *Catalog) commit() error {
+	if c.batch == nil {
+		return nil
+	}
+
+	b := c.batch
+	c.batch = nil
+
+	return b.tx.Commit()
+}
+
+// Commits the current batch once it is full and starts the next one
+func (c *Catalog) flush() error {
+	if c.batch == nil || c.batch.pending < c.Opts.BatchSize {
+		return nil
+	}
+
+	err := c.commit()
+	if err != nil {
+		return err
+	}
+
+	return c.begin()
+}
+
+var journalModes = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+var synchronousModes = []string{"off", "normal", "full", "extra"}
+
+func oneOf(value string, choices []string) bool {
+	for _, choice := range choices {
+		if value == choice {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pragmas are passed in the DSN rather than executed once, because most of
+// them only apply to the connection that runs them and database/sql keeps a
+// pool.
+func catalogDSN(options *Options) (string, error) {
+	journal := strings.ToLower(options.JournalMode)
+	if !oneOf(journal, journalModes) {
+		return "", fmt.Errorf("unknown journal mode %q, expected one of %s", options.JournalMode, strings.Join(journalModes, ", "))
+	}
+
+	synchronous := strings.ToLower(options.Synchronous)
+	if !oneOf(synchronous, synchronousModes) {
+		return "", fmt.Errorf("unknown synchronous mode %q, expected one of %s", options.Synchronous, strings.Join(synchronousModes, ", "))
+	}
+
+	if IsRemoteCatalog(options.CatalogPath) {
+		return remoteDSN(options, journal, synchronous)
+	}
+
+	// Setting the journal mode writes to the catalog, and SQLite only honours
+	// mode=ro in URI filenames
+	params := url.Values{}
+	if options.ReadOnly {
+		sqliteParams(params, "", "", options.CacheSize*1024, options.BusyTimeout)
+		params.Set("mode", "ro")
+		return "file:" + (&url.URL{Path: options.CatalogPath}).EscapedPath() + "?" + params.Encode(), nil
+	}
+
+	sqliteParams(params, journal, synchronous, options.CacheSize*1024, options.BusyTimeout)
+
+	// Writers take the write lock when they begin, rather than on their first
+	// write, where finding another writer got there first is an error that
+	// waiting doesn't fix
+	params.Set("_txlock", "immediate")
+
+	return options.CatalogPath + "?" + params.Encode(), nil
+}
+
+func OpenCatalog(options *Options) (*Catalog, error) {
+	// A dry run only reads the catalog, to tell which files -incremental
+	// would pass over, and makes do with an empty one in memory rather than
+	// creating it
+	if options.DryRun {
+		options.ReadOnly = true
+		if _, err := os.Stat(options.CatalogPath); os.IsNotExist(err) && !IsRemoteCatalog(options.CatalogPath) {
+			return openMemoryCatalog(options)
+		}
+	}
+
+	// Reports open the catalog read-only when they can, so they never hold up
+	// a writer, however long they take
+	if options.Reporting && !options.ReadOnly && !IsRemoteCatalog(options.CatalogPath) {
+		ro := *options
+		ro.ReadOnly = true
+		if c, err := OpenCatalog(&ro); err == nil {
+			return c, nil
+		}
+	}
+
+	dsn, err := catalogDSN(options)
+	if err != nil {
+		return nil, err
+	}
+
+	driverName := sqliteDriver
+	if IsRemoteCatalog(options.CatalogPath) {
+		driverName = remoteDriver
+	} else if options.ReadOnly {
+		// SQLite would only say it is unable to open the database file
+		_, err = os.Stat(options.CatalogPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ReadOnly {
+		err = checkSchema(db, options.CatalogPath)
+	} else {
+		err = retryBusy(func() error { return migrate(db, options.CatalogPath) })
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c, err := newCatalog(db, options)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// An empty catalog that lasts as long as the process. Every connection to
+// :memory: gets a database of its own, so there is only ever one.
+func openMemoryCatalog(options *Options) (*Catalog, error) {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	err = migrate(db, options.CatalogPath)
+	if err == nil {
+		var c *Catalog
+		c, err = newCatalog(db, options)
+		if err == nil {
+			return c, nil
+		}
+	}
+	db.Close()
+
+	return nil, err
+}
+
+func newCatalog(db *sql.DB, options *Options) (*Catalog, error) {
+	// The log stays open as long as the process
+	var out io.Writer = os.Stdout
+	if options.LogFile != "" {
+		var err error
+		out, err = os.OpenFile(options.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Catalog{Db: db, Opts: options, Out: NewOutput(out, options), Stats: NewScanStats()}, nil
+}
+
+// A get-or-insert command that always maintains the roots table
+func (c *Catalog) EnsureRootId(root string) (int64, error) {
+	var existingRoot string
+	var rootId int64
+	err := c.Db.QueryRow(`select id, root from roots where root=?`, root).Scan(&rootId, &existingRoot)
+
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := c.Db.Exec(`insert into roots (root) values (?)`, root)
+		if err != nil {
+			return -1, err
+		}
+
+		return res.LastInsertId()
+	case err != nil:
+		return -1, err
+	default:
+		return rootId, nil
+	}
+}
+
+// The cataloged roots, sorted
+func (c *Catalog) Roots() ([]string, error) {
+	rows, err := c.Db.Query(`select root from roots order by root`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := make([]string, 0)
+	for rows.Next() {
+		var root string
+		err = rows.Scan(&root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+
+	return roots, rows.Err()
+}
+
+// Deletes a root and every file cataloged under it, returning the number of
+// files removed
+func (c *Catalog) RemoveRoot(root string) (int64, error) {
+	var rootId int64
+	err := c.Db.QueryRow(`select id from roots where root=?`, root).Scan(&rootId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s is not a root in this catalog", root)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`delete from files where root_id=?`, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(`delete from links where root_id=?`, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(`delete from file_history where root_id=?`, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(`delete from dirs where root_id=?`, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(`delete from roots where id=?`, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return removed, tx.Commit()
+}
+
+// A file as it is cataloged. Dev and Inode are zero where the platform
+// doesn't provide them, and Size is -1 where it isn't known. Hashes holds
+// digests by algorithms other than Algo, which go in file_hashes, Phash the
+// perceptual hash of an image, and Media its metadata, when they were read.
+// Mime is the sniffed content type, or empty if it isn't known. Owner and
+// Xattrs are set when -owner and -xattrs ask for them. OnDisk is how much
+// of the disk the file takes up, less than Size for sparse files, or -1 where
+// it isn't known.
+type Entry struct {
+	Path   string
+	Algo   string
+	Hash   string
+	Mtime  time.Time
+	Dev    uint64
+	Inode  uint64
+	Size   int64
+	Hashes map[string]string
+	Phash  sql.NullString
+	Media  *Media
+	Mime   string
+	Owner  *Owner
+	Xattrs map[string][]byte
+	OnDisk int64
+}
+
+// A path already cataloged under the root has its row updated in place,
+// keeping its id, and the scan that first cataloged its content unless the
+// content changed. A file that was only touched keeps its first scan.
+var insertFileStmt string = `
+	insert into files (root_id, hash, path, mtime, algo, scan_id, first_scan_id, dev, inode, size, phash, mime, uid, gid, mode, allocated)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	on conflict (root_id, path) do update set
+		hash=excluded.hash, mtime=excluded.mtime, algo=excluded.algo, scan_id=excluded.scan_id,
+		first_scan_id=case when hash=excluded.hash and algo=excluded.algo then first_scan_id else excluded.first_scan_id end,
+		dev=excluded.dev, inode=excluded.inode, size=excluded.size, phash=excluded.phash, mime=excluded.mime,
+		uid=excluded.uid, gid=excluded.gid, mode=excluded.mode, allocated=excluded.allocated
+	returning id
 	`
 
-var createIdxStmt string = `
-	create unique index if not exists unique_root_idx on roots (root);
-	create index if not exists root_idx on files (root_id);
-	create index if not exists hash_idx on files (hash);
+// SQLite integers are signed, and inode numbers can use the top bit
+func (e *Entry) fileIdArgs() (interface{}, interface{}) {
+	if e.Dev == 0 && e.Inode == 0 {
+		return nil, nil
+	}
+
+	return int64(e.Dev), int64(e.Inode)
+}
+
+func (e *Entry) mimeArg() interface{} {
+	if e.Mime == "" {
+		return nil
+	}
+
+	return e.Mime
+}
+
+func (e *Entry) sizeArg() interface{} {
+	if e.Size < 0 {
+		return nil
+	}
+
+	return e.Size
+}
+
+func (e *Entry) onDiskArg() interface{} {
+	if e.OnDisk < 0 {
+		return nil
+	}
+
+	return e.OnDisk
+}
+
+func (c *Catalog) CatalogHash(rootId int64, e *Entry) (int64, error) {
+	dev, inode := e.fileIdArgs()
+	uid, gid, mode := e.ownerArgs()
+	err := c.keepHistory(rootId, e)
+	if err != nil {
+		return -1, err
+	}
+
+	var id int64
+	if c.batch == nil {
+		err = c.Db.QueryRow(insertFileStmt, rootId, e.Hash, e.Path, utc(e.Mtime), e.Algo, c.scanId(), c.scanId(), dev, inode, e.sizeArg(), e.Phash, e.mimeArg(), uid, gid, mode, e.onDiskArg()).Scan(&id)
+		if err != nil {
+			return -1, err
+		}
+
+		return id, c.catalogDetails(id, e)
+	}
+
+	err = c.batch.insert.QueryRow(rootId, e.Hash, e.Path, utc(e.Mtime), e.Algo, c.scanId(), c.scanId(), dev, inode, e.sizeArg(), e.Phash, e.mimeArg(), uid, gid, mode, e.onDiskArg()).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+	c.batch.pending++
+	c.sawFile()
+
+	err = c.catalogDetails(id, e)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, c.flush()
+}
+
+// Stores what was found out about e besides its main hash
+func (c *Catalog) catalogDetails(fileId int64, e *Entry) error {
+	if e.Media != nil {
+		err := c.catalogMedia(fileId, e.Media)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.Xattrs != nil {
+		err := c.catalogXattrs(fileId, e.Xattrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	for algo, hash := range e.Hashes {
+		if algo == e.Algo {
+			continue
+		}
+
+		_, err := c.queryer().Exec(`insert or replace into file_hashes (file_id, algo, hash) values (?, ?, ?)`, fileId, algo, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The digests of the file with id by every algorithm the catalog has, its
+// main one included
+func (c *Catalog) FileHashes(fileId int64) (map[string]string, error) {
+	rows, err := c.Db.Query(`
+		select algo, hash from files where id = ?
+		union all
+		select algo, hash from file_hashes where file_id = ?
+		`, fileId, fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var algo, hash string
+		err = rows.Scan(&algo, &hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes[algo] = hash
+	}
+
+	return hashes, rows.Err()
+}
+
+var lookupFileStmt string = `
+	select f.id, f.mtime, f.algo, f.size, f.phash, m.file_id is not null from files f
+	left join metadata m on m.file_id = f.id
+	where f.root_id=? and f.path=?
 	`
 
-type RegexFlag []*regexp.Regexp
+// Reports whether path is cataloged under rootId with the given size and with
+// an mtime within Opts.MtimeTolerance of the given one, hashed by the algorithm
+// in use and with every extra hash, perceptual hash and metadata asked for.
+// Rows from catalogs that predate the size column only have their mtime
+// compared.
+func (c *Catalog) Unchanged(rootId int64, path string, mtime time.Time, size int64) (bool, error) {
+	var id int64
+	var cataloged time.Time
+	var algo string
+	var catalogedSize sql.NullInt64
+	var phash sql.NullString
+	var hasMedia bool
+	var err error
+	if c.batch != nil {
+		err = c.batch.lookup.QueryRow(rootId, path).Scan(&id, &cataloged, &algo, &catalogedSize, &phash, &hasMedia)
+	} else {
+		err = c.Db.QueryRow(lookupFileStmt, rootId, path).Scan(&id, &cataloged, &algo, &catalogedSize, &phash, &hasMedia)
+	}
+
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	case catalogedSize.Valid && catalogedSize.Int64 != size:
+		return false, nil
+	case !c.sameMtime(cataloged, mtime) || algo != c.Opts.Hash:
+		return false, nil
+	case c.Opts.Similarity && !phash.Valid && isImage(path):
+		return false, nil
+	case c.Opts.Metadata && !hasMedia && isMedia(path):
+		return false, nil
+	}
+
+	for _, extra := range c.extraHashes() {
+		var has int
+		err = c.queryer().QueryRow(`select count(*) from file_hashes where file_id=? and algo=?`, id, extra).Scan(&has)
+		if err != nil || has == 0 {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// The algorithms to hash with besides Opts.Hash
+func (c *Catalog) extraHashes() []string {
+	extras := make([]string, 0, len(c.Opts.ExtraHashes))
+	for _, algo := range c.Opts.ExtraHashes {
+		if algo != c.Opts.Hash {
+			extras = append(extras, algo)
+		}
+	}
+
+	return extras
+}
+
+func (c *Catalog) HashAndCatalog(rootId int64, walked WalkerContext) error {
+	realpath := filepath.Join(walked.Context, walked.Info.Name())
+
+	// -type has to look inside the file before deciding anything else
+	var mime string
+	if len(c.Opts.Types) > 0 {
+		var err error
+		mime, err = sniffFile(realpath)
+		if err != nil {
+			c.Stats.DoneBytes += walked.Info.Size()
+			return c.recordError(rootId, realpath, "open", err)
+		}
+
+		if !c.typeWanted(mime) {
+			c.Out.Verbosity("excluded", Fields{"path": realpath, "size": walked.Info.Size(), "type": mime}, "Skipping %s (%s)\n", realpath, mime)
+			c.Stats.done(&c.Stats.Excluded, walked.Info.Size())
+			return nil
+		}
+	}
+
+	if c.Opts.Incremental {
+		unchanged, err := c.Unchanged(rootId, realpath, walked.Info.ModTime(), walked.Info.Size())
+		if err != nil {
+			return err
+		}
+
+		if unchanged {
+			c.Out.Verbosity("unchanged", Fields{"path": realpath}, "Unchanged %s\n", realpath)
+			c.Stats.done(&c.Stats.Unchanged, walked.Info.Size())
+			if c.Opts.DryRun {
+				return nil
+			}
+			if mime != "" {
+				err = c.fillType(rootId, realpath, mime)
+				if err != nil {
+					return err
+				}
+			}
+			if c.Opts.Owner || c.Opts.Xattrs {
+				err = c.refreshOwner(rootId, realpath, walked.Info)
+				if err != nil {
+					return err
+				}
+			}
+			if c.Opts.Archives && isArchive(realpath) {
+				err = c.seenArchive(rootId, realpath)
+				if err != nil {
+					return err
+				}
+			}
+			return c.Seen(rootId, realpath, walked.Info.Size())
+		}
+	}
+
+	if c.Opts.DryRun {
+		c.wouldCatalog(realpath, walked.Info.Size())
+		return nil
+	}
+
+	// Another link to this file was already hashed in this scan, or the
+	// file itself was hashed before under another path
+	hashes, ok := c.hashedInode(walked.Info)
+	if !ok {
+		hashes, ok = c.cachedHashes(walked.Info, append([]string{c.Opts.Hash}, c.extraHashes()...))
+	}
+	if ok {
+		if mime == "" {
+			mime, _ = sniffFile(realpath)
+		}
+		return c.catalogHashed(rootId, walked, realpath, hashes, mime)
+	}
+
+	c.Out.Event("hashing", Fields{"path": realpath, "size": walked.Info.Size()})
 
-func (e *RegexFlag) String() string {
-	var parts []string
-	if e == nil {
-		return ""
+	file, err := os.Open(realpath)
+	if err != nil {
+		c.Stats.DoneBytes += walked.Info.Size()
+		return c.recordError(rootId, realpath, "open", err)
 	}
+	defer file.Close()
 
-	for _, re := range *e {
-		parts = append(parts, re.String())
+	hashes, err = HashAll(append([]string{c.Opts.Hash}, c.extraHashes()...), c.hashReader(sparseReader(file, walked.Info)), walked.Info)
+	if err == ErrInterrupted {
+		return err
+	}
+	if err != nil {
+		c.Stats.DoneBytes += walked.Info.Size()
+		return c.recordError(rootId, realpath, "read", err)
 	}
 
-	return strings.Join(parts, ", ")
-}
+	// Something still writing to the file would leave a hash of neither
+	// version, so it is left for a later scan
+	after, err := file.Stat()
+	if err != nil {
+		c.Stats.DoneBytes += walked.Info.Size()
+		return c.recordError(rootId, realpath, "stat", err)
+	}
+	if after.Size() != walked.Info.Size() || !after.ModTime().Equal(walked.Info.ModTime()) {
+		c.Stats.DoneBytes += walked.Info.Size()
+		return c.recordError(rootId, realpath, "hash", ErrUnstable)
+	}
 
-func (e *RegexFlag) Set(value string) error {
-	excludeRe, err := regexp.Compile(value)
+	c.rememberInode(walked.Info, hashes)
+	err = c.cacheHashes(walked.Info, hashes)
 	if err != nil {
 		return err
 	}
 
-	*e = append(*e, excludeRe)
+	if mime == "" {
+		mime, err = SniffType(file)
+		if err != nil {
+			c.Stats.DoneBytes += walked.Info.Size()
+			return c.recordError(rootId, realpath, "read", err)
+		}
+	}
 
-	return nil
+	err = c.catalogHashed(rootId, walked, realpath, hashes, mime)
+	if err != nil || !c.Opts.Archives || !isArchive(realpath) {
+		return err
+	}
+
+	return c.catalogArchive(rootId, realpath)
 }
 
-func (e *RegexFlag) Match(s string) bool {
-	for _, re := range *e {
-		if re.MatchString(s) {
-			return true
-		}
+// Catalogs a file that has been hashed, unless it turns out to have moved.
+// hashes holds its digest by Opts.Hash and by each extra algorithm.
+func (c *Catalog) catalogHashed(rootId int64, walked WalkerContext, realpath string, hashes map[string]string, mime string) error {
+	dev, inode, _, _ := fileId(walked.Info)
+	hash := hashes[c.Opts.Hash]
+	allocated, ok := fileAllocated(walked.Info)
+	if !ok {
+		allocated = -1
+	}
+	entry := &Entry{realpath, c.Opts.Hash, hash, walked.Info.ModTime(), dev, inode, walked.Info.Size(), hashes, sql.NullString{}, nil, mime, nil, nil, allocated}
+	if c.Opts.Similarity && isImage(realpath) {
+		entry.Phash = c.similarityHash(realpath)
+	}
+	if c.Opts.Metadata && isMedia(realpath) {
+		entry.Media = c.readMedia(realpath)
+	}
+	if c.Opts.Owner {
+		entry.Owner = OwnerOf(walked.Info)
+	}
+	if c.Opts.Xattrs {
+		entry.Xattrs = c.readXattrs(realpath)
 	}
 
-	return false
-}
+	if c.Opts.DetectMoves {
+		from, err := c.DetectMove(rootId, entry)
+		if err != nil {
+			return err
+		}
 
-type Options struct {
-	root        string
-	catalogPath string
-	excludes    *RegexFlag
-	includes    *RegexFlag
-	hashFile    string
-	verbose     bool
-}
-
-func parseOptions() *Options {
-	home := os.Getenv("HOME")
-	root := flag.String("root", home, "Catalog all files in this directory")
-	verbosity := flag.Bool("verbose", false, "Be chattier")
-	catalogPath := flag.String("catalog", path.Join(home, ".leibniz-catalog"), "Path to the catalog file")
-	var excludes RegexFlag
-	var includes RegexFlag
-	flag.Var(&excludes, "exclude", "Exclude paths that match this regex. Excludes are tested before includes")
-	flag.Var(&includes, "include", "Include paths that match this regex")
-	hashFile := flag.String("singleton", "", "Hash a single file")
-
-	flag.Parse()
-
-	if root == nil || *root == "" || catalogPath == nil || *catalogPath == "" {
-		flag.Usage()
-		return nil
+		if from != "" {
+			c.Out.Verbosity("moved", Fields{"from": from, "path": realpath, "algo": c.Opts.Hash, "hash": hash}, "Moved %s -> %s\n", from, realpath)
+			c.Stats.done(&c.Stats.Moved, walked.Info.Size())
+			c.Stats.HashedBytes += walked.Info.Size()
+			return nil
+		}
 	}
 
-	for _, re := range excludes {
-		fmt.Println("Excluding:", re.String())
+	_, err := c.CatalogHash(rootId, entry)
+	if err != nil {
+		return err
 	}
 
-	return &Options{*root, *catalogPath, &excludes, &includes, *hashFile, *verbosity}
+	c.Out.Verbosity("cataloged", Fields{"path": realpath, "algo": c.Opts.Hash, "hash": hash}, "Cataloged %s: %s\n", realpath, hash)
+	c.Stats.done(&c.Stats.Hashed, walked.Info.Size())
+	c.Stats.HashedBytes += walked.Info.Size()
+
+	return nil
 }
 
-type Catalog struct {
-	Db   *sql.DB
-	Opts *Options
+type WalkerContext struct {
+	Info    os.FileInfo
+	Context string
 }
 
-func (c *Catalog) Verbosity(fmtstr string, vars ...interface{}) {
-	if c.Opts.verbose {
-		fmt.Printf(fmtstr, vars...)
+func (c *Catalog) Run() (err error) {
+	root := c.Opts.Root
+
+	var rootInfo os.FileInfo
+	if IsS3Root(root) {
+		root = strings.TrimSuffix(root, "/")
+	} else {
+		rootInfo, err = os.Stat(root)
+		if err != nil {
+			return err
+		}
+
+		if !rootInfo.IsDir() {
+			return fmt.Errorf("Root (%s) is not a directory.", root)
+		}
 	}
-}
 
-func OpenCatalog(options *Options) (*Catalog, error) {
-	db, err := sql.Open("sqlite3", options.catalogPath)
+	if c.Opts.FilesFrom != "" && rootInfo == nil {
+		return fmt.Errorf("-files-from only lists files under directories")
+	}
+
+	if rootInfo != nil {
+		c.warnWholeSystem(root)
+	}
+
+	if c.Opts.DryRun {
+		return c.dryRun(root, rootInfo)
+	}
+
+	unlock, err := c.lockScans()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer unlock()
 
-	_, err = db.Exec(createDbStmt)
-	if err != nil && err.Error() != "table roots already exists" {
-		db.Close()
-		return nil, err
+	if rootInfo != nil {
+		err = c.trackVolume(root)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = db.Exec(createIdxStmt)
+	rootId, err := c.EnsureRootId(root)
 	if err != nil {
-		db.Close()
-		return nil, err
+		return err
 	}
 
-	return &Catalog{db, options}, nil
-}
+	c.beNice()
 
-// A get-or-insert command that always maintains the roots table
-func (c *Catalog) EnsureRootId(root string) (int64, error) {
-	var existingRoot string
-	var rootId int64
-	err := c.Db.QueryRow(`select id, root from roots where root=?`, root).Scan(&rootId, &existingRoot)
+	err = c.startScan(rootId)
+	if err != nil {
+		return err
+	}
 
-	switch {
-	case err == sql.ErrNoRows:
-		res, err := c.Db.Exec(`insert into roots (root) values (?)`, root)
+	if rootInfo != nil && c.Opts.FilesFrom == "" {
+		err = c.startFastDirs(rootId)
 		if err != nil {
-			return -1, err
+			return err
 		}
-
-		return res.LastInsertId()
-	case err != nil:
-		return -1, err
-	default:
-		return rootId, nil
 	}
-}
 
-func (c *Catalog) CatalogHash(rootId int64, hash uint64, path string, mtime time.Time) (int64, error) {
-	hashString := fmt.Sprintf("%x", hash)
-	res, err := c.Db.Exec(`insert into files (root_id, hash, path, mtime) values (?, ?, ?, ?)`, rootId, hashString, path, mtime)
+	err = c.begin()
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	return res.LastInsertId()
-}
+	// Whatever was cataloged before an error is still good, so keep it. A
+	// scan stopped at a limit, or of a list of files, is over, but not
+	// finished, since it didn't see everything under the root.
+	defer func() {
+		commitErr := c.commit()
+		if err == ErrLimitReached {
+			c.Stats.Limited = true
+			err = commitErr
+			return
+		}
+		if err == nil {
+			err = commitErr
+		}
+		if err == nil && c.Opts.FilesFrom == "" {
+			err = c.saveDirs(rootId)
+		}
+		if err == nil && c.Opts.FilesFrom == "" {
+			err = c.finishScan()
+		}
+		if err == ErrInterrupted {
+			if checkpointErr := c.checkpoint(); checkpointErr != nil {
+				err = checkpointErr
+			}
+		}
+	}()
 
-func (c *Catalog) HashAndCatalog(rootId int64, walked WalkerContext) error {
-	realpath := path.Join(walked.Context, walked.Info.Name())
+	switch {
+	case rootInfo == nil:
+		return c.walkS3(rootId, root)
+	case c.Opts.FilesFrom != "":
+		return c.walkList(rootId, root)
+	default:
+		return c.Walk(rootId, WalkerContext{rootInfo, filepath.Dir(root)}, nil)
+	}
+}
 
-	file, err := os.Open(realpath)
-	if err != nil {
-		pathErr, ok := err.(*os.PathError)
-		if !ok {
-			return fmt.Errorf("not a PathError!")
-		}
+// Counts a file a dry run passes over as hashed, since it would have been
+func (c *Catalog) wouldCatalog(realpath string, size int64) {
+	c.Out.Print("would-catalog", Fields{"path": realpath, "size": size}, "Would catalog %s (%s)\n", realpath, c.Out.Size(size))
+	c.Stats.done(&c.Stats.Hashed, size)
+	c.Stats.HashedBytes += size
+}
 
-		if pathErr.Err.Error() == "permission denied" {
-			fmt.Println("Permission denied:", realpath)
-			return nil
-		}
+// Walks root as Run would, without writing to the catalog, which is only
+// read for -incremental
+func (c *Catalog) dryRun(root string, rootInfo os.FileInfo) error {
+	var rootId int64
+	err := c.Db.QueryRow(`select id from roots where root=?`, root).Scan(&rootId)
+	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
-	defer file.Close()
 
-	smartHash, err := SmartHash(file, walked.Info, 512*1024)
-	if err != nil {
-		return fmt.Errorf("%s: %s", realpath, err.Error())
+	switch {
+	case rootInfo == nil:
+		err = c.walkS3(rootId, root)
+	case c.Opts.FilesFrom != "":
+		err = c.walkList(rootId, root)
+	default:
+		err = c.Walk(rootId, WalkerContext{rootInfo, filepath.Dir(root)}, nil)
+	}
+	if err == ErrLimitReached {
+		c.Stats.Limited = true
+		return nil
 	}
 
-	c.CatalogHash(rootId, smartHash, realpath, walked.Info.ModTime())
+	return err
+}
+
+// The orders the walk can visit directories in. Either way, the entries of
+// each directory are taken in order of their names, so the same tree is
+// always walked the same way, as long as no directory holds more than
+// Opts.DirBatch entries.
+const (
+	WalkBFS = "bfs" // Everything directly in a directory before anything in its subdirectories
+	WalkDFS = "dfs" // Each subdirectory in full before the entries after it
+)
+
+var WalkOrders = []string{WalkBFS, WalkDFS}
 
-	c.Verbosity("Cataloged %s: %x\n", realpath, smartHash)
+// The orders an enumerated scan can hash files in
+const (
+	OrderBySize      = "size"       // Smallest first
+	OrderBySizeDesc  = "size-desc"  // Largest first
+	OrderByMtimeDesc = "mtime-desc" // Most recently modified first
+)
+
+var HashOrders = []string{OrderBySize, OrderBySizeDesc, OrderByMtimeDesc}
+
+// Whether the walk lists every file before hashing any, for -enumerate or
+// -order-by
+func (c *Catalog) enumerating() bool {
+	return c.Opts.Enumerate || c.Opts.OrderBy != ""
+}
+
+// Calls fn with each enumerated file, in -order-by order
+func (c *Catalog) walkEnumerated(files []WalkerContext, fn func(WalkerContext) error) error {
+	c.Stats.Enumerated = true
+	c.sortEnumerated(files)
+	for _, f := range files {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		err := fn(f)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-type WalkerContext struct {
-	Info    os.FileInfo
-	Context string
+// Sorts enumerated files into -order-by order, leaving ties in walk order
+func (c *Catalog) sortEnumerated(files []WalkerContext) {
+	switch c.Opts.OrderBy {
+	case OrderBySize:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Info.Size() < files[j].Info.Size()
+		})
+	case OrderBySizeDesc:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Info.Size() > files[j].Info.Size()
+		})
+	case OrderByMtimeDesc:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Info.ModTime().After(files[j].Info.ModTime())
+		})
+	}
 }
 
-func (c *Catalog) Run() error {
-	root := c.Opts.root
+type queued struct {
+	WalkerContext
+	ignores ignoreChain
+	depth   int // Of directories under the root
+}
 
-	rootInfo, err := os.Stat(root)
+// Catalogs start and, if it is a directory, everything under it. onDir, if
+// not nil, is called with the path of every directory walked.
+func (c *Catalog) Walk(rootId int64, start WalkerContext, onDir func(dir string) error) error {
+	ignores, err := c.ignoresFor(start.Context)
 	if err != nil {
 		return err
 	}
 
-	if !rootInfo.IsDir() {
-		return fmt.Errorf("Root (%s) is not a directory.", root)
+	startPath := filepath.Join(start.Context, start.Info.Name())
+	if startPath != c.Opts.Root && (c.excluded(startPath, start.Info.IsDir()) || ignores.Ignored(startPath, start.Info.IsDir())) {
+		return nil
+	}
+
+	if c.walkable(start.Info, startPath) {
+		c.Stats.discovered(start.Info.Size())
 	}
 
-	rootId, err := c.EnsureRootId(root)
-	if err != nil {
-		return err
+	// Watch walks from directories under the root
+	depth := 0
+	if rel := strings.TrimPrefix(startPath, dirPrefix(c.Opts.Root)); rel != startPath {
+		depth = strings.Count(rel, string(filepath.Separator)) + 1
+	}
+
+	// Mount points under the root show up as directories on another device
+	var rootDev uint64
+	var sameDevOnly bool
+	if c.Opts.OneFileSystem {
+		if rootInfo, err := os.Stat(c.Opts.Root); err == nil {
+			rootDev, _, _, sameDevOnly = fileId(rootInfo)
+		}
+	}
+
+	// Whether the walk goes into a directory it came to, which it doesn't
+	// for pseudo filesystems, or other filesystems with -one-file-system
+	enterable := func(realpath string, info os.FileInfo) bool {
+		if !c.Opts.SpecialFS {
+			if fstype := c.pseudoFS(realpath); fstype != "" {
+				c.Out.Verbosity("pseudo-filesystem", Fields{"path": realpath, "type": fstype}, "Not entering %s, a pseudo filesystem (%s)\n", realpath, fstype)
+				c.Stats.Excluded++
+				return false
+			}
+		}
+
+		if sameDevOnly {
+			if dev, _, _, ok := fileId(info); ok && dev != rootDev {
+				c.Out.Verbosity("other-filesystem", Fields{"path": realpath}, "Not entering %s, on another filesystem\n", realpath)
+				c.Stats.Excluded++
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// The files found, when enumerating
+	files := make([]WalkerContext, 0)
+
+	// Catalogs, or when enumerating holds on to, a file the walk came to
+	visit := func(f WalkerContext) error {
+		context := filepath.Join(f.Context, f.Info.Name())
+		if !c.walkable(f.Info, context) {
+			if f.Info.Mode().IsRegular() {
+				c.Out.Verbosity("excluded", Fields{"path": context}, "Skipping %s (not included)\n", context)
+				c.Stats.Excluded++
+			}
+			return nil
+		}
+
+		if c.enumerating() {
+			files = append(files, f)
+			c.showProgress(false)
+			return nil
+		}
+
+		return c.walkFile(rootId, f)
 	}
 
 	// Non-recursive directory walk
-	fileQ := make([]WalkerContext, 0)
-	fileQ = append(fileQ, WalkerContext{rootInfo, path.Dir(root)})
-	var cur WalkerContext
+	fileQ := make([]queued, 0)
+	fileQ = append(fileQ, queued{start, ignores, depth})
+	var cur queued
 	for {
 		if len(fileQ) < 1 {
 			break
 		}
 
-		cur, fileQ = fileQ[0], fileQ[1:]
-		context := path.Join(cur.Context, cur.Info.Name())
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		if c.Opts.Order == WalkDFS {
+			cur, fileQ = fileQ[len(fileQ)-1], fileQ[:len(fileQ)-1]
+		} else {
+			cur, fileQ = fileQ[0], fileQ[1:]
+		}
+		context := filepath.Join(cur.Context, cur.Info.Name())
 
 		if cur.Info.IsDir() {
-			dir, err := os.Open(context)
+			if c.Opts.MaxDepth > 0 && cur.depth >= c.Opts.MaxDepth {
+				c.Out.Verbosity("too-deep", Fields{"path": context}, "Not entering %s, -max-depth %d deep\n", context, c.Opts.MaxDepth)
+				continue
+			}
+
+			if onDir != nil {
+				err := onDir(context)
+				if err != nil {
+					return err
+				}
+			}
+
+			ignores, err := c.descendIgnores(cur.ignores, context)
 			if err != nil {
-				return err
+				ignores = cur.ignores
+				err = c.recordError(rootId, filepath.Join(context, IgnoreFileName), "read", err)
+				if err != nil {
+					return err
+				}
+			}
+
+			// With -fast-dirs, a directory that looks as it did is taken to
+			// hold the files it did, and only its subdirectories are walked
+			if c.fastDirs {
+				subdirs, unchanged, err := c.unchangedDir(rootId, context, cur.Info)
+				if err != nil {
+					return err
+				}
+
+				if unchanged {
+					err = c.seenDir(rootId, context)
+					if err != nil {
+						return err
+					}
+
+					children := make([]queued, 0, len(subdirs))
+					for _, info := range subdirs {
+						realpath := filepath.Join(context, info.Name())
+						if c.excluded(realpath, true) || ignores.Ignored(realpath, true) || !enterable(realpath, info) {
+							continue
+						}
+						children = append(children, queued{WalkerContext{info, context}, ignores, cur.depth + 1})
+					}
+
+					if c.Opts.Order == WalkDFS {
+						for i := len(children) - 1; i >= 0; i-- {
+							fileQ = append(fileQ, children[i])
+						}
+					} else {
+						fileQ = append(fileQ, children...)
+					}
+
+					continue
+				}
 			}
 
-			infos, err := dir.Readdir(0)
+			dir, err := os.Open(context)
 			if err != nil {
-				dir.Close()
-				return err
+				err = c.recordError(rootId, context, "open", err)
+				if err != nil {
+					return err
+				}
+				continue
 			}
 
-			for _, info := range infos {
-				realpath := path.Join(context, info.Name())
-				if c.Opts.excludes.Match(realpath) {
-					c.Verbosity("Skipping %s\n", realpath)
+			// Entries are read a batch at a time, so that a directory of
+			// hundreds of thousands of them isn't read into memory at once.
+			// Each batch is taken in order of names, which is the whole
+			// directory unless it holds more than one batch.
+			children := make([]queued, 0)
+			entries := 0
+			for done := false; !done; {
+				infos, err := dir.Readdir(c.Opts.DirBatch)
+				done = err != nil || c.Opts.DirBatch <= 0
+				entries += len(infos)
+				if err != nil && err != io.EOF {
+					// Whatever was read before the error is still walked
+					err = c.recordError(rootId, context, "readdir", err)
+					if err != nil {
+						dir.Close()
+						return err
+					}
+				}
+				sort.Slice(infos, func(i, j int) bool {
+					return infos[i].Name() < infos[j].Name()
+				})
+
+				batch := make([]queued, 0, len(infos))
+				for _, info := range infos {
+					realpath := filepath.Join(context, info.Name())
+					if c.excluded(realpath, info.IsDir()) {
+						c.Out.Verbosity("excluded", Fields{"path": realpath}, "Skipping %s\n", realpath)
+						c.Stats.Excluded++
+						continue
+					}
+
+					if ignores.Ignored(realpath, info.IsDir()) {
+						c.Out.Verbosity("ignored", Fields{"path": realpath}, "Ignoring %s\n", realpath)
+						c.Stats.Excluded++
+						continue
+					}
+
+					if info.Mode()&os.ModeSymlink != 0 {
+						info, err = c.walkLink(rootId, realpath, info)
+						if err != nil {
+							err = c.recordError(rootId, realpath, "readlink", err)
+							if err != nil {
+								dir.Close()
+								return err
+							}
+							continue
+						}
+
+						if info == nil {
+							continue
+						}
+					}
+
+					if info.IsDir() && !enterable(realpath, info) {
+						continue
+					}
+
+					if info.Mode().IsRegular() && !c.sizeWanted(info.Size()) {
+						c.Out.Verbosity("excluded", Fields{"path": realpath, "size": info.Size()}, "Skipping %s (%s)\n", realpath, c.Out.Size(info.Size()))
+						c.Stats.Excluded++
+						continue
+					}
+
+					if info.Mode().IsRegular() && !c.ageWanted(info.ModTime()) {
+						c.unsettleDir(realpath)
+						c.Out.Verbosity("excluded", Fields{"path": realpath, "mtime": info.ModTime()}, "Skipping %s (modified %s)\n", realpath, c.Out.Time(info.ModTime()))
+						c.Stats.Excluded++
+						continue
+					}
+
+					if c.walkable(info, realpath) {
+						c.Stats.discovered(info.Size())
+					}
+
+					batch = append(batch, queued{WalkerContext{info, context}, ignores, cur.depth + 1})
+				}
+
+				// Depth first has to hold on to the whole directory, to
+				// take its subdirectories in full before the entries
+				// after them
+				if c.Opts.Order == WalkDFS {
+					children = append(children, batch...)
 					continue
 				}
 
-				fileQ = append(fileQ, WalkerContext{info, context})
+				// Breadth first, the files are dealt with now and only the
+				// directories wait, or a wide tree would have every file of
+				// a level queued at once
+				for _, child := range batch {
+					if child.Info.IsDir() {
+						fileQ = append(fileQ, child)
+						continue
+					}
+
+					if c.stopped() {
+						dir.Close()
+						return ErrInterrupted
+					}
+
+					err := visit(child.WalkerContext)
+					if err != nil {
+						dir.Close()
+						return err
+					}
+				}
 			}
 
 			dir.Close()
+			c.readDir(context, cur.Info, entries)
+
+			// The queue is a stack in depth first order, so the first entry
+			// goes on top. It only ever holds the rest of the directories on
+			// the way down.
+			for i := len(children) - 1; i >= 0; i-- {
+				fileQ = append(fileQ, children[i])
+			}
 
 			continue
 		}
 
-		switch {
-		case !cur.Info.Mode().IsRegular():
-			continue
-		case len(*c.Opts.includes) > 0 && !c.Opts.includes.Match(context):
-			continue
-		default:
-			err = c.HashAndCatalog(rootId, cur)
-			if err != nil {
-				return err
-			}
-			break
+		err := visit(cur.WalkerContext)
+		if err != nil {
+			return err
 		}
 	}
 
+	if !c.enumerating() {
+		return nil
+	}
+
+	return c.walkEnumerated(files, func(f WalkerContext) error {
+		return c.walkFile(rootId, f)
+	})
+}
+
+// Catalogs a file the walk decided to catalog
+func (c *Catalog) walkFile(rootId int64, walked WalkerContext) error {
+	if c.limitReached(walked.Info.Size()) {
+		return ErrLimitReached
+	}
+
+	c.waitForLoad()
+
+	err := c.HashAndCatalog(rootId, walked)
+	if err != nil {
+		return err
+	}
+
+	c.showProgress(false)
+
 	return nil
 }
 
-func fullHash(file *os.File, size int64) ([]byte, error) {
+// Whether -exclude or -exclude-glob leaves p out. Directories are also tried
+// with a trailing slash, so that a pattern for everything under one, like
+// /cache/ or **/node_modules/**, prunes it before it is read.
+func (c *Catalog) excluded(p string, isDir bool) bool {
+	return c.Opts.Excludes.Match(p) || isDir && c.Opts.Excludes.Match(p+"/")
+}
+
+// Whether a file found by the walk should be cataloged. A file left out by
+// -min-age is cataloged once it is old enough, and one left out by -include
+// once a scan includes it, neither of which changes its directory, so the
+// directory is read again next time.
+func (c *Catalog) walkable(info os.FileInfo, realpath string) bool {
+	switch {
+	case !info.Mode().IsRegular():
+		return false
+	case info.Name() == VolumeMarker:
+		return false
+	case !c.sizeWanted(info.Size()):
+		return false
+	case !c.ageWanted(info.ModTime()):
+		c.unsettleDir(realpath)
+		return false
+	case len(*c.Opts.Includes) > 0 && !c.Opts.Includes.Match(realpath):
+		c.unsettleDir(realpath)
+		return false
+	default:
+		return true
+	}
+}
+
+// Whether a file was last modified at least -min-age ago, so it is unlikely
+// to still be being written
+func (c *Catalog) ageWanted(mtime time.Time) bool {
+	return c.Opts.MinAge <= 0 || time.Since(mtime) >= c.Opts.MinAge
+}
+
+// Whether a file's size is within -min-size and -max-size
+func (c *Catalog) sizeWanted(size int64) bool {
+	if size < int64(c.Opts.MinSize) {
+		return false
+	}
+
+	return c.Opts.MaxSize <= 0 || size <= int64(c.Opts.MaxSize)
+}
+
+func fullHash(file io.ReaderAt, size int64) ([]byte, error) {
 	xx := xxhash.New64()
-	_, err := io.Copy(xx, file)
+	_, err := io.Copy(xx, io.NewSectionReader(file, 0, size))
 	if err != nil {
 		return nil, err
 	}
@@ -285,20 +1649,20 @@ func fullHash(file *os.File, size int64) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// We take 1k samples from the start, middle, and end of the file
-// File should be big enough that size / 2 > 1024 and size - 1024 > (size / 2) + 1024
-// But really a file of at least 3k will work
-func sampleHash(file *os.File, size int64) ([]byte, error) {
-	offsets := []int64{
-		0,
-		size / 2,
-		size - 1024,
+// We take samples from the start and end of the file, and evenly between
+// File should be big enough that every sample fits before the next, which a
+// file of at least p.Count samples always is
+func sampleHash(file io.ReaderAt, size int64, p SampleParams) ([]byte, error) {
+	offsets := make([]int64, p.Count)
+	for i := 1; i < p.Count-1; i++ {
+		offsets[i] = size * int64(i) / int64(p.Count-1)
 	}
+	offsets[p.Count-1] = size - p.Size
 
 	xx := xxhash.New64()
 	var err error
 	for i, offset := range offsets {
-		buf := make([]byte, 1024)
+		buf := make([]byte, p.Size)
 		_, err = file.ReadAt(buf, offset)
 		if err == io.EOF && i < len(offsets)-1 {
 			return nil, fmt.Errorf("Unexpected EOF!")
@@ -320,14 +1684,25 @@ func sampleHash(file *os.File, size int64) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func SmartHash(file *os.File, info os.FileInfo, threshold int64) (uint64, error) {
+// Files smaller than this are hashed in full by SmartHash
+const SmartHashThreshold int64 = 512 * 1024
+
+func SmartHash(file io.ReaderAt, info os.FileInfo, threshold int64) (uint64, error) {
+	p := DefaultSampling
+	p.Threshold = threshold
+
+	return p.Hash(file, info)
+}
+
+// The sampled xxhash of file, sampled as p says
+func (p SampleParams) Hash(file io.ReaderAt, info os.FileInfo) (uint64, error) {
 	var xxSum []byte
 	var err error
 
-	if info.Size() < threshold {
+	if info.Size() < p.Threshold || info.Size() < int64(p.Count)*p.Size {
 		xxSum, err = fullHash(file, info.Size())
 	} else {
-		xxSum, err = sampleHash(file, info.Size())
+		xxSum, err = sampleHash(file, info.Size(), p)
 	}
 
 	if err != nil {
@@ -339,51 +1714,3 @@ func SmartHash(file *os.File, info os.FileInfo, threshold int64) (uint64, error)
 
 	return xx.Sum64(), nil
 }
-
-func singleton(file string) {
-	f, err := os.Open(file)
-	if err != nil {
-		panic(err)
-	}
-
-	finfo, err := f.Stat()
-	if err != nil {
-		panic(err)
-	}
-
-	hash, err := SmartHash(f, finfo, 512*1024)
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("%v (%x)\n", hash, hash)
-}
-
-func main() {
-	options := parseOptions()
-	if options == nil {
-		return
-	}
-
-	if len(options.hashFile) > 0 {
-		singleton(options.hashFile)
-		return
-	}
-
-	absroot, err := filepath.Abs(options.root)
-	if err != nil {
-		panic(err)
-	}
-	options.root = absroot
-
-	catalog, err := OpenCatalog(options)
-	if err != nil {
-		panic(err)
-	}
-
-	catalog.Verbosity("Cataloging %s\n", options.root)
-	err = catalog.Run()
-	if err != nil {
-		panic(err)
-	}
-}
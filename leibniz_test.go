@@ -0,0 +1,62 @@
+package leibniz
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func lastScan(t *testing.T, c *Catalog) int64 {
+	var id int64
+	err := c.Db.QueryRow(`select max(id) from scans`).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestRescanFirstScan(t *testing.T) {
+	root := t.TempDir()
+	touched, changed, same := filepath.Join(root, "touched"), filepath.Join(root, "changed"), filepath.Join(root, "same")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, p := range []string{touched, changed, same} {
+		writeFile(t, p, "content of "+p, mtime)
+	}
+
+	c := scannedCatalog(t, root)
+	first := lastScan(t, c)
+
+	writeFile(t, touched, "content of "+touched, mtime.Add(time.Hour))
+	writeFile(t, changed, "new content", mtime)
+	c.SetRoot(root)
+	err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := lastScan(t, c)
+	if second == first {
+		t.Fatalf("the rescan didn't record a scan of its own")
+	}
+
+	tests := []struct {
+		path      string
+		firstScan int64
+	}{
+		{touched, first},
+		{changed, second},
+		{same, first},
+	}
+
+	for _, test := range tests {
+		var rows int
+		var firstScan, scan int64
+		err := c.Db.QueryRow(`select count(*), min(first_scan_id), max(scan_id) from files where path=?`, test.path).Scan(&rows, &firstScan, &scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != 1 || firstScan != test.firstScan || scan != second {
+			t.Errorf("%s: %d rows, first scan %d and scan %d, want 1 row, first scan %d and scan %d", filepath.Base(test.path), rows, firstScan, scan, test.firstScan, second)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package leibniz
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What the walker does with symbolic links
+const (
+	SymlinksSkip   = "skip"   // Ignore them
+	SymlinksFollow = "follow" // Catalog what they point at, as if it were at the link's path
+	SymlinksRecord = "record" // Catalog the link itself in the links table
+)
+
+var SymlinkModes = []string{SymlinksSkip, SymlinksFollow, SymlinksRecord}
+
+// A recorded symbolic link
+type Link struct {
+	Root   string
+	Path   string
+	Target string
+	Mtime  time.Time
+}
+
+// Whether the link's target exists right now
+func (l *Link) Broken() bool {
+	_, err := os.Stat(l.Path)
+	return err != nil
+}
+
+func (c *Catalog) RecordLink(rootId int64, path, target string, mtime time.Time) error {
+	if c.Opts.DryRun {
+		return nil
+	}
+
+	_, err := c.queryer().Exec(`insert or replace into links (root_id, path, target, mtime, scan_id) values (?, ?, ?, ?, ?)`,
+		rootId, path, target, utc(mtime), c.scanId())
+	if err != nil {
+		return err
+	}
+
+	if c.batch != nil {
+		c.batch.pending++
+		return c.flush()
+	}
+
+	return nil
+}
+
+// Deals with a symbolic link found by the walk according to Opts.Symlinks.
+// If it should be walked as though it were what it points to, returns that
+// in place of info.
+func (c *Catalog) walkLink(rootId int64, realpath string, info os.FileInfo) (os.FileInfo, error) {
+	switch c.Opts.Symlinks {
+	case SymlinksRecord:
+		target, err := os.Readlink(realpath)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Out.Verbosity("link", Fields{"path": realpath, "target": target}, "Link %s -> %s\n", realpath, target)
+
+		return nil, c.RecordLink(rootId, realpath, target, info.ModTime())
+	case SymlinksFollow:
+		target, err := os.Stat(realpath)
+		if err != nil {
+			c.Out.Verbosity("broken-link", Fields{"path": realpath, "error": err}, "Broken link %s: %s\n", realpath, err)
+			return nil, nil
+		}
+
+		if target.IsDir() && !c.enterLinkedDir(realpath) {
+			c.Out.Verbosity("link-loop", Fields{"path": realpath}, "Not following %s, the walk already covers it\n", realpath)
+			return nil, nil
+		}
+
+		return target, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Reports whether a linked directory should be walked, remembering it if so.
+// Anything under the root or under a directory already entered through a link
+// is covered by the walk already, and following it again could loop forever.
+func (c *Catalog) enterLinkedDir(link string) bool {
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return false
+	}
+
+	if c.walkedDirs == nil {
+		root, err := filepath.EvalSymlinks(c.Opts.Root)
+		if err != nil {
+			root = c.Opts.Root
+		}
+		c.walkedDirs = []string{root}
+	}
+
+	for _, dir := range c.walkedDirs {
+		if underDir(real, dir) {
+			return false
+		}
+	}
+
+	c.walkedDirs = append(c.walkedDirs, real)
+
+	return true
+}
+
+// Lists the links recorded under root, or under every root if it is empty
+func (c *Catalog) Links(root string) ([]*Link, error) {
+	rows, err := c.Db.Query(`
+		select r.root, l.path, l.target, l.mtime from links l
+		join roots r on r.id = l.root_id
+		where ? = '' or r.root = ?
+		order by l.path
+		`, root, root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*Link, 0)
+	for rows.Next() {
+		l := &Link{}
+		err = rows.Scan(&l.Root, &l.Path, &l.Target, &l.Mtime)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
@@ -0,0 +1,45 @@
+package leibniz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Takes the catalog's scan lock, a file beside it holding the pid of the
+// process scanning, so two scans of one catalog, from a daemon and a cron job
+// say, don't both walk and write at once. The second fails rather than waits.
+// Returns what releases it. Read-only and remote catalogs aren't locked.
+func (c *Catalog) lockScans() (func(), error) {
+	if c.Opts.ReadOnly || IsRemoteCatalog(c.Opts.CatalogPath) {
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(c.Opts.CatalogPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := lockFile(f)
+	if err != nil || held {
+		pid, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is already being scanned by process %s", c.Opts.CatalogPath, strings.TrimSpace(string(pid)))
+	}
+
+	// The file stays, since removing it would let a third process lock a new
+	// one while a second still waits on the old
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return func() {
+		f.Truncate(0)
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
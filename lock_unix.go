@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package leibniz
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Locks f without waiting, returning whether another process holds it
+func lockFile(f *os.File) (held bool, err error) {
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func unlockFile(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package leibniz
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// Windows locks are mandatory, so the lock is on a byte far past the pid,
+// which leaves it readable
+var lockRange = windows.Overlapped{OffsetHigh: 1}
+
+// Locks f without waiting, returning whether another process holds it
+func lockFile(f *os.File) (held bool, err error) {
+	ol := lockRange
+	err = windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func unlockFile(f *os.File) {
+	ol := lockRange
+	windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
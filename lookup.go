@@ -0,0 +1,174 @@
+package leibniz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The algorithms the catalog has hashes by, main or extra
+func (c *Catalog) catalogAlgos() ([]string, error) {
+	rows, err := c.Db.Query(`select algo from files union select algo from file_hashes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	algos := make([]string, 0)
+	for rows.Next() {
+		var algo string
+		err = rows.Scan(&algo)
+		if err != nil {
+			return nil, err
+		}
+
+		if ValidHash(algo) {
+			algos = append(algos, algo)
+		}
+	}
+
+	return algos, rows.Err()
+}
+
+// Calls fn with every current file with one of hashes, which are by
+// algorithm, or by any algorithm under "". Hashes by extra algorithms count
+// as well as the main one.
+func (c *Catalog) Lookup(hashes map[string]string, fn func(*Record) error) error {
+	conds := make([]string, 0, len(hashes))
+	args := make([]interface{}, 0, 4*len(hashes))
+	for algo, hash := range hashes {
+		hash = strings.ToLower(hash)
+		if algo == "" {
+			conds = append(conds, "(f.hash = ? or f.id in (select file_id from file_hashes where hash = ?))")
+			args = append(args, hash, hash)
+			continue
+		}
+
+		conds = append(conds, "((f.hash = ? and f.algo = ?) or f.id in (select file_id from file_hashes where hash = ? and algo = ?))")
+		args = append(args, hash, algo, hash, algo)
+	}
+
+	if len(conds) == 0 {
+		return nil
+	}
+
+	return c.queryRecords("("+strings.Join(conds, " or ")+")", args, fn)
+}
+
+// The hashes to look what up by, a hash or the path of a file, and the
+// absolute path of the file. A file is hashed the way scans hash, by every
+// algorithm the catalog uses, so it needn't be cataloged itself.
+func (c *Catalog) lookupHashes(what string) (hashes map[string]string, self string, err error) {
+	info, err := os.Stat(what)
+	switch {
+	case err == nil && info.Mode().IsRegular():
+		algos, err := c.catalogAlgos()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(algos) == 0 {
+			algos = []string{c.Opts.Hash}
+		}
+
+		f, err := os.Open(what)
+		if err != nil {
+			return nil, "", err
+		}
+		hashes, err = HashAll(algos, f, info)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		self, _ = filepath.Abs(what)
+		for algo, hash := range hashes {
+			c.Out.Verbosity("lookup-hash", Fields{"path": what, "algo": algo, "hash": hash}, "%s (%s): %s\n", what, algo, hash)
+		}
+
+		return hashes, self, nil
+	case err == nil:
+		return nil, "", fmt.Errorf("%s isn't a regular file", what)
+	case !isHex(what):
+		return nil, "", fmt.Errorf("%s is neither a file nor a hash", what)
+	}
+
+	// A digest by the sampled xxhash may have been copied from before they
+	// were padded
+	hashes = map[string]string{"": what}
+	if len(what) < sampledDigits {
+		algos, err := c.catalogAlgos()
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, algo := range algos {
+			if IsSampled(algo) {
+				hashes[algo] = padDigest(algo, strings.ToLower(what))
+			}
+		}
+	}
+
+	return hashes, "", nil
+}
+
+// Looks up what, a hash or the path of a file, and prints every cataloged
+// copy of it under any root, naming the drive holding copies that aren't
+// mounted. Returns an error if there are no copies, so that scripts can tell.
+func (c *Catalog) ReportLookup(what string) error {
+	hashes, self, err := c.lookupHashes(what)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := c.RootVolumes()
+	if err != nil {
+		return err
+	}
+
+	var found int
+	err = c.Lookup(hashes, func(r *Record) error {
+		found++
+		fields := r.Fields()
+		mark := ""
+		if rv := volumes[r.Root]; rv != nil && rv.Volume != "" {
+			fields["volume"] = rv.Volume
+			fields["label"] = rv.Label
+			fields["online"] = rv.Online
+			if !rv.Online {
+				mark = " (on " + rv.Label + ", offline)"
+			}
+		}
+		if r.Path == self {
+			fields["self"] = true
+			mark = " (this file)"
+		}
+		c.Out.Print("file", fields, "%s%s\n", r.Path, mark)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Out.Verbosity("lookup-summary", Fields{"files": found}, "%d files\n", found)
+
+	if found == 0 {
+		return fmt.Errorf("%s isn't in the catalog", what)
+	}
+
+	return nil
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, ch := range strings.ToLower(s) {
+		if !strings.ContainsRune("0123456789abcdef", ch) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,345 @@
+package leibniz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What -metadata extracts from images and videos. Fields that a file doesn't
+// record are left zero.
+type Media struct {
+	Taken    time.Time // When the picture or video was taken, in local time
+	Camera   string    // Make and model
+	Width    int
+	Height   int
+	Duration float64 // Seconds, for videos
+	Codec    string  // The video track's sample format, like avc1 or hvc1
+}
+
+var videoExts = []string{".mp4", ".m4v", ".mov", ".3gp"}
+
+// Whether -metadata reads path, going by its extension
+func isMedia(path string) bool {
+	return isImage(path) || oneOf(strings.ToLower(filepath.Ext(path)), videoExts)
+}
+
+// Reads the metadata of the image or video at path. Files whose format isn't
+// understood give an empty Media rather than an error.
+func ReadMedia(path string) (*Media, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Media{}
+	ext := strings.ToLower(filepath.Ext(path))
+	if oneOf(ext, videoExts) {
+		readMP4(file, info.Size(), m)
+		return m, nil
+	}
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return m, nil
+	}
+	m.Width, m.Height = config.Width, config.Height
+
+	if ext == ".jpg" || ext == ".jpeg" {
+		readJPEGExif(io.NewSectionReader(file, 0, info.Size()), m)
+	}
+
+	return m, nil
+}
+
+// Walks the JPEG's segments up to the image data, parsing the EXIF one
+func readJPEGExif(r io.Reader, m *Media) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+
+		marker := header[1]
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if header[0] != 0xff || marker == 0xda || length < 0 {
+			return
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return
+		}
+
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			parseExif(segment[6:], m)
+			return
+		}
+	}
+}
+
+const (
+	exifMake             = 0x010f
+	exifModel            = 0x0110
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+	exifPixelXDimension  = 0xa002
+	exifPixelYDimension  = 0xa003
+)
+
+// Reads the tags Media wants from the TIFF structure inside an EXIF segment.
+// Corrupt or truncated data just leaves fields unset.
+func parseExif(tiff []byte, m *Media) {
+	if len(tiff) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	tags := make(map[uint16][]byte)
+	var readIFD func(offset uint32, depth int)
+	readIFD = func(offset uint32, depth int) {
+		if depth > 2 || int(offset)+2 > len(tiff) {
+			return
+		}
+
+		count := int(order.Uint16(tiff[offset:]))
+		for i := 0; i < count; i++ {
+			entry := int(offset) + 2 + i*12
+			if entry+12 > len(tiff) {
+				return
+			}
+
+			tag := order.Uint16(tiff[entry:])
+			typ := order.Uint16(tiff[entry+2:])
+			n := order.Uint32(tiff[entry+4:])
+
+			// Values over four bytes are stored at an offset
+			size := map[uint16]uint32{2: 1, 3: 2, 4: 4}[typ] * n
+			value := tiff[entry+8 : entry+12]
+			if size > 4 {
+				at := order.Uint32(value)
+				if uint64(at)+uint64(size) > uint64(len(tiff)) {
+					continue
+				}
+				value = tiff[at : at+size]
+			} else if size > 0 {
+				value = value[:size]
+			}
+
+			if tag == exifIFDPointer && typ == 4 {
+				readIFD(order.Uint32(value), depth+1)
+				continue
+			}
+			tags[tag] = value
+		}
+	}
+	readIFD(order.Uint32(tiff[4:]), 0)
+
+	text := func(tag uint16) string {
+		return strings.TrimSpace(strings.TrimRight(string(tags[tag]), "\x00"))
+	}
+	number := func(tag uint16) int {
+		v := tags[tag]
+		switch {
+		case len(v) == 2:
+			return int(order.Uint16(v))
+		case len(v) == 4:
+			return int(order.Uint32(v))
+		}
+		return 0
+	}
+
+	// Models usually repeat the make, as in Canon / Canon EOS 5D
+	maker, model := text(exifMake), text(exifModel)
+	if !strings.HasPrefix(model, maker) {
+		model = strings.TrimSpace(maker + " " + model)
+	}
+	m.Camera = model
+
+	for _, tag := range []uint16{exifDateTimeOriginal, exifDateTime} {
+		taken, err := time.ParseInLocation("2006:01:02 15:04:05", text(tag), time.Local)
+		if err == nil {
+			m.Taken = taken
+			break
+		}
+	}
+
+	if w, h := number(exifPixelXDimension), number(exifPixelYDimension); w > 0 && h > 0 {
+		m.Width, m.Height = w, h
+	}
+}
+
+// Calls fn with the type and extent of each box between start and end
+func mp4Boxes(r io.ReaderAt, start, end int64, fn func(typ string, start, end int64) error) error {
+	for start+8 <= end {
+		var header [16]byte
+		if _, err := r.ReadAt(header[:8], start); err != nil {
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:8])
+		body := start + 8
+		switch size {
+		case 0:
+			size = end - start
+		case 1:
+			if _, err := r.ReadAt(header[8:], start+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			body += 8
+		}
+		if size < body-start || start+size > end {
+			return fmt.Errorf("bad %q box", typ)
+		}
+
+		err := fn(typ, body, start+size)
+		if err != nil {
+			return err
+		}
+
+		start += size
+	}
+
+	return nil
+}
+
+// Seconds between the epoch MP4 timestamps count from and the Unix one
+const mp4Epoch = 2082844800
+
+// Reads the creation time and duration from the movie header, and the
+// dimensions and codec of the first video track. Damaged files keep whatever
+// was read before the damage.
+func readMP4(r io.ReaderAt, size int64, m *Media) {
+	read := func(at int64, n int) []byte {
+		buf := make([]byte, n)
+		if _, err := r.ReadAt(buf, at); err != nil {
+			return nil
+		}
+		return buf
+	}
+
+	// What the track being walked has said about itself so far
+	var width, height int
+	var handler string
+
+	var walk func(typ string, start, end int64) error
+	walk = func(typ string, start, end int64) error {
+		switch typ {
+		case "moov", "mdia", "minf", "stbl":
+			return mp4Boxes(r, start, end, walk)
+		case "trak":
+			if m.Codec != "" {
+				return nil
+			}
+			width, height, handler = 0, 0, ""
+			return mp4Boxes(r, start, end, walk)
+		case "mvhd":
+			b := read(start, 32)
+			if b == nil {
+				return nil
+			}
+			var created, timescale, duration uint64
+			if b[0] == 1 {
+				created = binary.BigEndian.Uint64(b[4:])
+				timescale = uint64(binary.BigEndian.Uint32(b[20:]))
+				duration = binary.BigEndian.Uint64(b[24:])
+			} else {
+				created = uint64(binary.BigEndian.Uint32(b[4:]))
+				timescale = uint64(binary.BigEndian.Uint32(b[12:]))
+				duration = uint64(binary.BigEndian.Uint32(b[16:]))
+			}
+			if created > mp4Epoch {
+				m.Taken = time.Unix(int64(created-mp4Epoch), 0).Local()
+			}
+			if timescale > 0 {
+				m.Duration = float64(duration) / float64(timescale)
+			}
+		case "tkhd":
+			// Version 1 headers have 64 bit times and durations
+			b, at := read(start, 84), 76
+			if b != nil && b[0] == 1 {
+				b, at = read(start, 96), 88
+			}
+			if b == nil {
+				return nil
+			}
+			// 16.16 fixed point
+			width, height = int(binary.BigEndian.Uint32(b[at:])>>16), int(binary.BigEndian.Uint32(b[at+4:])>>16)
+		case "hdlr":
+			if b := read(start, 12); b != nil {
+				handler = string(b[8:12])
+			}
+		case "stsd":
+			b := read(start, 16)
+			if b != nil && handler == "vide" {
+				m.Codec = strings.TrimSpace(string(b[12:16]))
+				m.Width, m.Height = width, height
+			}
+		}
+		return nil
+	}
+
+	mp4Boxes(r, 0, size, walk)
+}
+
+// Stores the metadata of the file with id, replacing what was there
+func (c *Catalog) catalogMedia(fileId int64, m *Media) error {
+	var taken interface{}
+	if !m.Taken.IsZero() {
+		taken = m.Taken
+	}
+
+	nullable := func(v interface{}, ok bool) interface{} {
+		if !ok {
+			return nil
+		}
+		return v
+	}
+
+	_, err := c.queryer().Exec(`insert or replace into metadata (file_id, taken, camera, width, height, duration, codec) values (?, ?, ?, ?, ?, ?, ?)`,
+		fileId, taken, nullable(m.Camera, m.Camera != ""), nullable(m.Width, m.Width > 0), nullable(m.Height, m.Height > 0),
+		nullable(m.Duration, m.Duration > 0), nullable(m.Codec, m.Codec != ""))
+
+	return err
+}
+
+// The metadata to store for the file at path, which is empty rather than nil
+// for files that can't be read, so they aren't tried again
+func (c *Catalog) readMedia(path string) *Media {
+	m, err := ReadMedia(path)
+	if err != nil {
+		c.Out.Verbosity("no-metadata", Fields{"path": path, "error": err}, "Can't read metadata from %s: %s\n", path, err)
+		return &Media{}
+	}
+
+	return m
+}
@@ -0,0 +1,183 @@
+package leibniz
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters of the scans a daemon or server has run since it started, for
+// MetricsHandler. Everything else it reports is read from the catalog.
+type Metrics struct {
+	mu       sync.Mutex
+	scans    map[string]int64   // By result: ok, failed or interrupted
+	files    int64              // Dealt with, hashed or not
+	hashed   int64              // Bytes
+	errors   int64              // Files that couldn't be read
+	duration map[string]float64 // Seconds the last scan of each root took
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{scans: make(map[string]int64), duration: make(map[string]float64)}
+}
+
+// Counts a scan of root that ended with err. stats is nil if the scan never
+// got started.
+func (m *Metrics) scanned(root string, stats *ScanStats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch err {
+	case nil, ErrLimitReached:
+		m.scans["ok"]++
+	case ErrInterrupted:
+		m.scans["interrupted"]++
+	default:
+		m.scans["failed"]++
+	}
+
+	if stats == nil {
+		return
+	}
+
+	m.files += stats.Done()
+	m.hashed += stats.HashedBytes
+	m.errors += stats.Errors
+	m.duration[root] = time.Since(stats.Started).Seconds()
+}
+
+// Runs a scan of the catalog's root, counting it into Metrics if it is set
+func (c *Catalog) runMetered() error {
+	before := c.Stats
+	err := c.Run()
+
+	if c.Metrics != nil {
+		stats := c.Stats
+		if stats == before {
+			stats = nil
+		}
+		c.Metrics.scanned(c.Opts.Root, stats, err)
+	}
+
+	return err
+}
+
+// What duplicate copies take up in the catalog, one copy of each set
+// staying. Hard links to one file count once.
+var dupeBytesQuery string = `
+	select coalesce(sum(wasted), 0) from (
+		select (count(distinct case when inode is null then 'id:' || id else dev || ':' || inode end) - 1) * max(size) as wasted
+		from files where size > 0
+		group by algo, hash having count(*) > 1
+	)
+	`
+
+// Serves the catalog's health in Prometheus's text format: the counters of
+// c.Metrics, if it is set, and the files, duplicates and last finished scan
+// of each root, read from the catalog when scraped
+func MetricsHandler(c *Catalog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		err := c.writeMetrics(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func (c *Catalog) writeMetrics(w io.Writer) error {
+	roots, err := c.RootsStats()
+	if err != nil {
+		return err
+	}
+
+	scans, err := c.Scans("")
+	if err != nil {
+		return err
+	}
+	finished := make(map[string]time.Time)
+	for _, s := range scans {
+		if !s.Finished.IsZero() && s.Finished.After(finished[s.Root]) {
+			finished[s.Root] = s.Finished
+		}
+	}
+
+	var dupeBytes int64
+	err = c.Db.QueryRow(dupeBytesQuery).Scan(&dupeBytes)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	if m := c.Metrics; m != nil {
+		m.mu.Lock()
+		metric("leibniz_scans_total", "counter", "Scans run since starting, by how they ended.")
+		for _, result := range []string{"ok", "failed", "interrupted"} {
+			fmt.Fprintf(&b, "leibniz_scans_total{result=%q} %d\n", result, m.scans[result])
+		}
+		metric("leibniz_files_scanned_total", "counter", "Files scans have dealt with since starting, hashed or not.")
+		fmt.Fprintf(&b, "leibniz_files_scanned_total %d\n", m.files)
+		metric("leibniz_hashed_bytes_total", "counter", "Bytes scans have hashed since starting.")
+		fmt.Fprintf(&b, "leibniz_hashed_bytes_total %d\n", m.hashed)
+		metric("leibniz_scan_errors_total", "counter", "Files scans couldn't read since starting.")
+		fmt.Fprintf(&b, "leibniz_scan_errors_total %d\n", m.errors)
+		metric("leibniz_scan_duration_seconds", "gauge", "How long the last scan of each root took.")
+		durations := make([]string, 0, len(m.duration))
+		for root := range m.duration {
+			durations = append(durations, root)
+		}
+		sort.Strings(durations)
+		for _, root := range durations {
+			fmt.Fprintf(&b, "leibniz_scan_duration_seconds{root=\"%s\"} %g\n", labelValue(root), m.duration[root])
+		}
+		m.mu.Unlock()
+	}
+
+	metric("leibniz_root_files", "gauge", "Files currently cataloged under each root.")
+	for _, r := range roots {
+		fmt.Fprintf(&b, "leibniz_root_files{root=\"%s\"} %d\n", labelValue(r.Root), r.Files)
+	}
+	metric("leibniz_root_bytes", "gauge", "Size of the files currently cataloged under each root.")
+	for _, r := range roots {
+		fmt.Fprintf(&b, "leibniz_root_bytes{root=\"%s\"} %d\n", labelValue(r.Root), r.Bytes)
+	}
+	metric("leibniz_root_last_scan_finished_timestamp_seconds", "gauge", "When the last finished scan of each root finished, as a Unix time.")
+	for _, r := range roots {
+		if t, ok := finished[r.Root]; ok {
+			fmt.Fprintf(&b, "leibniz_root_last_scan_finished_timestamp_seconds{root=\"%s\"} %d\n", labelValue(r.Root), t.Unix())
+		}
+	}
+
+	metric("leibniz_duplicate_bytes", "gauge", "Space duplicate copies take up, one copy of each set staying.")
+	fmt.Fprintf(&b, "leibniz_duplicate_bytes %d\n", dupeBytes)
+
+	if !IsRemoteCatalog(c.Opts.CatalogPath) {
+		var size int64
+		for _, suffix := range []string{"", "-wal"} {
+			if info, err := os.Stat(c.Opts.CatalogPath + suffix); err == nil {
+				size += info.Size()
+			}
+		}
+		metric("leibniz_catalog_size_bytes", "gauge", "Size of the catalog file and its write-ahead log.")
+		fmt.Fprintf(&b, "leibniz_catalog_size_bytes %d\n", size)
+	}
+
+	_, err = io.WriteString(w, b.String())
+
+	return err
+}
+
+// Escapes a label value the way Prometheus's text format needs
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
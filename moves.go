@@ -0,0 +1,90 @@
+package leibniz
+
+import (
+	"database/sql"
+	"os"
+)
+
+// The parts of *sql.DB and *sql.Tx that catalog queries need
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Queries made during a scan have to go through its transaction
+func (c *Catalog) queryer() queryer {
+	if c.batch != nil {
+		return c.batch.tx
+	}
+
+	return c.Db
+}
+
+// When e.Path is new to rootId, looks for a cataloged file under the same root
+// with the same hash whose path has vanished from disk. If there is one, the
+// file was moved, so its rows are repointed at e rather than cataloging e as a
+// new file. Returns the path it was moved from, or "" if it wasn't.
+func (c *Catalog) DetectMove(rootId int64, e *Entry) (string, error) {
+	q := c.queryer()
+
+	var known int
+	err := q.QueryRow(`select count(*) from files where root_id=? and path=?`, rootId, e.Path).Scan(&known)
+	if err != nil || known > 0 {
+		return "", err
+	}
+
+	rows, err := q.Query(`select distinct path from files where root_id=? and algo=? and hash=? order by id`, rootId, e.Algo, e.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	var from string
+	for rows.Next() {
+		var candidate string
+		err = rows.Scan(&candidate)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+
+		_, err = lstatCataloged(candidate)
+		if os.IsNotExist(err) {
+			from = candidate
+			break
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil || from == "" {
+		return "", err
+	}
+
+	dev, inode := e.fileIdArgs()
+	uid, gid, mode := e.ownerArgs()
+	_, err = q.Exec(`update files set path=?, mtime=?, size=?, dev=?, inode=?, phash=coalesce(?, phash), mime=coalesce(?, mime),
+		uid=coalesce(?, uid), gid=coalesce(?, gid), mode=coalesce(?, mode), scan_id=? where root_id=? and path=?`,
+		e.Path, utc(e.Mtime), e.sizeArg(), dev, inode, e.Phash, e.mimeArg(), uid, gid, mode, c.scanId(), rootId, from)
+	if err != nil {
+		return "", err
+	}
+	c.sawFile()
+
+	if len(e.Hashes) > 0 || e.Media != nil || e.Xattrs != nil {
+		var id int64
+		err = q.QueryRow(`select max(id) from files where root_id=? and path=?`, rootId, e.Path).Scan(&id)
+		if err == nil {
+			err = c.catalogDetails(id, e)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if c.batch != nil {
+		c.batch.pending++
+		err = c.flush()
+	}
+
+	return from, err
+}
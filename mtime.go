@@ -0,0 +1,24 @@
+package leibniz
+
+import (
+	"time"
+)
+
+// Mtimes are stored in UTC, to the nanosecond, so that an instant is always
+// written the same way whatever zone the scan ran in, and mtimes compare in
+// SQL as they do in Go
+func utc(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// Whether a cataloged mtime and one read from the filesystem are the same
+// within Opts.MtimeTolerance, for filesystems like FAT that keep mtimes to
+// two seconds, or NFS servers that truncate them
+func (c *Catalog) sameMtime(cataloged, mtime time.Time) bool {
+	d := cataloged.Sub(mtime)
+	if d < 0 {
+		d = -d
+	}
+
+	return d <= c.Opts.MtimeTolerance
+}
@@ -0,0 +1,52 @@
+package leibniz
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUtc(t *testing.T) {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		in   time.Time
+		want string
+	}{
+		{time.Date(2020, 1, 2, 3, 4, 5, 6, zone), "2020-01-02T01:04:05.000000006Z"},
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "2020-01-02T03:04:05Z"},
+		{time.Date(2020, 1, 1, 1, 0, 0, 0, zone), "2019-12-31T23:00:00Z"},
+	}
+
+	for _, test := range tests {
+		got := utc(test.in)
+		if got.Location() != time.UTC || got.Format(time.RFC3339Nano) != test.want {
+			t.Errorf("utc(%s) = %s, want %s", test.in, got.Format(time.RFC3339Nano), test.want)
+		}
+		if !got.Equal(test.in) {
+			t.Errorf("utc(%s) = %s, a different instant", test.in, got)
+		}
+	}
+}
+
+func TestSameMtime(t *testing.T) {
+	base := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		tolerance time.Duration
+		mtime     time.Time
+		same      bool
+	}{
+		{0, base, true},
+		{0, base.In(time.FixedZone("UTC-5", -5*60*60)), true},
+		{0, base.Add(time.Nanosecond), false},
+		{2 * time.Second, base.Add(2 * time.Second), true},
+		{2 * time.Second, base.Add(-2 * time.Second), true},
+		{2 * time.Second, base.Add(2*time.Second + 1), false},
+		{2 * time.Second, base.Add(-3 * time.Second), false},
+	}
+
+	for _, test := range tests {
+		c := &Catalog{Opts: &Options{MtimeTolerance: test.tolerance}}
+		if same := c.sameMtime(base, test.mtime); same != test.same {
+			t.Errorf("sameMtime(%s, %s) with tolerance %s = %v, want %v", base, test.mtime, test.tolerance, same, test.same)
+		}
+	}
+}
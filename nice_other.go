@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package leibniz
+
+// Priorities are only lowered on Linux
+func lowerPriority() error {
+	return nil
+}
+
+// Load averages are only read on Linux, so -nice never pauses elsewhere
+func loadAverage() (float64, bool) {
+	return 0, false
+}
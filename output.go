@@ -0,0 +1,240 @@
+package leibniz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Fields map[string]interface{}
+
+// Everything a command reports goes through an Output, which writes either
+// human readable text or, with -json, one JSON object per line. Every JSON
+// object carries an "event" field naming what it describes.
+//
+// If Progress is set, a status line is kept up to date on it in place. It is
+// always text, and should be a terminal.
+//
+// If Log is set, everything goes to it instead, as records with timestamps and
+// levels: chatty events are debug, events carrying an error are warnings, and
+// the rest are info.
+//
+// If Hook is set, it is called with every event as it happens, chatty or not,
+// on top of whatever is written, so an embedding application can show progress
+// its own way rather than reading the output. Scans also give it a "hashing"
+// event as they start reading each file, and a "progress" event with their
+// counters every so often.
+//
+// Sizes and times in text go through Size and Time, which make them easy to
+// read unless Bytes or ISO ask for the plain values. JSON always has those.
+type Output struct {
+	W        io.Writer
+	JSON     bool
+	Verbose  bool
+	Bytes    bool
+	ISO      bool
+	Progress io.Writer
+	Log      *slog.Logger
+	Hook     func(event string, fields Fields)
+
+	status bool
+}
+
+var LogFormats = []string{"text", "json"}
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+func NewOutput(w io.Writer, options *Options) *Output {
+	// A dry run is for seeing what the filters skip
+	out := &Output{W: w, JSON: options.JSON, Verbose: options.Verbose || options.DryRun, Bytes: options.Bytes, ISO: options.ISO}
+	if options.Progress {
+		out.Progress = os.Stderr
+	}
+	if options.LogFormat != "" || options.LogFile != "" {
+		out.Log = NewLogger(w, options)
+	}
+
+	return out
+}
+
+// A logger writing to w in Opts.LogFormat, text by default, at Opts.LogLevel,
+// or at debug with -verbose
+func NewLogger(w io.Writer, options *Options) *slog.Logger {
+	level := slog.LevelInfo
+	if options.LogLevel != "" {
+		level.UnmarshalText([]byte(options.LogLevel))
+	} else if options.Verbose {
+		level = slog.LevelDebug
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if options.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, handlerOpts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, handlerOpts))
+}
+
+// Writes an event as a log record whose message is its text
+func (o *Output) log(level slog.Level, event string, fields Fields, text string) {
+	if _, ok := fields["error"]; ok && level == slog.LevelInfo {
+		level = slog.LevelWarn
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(fields)+1)
+	attrs = append(attrs, slog.String("event", event))
+	for _, k := range keys {
+		v := fields[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		attrs = append(attrs, slog.Any(k, v))
+	}
+
+	o.Log.LogAttrs(context.Background(), level, strings.TrimSpace(text), attrs...)
+}
+
+// Replaces the status line with line, or clears it if line is empty
+func (o *Output) Status(line string) {
+	if o.Progress == nil {
+		return
+	}
+
+	fmt.Fprintf(o.Progress, "\r\x1b[K%s", line)
+	o.status = line != ""
+}
+
+// Gives an event to Hook alone, for those that are only of use to embedding
+// applications
+func (o *Output) Event(event string, fields Fields) {
+	if o.Hook != nil {
+		o.Hook(event, fields)
+	}
+}
+
+func (o *Output) Print(event string, fields Fields, fmtstr string, vars ...interface{}) {
+	o.Event(event, fields)
+	o.print(event, fields, fmtstr, vars...)
+}
+
+func (o *Output) print(event string, fields Fields, fmtstr string, vars ...interface{}) {
+	if o.status {
+		o.Status("")
+	}
+
+	if o.Log != nil {
+		o.log(slog.LevelInfo, event, fields, fmt.Sprintf(fmtstr, vars...))
+		return
+	}
+
+	if !o.JSON {
+		fmt.Fprintf(o.W, fmtstr, vars...)
+		return
+	}
+
+	record := Fields{"event": event}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(Fields{"event": "error", "error": err.Error()})
+	}
+
+	o.W.Write(append(line, '\n'))
+}
+
+// Like Print, but only when being chatty
+func (o *Output) Verbosity(event string, fields Fields, fmtstr string, vars ...interface{}) {
+	o.Event(event, fields)
+
+	if o.Log != nil {
+		if o.Log.Enabled(context.Background(), slog.LevelDebug) {
+			o.log(slog.LevelDebug, event, fields, fmt.Sprintf(fmtstr, vars...))
+		}
+		return
+	}
+
+	if o.Verbose {
+		o.print(event, fields, fmtstr, vars...)
+	}
+}
+
+var binaryUnits = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// A size as text, in KiB, MiB and up from a kibibyte on, or in bytes with
+// Bytes set
+func (o *Output) Size(n int64) string {
+	if o.Bytes || n < 1024 && n > -1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	v := float64(n) / 1024
+	unit := 0
+	for (v >= 1024 || v <= -1024) && unit < len(binaryUnits)-1 {
+		v /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %s", v, binaryUnits[unit])
+}
+
+// A time as text, in ISO 8601 in the local time zone, followed by how long ago
+// it was unless ISO is set
+func (o *Output) Time(t time.Time) string {
+	iso := t.Local().Format(time.RFC3339)
+	if o.ISO {
+		return iso
+	}
+
+	return iso + " (" + sinceText(t, time.Now()) + ")"
+}
+
+// How long before now t was, roughly, like "3 months ago", or how long after
+// for times still to come
+func sinceText(t, now time.Time) string {
+	d := now.Sub(t)
+	format := "%d %s ago"
+	if d < 0 {
+		d = -d
+		format = "in %d %s"
+	}
+
+	const day = 24 * time.Hour
+	var n time.Duration
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = d/time.Minute, "minute"
+	case d < day:
+		n, unit = d/time.Hour, "hour"
+	case d < 30*day:
+		n, unit = d/day, "day"
+	case d < 365*day:
+		n, unit = d/(30*day), "month"
+	default:
+		n, unit = d/(365*day), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+
+	return fmt.Sprintf(format, n, unit)
+}
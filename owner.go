@@ -0,0 +1,114 @@
+package leibniz
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Who owns a file and who may do what with it, as -owner records them. Uid and
+// Gid are -1 where the platform has no such thing.
+type Owner struct {
+	Uid  int
+	Gid  int
+	Mode uint32 // Permission bits with setuid, setgid and sticky, as chmod takes them
+}
+
+// The ownership and permissions of the file info describes
+func OwnerOf(info os.FileInfo) *Owner {
+	o := &Owner{Uid: -1, Gid: -1, Mode: uint32(info.Mode().Perm())}
+	if uid, gid, ok := fileOwner(info); ok {
+		o.Uid, o.Gid = uid, gid
+	}
+
+	if info.Mode()&os.ModeSetuid != 0 {
+		o.Mode |= 04000
+	}
+	if info.Mode()&os.ModeSetgid != 0 {
+		o.Mode |= 02000
+	}
+	if info.Mode()&os.ModeSticky != 0 {
+		o.Mode |= 01000
+	}
+
+	return o
+}
+
+// The uid, gid and mode columns for e
+func (e *Entry) ownerArgs() (interface{}, interface{}, interface{}) {
+	if e.Owner == nil {
+		return nil, nil, nil
+	}
+
+	var uid, gid interface{}
+	if e.Owner.Uid >= 0 {
+		uid, gid = e.Owner.Uid, e.Owner.Gid
+	}
+
+	return uid, gid, e.Owner.Mode
+}
+
+// The SQL for a mode column as ls shows permissions, like rw-r--r--
+func permColumn(mode string) string {
+	var chars []string
+	for i, c := range "rwxrwxrwx" {
+		chars = append(chars, fmt.Sprintf("case when %s & %d then '%c' else '-' end", mode, 1<<(8-i), c))
+	}
+
+	return strings.Join(chars, " || ")
+}
+
+// Stores the extended attributes of the file with id, replacing what was there
+func (c *Catalog) catalogXattrs(fileId int64, xattrs map[string][]byte) error {
+	_, err := c.queryer().Exec(`delete from xattrs where file_id=?`, fileId)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range xattrs {
+		_, err = c.queryer().Exec(`insert into xattrs (file_id, name, value) values (?, ?, ?)`, fileId, name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The extended attributes to store for the file at path, which are empty
+// rather than nil when they can't be read
+func (c *Catalog) readXattrs(path string) map[string][]byte {
+	xattrs, err := ReadXattrs(path)
+	if err != nil {
+		c.Out.Verbosity("no-xattrs", Fields{"path": path, "error": err}, "Can't read extended attributes of %s: %s\n", path, err)
+		return map[string][]byte{}
+	}
+
+	return xattrs
+}
+
+// Chmod, chown and setfattr don't touch a file's mtime, so unchanged files
+// have their ownership and attributes read again on every -owner or -xattrs
+// scan
+func (c *Catalog) refreshOwner(rootId int64, path string, info os.FileInfo) error {
+	var id int64
+	err := c.queryer().QueryRow(`select max(id) from files where root_id=? and path=?`, rootId, path).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if c.Opts.Owner {
+		e := &Entry{Owner: OwnerOf(info)}
+		uid, gid, mode := e.ownerArgs()
+		_, err = c.queryer().Exec(`update files set uid=?, gid=?, mode=? where id=?`, uid, gid, mode, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Opts.Xattrs {
+		return c.catalogXattrs(id, c.readXattrs(path))
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package leibniz
+
+import (
+	"os"
+	"time"
+)
+
+// Two catalog rows whose files were compared byte for byte, smaller id first
+type filePair [2]int64
+
+func pairOf(a, b int64) filePair {
+	if a > b {
+		a, b = b, a
+	}
+
+	return filePair{a, b}
+}
+
+// The pairs of files found identical before. A file that changes is cataloged
+// again under a new row, so a pair only stands while both files are as they
+// were compared.
+func (c *Catalog) verifiedPairs() (map[filePair]bool, error) {
+	rows, err := c.Db.Query(`select file_id, other_id from verified_pairs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pairs := make(map[filePair]bool)
+	for rows.Next() {
+		var p filePair
+		err = rows.Scan(&p[0], &p[1])
+		if err != nil {
+			return nil, err
+		}
+		pairs[p] = true
+	}
+
+	return pairs, rows.Err()
+}
+
+// Records that the files of two catalog rows were found identical. A
+// read-only catalog keeps no record, so they are compared again next time.
+func (c *Catalog) recordVerified(a, b int64) error {
+	if c.Opts.ReadOnly || a == b {
+		return nil
+	}
+
+	p := pairOf(a, b)
+	_, err := c.Db.Exec(`insert or ignore into verified_pairs (file_id, other_id, time) values (?, ?, ?)`, p[0], p[1], time.Now())
+
+	return err
+}
+
+// Splits each set into the copies that are byte for byte the same, since a
+// hash, and the sampled one in particular, can collide. Each copy is compared
+// with the first copy of each split so far, unless they are hard links to each
+// other or the catalog records they were compared before. Copies that differ
+// from the rest are dropped, and ones that can't be read are reported and
+// dropped.
+func (c *Catalog) confirmDupes(groups []*DupeGroup) ([]*DupeGroup, error) {
+	verified, err := c.verifiedPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	confirmed := make([]*DupeGroup, 0, len(groups))
+	for _, g := range groups {
+		if c.stopped() {
+			return nil, ErrInterrupted
+		}
+
+		splits := make([][]int, 0, 1)
+		for i := range g.Paths {
+			found := false
+			for s, split := range splits {
+				same, err := c.sameCopies(g, split[0], i, verified)
+				if err != nil {
+					c.Out.Print("dupes-error", Fields{"path": g.Paths[i], "error": err}, "%s: %s\n", g.Paths[i], err)
+					found = true
+					break
+				}
+
+				if same {
+					splits[s] = append(split, i)
+					found = true
+					break
+				}
+			}
+
+			if found {
+				continue
+			}
+
+			// Every copy after is compared with this one, so it had better
+			// be there
+			f, err := os.Open(g.Paths[i])
+			if err != nil {
+				c.Out.Print("dupes-error", Fields{"path": g.Paths[i], "error": err}, "%s: %s\n", g.Paths[i], err)
+				continue
+			}
+			f.Close()
+			splits = append(splits, []int{i})
+		}
+
+		if len(splits) > 1 {
+			c.Out.Print("dupes-mismatch", Fields{"algo": g.Algo, "hash": g.Hash, "paths": g.Paths, "contents": len(splits)},
+				"%s (%s): the copies share a hash but have %d different contents\n", g.Hash, g.Algo, len(splits))
+		}
+
+		for _, split := range splits {
+			in := make(map[int]bool, len(split))
+			for _, i := range split {
+				in[i] = true
+			}
+
+			if sub := g.subset(func(i int) bool { return in[i] }); sub != nil {
+				sub.Verified = true
+				confirmed = append(confirmed, sub)
+			}
+		}
+	}
+
+	return confirmed, nil
+}
+
+// Whether the copies at i and j of g are the same, comparing them only if
+// that isn't known already
+func (c *Catalog) sameCopies(g *DupeGroup, i, j int, verified map[filePair]bool) (bool, error) {
+	if g.ids[i] != (inodeKey{}) && g.ids[i] == g.ids[j] {
+		return true, nil
+	}
+
+	pair := pairOf(g.fileIds[i], g.fileIds[j])
+	if verified[pair] {
+		return true, nil
+	}
+
+	same, err := SameContent(g.Paths[i], g.Paths[j])
+	if err != nil || !same {
+		return false, err
+	}
+
+	verified[pair] = true
+
+	return true, c.recordVerified(pair[0], pair[1])
+}
@@ -0,0 +1,35 @@
+package leibniz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The user's home directory: $HOME, or on Windows %USERPROFILE%. Empty if
+// there isn't one.
+func homeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return home
+}
+
+// dir with a separator on the end, the prefix of everything under it.
+// Buckets use slashes whatever the OS, and so do archive members.
+func dirPrefix(dir string) string {
+	sep := string(filepath.Separator)
+	if IsS3Root(dir) {
+		sep = "/"
+	}
+
+	return strings.TrimSuffix(dir, sep) + sep
+}
+
+// Whether p is dir or somewhere under it, so /data holds /data/x but not
+// /database, and C:\Users holds C:\Users\me
+func underDir(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dirPrefix(dir))
+}
@@ -0,0 +1,109 @@
+package leibniz
+
+import (
+	"os"
+)
+
+type prunable struct {
+	rootId int64
+	path   string
+}
+
+// Removes every row for files under root (or under any root, if root is empty)
+// that no longer exist on disk, calling fn with each path removed. Returns the
+// number of paths pruned.
+func (c *Catalog) Prune(root string, fn func(path string)) (int64, error) {
+	rows, err := c.Db.Query(`
+		select f.root_id, f.path from files f
+		join roots r on r.id = f.root_id
+		where ? = '' or r.root = ?
+		union
+		select l.root_id, l.path from links l
+		join roots r on r.id = l.root_id
+		where ? = '' or r.root = ?
+		`, root, root, root, root)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := make([]prunable, 0)
+	for rows.Next() {
+		var p prunable
+		err = rows.Scan(&p.rootId, &p.path)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		_, err = lstatCataloged(p.path)
+		if os.IsNotExist(err) {
+			missing = append(missing, p)
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.deletePaths(missing, fn)
+}
+
+func (c *Catalog) deletePaths(paths []prunable, fn func(path string)) (int64, error) {
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	del, err := tx.Prepare(`delete from files where root_id=? and path=?`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	delLink, err := tx.Prepare(`delete from links where root_id=? and path=?`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, p := range paths {
+		_, err = del.Exec(p.rootId, p.path)
+		if err == nil {
+			_, err = delLink.Exec(p.rootId, p.path)
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		if fn != nil {
+			fn(p.path)
+		}
+	}
+
+	return int64(len(paths)), tx.Commit()
+}
+
+// Prunes files missing from disk, or with unseen files not seen by the last
+// scan of their root
+func (c *Catalog) ReportPrune(root string, unseen bool) error {
+	report := func(path string) {
+		c.Out.Verbosity("pruned", Fields{"path": path}, "Pruned %s\n", path)
+	}
+
+	var pruned int64
+	var err error
+	if unseen {
+		pruned, err = c.PruneUnseen(root, report)
+	} else {
+		pruned, err = c.Prune(root, report)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Out.Print("prune-summary", Fields{"pruned": pruned}, "Pruned %d files\n", pruned)
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package leibniz
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Directories that hold no files worth cataloging, only views of the running
+// system whose files can be endless or block when read
+var pseudoDirs = []string{"/proc", "/sys", "/dev", "/run"}
+
+// Filesystem types that are views of the kernel or the system rather than
+// storage. Every FUSE filesystem, whose type starts with fuse., is skipped as
+// well, since a remote one can hang a scan for as long as its server is gone.
+var pseudoTypes = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devfs": true, "devpts": true, "devtmpfs": true,
+	"efivarfs": true, "fuse": true, "fusectl": true, "hugetlbfs": true, "mqueue": true,
+	"nsfs": true, "proc": true, "pstore": true, "rpc_pipefs": true, "securityfs": true,
+	"selinuxfs": true, "sysfs": true, "tracefs": true,
+}
+
+// The type of the pseudo filesystem mounted at dir, if it is one or one of
+// the well known directories, or empty if it is ordinary storage
+func (c *Catalog) pseudoFS(dir string) string {
+	if c.mounts == nil {
+		c.mounts = mountTypes()
+	}
+
+	fstype, mounted := c.mounts[filepath.Clean(dir)]
+	if pseudoTypes[fstype] || strings.HasPrefix(fstype, "fuse.") {
+		return fstype
+	}
+
+	for _, p := range pseudoDirs {
+		if dir != p {
+			continue
+		}
+		if !mounted {
+			fstype = "system"
+		}
+		return fstype
+	}
+
+	return ""
+}
+
+// Warns when root is a whole system's filesystem, which holds a great deal
+// that isn't worth cataloging
+func (c *Catalog) warnWholeSystem(root string) {
+	if filepath.Dir(root) != root {
+		return
+	}
+
+	advice := "pseudo filesystems like /proc are skipped"
+	if c.Opts.SpecialFS {
+		advice = "-special-fs walks pseudo filesystems like /proc too"
+	}
+	if !c.Opts.OneFileSystem {
+		advice += ", and -one-file-system keeps it to the one filesystem"
+	}
+
+	c.Out.Print("whole-filesystem", Fields{"root": root, "special_fs": c.Opts.SpecialFS, "one_file_system": c.Opts.OneFileSystem},
+		"Warning: %s is the whole filesystem; %s\n", root, advice)
+}
@@ -0,0 +1,39 @@
+package leibniz
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// The type of every mounted filesystem, by mount point, from the kernel's
+// mount table
+func mountTypes() map[string]string {
+	types := make(map[string]string)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return types
+	}
+	defer f.Close()
+
+	// The mount point is the fifth field, and the type the first after the
+	// lone - that ends the optional fields
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 6; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				types[unescapeMount(fields[4])] = fields[i+1]
+				break
+			}
+		}
+	}
+
+	return types
+}
+
+// Mount points have spaces, tabs, newlines and backslashes as octal escapes
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
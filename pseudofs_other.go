@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package leibniz
+
+// The mount table is only read on Linux; elsewhere only the well known
+// directories are skipped
+func mountTypes() map[string]string {
+	return make(map[string]string)
+}
@@ -0,0 +1,498 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// How many compiled patterns to keep. A query only has a few, but a server
+// answers queries with new ones for as long as it runs.
+const regexpCacheSize = 64
+
+var (
+	regexpCache   = make(map[string]*regexp.Regexp)
+	regexpCacheMu sync.Mutex
+)
+
+// SQLite calls this for `value regexp pattern`, through whichever driver
+// registers it. Patterns are compiled once per query rather than for every
+// row, and the cache starts over once it is full.
+func sqlRegexp(pattern, value string) (bool, error) {
+	regexpCacheMu.Lock()
+	re, ok := regexpCache[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			regexpCacheMu.Unlock()
+			return false, err
+		}
+		if len(regexpCache) >= regexpCacheSize {
+			regexpCache = make(map[string]*regexp.Regexp)
+		}
+		regexpCache[pattern] = re
+	}
+	regexpCacheMu.Unlock()
+
+	return re.MatchString(value), nil
+}
+
+// A cataloged file returned by Query
+type Record struct {
+	Root   string
+	Path   string
+	Algo   string
+	Hash   string
+	Mtime  time.Time
+	Size   int64 // -1 if it isn't known
+	ScanId int64
+}
+
+// The record as the fields of a "file" event
+func (r *Record) Fields() Fields {
+	return Fields{"root": r.Root, "path": r.Path, "algo": r.Algo, "hash": r.Hash, "mtime": r.Mtime, "size": r.Size, "scan": r.ScanId}
+}
+
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	intField
+	floatField
+	timeField
+	utcTimeField // A time stored in UTC, compared with dates in local time
+	modeField    // An int compared with octal values, as chmod takes them
+)
+
+type queryField struct {
+	column string
+	kind   fieldKind
+}
+
+// The fields a query can test, and the columns of the current files (f),
+// their roots (r) and their metadata (m) they stand for
+var queryFields = map[string]queryField{
+	"path":       {"f.path", stringField},
+	"root":       {"r.root", stringField},
+	"hash":       {"f.hash", stringField},
+	"algo":       {"f.algo", stringField},
+	"mtime":      {"f.mtime", utcTimeField},
+	"scan":       {"f.scan_id", intField},
+	"first_scan": {"f.first_scan_id", intField},
+	"dev":        {"f.dev", intField},
+	"inode":      {"f.inode", intField},
+	"size":       {"f.size", intField},
+	"allocated":  {"f.allocated", intField},
+	"sparse":     {"(f.allocated < f.size)", intField},
+	"type":       {"f.mime", stringField},
+	"uid":        {"f.uid", intField},
+	"gid":        {"f.gid", intField},
+	"mode":       {"f.mode", modeField},
+	"perm":       {permColumn("f.mode"), stringField},
+	"xattrs":     {"(select group_concat(name, ' ') from xattrs x where x.file_id = f.id)", stringField},
+	"taken":      {"m.taken", timeField},
+	"camera":     {"m.camera", stringField},
+	"width":      {"m.width", intField},
+	"height":     {"m.height", intField},
+	"duration":   {"m.duration", floatField},
+	"codec":      {"m.codec", stringField},
+}
+
+// The names of the fields a query can test, for usage messages
+func QueryFields() []string {
+	return []string{"path", "root", "hash", "algo", "mtime", "scan", "first_scan", "dev", "inode", "size", "allocated", "sparse", "type", "uid", "gid", "mode", "perm", "xattrs", "taken", "camera", "width", "height", "duration", "codec"}
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokOp
+	tokOpen
+	tokClose
+	tokEnd
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var queryOps = []string{"!~", "!=", "<=", ">=", "==", "=", "<", ">", "~"}
+
+func lexQuery(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokClose, ")", i})
+			i++
+		case c == '\'' || c == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for ; i < len(expr) && expr[i] != c; i++ {
+				// A backslash escapes the quote; other backslashes are kept for patterns
+				if expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == c {
+					i++
+				}
+				b.WriteByte(expr[i])
+			}
+			if i >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, b.String(), start})
+		default:
+			op := ""
+			for _, o := range queryOps {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op != "" {
+				tokens = append(tokens, token{tokOp, op, i})
+				i += len(op)
+				continue
+			}
+
+			start := i
+			for i < len(expr) && !unicode.IsSpace(rune(expr[i])) && !strings.ContainsRune("()'\"=!<>~", rune(expr[i])) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokWord, expr[start:i], start})
+		}
+	}
+
+	return append(tokens, token{tokEnd, "", len(expr)}), nil
+}
+
+// Turns a query expression into a SQL condition and its arguments with a
+// recursive descent over
+//
+//	expr   = and { "or" and }
+//	and    = not { "and" not }
+//	not    = "not" not | "(" expr ")" | field op value
+type queryParser struct {
+	tokens []token
+	pos    int
+	args   []interface{}
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEnd {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *queryParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *queryParser) or() (string, error) {
+	left, err := p.and()
+	if err != nil {
+		return "", err
+	}
+
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " or " + right + ")"
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) and() (string, error) {
+	left, err := p.not()
+	if err != nil {
+		return "", err
+	}
+
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " and " + right + ")"
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) not() (string, error) {
+	if p.keyword("not") {
+		cond, err := p.not()
+		if err != nil {
+			return "", err
+		}
+		return "not " + cond, nil
+	}
+
+	if p.peek().kind == tokOpen {
+		p.next()
+		cond, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		if t := p.next(); t.kind != tokClose {
+			return "", fmt.Errorf("expected ) at %d", t.pos)
+		}
+		return "(" + cond + ")", nil
+	}
+
+	return p.comparison()
+}
+
+func (p *queryParser) comparison() (string, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return "", fmt.Errorf("expected a field at %d", t.pos)
+	}
+
+	field, ok := queryFields[strings.ToLower(t.text)]
+	if !ok {
+		return "", fmt.Errorf("unknown field %q at %d; fields are %s", t.text, t.pos, strings.Join(QueryFields(), ", "))
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return "", fmt.Errorf("expected a comparison after %s at %d", t.text, op.pos)
+	}
+
+	v := p.next()
+	if v.kind != tokWord && v.kind != tokString {
+		return "", fmt.Errorf("expected a value after %s %s at %d", t.text, op.text, v.pos)
+	}
+
+	if op.text == "~" || op.text == "!~" {
+		if field.kind != stringField {
+			return "", fmt.Errorf("%s can't be matched with %s at %d", t.text, op.text, op.pos)
+		}
+		if _, err := regexp.Compile(v.text); err != nil {
+			return "", fmt.Errorf("bad pattern at %d: %s", v.pos, err)
+		}
+
+		// Metadata is missing for most files, and matches as empty
+		p.args = append(p.args, v.text)
+		column := "coalesce(" + field.column + ", '')"
+		if op.text == "!~" {
+			return column + " not regexp ?", nil
+		}
+		return column + " regexp ?", nil
+	}
+
+	value, err := queryValue(field.kind, v.text)
+	if err != nil {
+		return "", fmt.Errorf("bad value for %s at %d: %s", t.text, v.pos, err)
+	}
+	p.args = append(p.args, value)
+
+	sqlOp := op.text
+	if sqlOp == "==" {
+		sqlOp = "="
+	}
+
+	return field.column + " " + sqlOp + " ?", nil
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"k":   1024,
+	"m":   1024 * 1024,
+	"g":   1024 * 1024 * 1024,
+	"t":   1024 * 1024 * 1024 * 1024,
+	"kib": 1024,
+	"mib": 1024 * 1024,
+	"gib": 1024 * 1024 * 1024,
+	"tib": 1024 * 1024 * 1024 * 1024,
+}
+
+// Parses a number with an optional size unit, like 100MB or 4KiB. Decimal
+// units are powers of 1000 and binary ones (and bare K, M, G, T) powers of
+// 1024.
+func ParseSize(s string) (int64, error) {
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't a number", s)
+	}
+
+	unit, ok := sizeUnits[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+
+	return int64(n * float64(unit)), nil
+}
+
+var dateLayouts = []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05", time.RFC3339}
+
+func queryValue(kind fieldKind, s string) (interface{}, error) {
+	switch kind {
+	case intField:
+		return ParseSize(s)
+	case floatField:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", s)
+		}
+		return f, nil
+	case modeField:
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an octal mode like 644", s)
+		}
+		return int64(mode), nil
+	case timeField, utcTimeField:
+		for _, layout := range dateLayouts {
+			t, err := time.ParseInLocation(layout, s, time.Local)
+			if err == nil && kind == utcTimeField {
+				return utc(t), nil
+			}
+			if err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("%q isn't a date like 2006-01-02 or 2006-01-02T15:04:05", s)
+	}
+
+	return s, nil
+}
+
+// Translates a query expression into a SQL condition on the current files
+// (f), their roots (r) and their metadata (m), and the arguments it binds
+func ParseQuery(expr string) (string, []interface{}, error) {
+	tokens, err := lexQuery(expr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	cond, err := p.or()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEnd {
+		return "", nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+
+	return cond, p.args, nil
+}
+
+var queryStmt string = `
+	select r.root, f.path, f.algo, f.hash, f.mtime, f.size, f.scan_id from files f
+	join roots r on r.id = f.root_id
+	left join metadata m on m.file_id = f.id
+	where %s
+	order by r.root, f.path
+	`
+
+// Calls fn for each cataloged file that matches expr, like
+// `path ~ '\.mp4$' and mtime < 2020-01-01`. An empty expr matches every file.
+func (c *Catalog) Query(expr string, fn func(*Record) error) error {
+	cond := "1"
+	var args []interface{}
+	if strings.TrimSpace(expr) != "" {
+		var err error
+		cond, args, err = ParseQuery(expr)
+		if err != nil {
+			return fmt.Errorf("query: %s", err)
+		}
+	}
+
+	return c.queryRecords(cond, args, fn)
+}
+
+// Calls fn for each current file that matches the SQL condition cond
+func (c *Catalog) queryRecords(cond string, args []interface{}, fn func(*Record) error) error {
+	rows, err := c.Db.Query(fmt.Sprintf(queryStmt, cond), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record Record
+		var size, scanId sql.NullInt64
+		err = rows.Scan(&record.Root, &record.Path, &record.Algo, &record.Hash, &record.Mtime, &size, &scanId)
+		if err != nil {
+			return err
+		}
+		record.ScanId = scanId.Int64
+
+		record.Size = -1
+		if size.Valid {
+			record.Size = size.Int64
+		}
+
+		err = fn(&record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Prints the files that match expr
+func (c *Catalog) ReportQuery(expr string) error {
+	var count int
+	err := c.Query(expr, func(r *Record) error {
+		count++
+		c.Out.Print("file", r.Fields(), "%s\n", r.Path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Out.Verbosity("query-summary", Fields{"files": count}, "%d files\n", count)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package leibniz
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr string
+		cond string
+		args []interface{}
+	}{
+		{`path ~ '\.mp4$'`, "coalesce(f.path, '') regexp ?", []interface{}{`\.mp4$`}},
+		{`path !~ "^/tmp/"`, "coalesce(f.path, '') not regexp ?", []interface{}{"^/tmp/"}},
+		{`size > 10K`, "f.size > ?", []interface{}{int64(10 * 1024)}},
+		{`SIZE <= 1.5MiB`, "f.size <= ?", []interface{}{int64(1.5 * 1024 * 1024)}},
+		{`size >= 1MB and not algo == sha256`, "(f.size >= ? and not f.algo = ?)", []interface{}{int64(1000 * 1000), "sha256"}},
+		{`mode = 644`, "f.mode = ?", []interface{}{int64(0644)}},
+		{`(root = "/a" or root = '/b') and camera !~ x`, "(((r.root = ? or r.root = ?)) and coalesce(m.camera, '') not regexp ?)", []interface{}{"/a", "/b", "x"}},
+		{`path = a or path = b or path = c`, "((f.path = ? or f.path = ?) or f.path = ?)", []interface{}{"a", "b", "c"}},
+		{`path = a or path = b and size > 0`, "(f.path = ? or (f.path = ? and f.size > ?))", []interface{}{"a", "b", int64(0)}},
+		{`path = 'it\'s'`, "f.path = ?", []interface{}{"it's"}},
+		{`mtime < 2020-01-01`, "f.mtime < ?", []interface{}{time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local).UTC()}},
+		{`duration > 90.5`, "m.duration > ?", []interface{}{90.5}},
+		{`taken >= 2020-01-01T10:30`, "m.taken >= ?", []interface{}{time.Date(2020, 1, 1, 10, 30, 0, 0, time.Local)}},
+	}
+
+	for _, test := range tests {
+		cond, args, err := ParseQuery(test.expr)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %s", test.expr, err)
+			continue
+		}
+		if cond != test.cond {
+			t.Errorf("ParseQuery(%q) = %q, want %q", test.expr, cond, test.cond)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("ParseQuery(%q) args = %#v, want %#v", test.expr, args, test.args)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, "expected a field at 0"},
+		{`path`, "expected a comparison after path at 4"},
+		{`path ~`, "expected a value after path ~ at 6"},
+		{`bogus = 1`, `unknown field "bogus" at 0`},
+		{`size ~ 1`, "size can't be matched with ~ at 5"},
+		{`size = lots`, "bad value for size at 7"},
+		{`mode = 9`, "bad value for mode at 7"},
+		{`duration > 10K`, "bad value for duration at 11"},
+		{`mtime < yesterday`, "bad value for mtime at 8"},
+		{`path ~ '('`, "bad pattern at 7"},
+		{`(path = a`, "expected ) at 9"},
+		{`path = a b`, `unexpected "b" at 9`},
+		{`path = 'open`, "unterminated string at 7"},
+		{`path = a and`, "expected a field at 12"},
+	}
+
+	for _, test := range tests {
+		_, _, err := ParseQuery(test.expr)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseQuery(%q) error = %v, want one containing %q", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestSqlRegexpCache(t *testing.T) {
+	for i := 0; i < 3*regexpCacheSize; i++ {
+		pattern := fmt.Sprintf("^x%d$", i)
+		matched, err := sqlRegexp(pattern, fmt.Sprintf("x%d", i))
+		if err != nil || !matched {
+			t.Fatalf("%s didn't match: %v", pattern, err)
+		}
+	}
+
+	regexpCacheMu.Lock()
+	defer regexpCacheMu.Unlock()
+	if len(regexpCache) > regexpCacheSize {
+		t.Errorf("the cache holds %d patterns, more than %d", len(regexpCache), regexpCacheSize)
+	}
+}
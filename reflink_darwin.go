@@ -0,0 +1,14 @@
+package leibniz
+
+import "golang.org/x/sys/unix"
+
+// Creates dst as a clone of src that shares its extents, with clonefile(2)
+// on APFS
+func cloneFile(src, dst string) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if err == unix.ENOTSUP || err == unix.EXDEV {
+		return ErrReflinkUnsupported
+	}
+
+	return err
+}
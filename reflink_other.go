@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package leibniz
+
+func cloneFile(src, dst string) error {
+	return ErrReflinkUnsupported
+}
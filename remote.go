@@ -0,0 +1,688 @@
+package leibniz
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Catalogs on another host are given as ssh://[user@]host[:port]/path. The
+// path is absolute unless it starts with /~/, and ?leibniz=command names the
+// leibniz to run there if it isn't on the remote PATH.
+//
+// Nothing is copied: each connection runs `leibniz remote` on the host over
+// ssh, and the statements the catalog would run against a local file are sent
+// to it as JSON lines, with the rows they return streamed back. So every
+// command works against a remote catalog, several machines can scan into the
+// same one, and SQLite on the host serializes their writes as it would for
+// local processes.
+const remoteDriver = "leibniz_ssh"
+
+func init() {
+	sql.Register(remoteDriver, &sshDriver{})
+}
+
+// Whether path names a catalog on another host
+func IsRemoteCatalog(path string) bool {
+	return strings.HasPrefix(path, "ssh://")
+}
+
+// The DSN of a remote catalog is its URL, carrying the options the remote end
+// opens the catalog with
+func remoteDSN(options *Options, journal, synchronous string) (string, error) {
+	u, err := url.Parse(options.CatalogPath)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return "", fmt.Errorf("bad remote catalog %q, expected ssh://[user@]host[:port]/path", options.CatalogPath)
+	}
+
+	// ssh would take a host or user starting with a dash for an option,
+	// like -oProxyCommand, which runs a command here
+	if strings.HasPrefix(u.Hostname(), "-") || u.User != nil && strings.HasPrefix(u.User.Username(), "-") {
+		return "", fmt.Errorf("bad remote catalog %q, the host and user can't start with -", options.CatalogPath)
+	}
+
+	params := u.Query()
+	params.Set("journal_mode", journal)
+	params.Set("synchronous", synchronous)
+	params.Set("cache_size", strconv.Itoa(options.CacheSize))
+	if options.ReadOnly {
+		params.Set("ro", "1")
+	}
+	u.RawQuery = params.Encode()
+
+	return u.String(), nil
+}
+
+type sshDriver struct{}
+
+// Starts `leibniz remote` on the host the DSN names
+func (d *sshDriver) Open(dsn string) (driver.Conn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("ssh", sshArgs(u)...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(stdin)
+	return &sshConn{
+		name:  u.Host,
+		cmd:   cmd,
+		stdin: stdin,
+		w:     w,
+		enc:   json.NewEncoder(w),
+		dec:   json.NewDecoder(bufio.NewReader(stdout)),
+	}, nil
+}
+
+// The arguments to ssh that run `leibniz remote` on the catalog the DSN u
+// names. The host comes after --, and the remote command is quoted for the
+// shell ssh hands it to.
+func sshArgs(u *url.URL) []string {
+	params := u.Query()
+	command := params.Get("leibniz")
+	if command == "" {
+		command = "leibniz"
+	}
+
+	// Paths under /~/ are relative to the remote home directory, which the
+	// remote end expands since the shell won't inside quotes
+	catalog := u.Path
+	if strings.HasPrefix(catalog, "/~/") {
+		catalog = catalog[1:]
+	}
+
+	remote := []string{command, "remote",
+		"-catalog", catalog,
+		"-journal-mode", params.Get("journal_mode"),
+		"-synchronous", params.Get("synchronous"),
+		"-cache-size", params.Get("cache_size"),
+	}
+	if params.Get("ro") != "" {
+		remote = append(remote, "-ro")
+	}
+
+	quoted := make([]string, len(remote))
+	for i, arg := range remote {
+		quoted[i] = shellQuote(arg)
+	}
+
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+
+	var args []string
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host, strings.Join(quoted, " "))
+
+	return args
+}
+
+// Quotes an argument for the remote shell ssh hands the command to
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// A value as it goes over the wire. database/sql values are JSON numbers,
+// strings and so on, but those lose the difference between integers and
+// floats, and between text, blobs and times, so each is tagged with its type.
+// A value with no field set is NULL.
+type wireValue struct {
+	Int   *int64     `json:"i,omitempty"`
+	Float *float64   `json:"f,omitempty"`
+	Text  *string    `json:"s,omitempty"`
+	Blob  *[]byte    `json:"b,omitempty"`
+	Time  *time.Time `json:"t,omitempty"`
+	Bool  *bool      `json:"o,omitempty"`
+}
+
+func toWire(v interface{}) (wireValue, error) {
+	var w wireValue
+	switch v := v.(type) {
+	case nil:
+	case int64:
+		w.Int = &v
+	case float64:
+		w.Float = &v
+	case string:
+		w.Text = &v
+	case []byte:
+		w.Blob = &v
+	case time.Time:
+		w.Time = &v
+	case bool:
+		w.Bool = &v
+	default:
+		return w, fmt.Errorf("can't send a %T to a remote catalog", v)
+	}
+
+	return w, nil
+}
+
+func (w wireValue) value() driver.Value {
+	switch {
+	case w.Int != nil:
+		return *w.Int
+	case w.Float != nil:
+		return *w.Float
+	case w.Text != nil:
+		return *w.Text
+	case w.Blob != nil:
+		return *w.Blob
+	case w.Time != nil:
+		return *w.Time
+	case w.Bool != nil:
+		return *w.Bool
+	}
+
+	return nil
+}
+
+type remoteRequest struct {
+	Op    string      `json:"op"` // exec, query, begin, commit or rollback
+	Query string      `json:"query,omitempty"`
+	Args  []wireValue `json:"args,omitempty"`
+}
+
+// Exec gets one response with the result. Query gets one with the columns,
+// then one for each row, then one with End set. Any of them can be an error
+// instead.
+type remoteResponse struct {
+	Error        string      `json:"error,omitempty"`
+	LastInsertId int64       `json:"last_insert_id,omitempty"`
+	RowsAffected int64       `json:"rows_affected,omitempty"`
+	Columns      []string    `json:"columns,omitempty"`
+	Row          []wireValue `json:"row,omitempty"`
+	End          bool        `json:"end,omitempty"`
+}
+
+type sshConn struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.Closer
+	w     *bufio.Writer
+	enc   *json.Encoder
+	dec   *json.Decoder
+
+	// Rows still being streamed. database/sql lets a transaction run a
+	// statement while rows from an earlier one are open, so those are read
+	// into memory first.
+	rows *sshRows
+
+	// Set once the connection is lost, so the pool drops it
+	broken bool
+}
+
+func (c *sshConn) send(req remoteRequest) error {
+	if c.broken {
+		return driver.ErrBadConn
+	}
+
+	if c.rows != nil {
+		err := c.rows.buffer()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.enc.Encode(req)
+	if err == nil {
+		err = c.w.Flush()
+	}
+
+	return c.lost(err)
+}
+
+func (c *sshConn) receive() (*remoteResponse, error) {
+	var resp remoteResponse
+	err := c.dec.Decode(&resp)
+	if err != nil {
+		return nil, c.lost(err)
+	}
+
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+
+	return &resp, nil
+}
+
+func (c *sshConn) lost(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	c.broken = true
+	if err == io.EOF {
+		return fmt.Errorf("lost the connection to %s", c.name)
+	}
+
+	return fmt.Errorf("%s: %s", c.name, err)
+}
+
+// Sends a request that gets a single response
+func (c *sshConn) roundTrip(req remoteRequest) (*remoteResponse, error) {
+	err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.receive()
+}
+
+func (c *sshConn) IsValid() bool {
+	return !c.broken
+}
+
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+func (c *sshConn) Prepare(query string) (driver.Stmt, error) {
+	return &sshStmt{c, query}, nil
+}
+
+func (c *sshConn) Begin() (driver.Tx, error) {
+	_, err := c.roundTrip(remoteRequest{Op: "begin"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshTx{c}, nil
+}
+
+func (c *sshConn) exec(query string, args []driver.Value) (driver.Result, error) {
+	req, err := request("exec", query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return sshResult{resp.LastInsertId, resp.RowsAffected}, nil
+}
+
+func (c *sshConn) query(query string, args []driver.Value) (driver.Rows, error) {
+	req, err := request("query", query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rows = &sshRows{conn: c, columns: resp.Columns}
+	return c.rows, nil
+}
+
+func request(op, query string, args []driver.Value) (remoteRequest, error) {
+	req := remoteRequest{Op: op, Query: query, Args: make([]wireValue, len(args))}
+	for i, arg := range args {
+		w, err := toWire(arg)
+		if err != nil {
+			return req, err
+		}
+		req.Args[i] = w
+	}
+
+	return req, nil
+}
+
+// Statements aren't prepared on the remote end, since each is sent whole
+// anyway
+type sshStmt struct {
+	conn  *sshConn
+	query string
+}
+
+func (s *sshStmt) Close() error {
+	return nil
+}
+
+func (s *sshStmt) NumInput() int {
+	return -1
+}
+
+func (s *sshStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(s.query, args)
+}
+
+func (s *sshStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(s.query, args)
+}
+
+type sshTx struct {
+	conn *sshConn
+}
+
+func (t *sshTx) Commit() error {
+	_, err := t.conn.roundTrip(remoteRequest{Op: "commit"})
+	return err
+}
+
+func (t *sshTx) Rollback() error {
+	_, err := t.conn.roundTrip(remoteRequest{Op: "rollback"})
+	return err
+}
+
+type sshResult struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func (r sshResult) LastInsertId() (int64, error) {
+	return r.lastInsertId, nil
+}
+
+func (r sshResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type sshRows struct {
+	conn     *sshConn
+	columns  []string
+	buffered [][]wireValue
+	done     bool
+	err      error
+}
+
+func (r *sshRows) Columns() []string {
+	return r.columns
+}
+
+// Reads the next row off the connection
+func (r *sshRows) read() ([]wireValue, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	resp, err := r.conn.receive()
+	if err != nil || resp.End {
+		r.done = true
+		r.conn.rows = nil
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	return resp.Row, nil
+}
+
+// Reads the rest of the rows into memory, so the connection is free for the
+// next statement
+func (r *sshRows) buffer() error {
+	for !r.done {
+		row, err := r.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.err = err
+			break
+		}
+		r.buffered = append(r.buffered, row)
+	}
+
+	if r.err != nil && r.conn.broken {
+		return r.err
+	}
+
+	return nil
+}
+
+func (r *sshRows) Next(dest []driver.Value) error {
+	var row []wireValue
+	if len(r.buffered) > 0 {
+		row, r.buffered = r.buffered[0], r.buffered[1:]
+	} else if r.err != nil {
+		return r.err
+	} else {
+		var err error
+		row, err = r.read()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range dest {
+		dest[i] = row[i].value()
+	}
+
+	return nil
+}
+
+// Rows left unread still have to be read off the connection
+func (r *sshRows) Close() error {
+	for !r.done {
+		_, err := r.read()
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	r.buffered = nil
+
+	return nil
+}
+
+// The remote end of an ssh:// catalog: runs the statements read from r against
+// the catalog the options name, writing what they return to w, until r is
+// closed. The catalog isn't migrated here; the leibniz on the other end does
+// that through the connection, the same way it would for a local catalog.
+func ServeRemote(options *Options, r io.Reader, w io.Writer) error {
+	options.CatalogPath = expandHome(options.CatalogPath)
+
+	dsn, err := catalogDSN(options)
+	if err != nil {
+		return err
+	}
+
+	if options.ReadOnly {
+		_, err = os.Stat(options.CatalogPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Transactions belong to a connection, so everything goes through one
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	out := bufio.NewWriter(w)
+	s := &remoteServer{conn: conn, enc: json.NewEncoder(out)}
+	defer func() {
+		if s.tx != nil {
+			s.tx.Rollback()
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var req remoteRequest
+		err = dec.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.handle(ctx, &req)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type remoteServer struct {
+	conn *sql.Conn
+	tx   *sql.Tx
+	enc  *json.Encoder
+}
+
+type execQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *remoteServer) queryer() execQueryer {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.conn
+}
+
+// Answers a request. Errors from SQLite go back to the other end; only a
+// failure to write the answer is returned.
+func (s *remoteServer) handle(ctx context.Context, req *remoteRequest) error {
+	args := make([]interface{}, len(req.Args))
+	for i, arg := range req.Args {
+		args[i] = arg.value()
+	}
+
+	var err error
+	switch req.Op {
+	case "begin":
+		if s.tx != nil {
+			err = fmt.Errorf("a transaction is already open")
+		} else {
+			s.tx, err = s.conn.BeginTx(ctx, nil)
+		}
+	case "commit", "rollback":
+		if s.tx == nil {
+			err = fmt.Errorf("no transaction is open")
+			break
+		}
+		if req.Op == "commit" {
+			err = s.tx.Commit()
+		} else {
+			err = s.tx.Rollback()
+		}
+		s.tx = nil
+	case "exec":
+		var res sql.Result
+		res, err = s.queryer().ExecContext(ctx, req.Query, args...)
+		if err == nil {
+			resp := remoteResponse{}
+			resp.LastInsertId, _ = res.LastInsertId()
+			resp.RowsAffected, _ = res.RowsAffected()
+			return s.enc.Encode(resp)
+		}
+	case "query":
+		return s.query(ctx, req.Query, args)
+	default:
+		err = fmt.Errorf("unknown request %q", req.Op)
+	}
+
+	return s.reply(err)
+}
+
+func (s *remoteServer) reply(err error) error {
+	if err != nil {
+		return s.enc.Encode(remoteResponse{Error: err.Error()})
+	}
+
+	return s.enc.Encode(remoteResponse{})
+}
+
+func (s *remoteServer) query(ctx context.Context, query string, args []interface{}) error {
+	rows, err := s.queryer().QueryContext(ctx, query, args...)
+	if err != nil {
+		return s.reply(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return s.reply(err)
+	}
+
+	err = s.enc.Encode(remoteResponse{Columns: columns})
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return s.reply(err)
+		}
+
+		row := make([]wireValue, len(values))
+		for i, v := range values {
+			row[i], err = toWire(v)
+			if err != nil {
+				return s.reply(err)
+			}
+		}
+
+		err = s.enc.Encode(remoteResponse{Row: row})
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return s.reply(err)
+	}
+
+	return s.enc.Encode(remoteResponse{End: true})
+}
@@ -0,0 +1,87 @@
+package leibniz
+
+import (
+	"net/url"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoteDSN(t *testing.T) {
+	tests := []struct {
+		catalog string
+		ssh     []string // The arguments to ssh, or nil if the catalog is refused
+	}{
+		{"ssh://host/srv/catalog", []string{"--", "host", "'leibniz' 'remote' '-catalog' '/srv/catalog' '-journal-mode' 'wal' '-synchronous' 'normal' '-cache-size' '64'"}},
+		{"ssh://me@host:2222/~/catalog", []string{"-p", "2222", "--", "me@host", "'leibniz' 'remote' '-catalog' '~/catalog' '-journal-mode' 'wal' '-synchronous' 'normal' '-cache-size' '64'"}},
+		{"ssh://[::1]/c?leibniz=/opt/bin/leibniz", []string{"--", "::1", "'/opt/bin/leibniz' 'remote' '-catalog' '/c' '-journal-mode' 'wal' '-synchronous' 'normal' '-cache-size' '64'"}},
+		{"ssh://host/it's%20here?leibniz=$(reboot)", []string{"--", "host", `'$(reboot)' 'remote' '-catalog' '/it'\''s here' '-journal-mode' 'wal' '-synchronous' 'normal' '-cache-size' '64'`}},
+		{"ssh://host/c;reboot", []string{"--", "host", "'leibniz' 'remote' '-catalog' '/c;reboot' '-journal-mode' 'wal' '-synchronous' 'normal' '-cache-size' '64'"}},
+		{"ssh://host", nil},
+		{"ssh://host/", nil},
+		{"ssh:///catalog", nil},
+		{"ssh://host:port/catalog", nil},
+		{"ssh://-host/catalog", nil},
+		{"ssh://-oProxyCommand=x/catalog", nil},
+		{"ssh://-host:22/catalog", nil},
+		{"ssh://-oProxyCommand=touch%20pwned/catalog", nil},
+		{"ssh://-oProxyCommand=touch pwned/catalog", nil},
+		{"ssh://[-oProxyCommand=x]/catalog", nil},
+		{"ssh://-oProxyCommand=x@host/catalog", nil},
+		{"ssh://-x:y@host/catalog", nil},
+		{"ssh://host%00/catalog", nil},
+	}
+
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.CatalogPath = test.catalog
+		dsn, err := remoteDSN(opts, "wal", "normal")
+		if test.ssh == nil {
+			if err == nil {
+				t.Errorf("%q was taken, as %s", test.catalog, dsn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.catalog, err)
+			continue
+		}
+
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Errorf("%q: the DSN %q doesn't parse: %s", test.catalog, dsn, err)
+			continue
+		}
+		if args := sshArgs(u); !reflect.DeepEqual(args, test.ssh) {
+			t.Errorf("%q: ssh %q, want %q", test.catalog, args, test.ssh)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to quote for")
+	}
+
+	args := []string{"", "plain", "it's", "''", `\'`, "$(touch pwned)", "`touch pwned`", "a b\tc", "x\ny", "*", "~", "-n", `"$HOME"`, "!!", "a;b|c&d"}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	// sh prints back each argument it takes the quoted ones for, ending each
+	// with a NUL so that newlines in them show
+	script := "set -- " + strings.Join(quoted, " ") + "\n" + `for a in "$@"; do printf '%s\0' "$a"; done`
+	sh := exec.Command("sh", "-c", script)
+	sh.Dir = t.TempDir()
+	out, err := sh.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("sh took the quoted arguments as %q, want %q", got, args)
+	}
+}
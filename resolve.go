@@ -0,0 +1,233 @@
+package leibniz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var resolveHelp = `  k N...   keep copies
+  r N...   remove copies
+  l N...   replace copies with hard links to the first copy kept
+  o N      keep only this copy and remove the rest
+  i N      show a copy as it is on disk now
+  n        next set (or just enter)
+  p        previous set
+  q        write the script and quit
+`
+
+// Walks through the sets of duplicates one at a time on ui, reading commands
+// from in that mark each copy to be kept, removed or replaced with a hard link
+// to the kept copy. Sets start out resolved by policy, or with every copy kept
+// if it is nil. On q or at the end of in, writes the script carrying out the
+// marks, as EmitDupesScript does, so nothing changes until it is run.
+func (c *Catalog) ResolveDupes(scope DupeScope, policy *KeepPolicy, remove string, in io.Reader, ui io.Writer) error {
+	err := c.checkKeepRoot(policy)
+	if err != nil {
+		return err
+	}
+
+	groups, err := c.ScopedDupes(scope)
+	if err != nil {
+		return err
+	}
+
+	if len(groups) == 0 {
+		fmt.Fprintf(ui, "No duplicates %s\n", scope)
+		return nil
+	}
+
+	resolutions := make([]*Resolution, len(groups))
+	for i, g := range groups {
+		if policy != nil {
+			resolutions[i] = policy.resolve(g)
+		} else {
+			resolutions[i] = keepAll(g)
+		}
+	}
+
+	lines := bufio.NewScanner(in)
+	cur := 0
+	show := true
+	for {
+		r := resolutions[cur]
+		if show {
+			showResolution(ui, c.Out, r, cur, len(resolutions))
+		}
+		show = true
+
+		fmt.Fprintf(ui, "[%d/%d] k, r, l, o, i, n, p, q or ? > ", cur+1, len(resolutions))
+		if !lines.Scan() {
+			fmt.Fprintln(ui)
+			break
+		}
+
+		args := strings.Fields(lines.Text())
+		if len(args) == 0 {
+			args = []string{"n"}
+		}
+
+		copies, err := parseCopies(args[1:], len(r.Group.Paths))
+		if err != nil {
+			fmt.Fprintf(ui, "%s\n", err)
+			show = false
+			continue
+		}
+
+		switch args[0] {
+		case "n":
+			if cur == len(resolutions)-1 {
+				fmt.Fprintf(ui, "That was the last set, q writes the script\n")
+				show = false
+				continue
+			}
+			cur++
+		case "p":
+			if cur > 0 {
+				cur--
+			}
+		case "k", "r":
+			action := map[string]string{"k": ActionKeep, "r": ActionRemove}[args[0]]
+			for _, i := range copies {
+				r.Actions[i] = action
+			}
+		case "l":
+			for _, i := range copies {
+				r.Actions[i] = ActionLink
+			}
+
+			if msg := r.checkLinks(); msg != "" {
+				for _, i := range copies {
+					r.Actions[i] = ActionKeep
+				}
+				fmt.Fprintf(ui, "%s\n", msg)
+				show = false
+			}
+		case "o":
+			if len(copies) != 1 {
+				fmt.Fprintf(ui, "o takes one copy\n")
+				show = false
+				continue
+			}
+
+			for i := range r.Actions {
+				r.Actions[i] = ActionRemove
+			}
+			r.Actions[copies[0]] = ActionKeep
+		case "i":
+			for _, i := range copies {
+				showCopy(ui, c.Out, r.Group, i)
+			}
+			show = false
+		case "q":
+			return writeDupesScript(c.Out, "-interactive", resolutions, remove)
+		default:
+			fmt.Fprint(ui, resolveHelp)
+			show = false
+		}
+	}
+
+	if err = lines.Err(); err != nil {
+		return err
+	}
+
+	return writeDupesScript(c.Out, "-interactive", resolutions, remove)
+}
+
+// Parses the 1-based copy numbers given to a command
+func parseCopies(args []string, n int) ([]int, error) {
+	copies := make([]int, 0, len(args))
+	for _, arg := range args {
+		i, err := strconv.Atoi(arg)
+		if err != nil || i < 1 || i > n {
+			return nil, fmt.Errorf("%q isn't a copy between 1 and %d", arg, n)
+		}
+		copies = append(copies, i-1)
+	}
+
+	return copies, nil
+}
+
+// Why the copies marked to be linked can't be, or "" if they can. Hard links
+// can't cross filesystems, and need a kept copy to point at.
+func (r *Resolution) checkLinks() string {
+	keep := r.kept()
+	if keep < 0 {
+		return "keep a copy to link to first"
+	}
+
+	g := r.Group
+	for i, action := range r.Actions {
+		if action != ActionLink {
+			continue
+		}
+
+		if IsS3Root(g.Paths[i]) || IsS3Root(g.Paths[keep]) {
+			return "objects in buckets can't be hard linked"
+		}
+		if _, _, ok := SplitArchivePath(g.Paths[i]); ok {
+			return "files inside archives can't be hard linked"
+		}
+		if g.ids[i].dev != 0 && g.ids[keep].dev != 0 && g.ids[i].dev != g.ids[keep].dev {
+			return fmt.Sprintf("%s isn't on the same filesystem as %s", g.Paths[i], g.Paths[keep])
+		}
+	}
+
+	return ""
+}
+
+func showResolution(w io.Writer, o *Output, r *Resolution, n, total int) {
+	g := r.Group
+	fmt.Fprintf(w, "\nSet %d of %d: %s (%s), %d copies of %s, %s wasted\n", n+1, total, g.Hash, g.Algo, len(g.Paths), o.Size(g.Size), o.Size(g.Wasted()))
+
+	keep := r.kept()
+	for i, p := range g.Paths {
+		action := r.Actions[i]
+		if action == ActionLink && keep >= 0 {
+			action = fmt.Sprintf("link to %d", keep+1)
+		}
+
+		// Hard links to a copy listed before
+		same := ""
+		for j := 0; j < i; j++ {
+			if g.ids[i] != (inodeKey{}) && g.ids[i] == g.ids[j] {
+				same = fmt.Sprintf(" (hard link of %d)", j+1)
+				break
+			}
+		}
+
+		fmt.Fprintf(w, "  %2d  %-10s %s  %s%s\n", i+1, action, o.Time(g.mtimes[i]), p, same)
+	}
+}
+
+// Shows a copy as it is on disk, and whether it changed since it was cataloged
+func showCopy(w io.Writer, o *Output, g *DupeGroup, i int) {
+	p := g.Paths[i]
+	fmt.Fprintf(w, "%s\n  root      %s\n  cataloged %s, modified %s\n", p, g.Roots[i], o.Size(g.Size), o.Time(g.mtimes[i]))
+
+	info, err := lstatCataloged(p)
+	if err != nil {
+		fmt.Fprintf(w, "  on disk   %s\n", err)
+		return
+	}
+	if info == nil {
+		return
+	}
+
+	if _, _, ok := SplitArchivePath(p); ok {
+		fmt.Fprintf(w, "  archive   %s, modified %s\n", o.Size(info.Size()), o.Time(info.ModTime()))
+		return
+	}
+
+	changed := ""
+	if info.Size() != g.Size || !info.ModTime().Equal(g.mtimes[i]) {
+		changed = ", changed since it was cataloged"
+	}
+	fmt.Fprintf(w, "  on disk   %s, modified %s, %s%s\n", o.Size(info.Size()), o.Time(info.ModTime()), info.Mode(), changed)
+
+	if _, _, nlink, ok := fileId(info); ok && nlink > 1 {
+		fmt.Fprintf(w, "  links     %d\n", nlink)
+	}
+}
@@ -0,0 +1,165 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Re-points the root at old, and any roots under it, to new, along with the
+// paths of everything cataloged under them, for a directory that was renamed
+// or a drive that mounts somewhere else now. The hashes stay, so the next
+// incremental scan only reads what changed. Returns how many files were
+// re-pointed.
+func (c *Catalog) RenameRoot(old, new string) (int64, error) {
+	var rootId int64
+	err := c.Db.QueryRow(`select id from roots where root=?`, old).Scan(&rootId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s is not a root in this catalog", old)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var taken int
+	err = c.Db.QueryRow(`select count(*) from roots where root=?`, new).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, fmt.Errorf("%s is already a root in this catalog", new)
+	}
+
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`update roots set root=? where id=?`, new, rootId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// Everything else is rewritten by prefix, which has to end at a directory
+	// so /data doesn't take /database with it
+	prefix := dirPrefix(old)
+	newPrefix := dirPrefix(new)
+	var moved int64
+	for _, column := range []string{"roots.root", "files.path", "links.path", "errors.path", "file_history.path", "dirs.path"} {
+		table, col, _ := strings.Cut(column, ".")
+		res, err := tx.Exec(fmt.Sprintf(`update %s set %s = ? || substr(%s, length(?) + 1) where substr(%s, 1, length(?)) = ?`, table, col, col, col),
+			newPrefix, prefix, prefix, prefix)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		if table == "files" {
+			moved, err = res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+
+	return moved, tx.Commit()
+}
+
+// A root in detail: what it holds, its scans, and what its last scan couldn't
+// read
+type RootInfo struct {
+	RootStats
+	FirstScan *Scan // Nil if it was never scanned
+	Errors    int64 // Recorded by the last scan
+	Links     int64 // Symbolic links recorded by -symlinks record
+}
+
+// Looks up what root holds, the space deduplicating the copies within it
+// would free, and its scans
+func (c *Catalog) RootInfo(root string) (*RootInfo, error) {
+	roots, err := c.RootsStats()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &RootInfo{}
+	for _, r := range roots {
+		if r.Root == root {
+			info.RootStats = *r
+		}
+	}
+	if info.Root == "" {
+		return nil, fmt.Errorf("%s is not a root in this catalog", root)
+	}
+
+	groups, err := c.ScopedDupes(DupeScope{WithinRoot: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Roots[0] == root {
+			info.Reclaimable += g.Wasted()
+		}
+	}
+
+	scans, err := c.Scans(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(scans) > 0 {
+		info.FirstScan = scans[0]
+		err = c.Db.QueryRow(`select count(*) from errors where scan_id=?`, info.LastScan.Id).Scan(&info.Errors)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.Db.QueryRow(`
+		select count(distinct l.path) from links l
+		join roots r on r.id = l.root_id
+		where r.root = ?
+		`, root).Scan(&info.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Prints each root with its files, size and when it was last scanned
+func (c *Catalog) ReportRoots(roots []*RootStats) {
+	for _, r := range roots {
+		fields := Fields{"root": r.Root, "files": r.Files, "bytes": r.Bytes, "scans": r.Scans}
+		if r.LastScan != nil {
+			fields["last_scan"] = r.LastScan.Fields()
+		}
+
+		c.Out.Print("root", fields, "%s: %d files, %s, %s\n", r.Root, r.Files, c.Out.Size(r.Bytes), r.lastScanned(c.Out))
+	}
+}
+
+// Prints a root's details, one to a line
+func (c *Catalog) ReportRootInfo(info *RootInfo) {
+	fields := Fields{
+		"root":        info.Root,
+		"files":       info.Files,
+		"bytes":       info.Bytes,
+		"hashes":      info.Hashes,
+		"reclaimable": info.Reclaimable,
+		"scans":       info.Scans,
+		"errors":      info.Errors,
+		"links":       info.Links,
+	}
+
+	scans := fmt.Sprintf("%d", info.Scans)
+	if info.FirstScan != nil {
+		fields["first_scan"] = info.FirstScan.Fields()
+		fields["last_scan"] = info.LastScan.Fields()
+		scans += ", first " + c.Out.Time(info.FirstScan.Started) + ", " + info.lastScanned(c.Out)
+	}
+
+	c.Out.Print("root-info", fields, "%s\n  files        %d, %s, %d distinct contents\n  reclaimable  %s within it\n  scans        %s\n  errors       %d in the last scan\n  links        %d\n",
+		info.Root, info.Files, c.Out.Size(info.Bytes), info.Hashes, c.Out.Size(info.Reclaimable), scans, info.Errors, info.Links)
+}
@@ -0,0 +1,554 @@
+package leibniz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roots like s3://bucket/prefix are buckets in S3 or a service compatible with
+// it, like MinIO. Objects are cataloged as s3://bucket/key. Credentials,
+// region and endpoint come from the usual AWS environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION and
+// AWS_ENDPOINT_URL. Without credentials, requests are anonymous.
+const s3Scheme = "s3://"
+
+// Whether root names a bucket rather than a directory
+func IsS3Root(root string) bool {
+	return strings.HasPrefix(root, s3Scheme)
+}
+
+// Splits s3://bucket/key into the bucket and the key
+func splitS3Path(p string) (bucket, key string, err error) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(p, s3Scheme), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("bad S3 path %q, expected s3://bucket/prefix", p)
+	}
+
+	return bucket, key, nil
+}
+
+type s3Client struct {
+	endpoint *url.URL
+	region   string
+	key      string
+	secret   string
+	token    string
+}
+
+func newS3Client() (*s3Client, error) {
+	s := &s3Client{
+		region: os.Getenv("AWS_REGION"),
+		key:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad S3 endpoint %q: %s", endpoint, err)
+	}
+
+	return s, nil
+}
+
+// Escapes a path or query value the way AWS signatures expect, which is
+// stricter than net/url
+func awsEscape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// The SHA-256 of an empty body, which is all the requests here send
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Makes a request for an object, or for the bucket if key is empty, in path
+// style so it works with services other than AWS. Requests are signed with
+// AWS Signature Version 4 when there are credentials.
+func (s *s3Client) do(method, bucket, key string, query url.Values, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, bucket) + "/" + key
+	u.RawPath = awsEscape(u.Path, true)
+
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, awsEscape(name, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(params)
+	u.RawQuery = strings.Join(params, "&")
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if s.key != "" {
+		s.sign(req, u.RawPath, u.RawQuery)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+
+	return resp, nil
+}
+
+func (s *s3Client) sign(req *http.Request, escapedPath, escapedQuery string) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, escapedPath, escapedQuery, canonicalHeaders.String(), signedHeaders, emptySHA256}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// The error S3 answered with, from its XML body when there is one
+func s3Error(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("%s: %s", body.Code, body.Message)
+	}
+
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+}
+
+// An object as a listing describes it
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+}
+
+// Calls fn with every object whose key starts with prefix, in key order
+func (s *s3Client) list(bucket, prefix string, fn func(*s3Object) error) error {
+	query := url.Values{"list-type": {"2"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+
+	for {
+		resp, err := s.do("GET", bucket, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents              []*s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range result.Contents {
+			err = fn(obj)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Looks an object up without reading it
+func (s *s3Client) head(bucket, key string) (*s3Object, error) {
+	resp, err := s.do("HEAD", bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{Key: key, LastModified: modified, ETag: resp.Header.Get("ETag"), Size: resp.ContentLength}, nil
+}
+
+// The MD5 of the object's contents, if its ETag is one. Objects uploaded in
+// parts, or encrypted with KMS keys, have other ETags.
+func (o *s3Object) md5() (string, bool) {
+	etag := strings.Trim(o.ETag, `"`)
+	if len(etag) != 32 || strings.ContainsRune(etag, '-') {
+		return "", false
+	}
+
+	if _, err := hex.DecodeString(etag); err != nil {
+		return "", false
+	}
+
+	return strings.ToLower(etag), true
+}
+
+// An object as os.FileInfo, for the hashers
+type s3Info struct {
+	obj *s3Object
+}
+
+func (i s3Info) Name() string       { return path.Base(i.obj.Key) }
+func (i s3Info) Size() int64        { return i.obj.Size }
+func (i s3Info) Mode() os.FileMode  { return 0444 }
+func (i s3Info) ModTime() time.Time { return i.obj.LastModified }
+func (i s3Info) IsDir() bool        { return false }
+func (i s3Info) Sys() interface{}   { return nil }
+
+// Reads far enough ahead of reads that follow on from the last one to make a
+// request worth it
+const s3ReadAhead = 8 << 20
+
+// Reads an object with ranged GETs. Reads that carry on where the last one
+// ended fetch s3ReadAhead at a time, so whole-file hashes take few requests,
+// while the sampled hash's scattered reads only fetch what they need.
+type s3Reader struct {
+	client *s3Client
+	bucket string
+	obj    *s3Object
+	buf    []byte
+	bufOff int64
+}
+
+func (r *s3Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.obj.Size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < r.obj.Size {
+		if off < r.bufOff || off >= r.bufOff+int64(len(r.buf)) {
+			want := int64(len(p) - n)
+			if off == r.bufOff+int64(len(r.buf)) && want < s3ReadAhead {
+				want = s3ReadAhead
+			}
+			if off+want > r.obj.Size {
+				want = r.obj.Size - off
+			}
+
+			err := r.fetch(off, want)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(p[n:], r.buf[off-r.bufOff:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (r *s3Reader) fetch(off, size int64) error {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+size-1)}}
+	resp, err := r.client.do("GET", r.bucket, r.obj.Key, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(resp.Body, buf)
+	if err != nil {
+		return err
+	}
+
+	r.buf, r.bufOff = buf, off
+	return nil
+}
+
+// Catalogs every object under an s3:// root
+func (c *Catalog) walkS3(rootId int64, root string) error {
+	bucket, prefix, err := splitS3Path(root)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	client, err := newS3Client()
+	if err != nil {
+		return err
+	}
+
+	// The objects found, when enumerating, with their URLs as their contexts
+	objects := make([]WalkerContext, 0)
+
+	err = client.list(bucket, prefix, func(obj *s3Object) error {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		// Keys ending in / are the empty objects consoles make for folders
+		if strings.HasSuffix(obj.Key, "/") {
+			return nil
+		}
+
+		// Keys have no directories, but their slashes stand in for them
+		if c.Opts.MaxDepth > 0 && strings.Count(strings.TrimPrefix(obj.Key, prefix), "/") >= c.Opts.MaxDepth {
+			return nil
+		}
+
+		realpath := s3Scheme + bucket + "/" + obj.Key
+		info := s3Info{obj}
+		if c.Opts.Excludes.Match(realpath) || !c.walkable(info, realpath) {
+			c.Out.Verbosity("excluded", Fields{"path": realpath}, "Skipping %s\n", realpath)
+			c.Stats.Excluded++
+			return nil
+		}
+		c.Stats.discovered(obj.Size)
+
+		if c.enumerating() {
+			objects = append(objects, WalkerContext{info, realpath})
+			c.showProgress(false)
+			return nil
+		}
+
+		return c.walkObject(rootId, client, bucket, realpath, obj)
+	})
+	if err != nil || !c.enumerating() {
+		return err
+	}
+
+	return c.walkEnumerated(objects, func(o WalkerContext) error {
+		return c.walkObject(rootId, client, bucket, o.Context, o.Info.(s3Info).obj)
+	})
+}
+
+func (c *Catalog) walkObject(rootId int64, client *s3Client, bucket, realpath string, obj *s3Object) error {
+	if c.limitReached(obj.Size) {
+		return ErrLimitReached
+	}
+
+	c.waitForLoad()
+	err := c.catalogObject(rootId, client, bucket, realpath, obj)
+	c.showProgress(false)
+
+	return err
+}
+
+func (c *Catalog) catalogObject(rootId int64, client *s3Client, bucket, realpath string, obj *s3Object) error {
+	info := s3Info{obj}
+	if c.Opts.Incremental {
+		unchanged, err := c.Unchanged(rootId, realpath, obj.LastModified, obj.Size)
+		if err != nil {
+			return err
+		}
+
+		if unchanged {
+			c.Out.Verbosity("unchanged", Fields{"path": realpath}, "Unchanged %s\n", realpath)
+			c.Stats.done(&c.Stats.Unchanged, obj.Size)
+			if c.Opts.DryRun {
+				return nil
+			}
+			return c.Seen(rootId, realpath, obj.Size)
+		}
+	}
+
+	r := &s3Reader{client: client, bucket: bucket, obj: obj}
+
+	var mime string
+	var err error
+	if len(c.Opts.Types) > 0 {
+		mime, err = SniffType(r)
+		if err != nil {
+			c.Stats.DoneBytes += obj.Size
+			return c.recordError(rootId, realpath, "read", err)
+		}
+
+		if !c.typeWanted(mime) {
+			c.Out.Verbosity("excluded", Fields{"path": realpath, "size": obj.Size, "type": mime}, "Skipping %s (%s)\n", realpath, mime)
+			c.Stats.done(&c.Stats.Excluded, obj.Size)
+			return nil
+		}
+	}
+
+	if c.Opts.DryRun {
+		c.wouldCatalog(realpath, obj.Size)
+		return nil
+	}
+
+	// An MD5 ETag saves reading the object at all
+	var hashes map[string]string
+	if sum, ok := obj.md5(); ok && c.Opts.S3ETags && c.Opts.Hash == "md5" && len(c.extraHashes()) == 0 {
+		hashes = map[string]string{"md5": sum}
+	} else {
+		c.Out.Event("hashing", Fields{"path": realpath, "size": obj.Size})
+		hashes, err = HashAll(append([]string{c.Opts.Hash}, c.extraHashes()...), c.hashReader(r), info)
+		if err == ErrInterrupted {
+			return err
+		}
+		if err != nil {
+			c.Stats.DoneBytes += obj.Size
+			return c.recordError(rootId, realpath, "read", err)
+		}
+
+		if mime == "" {
+			mime, _ = SniffType(r)
+		}
+	}
+
+	hash := hashes[c.Opts.Hash]
+	_, err = c.CatalogHash(rootId, &Entry{Path: realpath, Algo: c.Opts.Hash, Hash: hash, Mtime: obj.LastModified, Size: obj.Size, Hashes: hashes, Mime: mime, OnDisk: -1})
+	if err != nil {
+		return err
+	}
+
+	c.Out.Verbosity("cataloged", Fields{"path": realpath, "algo": c.Opts.Hash, "hash": hash}, "Cataloged %s: %s\n", realpath, hash)
+	c.Stats.done(&c.Stats.Hashed, obj.Size)
+	c.Stats.HashedBytes += obj.Size
+
+	return nil
+}
+
+// Rehashes an object for verify
+func rehashObject(algo, p string) (string, time.Time, error) {
+	bucket, key, err := splitS3Path(p)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	client, err := newS3Client()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	obj, err := client.head(bucket, key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	hash, err := HashContent(algo, &s3Reader{client: client, bucket: bucket, obj: obj}, s3Info{obj})
+
+	return hash, obj.LastModified, err
+}
+
+// Checks that an S3 root can be listed, before a scan starts
+func CheckS3Root(root string) error {
+	bucket, prefix, err := splitS3Path(root)
+	if err != nil {
+		return err
+	}
+
+	client, err := newS3Client()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.do("GET", bucket, "", url.Values{"list-type": {"2"}, "max-keys": {strconv.Itoa(1)}, "prefix": {prefix}}, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s", root, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
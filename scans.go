@@ -0,0 +1,176 @@
+package leibniz
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Every scan of a root is recorded in the scans table, and each file row
+// carries the ids of the scan that cataloged it and the last scan that saw it.
+type Scan struct {
+	Id       int64
+	Root     string
+	Started  time.Time
+	Finished time.Time // Zero if the scan never finished
+	Files    int64
+}
+
+// The scan as the fields of a "scan" event, leaving out finished if it never did
+func (s *Scan) Fields() Fields {
+	fields := Fields{"id": s.Id, "root": s.Root, "started": s.Started, "files": s.Files}
+	if !s.Finished.IsZero() {
+		fields["finished"] = s.Finished
+	}
+
+	return fields
+}
+
+var seenStmt string = `update files set scan_id=?, size=coalesce(size, ?) where root_id=? and path=?`
+
+type scan struct {
+	id     int64
+	rootId int64
+	files  int64
+}
+
+func (c *Catalog) startScan(rootId int64) error {
+	res, err := c.Db.Exec(`insert into scans (root_id, started) values (?, ?)`, rootId, time.Now())
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	c.scan = &scan{id, rootId, 0}
+	c.Stats = NewScanStats()
+	c.walkedDirs = nil
+	c.inodes = nil
+	c.fastDirs = false
+	c.dirStates = nil
+
+	return nil
+}
+
+func (c *Catalog) finishScan() error {
+	if c.scan == nil {
+		return nil
+	}
+
+	_, err := c.Db.Exec(`update scans set finished=?, files=? where id=?`, time.Now(), c.scan.files, c.scan.id)
+
+	return err
+}
+
+// The id of the scan in progress, or nil outside of one
+func (c *Catalog) scanId() interface{} {
+	if c.scan == nil {
+		return nil
+	}
+
+	return c.scan.id
+}
+
+func (c *Catalog) sawFile() {
+	if c.scan != nil {
+		c.scan.files++
+	}
+}
+
+// Tags the rows for a file that is already cataloged with the scan in
+// progress, filling in its size if they predate the size column
+func (c *Catalog) Seen(rootId int64, path string, size int64) error {
+	if c.scan == nil {
+		return nil
+	}
+
+	var err error
+	if c.batch != nil {
+		_, err = c.batch.seen.Exec(c.scan.id, size, rootId, path)
+	} else {
+		_, err = c.Db.Exec(seenStmt, c.scan.id, size, rootId, path)
+	}
+	if err != nil {
+		return err
+	}
+	c.sawFile()
+
+	if c.batch != nil {
+		c.batch.pending++
+		return c.flush()
+	}
+
+	return nil
+}
+
+// Lists the scans of root, or of every root if it is empty, oldest first
+func (c *Catalog) Scans(root string) ([]*Scan, error) {
+	rows, err := c.Db.Query(`
+		select s.id, r.root, s.started, s.finished, s.files from scans s
+		join roots r on r.id = s.root_id
+		where ? = '' or r.root = ?
+		order by s.id
+		`, root, root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scans := make([]*Scan, 0)
+	for rows.Next() {
+		s := &Scan{}
+		var finished sql.NullTime
+		var files sql.NullInt64
+		err = rows.Scan(&s.Id, &s.Root, &s.Started, &finished, &files)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Finished = finished.Time
+		s.Files = files.Int64
+		scans = append(scans, s)
+	}
+
+	return scans, rows.Err()
+}
+
+// Removes every file cataloged under root (or under any root, if root is
+// empty) that the root's last finished scan didn't see, calling fn with each
+// path removed. Scans are ordered by when they started, since sync can copy
+// in older ones after newer. Unlike Prune this never touches the filesystem,
+// but it also drops files that still exist and were only excluded from that
+// scan.
+func (c *Catalog) PruneUnseen(root string, fn func(path string)) (int64, error) {
+	rows, err := c.Db.Query(`
+		select distinct f.root_id, f.path from files f
+		join roots r on r.id = f.root_id
+		join (select root_id, max(julianday(started)) as started from scans where finished is not null group by root_id) last
+		on last.root_id = f.root_id
+		left join scans s on s.id = f.scan_id
+		where (? = '' or r.root = ?) and (s.id is null or julianday(s.started) < last.started)
+		`, root, root)
+	if err != nil {
+		return 0, err
+	}
+
+	unseen := make([]prunable, 0)
+	for rows.Next() {
+		var p prunable
+		err = rows.Scan(&p.rootId, &p.path)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		unseen = append(unseen, p)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.deletePaths(unseen, fn)
+}
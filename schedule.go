@@ -0,0 +1,173 @@
+package leibniz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the daemon scans next
+type Schedule interface {
+	// The first time after t to scan
+	Next(t time.Time) time.Time
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// A schedule that scans every d
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+// A cron schedule: the minutes, hours, days of the month, months and
+// weekdays it fires on
+type cronSchedule struct {
+	minute, hour, dom, month, dow [64]bool
+
+	// Whether the days of the month or of the week were restricted, since a
+	// day then matches when either of them does, as in cron
+	domAny, dowAny bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// Parses a five field cron spec, like "30 3 * * 1-5" for 3:30 on weekdays.
+// Fields take *, numbers, ranges, lists and steps like */15; weekdays run
+// from 0 for Sunday to 6, and 7 is Sunday too. @hourly, @daily, @weekly,
+// @monthly and @yearly are accepted as well.
+func ParseCron(spec string) (Schedule, error) {
+	if expanded, ok := cronShorthands[strings.TrimSpace(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q should have 5 fields, not %d", spec, len(fields))
+	}
+
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	ranges := []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+
+	for i, field := range fields {
+		r := ranges[i]
+		err := parseCronField(field, r.set, r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %s", spec, err)
+		}
+	}
+
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+
+	return s, nil
+}
+
+func parseCronField(field string, set *[64]bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			// A step past max could only ever take the first value, and
+			// a huge one would overflow stepping through the range
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 || n > max {
+				return fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err == nil {
+				hi, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil {
+				return fmt.Errorf("bad range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return fmt.Errorf("bad value %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+
+	return nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Steps forward a month, day, hour or minute at a time, whichever the first
+// field that doesn't match allows. Specs that can never fire, like 0 0 31 2 *,
+// give up after a few years and return the zero time.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,90 @@
+package leibniz
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// A Friday
+	start := time.Date(2024, 3, 15, 4, 0, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 4, 1, 0, 0, time.UTC)},
+		{"30 3 * * 1-5", time.Date(2024, 3, 18, 3, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 15, 4, 15, 0, 0, time.UTC)},
+		{"5/20 4 * * *", time.Date(2024, 3, 15, 4, 5, 0, 0, time.UTC)},
+		{"0 0,12 * * *", time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 20 * 6", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 16 * 1", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+		{"  0\t0  1 1 *  ", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 3, 15, 5, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %s", test.spec, err)
+			continue
+		}
+		if next := s.Next(start); !next.Equal(test.next) {
+			t.Errorf("%q fires next at %s, want %s", test.spec, next, test.next)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"", "should have 5 fields, not 0"},
+		{"* * * *", "should have 5 fields, not 4"},
+		{"* * * * * *", "should have 5 fields, not 6"},
+		{"@often", "should have 5 fields, not 1"},
+		{"60 * * * *", `"60" is outside 0-59`},
+		{"* 24 * * *", `"24" is outside 0-23`},
+		{"* * 0 * *", `"0" is outside 1-31`},
+		{"* * * 13 *", `"13" is outside 1-12`},
+		{"* * * * 8", `"8" is outside 0-7`},
+		{"5-1 * * * *", `"5-1" is outside 0-59`},
+		{"-1 * * * *", `bad range "-1"`},
+		{"1-2-3 * * * *", `bad range "1-2-3"`},
+		{"*-5 * * * *", `bad range "*-5"`},
+		{"1,,2 * * * *", `bad value ""`},
+		{"x * * * *", `bad value "x"`},
+		{"99999999999999999999 * * * *", "bad value"},
+		{"*/0 * * * *", `bad step in "*/0"`},
+		{"*/-1 * * * *", `bad step in "*/-1"`},
+		{"*/x * * * *", `bad step in "*/x"`},
+		{"1-59/9223372036854775807 * * * *", "bad step"},
+		{"*/60 * * * *", "bad step"},
+		{"$(reboot) * * * *", "bad value"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseCron(test.spec)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseCron(%q) error = %v, want one containing %q", test.spec, err, test.err)
+		}
+	}
+}
+
+func TestEvery(t *testing.T) {
+	start := time.Date(2024, 3, 15, 4, 0, 30, 0, time.UTC)
+	if next := Every(90 * time.Minute).Next(start); !next.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("every 90m fires next at %s", next)
+	}
+}
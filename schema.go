@@ -0,0 +1,292 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Every change to the catalog's schema is a migration. A catalog records the
+// number of migrations applied to it in its schema_version table, so opening
+// it only has to run the ones after that. New migrations go at the end and
+// existing ones must never change.
+var migrations = [][]string{
+	// 1: the original schema
+	{
+		`create table roots (id integer not null primary key, root text)`,
+		`create table files (id integer not null primary key, root_id integer, hash text, path string, mtime datetime)`,
+	},
+	// 2: hash algorithms other than xxhash
+	{`alter table files add column algo text not null default 'xxhash'`},
+	// 3: scan history
+	{`create table scans (id integer not null primary key, root_id integer, started datetime, finished datetime, files integer)`},
+	{`alter table files add column scan_id integer`},
+	{`alter table files add column first_scan_id integer`},
+	// 6: symlinks recorded by -symlinks record
+	{`create table links (id integer not null primary key, root_id integer, path text, target text, mtime datetime, scan_id integer)`},
+	// 7: hard link awareness
+	{
+		`alter table files add column dev integer`,
+		`alter table files add column inode integer`,
+	},
+	// 8: the error ledger
+	{`create table errors (id integer not null primary key, scan_id integer, root_id integer, path text, op text, kind text, error text, time datetime)`},
+	// 9: file sizes
+	{`alter table files add column size integer`},
+	// 10: hashes by more than one algorithm, which go when their file does
+	{
+		`create table file_hashes (file_id integer not null, algo text not null, hash text not null)`,
+		`create trigger file_hashes_delete after delete on files begin delete from file_hashes where file_id = old.id; end`,
+	},
+	// 11: perceptual hashes of images, for -similarity
+	{`alter table files add column phash text`},
+	// 12: image and video metadata, for -metadata
+	{
+		`create table metadata (file_id integer not null primary key, taken datetime, camera text, width integer, height integer, duration real, codec text)`,
+		`create trigger metadata_delete after delete on files begin delete from metadata where file_id = old.id; end`,
+	},
+	// 13: sniffed content types
+	{`alter table files add column mime text`},
+	// 14: owners, permissions and extended attributes, for -owner and -xattrs
+	{
+		`alter table files add column uid integer`,
+		`alter table files add column gid integer`,
+		`alter table files add column mode integer`,
+		`create table xattrs (file_id integer not null, name text not null, value blob)`,
+		`create trigger xattrs_delete after delete on files begin delete from xattrs where file_id = old.id; end`,
+	},
+	// 15: hashes by device and inode, reused wherever the file turns up again
+	{`create table hash_cache (dev integer not null, inode integer not null, size integer not null, mtime datetime not null, algo text not null, hash text not null)`},
+	// 16: space taken on disk, which sparse files take less of than their size
+	{`alter table files add column allocated integer`},
+	// 17: pairs of files compared byte for byte by -paranoid and dedup
+	{
+		`create table verified_pairs (file_id integer not null, other_id integer not null, time datetime, primary key (file_id, other_id))`,
+		`create trigger verified_pairs_delete after delete on files begin delete from verified_pairs where file_id = old.id or other_id = old.id; end`,
+	},
+	// 18: the volume each root is on, so removable drives are known wherever
+	// they mount
+	{
+		`alter table roots add column volume text`,
+		`alter table roots add column volume_label text`,
+		`alter table roots add column volume_path text`,
+	},
+	// 19: one row a path, updated in place when the file changes. The rows
+	// of earlier versions of changed files go, and what was stored about a
+	// file besides its hash goes when its content does.
+	{
+		`delete from files where id not in (select max(id) from files group by root_id, path)`,
+		`drop index if exists path_idx`,
+		`create unique index path_idx on files (root_id, path)`,
+		createFilesChanged,
+	},
+	// 20: the earlier contents of changed files, kept by -keep-history
+	{`create table file_history (id integer not null primary key, root_id integer not null, path text not null, algo text, hash text, mtime datetime, size integer, first_scan_id integer, scan_id integer, replaced_scan_id integer)`},
+	// 21: mtimes in UTC, which they were written in the zone of the scan
+	// before. Only whole seconds go through strftime, so the fraction is
+	// carried over as it was. The files haven't changed, so files_changed
+	// is kept from dropping what is stored about them.
+	{
+		`drop trigger files_changed`,
+		`update files set mtime = ` + utcMtime + ` where ` + zonedMtime,
+		createFilesChanged,
+		`update file_history set mtime = ` + utcMtime + ` where ` + zonedMtime,
+		`update links set mtime = ` + utcMtime + ` where ` + zonedMtime,
+		`update hash_cache set mtime = ` + utcMtime + ` where ` + zonedMtime,
+	},
+	// 22: digests by the sampled xxhash padded to their full 16 digits, which
+	// were written without leading zeros before. As with 21, the files
+	// haven't changed.
+	{
+		`drop trigger files_changed`,
+		`update files set hash = ` + paddedSampled + ` where ` + shortSampled,
+		createFilesChanged,
+		`update file_history set hash = ` + paddedSampled + ` where ` + shortSampled,
+		`update file_hashes set hash = ` + paddedSampled + ` where ` + shortSampled,
+		`update hash_cache set hash = ` + paddedSampled + ` where ` + shortSampled,
+	},
+	// 23: the mtime and number of entries of each directory a -fast-dirs
+	// scan read, which scans went by them rather than reading everything, and
+	// the filters they scanned with
+	{
+		`create table dirs (root_id integer not null, path text not null, mtime datetime, entries integer, primary key (root_id, path))`,
+		`alter table scans add column fast integer`,
+		`alter table scans add column filters text`,
+	},
+}
+
+// Drops what is stored about a file besides its hash when its content changes
+const createFilesChanged = `create trigger files_changed after update of hash, mtime on files when old.hash is not new.hash or old.mtime is not new.mtime begin
+			delete from file_hashes where file_id = old.id;
+			delete from metadata where file_id = old.id;
+			delete from xattrs where file_id = old.id;
+			delete from verified_pairs where file_id = old.id or other_id = old.id;
+		end`
+
+// An mtime written as 2006-01-02 15:04:05.999999999-07:00 in a zone other
+// than UTC, and the same mtime in UTC
+const (
+	zonedMtime = `mtime like '____-__-__ __:__:__%' and (mtime like '%+__:__' or mtime like '%-__:__') and mtime not like '%+00:00'`
+	utcMtime   = `strftime('%Y-%m-%d %H:%M:%S', mtime) || case when substr(mtime, 20, 1) = '.' then substr(mtime, 20, length(mtime) - 25) else '' end || '+00:00'`
+)
+
+// A digest by the sampled xxhash, whatever its sampling, short of 16 digits,
+// and the same digest padded
+const (
+	shortSampled  = `(algo = 'xxhash' or algo like 'xxhash:%') and length(hash) < 16`
+	paddedSampled = `substr('0000000000000000' || hash, -16)`
+)
+
+// The schema version this build of leibniz creates and understands
+var SchemaVersion = len(migrations)
+
+// Catalogs created before schema_version existed were migrated by running
+// every statement and ignoring the ones they already had, up to this version.
+const unversionedSchema = 9
+
+var createIdxStmt string = `
+	create unique index if not exists unique_root_idx on roots (root);
+	create index if not exists root_idx on files (root_id);
+	create index if not exists hash_idx on files (hash);
+	create unique index if not exists path_idx on files (root_id, path);
+	create index if not exists file_history_path_idx on file_history (path);
+	create index if not exists scan_idx on files (scan_id);
+	create unique index if not exists link_path_idx on links (root_id, path);
+	create index if not exists inode_idx on files (dev, inode);
+	create index if not exists error_scan_idx on errors (scan_id);
+	create unique index if not exists file_hashes_idx on file_hashes (file_id, algo);
+	create index if not exists file_hashes_hash_idx on file_hashes (hash);
+	create unique index if not exists xattrs_idx on xattrs (file_id, name);
+	create unique index if not exists hash_cache_idx on hash_cache (dev, inode, algo);
+	`
+
+// The schema version of the catalog in db, which is zero for a new one
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`create table if not exists schema_version (version integer not null)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version)
+	if err != nil || version > 0 {
+		return version, err
+	}
+
+	var legacy int
+	err = db.QueryRow(`select count(*) from sqlite_master where type='table' and name='roots'`).Scan(&legacy)
+	if err != nil || legacy == 0 {
+		return 0, err
+	}
+
+	return adoptUnversioned(db)
+}
+
+// Brings a catalog from before schema versioning up to unversionedSchema the
+// way it used to be done, then records that version
+func adoptUnversioned(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, stmts := range migrations[:unversionedSchema] {
+		for _, stmt := range stmts {
+			_, err = tx.Exec(stmt)
+			if err != nil && !alreadyApplied(err) {
+				return 0, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`insert into schema_version (version) values (?)`, unversionedSchema)
+	if err != nil {
+		return 0, err
+	}
+
+	return unversionedSchema, tx.Commit()
+}
+
+// Whether a migration statement failed only because the catalog already had
+// what it adds. The pure Go driver wraps SQLite's messages, so they are looked
+// for anywhere in the error.
+func alreadyApplied(err error) bool {
+	msg := err.Error()
+
+	return strings.Contains(msg, "duplicate column name") || strings.Contains(msg, "already exists")
+}
+
+// Makes sure a catalog opened read-only has the schema this leibniz expects,
+// since it can't be upgraded in place
+func checkSchema(db *sql.DB, path string) error {
+	var versioned int
+	err := db.QueryRow(`select count(*) from sqlite_master where type='table' and name='schema_version'`).Scan(&versioned)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if versioned > 0 {
+		err = db.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case version > SchemaVersion:
+		return fmt.Errorf("%s has schema version %d, but this leibniz only understands up to %d; upgrade leibniz to use it", path, version, SchemaVersion)
+	case version < SchemaVersion:
+		return fmt.Errorf("%s has schema version %d and needs upgrading to %d, which can't be done read-only; open it once without -ro", path, version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// Applies the migrations the catalog doesn't have yet, each in its own
+// transaction. Catalogs written by a newer leibniz are refused rather than
+// guessed at.
+func migrate(db *sql.DB, path string) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%s has schema version %d, but this leibniz only understands up to %d; upgrade leibniz to use it", path, version, SchemaVersion)
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range migrations[v] {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migrating %s to schema version %d: %s", path, v+1, err)
+			}
+		}
+
+		_, err = tx.Exec(`delete from schema_version`)
+		if err == nil {
+			_, err = tx.Exec(`insert into schema_version (version) values (?)`, v+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(createIdxStmt)
+
+	return err
+}
@@ -0,0 +1,228 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// A catalog in a temporary directory with the first version migrations
+// applied the way the leibniz of that version left it
+func catalogAt(t *testing.T, version int, versioned bool) (*sql.DB, string) {
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, stmts := range migrations[:version] {
+		for _, stmt := range stmts {
+			_, err = db.Exec(stmt)
+			if err != nil {
+				t.Fatalf("%s: %s", stmt, err)
+			}
+		}
+	}
+
+	if versioned {
+		_, err = db.Exec(`create table schema_version (version integer not null)`)
+		if err == nil {
+			_, err = db.Exec(`insert into schema_version (version) values (?)`, version)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db, path
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	// Catalogs from before schema_version could be at any of the early
+	// versions, with nothing saying which
+	for _, version := range []int{1, 2, 5, unversionedSchema} {
+		db, path := catalogAt(t, version, false)
+		_, err := db.Exec(`insert into roots (id, root) values (1, '/r')`)
+		if err == nil {
+			_, err = db.Exec(`insert into files (root_id, hash, path, mtime) values (1, '0123456789abcdef', '/r/a', '2020-01-02 03:04:05+00:00')`)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = migrate(db, path)
+		if err != nil {
+			t.Errorf("migrating unversioned catalog at %d: %s", version, err)
+			continue
+		}
+
+		got, err := schemaVersion(db)
+		if err != nil || got != SchemaVersion {
+			t.Errorf("unversioned catalog at %d migrated to %d (%v), want %d", version, got, err, SchemaVersion)
+		}
+
+		var algo, hash string
+		err = db.QueryRow(`select algo, hash from files where path = '/r/a'`).Scan(&algo, &hash)
+		if err != nil || algo != "xxhash" || hash != "0123456789abcdef" {
+			t.Errorf("unversioned catalog at %d lost its file: %q %q %v", version, algo, hash, err)
+		}
+	}
+}
+
+func TestAdoptUnversionedTwice(t *testing.T) {
+	db, _ := catalogAt(t, unversionedSchema, false)
+	_, err := db.Exec(`create table schema_version (version integer not null)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every statement of a version a catalog already has fails, and is let be
+	for i := 0; i < 2; i++ {
+		version, err := adoptUnversioned(db)
+		if err != nil || version != unversionedSchema {
+			t.Fatalf("adoptUnversioned = %d, %v, want %d", version, err, unversionedSchema)
+		}
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	db, path := catalogAt(t, SchemaVersion, true)
+	_, err := db.Exec(`update schema_version set version = ?`, SchemaVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = migrate(db, path); err == nil {
+		t.Errorf("migrated a catalog at a newer schema version")
+	}
+}
+
+func TestMigrateUtcMtimes(t *testing.T) {
+	tests := []struct {
+		mtime string
+		want  string
+	}{
+		{"2020-01-02 03:04:05+02:00", "2020-01-02 01:04:05+00:00"},
+		{"2020-01-02 03:04:05.123456789+02:00", "2020-01-02 01:04:05.123456789+00:00"},
+		{"2020-01-02 03:04:05.5-05:00", "2020-01-02 08:04:05.5+00:00"},
+		{"2020-01-01 00:30:00+01:00", "2019-12-31 23:30:00+00:00"},
+		{"2020-01-02 03:04:05+00:00", "2020-01-02 03:04:05+00:00"},
+		{"2020-01-02 03:04:05.25+00:00", "2020-01-02 03:04:05.25+00:00"},
+	}
+
+	db, path := catalogAt(t, 20, true)
+	for i, test := range tests {
+		_, err := db.Exec(`insert into files (root_id, path, hash, mtime) values (1, ?, 'h', ?)`, test.mtime, test.mtime)
+		if err == nil {
+			_, err = db.Exec(`insert into file_history (root_id, path, mtime) values (1, ?, ?)`, test.mtime, test.mtime)
+		}
+		if err == nil {
+			_, err = db.Exec(`insert into links (root_id, path, mtime) values (1, ?, ?)`, test.mtime, test.mtime)
+		}
+		if err == nil {
+			_, err = db.Exec(`insert into hash_cache (dev, inode, size, algo, hash, mtime) values (1, ?, 0, 'xxhash', 'h', ?)`, i, test.mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec(`insert into metadata (file_id, camera) select id, 'camera' from files`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files didn't change, only how their mtimes are written
+	var kept int
+	err = db.QueryRow(`select count(*) from metadata`).Scan(&kept)
+	if err != nil || kept != len(tests) {
+		t.Errorf("migrating mtimes kept the metadata of %d files, want %d: %v", kept, len(tests), err)
+	}
+
+	queries := map[string]string{
+		"files":        `select mtime from files where path = ?`,
+		"file_history": `select mtime from file_history where path = ?`,
+		"links":        `select mtime from links where path = ?`,
+		"hash_cache":   `select mtime from hash_cache where inode = ?`,
+	}
+	for i, test := range tests {
+		for table, query := range queries {
+			var key interface{} = test.mtime
+			if table == "hash_cache" {
+				key = i
+			}
+
+			var got string
+			err = db.QueryRow(`select cast((`+query+`) as text)`, key).Scan(&got)
+			if err != nil {
+				t.Fatalf("%s: %s", table, err)
+			}
+			if got != test.want {
+				t.Errorf("%s mtime %s migrated to %s, want %s", table, test.mtime, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMigratePaddedHashes(t *testing.T) {
+	tests := []struct {
+		algo string
+		hash string
+		want string
+	}{
+		{"xxhash", "abc", "0000000000000abc"},
+		{"xxhash", "123456789abcdef", "0123456789abcdef"},
+		{"xxhash", "0123456789abcdef", "0123456789abcdef"},
+		{"xxhash:1M:4K:8", "1", "0000000000000001"},
+		{"xxhash-full", "abc", "abc"},
+		{"sha256", "abc", "abc"},
+	}
+
+	db, path := catalogAt(t, 21, true)
+	for i, test := range tests {
+		p := fmt.Sprintf("/r/%d", i)
+		_, err := db.Exec(`insert into files (id, root_id, path, algo, hash) values (?, 1, ?, ?, ?)`, i+1, p, test.algo, test.hash)
+		if err == nil {
+			_, err = db.Exec(`insert into file_history (root_id, path, algo, hash) values (1, ?, ?, ?)`, p, test.algo, test.hash)
+		}
+		if err == nil {
+			_, err = db.Exec(`insert into file_hashes (file_id, algo, hash) values (?, ?, ?)`, i+1, test.algo, test.hash)
+		}
+		if err == nil {
+			_, err = db.Exec(`insert into hash_cache (dev, inode, size, mtime, algo, hash) values (1, ?, 0, 0, ?, ?)`, i, test.algo, test.hash)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := migrate(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := map[string]string{
+		"files":        `select hash from files where path = '/r/' || ?`,
+		"file_history": `select hash from file_history where path = '/r/' || ?`,
+		"file_hashes":  `select hash from file_hashes where file_id = ? + 1`,
+		"hash_cache":   `select hash from hash_cache where inode = ?`,
+	}
+	for i, test := range tests {
+		for table, query := range queries {
+			var got string
+			err = db.QueryRow(query, i).Scan(&got)
+			if err != nil {
+				t.Fatalf("%s: %s", table, err)
+			}
+			if got != test.want {
+				t.Errorf("%s %s digest %s migrated to %s, want %s", table, test.algo, test.hash, got, test.want)
+			}
+		}
+	}
+}
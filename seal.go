@@ -0,0 +1,247 @@
+package leibniz
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A digest of what the catalog says about its current files, to show later
+// that it hasn't been changed. Signature is an ed25519 signature of the seal's
+// other fields, or nil if it wasn't signed.
+type Seal struct {
+	Digest    string // SHA-256, in hex
+	Files     int64
+	Sealed    time.Time
+	Signature []byte
+}
+
+// Attest fails with this when the catalog no longer matches a seal
+var ErrSealBroken = errors.New("the catalog doesn't match the seal")
+
+var sealQuery string = `
+	select r.root, f.path, f.algo, f.hash, f.size, f.mtime from files f
+	join roots r on r.id = f.root_id
+	order by r.root, f.path
+	`
+
+// Computes the SHA-256 over every current file's root, path, algorithm, hash,
+// size and mtime, in path order, so the same contents always give the same
+// digest. Which scans saw the files and in what order their rows were written
+// don't count, so rescanning an unchanged root keeps the digest.
+func (c *Catalog) CatalogDigest() (string, int64, error) {
+	rows, err := c.Db.Query(sealQuery)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	var files int64
+	for rows.Next() {
+		var root, path, algo, hash string
+		var size sql.NullInt64
+		var mtime time.Time
+		err = rows.Scan(&root, &path, &algo, &hash, &size, &mtime)
+		if err != nil {
+			return "", 0, err
+		}
+
+		sizeText := ""
+		if size.Valid {
+			sizeText = strconv.FormatInt(size.Int64, 10)
+		}
+
+		// Fields are NUL separated, since paths can hold anything else.
+		// Digests go in as they were written when seals were first made, so
+		// that padding them didn't break the seals made before.
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%d\n", root, path, algo, legacyDigest(algo, hash), sizeText, mtime.UnixNano())
+		files++
+	}
+	if err = rows.Err(); err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), files, nil
+}
+
+// Seals the catalog as it is now, signing the seal if key isn't nil
+func (c *Catalog) Seal(key ed25519.PrivateKey) (*Seal, error) {
+	digest, files, err := c.CatalogDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Seal{Digest: digest, Files: files, Sealed: time.Now().UTC().Truncate(time.Second)}
+	if key != nil {
+		s.Signature = ed25519.Sign(key, []byte(s.signed()))
+	}
+
+	return s, nil
+}
+
+// The part of a seal's text that its signature covers
+func (s *Seal) signed() string {
+	return fmt.Sprintf("leibniz seal\ndigest: sha256:%s\nfiles: %d\nsealed: %s\n", s.Digest, s.Files, s.Sealed.Format(time.RFC3339))
+}
+
+// Writes the seal as text, a few lines of "name: value"
+func (s *Seal) WriteTo(w io.Writer) (int64, error) {
+	text := s.signed()
+	if s.Signature != nil {
+		text += "signature: " + base64.StdEncoding.EncodeToString(s.Signature) + "\n"
+	}
+
+	n, err := io.WriteString(w, text)
+	return int64(n), err
+}
+
+// Reads a seal written by WriteTo
+func ReadSeal(r io.Reader) (*Seal, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != "leibniz seal" {
+		return nil, fmt.Errorf("not a leibniz seal")
+	}
+
+	s := &Seal{}
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			return nil, fmt.Errorf("bad seal line %q", scanner.Text())
+		}
+
+		var err error
+		switch name {
+		case "digest":
+			s.Digest = strings.TrimPrefix(value, "sha256:")
+		case "files":
+			s.Files, err = strconv.ParseInt(value, 10, 64)
+		case "sealed":
+			s.Sealed, err = time.Parse(time.RFC3339, value)
+		case "signature":
+			s.Signature, err = base64.StdEncoding.DecodeString(value)
+		default:
+			err = fmt.Errorf("unknown field")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad seal %s: %s", name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.Digest == "" {
+		return nil, fmt.Errorf("the seal has no digest")
+	}
+
+	return s, nil
+}
+
+// Checks the catalog against a seal, and the seal's signature against key if
+// it isn't nil
+func (c *Catalog) Attest(s *Seal, key ed25519.PublicKey) error {
+	if key != nil {
+		if s.Signature == nil {
+			return fmt.Errorf("the seal isn't signed")
+		}
+		if !ed25519.Verify(key, []byte(s.signed()), s.Signature) {
+			return fmt.Errorf("the seal's signature doesn't match the key")
+		}
+	}
+
+	digest, files, err := c.CatalogDigest()
+	if err != nil {
+		return err
+	}
+
+	if digest != s.Digest || files != s.Files {
+		c.Out.Print("attest", Fields{"ok": false, "digest": digest, "sealed_digest": s.Digest, "files": files, "sealed_files": s.Files},
+			"Catalog has %d files with digest %s, but was sealed with %d files and digest %s\n", files, digest, s.Files, s.Digest)
+		return ErrSealBroken
+	}
+
+	signed := s.Signature != nil && key != nil
+	c.Out.Print("attest", Fields{"ok": true, "digest": digest, "files": files, "sealed": s.Sealed, "signed": signed},
+		"Catalog matches the seal of %s: %d files, digest %s\n", c.Out.Time(s.Sealed), files, digest)
+
+	return nil
+}
+
+const (
+	secretKeyHeader = "leibniz secret key"
+	publicKeyHeader = "leibniz public key"
+)
+
+// Writes a new signing key pair to path, readable only by its owner, and its
+// public half to path.pub
+func GenerateSealKey(path string) error {
+	public, secret, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(path+".pub", publicKeyHeader, public, 0644)
+	if err != nil {
+		return err
+	}
+
+	return writeKey(path, secretKeyHeader, secret, 0600)
+}
+
+func writeKey(path, header string, key []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s\n%s\n", header, base64.StdEncoding.EncodeToString(key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func readKey(path, header string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != header {
+		return nil, fmt.Errorf("%s isn't a %s", path, header)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("%s isn't a %s", path, header)
+	}
+
+	return key, nil
+}
+
+// Reads a secret key written by GenerateSealKey
+func ReadSecretKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readKey(path, secretKeyHeader, ed25519.PrivateKeySize)
+	return ed25519.PrivateKey(key), err
+}
+
+// Reads a public key written by GenerateSealKey
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKey(path, publicKeyHeader, ed25519.PublicKeySize)
+	return ed25519.PublicKey(key), err
+}
@@ -0,0 +1,332 @@
+package leibniz
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves the catalog as JSON over HTTP, so scripts and other machines can ask
+// whether a file is already cataloged before copying data around:
+//
+//	GET  /files?hash=&path=&root=&q=&limit=  files matching every parameter given
+//	GET  /hashes/<hash>                      files with hash, or 404 if there are none
+//	GET  /dupes?within_root=1|across_roots=1|between=a&between=b
+//	GET  /roots                              cataloged roots
+//	GET  /scans?root=                        recorded scans, the one running, and
+//	                                         the ones that failed since serving
+//	POST /scans?root=dir                     starts a scan of dir in the background,
+//	                                         unless the catalog was opened read-only
+//	GET  /metrics                            Prometheus metrics
+//
+// Objects carry the same fields as the matching -json events. Everything else
+// is the web UI, a single page built on the API.
+//
+// POST /scans must be sent as application/json. A page on another site can
+// only send a browser cross-origin as a form or plain text, so it can't start
+// scans through the browser of someone who runs the server.
+type Server struct {
+	catalog *Catalog
+	mux     *http.ServeMux
+
+	// Scans share the catalog's batch and stats, so only one runs at a time
+	mu       sync.Mutex
+	scanning string
+
+	// The latest failure for each root whose last scan failed
+	failures []Fields
+}
+
+//go:embed web
+var webFiles embed.FS
+
+func NewServer(c *Catalog) *Server {
+	s := &Server{catalog: c, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/files", s.files)
+	s.mux.HandleFunc("/hashes/", s.hashes)
+	s.mux.HandleFunc("/dupes", s.dupes)
+	s.mux.HandleFunc("/roots", s.roots)
+	s.mux.HandleFunc("/scans", s.scans)
+
+	if c.Metrics == nil {
+		c.Metrics = NewMetrics()
+	}
+	s.mux.Handle("/metrics", MetricsHandler(c))
+
+	ui, _ := fs.Sub(webFiles, "web")
+	s.mux.Handle("/", http.FileServer(http.FS(ui)))
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Fields{"error": err.Error()})
+}
+
+func onlyGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+		return false
+	}
+
+	return true
+}
+
+var errLimit = fmt.Errorf("limit reached")
+
+// The current files matching all of conds, up to limit of them unless it is
+// zero
+func (s *Server) findFiles(conds []string, args []interface{}, limit int) ([]Fields, error) {
+	cond := "1"
+	if len(conds) > 0 {
+		cond = strings.Join(conds, " and ")
+	}
+
+	files := make([]Fields, 0)
+	err := s.catalog.queryRecords(cond, args, func(r *Record) error {
+		if limit > 0 && len(files) >= limit {
+			return errLimit
+		}
+		files = append(files, r.Fields())
+		return nil
+	})
+	if err == errLimit {
+		err = nil
+	}
+
+	return files, err
+}
+
+func (s *Server) files(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	var conds []string
+	var args []interface{}
+	for _, p := range []struct{ param, column string }{{"hash", "f.hash"}, {"path", "f.path"}, {"root", "r.root"}, {"algo", "f.algo"}} {
+		if v := params.Get(p.param); v != "" {
+			conds = append(conds, p.column+" = ?")
+			args = append(args, v)
+		}
+	}
+
+	if q := params.Get("q"); strings.TrimSpace(q) != "" {
+		cond, qargs, err := ParseQuery(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("query: %s", err))
+			return
+		}
+		conds = append(conds, "("+cond+")")
+		args = append(args, qargs...)
+	}
+
+	var limit int
+	if l := params.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit %q isn't a count", l))
+			return
+		}
+	}
+
+	files, err := s.findFiles(conds, args, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, files)
+}
+
+// Hashes are stored as lower case hex, but people paste them either way
+func (s *Server) hashes(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/hashes/"))
+	if hash == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no hash given"))
+		return
+	}
+
+	// Hashes by extra algorithms count as well as the main one
+	cond := "(f.hash = ? or f.id in (select file_id from file_hashes where hash = ?))"
+	args := []interface{}{hash, hash}
+	if algo := r.URL.Query().Get("algo"); algo != "" {
+		cond = "((f.hash = ? and f.algo = ?) or f.id in (select file_id from file_hashes where hash = ? and algo = ?))"
+		args = []interface{}{hash, algo, hash, algo}
+	}
+
+	files, err := s.findFiles([]string{cond}, args, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := http.StatusOK
+	if len(files) == 0 {
+		status = http.StatusNotFound
+	}
+
+	writeJSON(w, status, files)
+}
+
+func (s *Server) dupes(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	scope := DupeScope{WithinRoot: params.Get("within_root") != "", AcrossRoots: params.Get("across_roots") != ""}
+	if between := params["between"]; len(between) > 0 {
+		if len(between) != 2 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("between takes two roots"))
+			return
+		}
+		scope.Between = [2]string{between[0], between[1]}
+	}
+
+	groups, err := s.catalog.ScopedDupes(scope)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sets := make([]Fields, len(groups))
+	for i, g := range groups {
+		sets[i] = g.Fields()
+	}
+
+	writeJSON(w, http.StatusOK, sets)
+}
+
+func (s *Server) roots(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+
+	roots, err := s.catalog.Roots()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roots)
+}
+
+func (s *Server) scans(w http.ResponseWriter, r *http.Request) {
+	root := r.URL.Query().Get("root")
+
+	switch r.Method {
+	case http.MethodGet:
+		scans, err := s.catalog.Scans(root)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		list := make([]Fields, len(scans))
+		for i, scan := range scans {
+			list[i] = scan.Fields()
+		}
+
+		s.mu.Lock()
+		running := s.scanning
+		failed := make([]Fields, 0, len(s.failures))
+		for _, f := range s.failures {
+			if root == "" || f["root"] == root {
+				failed = append(failed, f)
+			}
+		}
+		s.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, Fields{"scans": list, "running": running, "failed": failed})
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("scans must be started as application/json"))
+			return
+		}
+		if s.catalog.Opts.ReadOnly {
+			writeError(w, http.StatusForbidden, fmt.Errorf("the catalog is read-only"))
+			return
+		}
+		s.startScan(w, root)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s isn't allowed", r.Method))
+	}
+}
+
+// Scans root in the background with the catalog's options, answering as soon
+// as the scan has started. Its progress goes to the catalog's output, and its
+// failure, if it fails, to GET /scans.
+func (s *Server) startScan(w http.ResponseWriter, root string) {
+	if root == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no root given"))
+		return
+	}
+
+	root, err := filepath.Abs(root)
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(root)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", root)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanning != "" {
+		writeError(w, http.StatusConflict, fmt.Errorf("already scanning %s", s.scanning))
+		return
+	}
+	s.scanning = root
+
+	go func() {
+		err := s.catalog.scanRoots([]string{root})
+
+		s.mu.Lock()
+		s.scanning = ""
+		failures := s.failures[:0]
+		for _, f := range s.failures {
+			if f["root"] != root {
+				failures = append(failures, f)
+			}
+		}
+		if err != nil {
+			failures = append(failures, Fields{"root": root, "error": err.Error(), "time": time.Now()})
+		}
+		s.failures = failures
+		s.mu.Unlock()
+	}()
+
+	writeJSON(w, http.StatusAccepted, Fields{"root": root})
+}
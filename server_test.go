@@ -0,0 +1,70 @@
+package leibniz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerStartScan(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a"), "content", time.Now())
+	server := httptest.NewServer(NewServer(scannedCatalog(t, root)))
+	defer server.Close()
+
+	scans := server.URL + "/scans?root=" + url.QueryEscape(root)
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		// What a form or fetch on another site can send without asking first
+		{"", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"multipart/form-data; boundary=x", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"text/plain; x=application/json", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusAccepted},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Post(scans, test.contentType, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("POST /scans as %q = %d, want %d", test.contentType, resp.StatusCode, test.status)
+		}
+	}
+
+	// The scan started runs in the background
+	var body struct {
+		Running string
+		Failed  []Fields
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(server.URL + "/scans")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Running == "" {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("still scanning %s", body.Running)
+		}
+	}
+	if len(body.Failed) != 0 {
+		t.Errorf("the scan failed: %v", body.Failed)
+	}
+}
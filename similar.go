@@ -0,0 +1,218 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The images -similarity hashes, by extension. These are the formats the
+// standard library decodes.
+var imageExts = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+func isImage(path string) bool {
+	return oneOf(strings.ToLower(filepath.Ext(path)), imageExts)
+}
+
+// The distance under which similar counts images as the same picture by
+// default. Resizing and recompressing usually moves a few bits; different
+// pictures are typically 20 or more apart.
+const DefaultSimilarity = 10
+
+// Computes a 64 bit difference hash of an image: it is shrunk to 9x8 gray
+// cells, and each bit records whether a cell is brighter than its right hand
+// neighbour. Resized, recompressed and slightly edited copies of a picture get
+// hashes a few bits apart, so they can be compared by Hamming distance.
+func ImageHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+
+	const cols, rows = 9, 8
+	var cells [rows][cols]float64
+
+	// Averaging every pixel of a big photo is slow, and a grid of samples in
+	// each cell is just as good for a hash this coarse
+	const samples = 8
+	b := img.Bounds()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			var sum float64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (x*samples+sx)*b.Dx()/(cols*samples)
+					py := b.Min.Y + (y*samples+sy)*b.Dy()/(rows*samples)
+					red, green, blue, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(red) + 0.587*float64(green) + 0.114*float64(blue)
+				}
+			}
+			cells[y][x] = sum
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash, nil
+}
+
+// The perceptual hash to store for the file at path: its hex ImageHash, or
+// an empty string if it isn't an image that can be decoded, so it isn't
+// tried again. Only called for paths isImage accepts.
+func (c *Catalog) similarityHash(path string) sql.NullString {
+	file, err := os.Open(path)
+	if err != nil {
+		return sql.NullString{}
+	}
+	defer file.Close()
+
+	hash, err := ImageHash(file)
+	if err != nil {
+		c.Out.Verbosity("not-image", Fields{"path": path, "error": err}, "Can't decode %s as an image: %s\n", path, err)
+		return sql.NullString{Valid: true}
+	}
+
+	return sql.NullString{String: fmt.Sprintf("%016x", hash), Valid: true}
+}
+
+// A set of images within some distance of each other. Distances holds how
+// far each path's hash is from the first path's.
+type SimilarGroup struct {
+	Paths     []string
+	Hashes    []string
+	Distances []int
+}
+
+var similarQuery string = `
+	select f.path, f.phash from files f
+	join roots r on r.id = f.root_id
+	where f.phash is not null and f.phash != '' and (? = '' or r.root = ?)
+	order by f.path
+	`
+
+// Groups the cataloged images under root, or under every root if it is
+// empty, whose perceptual hashes are within distance bits of another's.
+// Groups are chained, so two images in a group can be further apart than
+// distance when others sit between them. Every pair is compared, which takes
+// seconds for a hundred thousand images.
+func (c *Catalog) Similar(root string, distance int) ([]*SimilarGroup, error) {
+	rows, err := c.Db.Query(similarQuery, root, root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths, hexes []string
+	var hashes []uint64
+	for rows.Next() {
+		var path, phash string
+		err = rows.Scan(&path, &phash)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := strconv.ParseUint(phash, 16, 64)
+		if err != nil {
+			continue
+		}
+
+		// Overlapping roots catalog the same path twice
+		if len(paths) > 0 && paths[len(paths)-1] == path {
+			continue
+		}
+
+		paths = append(paths, path)
+		hexes = append(hexes, phash)
+		hashes = append(hashes, hash)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Union-find over the images, joining every pair close enough
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if bits.OnesCount64(hashes[i]^hashes[j]) <= distance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range hashes {
+		members[find(i)] = append(members[find(i)], i)
+	}
+
+	groups := make([]*SimilarGroup, 0)
+	for _, m := range members {
+		if len(m) < 2 {
+			continue
+		}
+
+		g := &SimilarGroup{}
+		for _, i := range m {
+			g.Paths = append(g.Paths, paths[i])
+			g.Hashes = append(g.Hashes, hexes[i])
+			g.Distances = append(g.Distances, bits.OnesCount64(hashes[m[0]]^hashes[i]))
+		}
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+
+	return groups, nil
+}
+
+func (c *Catalog) ReportSimilar(root string, distance int) error {
+	groups, err := c.Similar(root, distance)
+	if err != nil {
+		return err
+	}
+
+	var images int
+	for _, g := range groups {
+		text := fmt.Sprintf("%d similar images:\n", len(g.Paths))
+		for i, path := range g.Paths {
+			text += fmt.Sprintf("\t%s (%d)\n", path, g.Distances[i])
+		}
+
+		c.Out.Print("similar", Fields{"paths": g.Paths, "hashes": g.Hashes, "distances": g.Distances}, "%s", text)
+		images += len(g.Paths)
+	}
+
+	c.Out.Print("similar-summary", Fields{"sets": len(groups), "images": images, "distance": distance}, "%d sets of similar images, %d images\n", len(groups), images)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package leibniz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A stretch of a sparse file that holds data, from start up to end
+type extent struct {
+	start, end int64
+}
+
+// Reads a sparse file, handing back zeros for its holes without reading them.
+// data is where the file holds data, in order, as it was when opened.
+type holeReader struct {
+	r    io.ReaderAt
+	size int64
+	data []extent
+}
+
+// A reader of file that skips its holes, or file itself where it has none or
+// the system can't tell where they are
+func sparseReader(file *os.File, info os.FileInfo) io.ReaderAt {
+	allocated, ok := fileAllocated(info)
+	if !ok || allocated >= info.Size() {
+		return file
+	}
+
+	data, ok := dataExtents(file, info.Size())
+	if !ok {
+		return file
+	}
+
+	return &holeReader{file, info.Size(), data}
+}
+
+func (h *holeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= h.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if int64(len(p)) > h.size-off {
+		p = p[:h.size-off]
+		eof = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		end := off + int64(len(p))
+
+		// The first extent that ends after pos, which pos is either in or
+		// in the hole before
+		i := sort.Search(len(h.data), func(i int) bool { return h.data[i].end > pos })
+		if i < len(h.data) && h.data[i].start <= pos {
+			if h.data[i].end < end {
+				end = h.data[i].end
+			}
+
+			m, err := h.r.ReadAt(p[n:end-off], pos)
+			n += m
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		if i < len(h.data) && h.data[i].start < end {
+			end = h.data[i].start
+		}
+		for j := range p[n : end-off] {
+			p[n+j] = 0
+		}
+		n = int(end - off)
+	}
+
+	return n, eof
+}
+
+// Every zero-length file has the same digest by each algorithm, so it is only
+// worked out once, and empty files are never read
+var emptyDigests sync.Map
+
+// The digest of no content at all by h
+func emptyDigest(h Hasher, info os.FileInfo) (string, error) {
+	if digest, ok := emptyDigests.Load(h.Name()); ok {
+		return digest.(string), nil
+	}
+
+	sum, err := h.Hash(bytes.NewReader(nil), info)
+	if err != nil {
+		return "", err
+	}
+
+	digest := hexDigest(sum)
+	emptyDigests.Store(h.Name(), digest)
+
+	return digest, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package leibniz
+
+import (
+	"os"
+)
+
+// Holes are only found on Linux and macOS
+func dataExtents(file *os.File, size int64) ([]extent, bool) {
+	return nil, false
+}
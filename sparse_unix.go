@@ -0,0 +1,39 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package leibniz
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Where file holds data, found by seeking from hole to data and back with
+// SEEK_DATA and SEEK_HOLE. Filesystems without them report the whole file as
+// data, which is merely slower.
+func dataExtents(file *os.File, size int64) ([]extent, bool) {
+	fd := int(file.Fd())
+	data := make([]extent, 0)
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break
+		}
+		if err != nil {
+			return nil, false
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false
+		}
+		if end > size {
+			end = size
+		}
+
+		data = append(data, extent{start, end})
+		off = end
+	}
+
+	return data, true
+}
@@ -0,0 +1,41 @@
+//go:build !modernc
+// +build !modernc
+
+package leibniz
+
+import (
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The SQLite driver catalogs are opened with. It is the stock driver plus a
+// regexp function, so queries can use the REGEXP operator. Building with
+// -tags modernc swaps it for a pure Go one.
+const sqliteDriver = "sqlite3_leibniz"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", sqlRegexp, true)
+		},
+	})
+}
+
+// The DSN parameters that set the pragmas. cacheSize is in KiB, and journal
+// and synchronous are empty for read-only catalogs.
+func sqliteParams(params url.Values, journal, synchronous string, cacheSize int, busyTimeout time.Duration) {
+	params.Set("_busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10))
+	if cacheSize > 0 {
+		// Negative sizes are in KiB rather than pages
+		params.Set("_cache_size", strconv.Itoa(-cacheSize))
+	}
+	if journal != "" {
+		params.Set("_journal_mode", journal)
+	}
+	if synchronous != "" {
+		params.Set("_synchronous", synchronous)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build modernc
+// +build modernc
+
+package leibniz
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"modernc.org/sqlite"
+	"net/url"
+	"time"
+)
+
+// modernc.org/sqlite is SQLite translated to Go, so leibniz builds without
+// cgo and cross-compiles like any other Go program, at some cost in speed.
+const sqliteDriver = "sqlite"
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+
+		match, err := sqlRegexp(text(args[0]), text(args[1]))
+		if err != nil || !match {
+			return int64(0), err
+		}
+
+		return int64(1), nil
+	})
+}
+
+func text(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// The DSN parameters that set the pragmas. cacheSize is in KiB, and journal
+// and synchronous are empty for read-only catalogs. Times are written the way
+// mattn/go-sqlite3 writes them, so catalogs work with either build.
+func sqliteParams(params url.Values, journal, synchronous string, cacheSize int, busyTimeout time.Duration) {
+	params.Set("_time_format", "sqlite")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	if cacheSize > 0 {
+		params.Add("_pragma", fmt.Sprintf("cache_size(%d)", -cacheSize))
+	}
+	if journal != "" {
+		params.Add("_pragma", "journal_mode("+journal+")")
+	}
+	if synchronous != "" {
+		params.Add("_pragma", "synchronous("+synchronous+")")
+	}
+}
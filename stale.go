@@ -0,0 +1,124 @@
+package leibniz
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parses an age like 2y, 6w or 90d, or anything time.ParseDuration takes. A
+// year is 365 days.
+func ParseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"y": 365 * 24 * time.Hour, "w": 7 * 24 * time.Hour, "d": 24 * time.Hour}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+
+		return time.Duration(n * float64(unit)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// A directory holding files that haven't been modified in a long time.
+// Files and Bytes count every file in it, stale or not, so that a directory
+// that is stale through and through stands out.
+type StaleDir struct {
+	Dir        string
+	Files      int64
+	Bytes      int64
+	StaleFiles int64
+	StaleBytes int64
+	Newest     time.Time // The latest mtime among its stale files
+}
+
+// Whether none of the directory's files were modified since the cutoff
+func (d *StaleDir) AllStale() bool {
+	return d.StaleFiles == d.Files
+}
+
+// Groups the files currently cataloged under root, or under every root if it
+// is empty, that weren't modified since before, by directory, largest stale
+// size first. Files deeper than depth levels under their root count toward
+// the directory at that depth, or their own with a depth of zero. Hard links
+// and files inside archives count as they do for Usage.
+func (c *Catalog) Stale(root string, before time.Time, depth int) ([]*StaleDir, error) {
+	dirs := make(map[string]*StaleDir)
+	err := c.spaceTakers(root, func(fileRoot, p string, size int64, mtime time.Time) {
+		dir := filepath.Dir(p)
+		if depth > 0 {
+			for dirDepth(fileRoot, dir) > depth {
+				dir = filepath.Dir(dir)
+			}
+		}
+
+		d, ok := dirs[dir]
+		if !ok {
+			d = &StaleDir{Dir: dir}
+			dirs[dir] = d
+		}
+		d.Files++
+		d.Bytes += size
+
+		if !mtime.Before(before) {
+			return
+		}
+		d.StaleFiles++
+		d.StaleBytes += size
+		if mtime.After(d.Newest) {
+			d.Newest = mtime
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make([]*StaleDir, 0)
+	for _, d := range dirs {
+		if d.StaleFiles > 0 {
+			stale = append(stale, d)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].StaleBytes != stale[j].StaleBytes {
+			return stale[i].StaleBytes > stale[j].StaleBytes
+		}
+		return stale[i].Dir < stale[j].Dir
+	})
+
+	return stale, nil
+}
+
+// Prints each directory with stale files and the totals
+func (c *Catalog) ReportStale(dirs []*StaleDir, before time.Time) {
+	var files, bytes int64
+	for _, d := range dirs {
+		marker := ""
+		if d.AllStale() {
+			marker = " (all stale)"
+		}
+
+		c.Out.Print("stale-dir", Fields{
+			"dir":         d.Dir,
+			"files":       d.Files,
+			"bytes":       d.Bytes,
+			"stale_files": d.StaleFiles,
+			"stale_bytes": d.StaleBytes,
+			"newest":      d.Newest,
+		}, "%s: %d of %d files (%s of %s), newest %s%s\n", d.Dir, d.StaleFiles, d.Files, c.Out.Size(d.StaleBytes), c.Out.Size(d.Bytes), c.Out.Time(d.Newest), marker)
+		files += d.StaleFiles
+		bytes += d.StaleBytes
+	}
+
+	c.Out.Print("stale-summary", Fields{"dirs": len(dirs), "files": files, "bytes": bytes, "before": before},
+		"%d files of %s in %d directories not modified since %s\n", files, c.Out.Size(bytes), len(dirs), c.Out.Time(before))
+}
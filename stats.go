@@ -0,0 +1,160 @@
+package leibniz
+
+import (
+	"fmt"
+	"time"
+)
+
+// Counters for the scan in progress. Files are discovered as the walk
+// reaches their directory, so Discovered keeps growing until the walk ends,
+// unless the scan enumerates everything first.
+type ScanStats struct {
+	Started         time.Time
+	Discovered      int64
+	DiscoveredBytes int64
+	Hashed          int64
+	HashedBytes     int64
+	Unchanged       int64
+	Moved           int64
+	Excluded        int64
+	Errors          int64
+	ErrorKinds      map[string]int64
+	DoneBytes       int64 // Sizes of every file dealt with, hashed or not
+	Limited         bool  // Whether the scan stopped at -max-files or -max-bytes
+	Enumerated      bool  // Whether Discovered is the whole of what the scan will deal with
+
+	shown time.Time
+}
+
+func NewScanStats() *ScanStats {
+	return &ScanStats{Started: time.Now(), ErrorKinds: make(map[string]int64)}
+}
+
+func (s *ScanStats) Done() int64 {
+	return s.Hashed + s.Unchanged + s.Moved + s.Errors
+}
+
+// Counts a file the scan has dealt with into counter
+func (s *ScanStats) done(counter *int64, size int64) {
+	*counter++
+	s.DoneBytes += size
+}
+
+func (s *ScanStats) discovered(size int64) {
+	s.Discovered++
+	s.DiscoveredBytes += size
+}
+
+// Estimated from the bytes left among the files discovered so far, which
+// makes it optimistic until the walk has seen most of the tree, unless it
+// was enumerated first
+func (s *ScanStats) ETA() time.Duration {
+	elapsed := time.Since(s.Started)
+	if s.DoneBytes == 0 || elapsed <= 0 {
+		return 0
+	}
+
+	rate := float64(s.DoneBytes) / elapsed.Seconds()
+	left := float64(s.DiscoveredBytes - s.DoneBytes)
+
+	return time.Duration(left/rate) * time.Second
+}
+
+func (s *ScanStats) String() string {
+	elapsed := time.Since(s.Started).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+
+	// Only a total known up front makes for a meaningful percentage
+	percent := ""
+	if s.Enumerated && s.DiscoveredBytes > 0 {
+		percent = fmt.Sprintf("%.1f%% of %.1f MB, ", 100*float64(s.DoneBytes)/float64(s.DiscoveredBytes), float64(s.DiscoveredBytes)/1e6)
+	}
+
+	return fmt.Sprintf("%s%d/%d files, %.1f files/s, %.1f MB/s, ETA %s",
+		percent, s.Done(), s.Discovered,
+		float64(s.Done())/elapsed,
+		float64(s.HashedBytes)/elapsed/1e6,
+		s.ETA().Round(time.Second))
+}
+
+const progressInterval = 250 * time.Millisecond
+
+// The counters as the fields of a "progress" event
+func (s *ScanStats) Fields() Fields {
+	return Fields{
+		"discovered":       s.Discovered,
+		"discovered_bytes": s.DiscoveredBytes,
+		"done":             s.Done(),
+		"done_bytes":       s.DoneBytes,
+		"hashed":           s.Hashed,
+		"hashed_bytes":     s.HashedBytes,
+		"unchanged":        s.Unchanged,
+		"moved":            s.Moved,
+		"excluded":         s.Excluded,
+		"errors":           s.Errors,
+		"enumerated":       s.Enumerated,
+		"eta_seconds":      s.ETA().Seconds(),
+	}
+}
+
+// Redraws the progress line and tells the hook how far along the scan is, at
+// most every progressInterval unless forced
+func (c *Catalog) showProgress(force bool) {
+	if c.Out.Progress == nil && c.Out.Hook == nil {
+		return
+	}
+
+	if !force && time.Since(c.Stats.shown) < progressInterval {
+		return
+	}
+	c.Stats.shown = time.Now()
+
+	c.Out.Event("progress", c.Stats.Fields())
+	c.Out.Status(c.Stats.String())
+}
+
+func (c *Catalog) ReportStats() {
+	s := c.Stats
+	c.Out.Status("")
+
+	elapsed := time.Since(s.Started).Round(time.Millisecond)
+	if c.Opts.DryRun {
+		c.Out.Print("dry-run-summary", Fields{
+			"root":      c.Opts.Root,
+			"files":     s.Hashed,
+			"bytes":     s.HashedBytes,
+			"unchanged": s.Unchanged,
+			"excluded":  s.Excluded,
+			"errors":    s.Errors,
+		}, "%d files would be cataloged (%s), %d unchanged, %d excluded, %d errors\n",
+			s.Hashed, c.Out.Size(s.HashedBytes), s.Unchanged, s.Excluded, s.Errors)
+	} else {
+		c.Out.Print("scan-summary", Fields{
+			"root":         c.Opts.Root,
+			"hashed":       s.Hashed,
+			"hashed_bytes": s.HashedBytes,
+			"unchanged":    s.Unchanged,
+			"moved":        s.Moved,
+			"excluded":     s.Excluded,
+			"errors":       s.Errors,
+			"bytes":        s.DoneBytes,
+			"seconds":      elapsed.Seconds(),
+		}, "%d files hashed (%s), %d unchanged, %d moved, %d excluded, %d errors; %s in %s\n",
+			s.Hashed, c.Out.Size(s.HashedBytes), s.Unchanged, s.Moved, s.Excluded, s.Errors, c.Out.Size(s.DoneBytes), elapsed)
+	}
+
+	if s.Limited {
+		c.Out.Print("scan-limited", Fields{"root": c.Opts.Root, "max_files": c.Opts.MaxFiles, "max_bytes": int64(c.Opts.MaxBytes), "max_duration": c.Opts.MaxDuration.String()},
+			"Stopped at the -max-files, -max-bytes or -max-duration limit, so the scan didn't see everything under %s\n", c.Opts.Root)
+	}
+
+	if s.Errors > 0 {
+		fields := Fields{"scan": c.scanId()}
+		for kind, n := range s.ErrorKinds {
+			fields[kind] = n
+		}
+		c.Out.Print("error-summary", fields, "Errors: %s\n", s.errorSummary())
+	}
+}
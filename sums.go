@@ -0,0 +1,47 @@
+package leibniz
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A line of a manifest in the format of sha256sum and xxhsum, which
+// ReadManifest reads back. Like the GNU tools, paths containing a backslash
+// or a newline are escaped, and the line marked with a leading backslash.
+func SumLine(hash, path string) string {
+	if !strings.ContainsAny(path, "\\\n\r") {
+		return hash + "  " + path
+	}
+
+	return "\\" + hash + "  " + strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(path)
+}
+
+// Rehashes every file listed in a manifest, as sha256sum -c does, printing
+// whether each still matches. algo is the algorithm the digests were made
+// with, or empty to work it out from the manifest. Returns how many files
+// were checked and how many of those failed, missing files included.
+func CheckManifest(r io.Reader, algo string, out *Output) (checked, failed int, err error) {
+	err = ReadManifest(r, algo, func(e *ManifestEntry) error {
+		checked++
+
+		hash, err := HashFile(e.Algo, e.Path)
+		switch {
+		case err != nil:
+			failed++
+			out.Print("check", Fields{"path": e.Path, "algo": e.Algo, "ok": false, "error": err}, "%s: FAILED open or read: %s\n", e.Path, err)
+		case hash != e.Hash:
+			failed++
+			out.Print("check", Fields{"path": e.Path, "algo": e.Algo, "ok": false, "expected": e.Hash, "hash": hash}, "%s: FAILED\n", e.Path)
+		default:
+			out.Print("check", Fields{"path": e.Path, "algo": e.Algo, "ok": true}, "%s: OK\n", e.Path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return checked, failed, fmt.Errorf("reading manifest: %s", err)
+	}
+
+	return checked, failed, nil
+}
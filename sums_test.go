@@ -0,0 +1,97 @@
+package leibniz
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSumLineCheck(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"plain", "with space", " leading", "trailing ", "*star", `back\slash`, "new\nline", "carriage\rreturn", `\n literally`, "a (1) = b", "$(touch pwned)"}
+
+	var manifest strings.Builder
+	want := make(map[string]bool)
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := HashFile("sha256", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := SumLine(hash, p)
+		if strings.ContainsAny(line, "\n\r") {
+			t.Errorf("the line for %q isn't a single line: %q", name, line)
+		}
+		manifest.WriteString(line + "\n")
+		want[p] = true
+	}
+
+	// A file that changed and one that is gone fail
+	changed, missing := filepath.Join(dir, "changed\nname"), filepath.Join(dir, `missing\name`)
+	manifest.WriteString(SumLine(emptySha256, changed) + "\n")
+	manifest.WriteString(SumLine(emptySha256, missing) + "\n")
+	err := os.WriteFile(changed, []byte("not empty"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[changed], want[missing] = false, false
+
+	var events bytes.Buffer
+	checked, failed, err := CheckManifest(strings.NewReader(manifest.String()), "", &Output{W: &events, JSON: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	dec := json.NewDecoder(&events)
+	for dec.More() {
+		var check struct {
+			Event, Path string
+			Ok          bool
+		}
+		if err := dec.Decode(&check); err != nil {
+			t.Fatal(err)
+		}
+		if check.Event == "check" {
+			got[check.Path] = check.Ok
+		}
+	}
+	if checked != len(names)+2 || failed != 2 {
+		t.Errorf("checked %d and failed %d, want %d and 2", checked, failed, len(names)+2)
+	}
+	for p, ok := range want {
+		if got[p] != ok {
+			t.Errorf("%q: ok = %v, want %v", p, got[p], ok)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("checked %v, want %d paths", got, len(want))
+	}
+
+	// GNU sha256sum reads the same manifest the same way
+	if _, err := exec.LookPath("sha256sum"); err == nil {
+		sum := exec.Command("sha256sum", "-c", "--quiet", "-")
+		sum.Dir = dir
+		sum.Stdin = strings.NewReader(manifest.String())
+		out, _ := sum.CombinedOutput()
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		failures := 0
+		for _, line := range lines {
+			if strings.Contains(line, ": FAILED") {
+				failures++
+			}
+		}
+		if failures != 2 {
+			t.Errorf("sha256sum -c found %d failures, want 2:\n%s", failures, out)
+		}
+	}
+}
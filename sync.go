@@ -0,0 +1,394 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What Sync copied into a catalog
+type SyncResult struct {
+	Roots int64 // Roots it didn't have
+	Scans int64 // Scans of them it didn't have
+	Files int64 // Files it didn't have, or had with an older mtime
+	Seen  int64 // Unchanged files that a later scan in the other catalog saw
+}
+
+// A file's current row, as Sync reads it from either catalog. Rest holds the
+// columns that are copied as they are, in the order insertFileStmt takes them.
+type syncFile struct {
+	id          int64
+	path        string
+	hash        string
+	algo        string
+	mtime       time.Time
+	scanId      sql.NullInt64
+	firstScanId sql.NullInt64
+	rest        []interface{}
+}
+
+var syncStateQuery string = `
+	select id, path, hash, algo, mtime, scan_id, first_scan_id, dev, inode, size, phash, mime, uid, gid, mode, allocated from files
+	where root_id=?
+	`
+
+// The tables holding more about a file, copied along with it
+var syncDetails = []struct {
+	table   string
+	columns []string
+}{
+	{"file_hashes", []string{"algo", "hash"}},
+	{"metadata", []string{"taken", "camera", "width", "height", "duration", "codec"}},
+	{"xattrs", []string{"name", "value"}},
+}
+
+// Merges the current files of another catalog into this one, matching them by
+// root and path. The newest mtime wins: a file this catalog doesn't have, or
+// has with an older mtime, is cataloged with the other's hash and details in
+// place of what was there. Scans are copied too, so
+// the files keep the scans that saw them. Files deleted from one catalog are
+// never deleted from the other, so syncing both ways builds a union of them.
+func (c *Catalog) Sync(from *Catalog) (*SyncResult, error) {
+	roots, err := from.Roots()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SyncRoots(from, roots)
+}
+
+// Syncs only the given roots of another catalog, and what is cataloged under
+// them, into this one, the way Sync does
+func (c *Catalog) SyncRoots(from *Catalog, roots []string) (*SyncResult, error) {
+	result := &SyncResult{}
+	for _, root := range roots {
+		err := c.syncRoot(from, root, result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", root, err)
+		}
+	}
+
+	return result, nil
+}
+
+func (c *Catalog) syncRoot(from *Catalog, root string, result *SyncResult) (err error) {
+	var fromRootId int64
+	var volume, label, volumePath sql.NullString
+	err = from.Db.QueryRow(`select id, volume, volume_label, volume_path from roots where root=?`, root).Scan(&fromRootId, &volume, &label, &volumePath)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("not a root of %s", from.Opts.CatalogPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A new root keeps the volume it is on, so it is found again wherever
+	// the volume is mounted
+	var rootId int64
+	err = c.Db.QueryRow(`select id from roots where root=?`, root).Scan(&rootId)
+	if err == sql.ErrNoRows {
+		rootId, err = c.EnsureRootId(root)
+		if err == nil {
+			_, err = c.Db.Exec(`update roots set volume=?, volume_label=?, volume_path=? where id=?`, volume, label, volumePath, rootId)
+		}
+		result.Roots++
+	}
+	if err != nil {
+		return err
+	}
+
+	scanIds, started, err := c.syncScans(from, fromRootId, rootId, result)
+	if err != nil {
+		return err
+	}
+
+	theirs, err := syncState(from, fromRootId)
+	if err != nil {
+		return err
+	}
+
+	ours := make(map[string]*syncFile)
+	files, err := syncState(c, rootId)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		ours[f.path] = f
+	}
+
+	mapScan := func(id sql.NullInt64) interface{} {
+		if mapped, ok := scanIds[id.Int64]; id.Valid && ok {
+			return mapped
+		}
+		return nil
+	}
+
+	err = c.begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		commitErr := c.commit()
+		if err == nil {
+			err = commitErr
+		}
+	}()
+
+	for _, f := range theirs {
+		o, ok := ours[f.path]
+		switch {
+		case !ok || f.mtime.After(o.mtime.Add(c.Opts.MtimeTolerance)):
+			args := append([]interface{}{rootId, f.hash, f.path, utc(f.mtime), f.algo, mapScan(f.scanId), mapScan(f.firstScanId)}, f.rest...)
+			var id int64
+			err := c.batch.insert.QueryRow(args...).Scan(&id)
+			if err != nil {
+				return err
+			}
+
+			err = c.syncDetails(from, f.id, id)
+			if err != nil {
+				return err
+			}
+
+			result.Files++
+			c.Out.Verbosity("synced", Fields{"path": f.path, "algo": f.algo, "hash": f.hash}, "%s %s\n", f.hash, f.path)
+		case c.sameMtime(o.mtime, f.mtime) && f.algo == o.algo && f.hash == o.hash:
+			// The same file, which a later scan may have seen since
+			scanId, ok := mapScan(f.scanId).(int64)
+			if !ok || (o.scanId.Valid && !started[scanId].After(started[o.scanId.Int64])) {
+				continue
+			}
+
+			_, err = c.batch.tx.Exec(`update files set scan_id=? where id=?`, scanId, o.id)
+			if err != nil {
+				return err
+			}
+			result.Seen++
+		default:
+			continue
+		}
+
+		c.batch.pending++
+		err = c.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func syncState(c *Catalog, rootId int64) ([]*syncFile, error) {
+	rows, err := c.Db.Query(syncStateQuery, rootId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*syncFile, 0)
+	for rows.Next() {
+		f := &syncFile{rest: make([]interface{}, 9)}
+		dest := []interface{}{&f.id, &f.path, &f.hash, &f.algo, &f.mtime, &f.scanId, &f.firstScanId}
+		for i := range f.rest {
+			dest = append(dest, &f.rest[i])
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// Copies the scans of a root this catalog doesn't have, matching them by when
+// they started. Returns the ids they have here by their ids in from, and when
+// each of the root's scans here started, since copied scans get new ids
+// whenever they ran.
+func (c *Catalog) syncScans(from *Catalog, fromRootId, rootId int64, result *SyncResult) (map[int64]int64, map[int64]time.Time, error) {
+	ours := make(map[int64]int64)
+	started := make(map[int64]time.Time)
+	rows, err := c.Db.Query(`select id, started from scans where root_id=?`, rootId)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var when time.Time
+		err = rows.Scan(&id, &when)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		ours[when.UnixNano()] = id
+		started[id] = when
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	type scanRow struct {
+		id       int64
+		started  time.Time
+		finished interface{}
+		files    interface{}
+	}
+
+	rows, err = from.Db.Query(`select id, started, finished, files from scans where root_id=? order by id`, fromRootId)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirs := make([]scanRow, 0)
+	for rows.Next() {
+		var s scanRow
+		err = rows.Scan(&s.id, &s.started, &s.finished, &s.files)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		theirs = append(theirs, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make(map[int64]int64)
+	for _, s := range theirs {
+		if id, ok := ours[s.started.UnixNano()]; ok {
+			ids[s.id] = id
+
+			// It may have been copied while it was still running
+			if s.finished != nil {
+				_, err = c.Db.Exec(`update scans set finished=?, files=? where id=? and finished is null`, s.finished, s.files, id)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+
+		res, err := c.Db.Exec(`insert into scans (root_id, started, finished, files) values (?, ?, ?, ?)`, rootId, s.started, s.finished, s.files)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, nil, err
+		}
+		ids[s.id] = id
+		started[id] = s.started
+		result.Scans++
+	}
+
+	return ids, started, nil
+}
+
+// Copies what from has about a file besides its row
+func (c *Catalog) syncDetails(from *Catalog, fromId, id int64) error {
+	for _, d := range syncDetails {
+		rows, err := from.Db.Query(`select `+strings.Join(d.columns, ", ")+` from `+d.table+` where file_id=?`, fromId)
+		if err != nil {
+			return err
+		}
+
+		values := make([][]interface{}, 0)
+		for rows.Next() {
+			row := make([]interface{}, len(d.columns))
+			dest := make([]interface{}, len(row))
+			for i := range row {
+				dest[i] = &row[i]
+			}
+
+			err = rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			values = append(values, row)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		insert := `insert or replace into ` + d.table + ` (file_id, ` + strings.Join(d.columns, ", ") + `) values (?` + strings.Repeat(", ?", len(d.columns)) + `)`
+		for _, row := range values {
+			_, err = c.queryer().Exec(insert, append([]interface{}{id}, row...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Syncs from other into the catalog, and from the catalog into other too if
+// both is set, reporting what each got
+func (c *Catalog) ReportSync(other *Catalog, both bool) error {
+	report := func(to, from *Catalog) error {
+		result, err := to.Sync(from)
+		if err != nil {
+			return err
+		}
+
+		c.Out.Print("sync", Fields{"from": from.Opts.CatalogPath, "to": to.Opts.CatalogPath, "roots": result.Roots, "scans": result.Scans, "files": result.Files, "seen": result.Seen},
+			"Synced %d files, %d scans and %d roots from %s into %s, and %d unchanged files seen by later scans\n",
+			result.Files, result.Scans, result.Roots, from.Opts.CatalogPath, to.Opts.CatalogPath, result.Seen)
+
+		return nil
+	}
+
+	err := report(c, other)
+	if err != nil || !both {
+		return err
+	}
+
+	return report(other, c)
+}
+
+// Syncs each of catalogs into this one in turn, as the union of them all,
+// reporting what each added and what they add up to
+func (c *Catalog) ReportMerge(catalogs []*Catalog) error {
+	total := &SyncResult{}
+	for _, from := range catalogs {
+		result, err := c.Sync(from)
+		if err != nil {
+			return fmt.Errorf("%s: %s", from.Opts.CatalogPath, err)
+		}
+
+		c.Out.Print("merge", Fields{"from": from.Opts.CatalogPath, "to": c.Opts.CatalogPath, "roots": result.Roots, "scans": result.Scans, "files": result.Files, "seen": result.Seen},
+			"Merged %d files, %d scans and %d roots from %s\n", result.Files, result.Scans, result.Roots, from.Opts.CatalogPath)
+
+		total.Roots += result.Roots
+		total.Scans += result.Scans
+		total.Files += result.Files
+		total.Seen += result.Seen
+	}
+
+	c.Out.Print("merge-summary", Fields{"catalogs": len(catalogs), "to": c.Opts.CatalogPath, "roots": total.Roots, "scans": total.Scans, "files": total.Files},
+		"Merged %d catalogs into %s: %d roots, %d scans, %d files\n", len(catalogs), c.Opts.CatalogPath, total.Roots, total.Scans, total.Files)
+
+	return nil
+}
+
+// Copies roots of another catalog into this one, a new catalog of their own,
+// reporting what it got
+func (c *Catalog) ReportSplit(from *Catalog, roots []string) error {
+	result, err := c.SyncRoots(from, roots)
+	if err != nil {
+		return err
+	}
+
+	c.Out.Print("split", Fields{"from": from.Opts.CatalogPath, "to": c.Opts.CatalogPath, "roots": result.Roots, "scans": result.Scans, "files": result.Files},
+		"Split %d roots, with %d scans and %d files, from %s into %s\n", result.Roots, result.Scans, result.Files, from.Opts.CatalogPath, c.Opts.CatalogPath)
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package leibniz
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tells systemd how the service is doing, as sd_notify(3) does, with a state
+// like "READY=1" or "STATUS=Scanning". Does nothing unless systemd started the
+// process with NOTIFY_SOCKET set, as it does for Type=notify services.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// How often to send systemd "WATCHDOG=1", half its WatchdogSec so a ping
+// running late isn't taken for a hang, or zero if it isn't watching this
+// process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,108 @@
+package leibniz
+
+import (
+	"io"
+	"runtime"
+	"time"
+)
+
+// Spreads reads out so that they average no more than rate bytes a second.
+// Time spent idle, between files or waiting on the disk, only earns a second's
+// worth of credit, so a pause isn't followed by a burst.
+type throttle struct {
+	rate  float64
+	start time.Time
+	bytes int64
+}
+
+func (t *throttle) wait(n int) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	t.bytes += int64(n)
+
+	ahead := time.Duration(float64(t.bytes)/t.rate*float64(time.Second)) - time.Since(t.start)
+	switch {
+	case ahead > 0:
+		time.Sleep(ahead)
+	case ahead < -time.Second:
+		t.start = time.Now().Add(-time.Second)
+		t.bytes = int64(t.rate)
+	}
+}
+
+// A file being hashed, read no faster than -bwlimit allows
+type throttledReader struct {
+	r io.ReaderAt
+	t *throttle
+}
+
+func (r throttledReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.t.wait(n)
+	return n, err
+}
+
+// The reader to hash a file through, which keeps to -bwlimit and stops when
+// the scan is interrupted
+func (c *Catalog) hashReader(file io.ReaderAt) io.ReaderAt {
+	r := io.ReaderAt(interruptibleReader{file, c})
+	if c.Opts.BandwidthLimit <= 0 {
+		return r
+	}
+
+	if c.throttle == nil || c.throttle.rate != float64(c.Opts.BandwidthLimit) {
+		c.throttle = &throttle{rate: float64(c.Opts.BandwidthLimit)}
+	}
+
+	return throttledReader{r, c.throttle}
+}
+
+// With -nice, drops the process to the lowest priorities it can. Scans go on
+// at normal priority where that fails.
+func (c *Catalog) beNice() {
+	if !c.Opts.Nice {
+		return
+	}
+
+	err := lowerPriority()
+	if err != nil {
+		c.Out.Verbosity("nice-error", Fields{"error": err}, "Can't lower priority: %s\n", err)
+	}
+}
+
+// How often -nice looks at the load average, and how long it pauses for
+const loadCheckInterval = 5 * time.Second
+
+// With -nice, waits between files while the machine is busier than it has
+// CPUs for, going by the one minute load average. It gives up waiting if the
+// scan is stopped.
+func (c *Catalog) waitForLoad() {
+	if !c.Opts.Nice || time.Since(c.loadChecked) < loadCheckInterval {
+		return
+	}
+
+	cpus := float64(runtime.NumCPU())
+	paused := false
+	for {
+		c.loadChecked = time.Now()
+		load, ok := loadAverage()
+		if !ok || load <= cpus {
+			if paused {
+				c.Out.Verbosity("resumed", Fields{"load": load}, "Load is down to %.2f, resuming\n", load)
+			}
+			return
+		}
+
+		if !paused {
+			c.Out.Verbosity("paused", Fields{"load": load, "cpus": cpus}, "Load is %.2f on %.0f CPUs, pausing\n", load, cpus)
+			paused = true
+		}
+
+		select {
+		case <-c.Stop:
+			return
+		case <-time.After(loadCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package leibniz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options.Trash to throw away what dedup replaces instead of trashing it
+const TrashNone = "none"
+
+// The operation that trash journals
+const OpTrash = "trash"
+
+// Operations that change files journal what they did, one UndoRecord a line,
+// in a file next to the catalog named after the operation's id, so undo can
+// find them by id alone
+func JournalPath(catalogPath, operation string) string {
+	return fmt.Sprintf("%s.%s.log", catalogPath, operation)
+}
+
+// A new operation id, like dedup-20240101T120000.123456789, to the
+// nanosecond so that runs in the same second get ids of their own
+func NewOperationId(kind string) string {
+	return kind + "-" + time.Now().Format("20060102T150405.000000000")
+}
+
+// The ids of the operations journaled next to the catalog, oldest first
+func Operations(catalogPath string) ([]string, error) {
+	logs, err := filepath.Glob(JournalPath(catalogPath, "*-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]string, 0, len(logs))
+	for _, log := range logs {
+		ops = append(ops, strings.TrimSuffix(strings.TrimPrefix(log, catalogPath+"."), ".log"))
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i][strings.LastIndex(ops[i], "-"):] < ops[j][strings.LastIndex(ops[j], "-"):]
+	})
+
+	return ops, nil
+}
+
+// The command scripts written by dupes remove copies with unless told
+// otherwise: this leibniz trashing them as one operation, so that a single
+// undo puts them all back
+func TrashCommand(catalogPath, operation string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := shellQuote(exe) + " trash -catalog " + shellQuote(catalogPath) + " -operation " + shellQuote(operation)
+	if IsRemoteCatalog(catalogPath) {
+		log, err := filepath.Abs(operation + ".log")
+		if err != nil {
+			return "", err
+		}
+		cmd += " -undo-log " + shellQuote(log)
+	}
+
+	return cmd, nil
+}
+
+// A trash directory. Files go in files, and the freedesktop.org .trashinfo
+// recording where each came from goes in info, unless info is empty. Paths
+// in them are relative to top, or absolute if it is empty.
+type trashCan struct {
+	files string
+	info  string
+	top   string
+}
+
+// The trash p goes in: Options.Trash, or the OS trash. Files on another
+// filesystem than the home trash go in the trash at the top of their own, as
+// desktops do, where there is one.
+func (c *Catalog) trashFor(p string) *trashCan {
+	if c.Opts.Trash != "" {
+		return &trashCan{files: filepath.Join(c.Opts.Trash, "files"), info: filepath.Join(c.Opts.Trash, "info")}
+	}
+
+	home := homeTrash()
+	dev, ok := deviceOf(filepath.Dir(p))
+	if homeDev, homeOk := deviceOf(home.files); ok && homeOk && dev != homeDev {
+		if volume := volumeTrash(mountTop(filepath.Dir(p), dev)); volume != nil {
+			return volume
+		}
+	}
+
+	return home
+}
+
+// The device of the nearest directory at or above p that exists
+func deviceOf(p string) (uint64, bool) {
+	for {
+		info, err := os.Stat(p)
+		if err == nil {
+			dev, _, _, ok := fileId(info)
+			return dev, ok
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return 0, false
+		}
+		p = parent
+	}
+}
+
+// The topmost directory above dir on the filesystem dev
+func mountTop(dir string, dev uint64) string {
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+
+		if parentDev, ok := deviceOf(parent); !ok || parentDev != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Claims a name in the trash for p, writing its trashinfo, and returns the
+// path it goes to
+func (t *trashCan) reserve(p string) (string, error) {
+	for _, dir := range []string{t.files, t.info} {
+		if dir == "" {
+			continue
+		}
+
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	original := p
+	if t.top != "" {
+		rel, err := filepath.Rel(t.top, p)
+		if err == nil {
+			original = rel
+		}
+	}
+	segments := strings.Split(filepath.ToSlash(original), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", strings.Join(segments, "/"), time.Now().Format("2006-01-02T15:04:05"))
+
+	base := filepath.Base(p)
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+		dest := filepath.Join(t.files, name)
+
+		if t.info != "" {
+			f, err := os.OpenFile(filepath.Join(t.info, name+".trashinfo"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if os.IsExist(err) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+
+			_, err = f.WriteString(info)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if _, err := os.Lstat(dest); err == nil {
+			removeTrashInfo(dest)
+			continue
+		}
+
+		return dest, nil
+	}
+}
+
+// Drops the trashinfo of a file in the trash, if it has one
+func removeTrashInfo(trashed string) {
+	files := filepath.Dir(trashed)
+	if filepath.Base(files) == "files" {
+		os.Remove(filepath.Join(filepath.Dir(files), "info", filepath.Base(trashed)+".trashinfo"))
+	}
+}
+
+// Puts p in the trash and returns where it went. With keep, p is hard linked
+// into the trash instead of moved, so it stays in place for the caller to
+// replace. Files that can't be moved or linked there, across filesystems, are
+// copied.
+func (c *Catalog) trash(p string, keep bool) (string, error) {
+	dest, err := c.trashFor(p).reserve(p)
+	if err != nil {
+		return "", err
+	}
+
+	if keep {
+		err = os.Link(p, dest)
+	} else {
+		err = os.Rename(p, dest)
+	}
+	if err != nil && (keep || errors.Is(err, syscall.EXDEV)) {
+		err = copyFile(p, dest)
+		if err == nil && !keep {
+			err = os.Remove(p)
+		}
+	}
+	if err != nil {
+		os.Remove(dest)
+		removeTrashInfo(dest)
+		return "", err
+	}
+
+	return dest, nil
+}
+
+// Copies src to dst with its mode and mtime
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, time.Now(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
+
+// Moves a trashed file back to p. With replace, whatever is at p now gives
+// way to it, in one rename.
+func restoreTrashed(trashed, p string, replace bool) error {
+	if !replace {
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%s is in the way", p)
+		}
+	}
+
+	err := os.Rename(trashed, p)
+	if errors.Is(err, syscall.EXDEV) {
+		tmp := filepath.Join(filepath.Dir(p), fmt.Sprintf(".leibniz-restore-%d", time.Now().UnixNano()))
+		err = copyFile(trashed, tmp)
+		if err == nil {
+			err = os.Rename(tmp, p)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		err = os.Remove(trashed)
+	}
+	if err != nil {
+		return err
+	}
+
+	removeTrashInfo(trashed)
+
+	return nil
+}
+
+// Moves files to the trash, journaling each to journal so that undo can put
+// them back, and drops them from the catalog
+func (c *Catalog) Trash(paths []string, journal io.Writer) error {
+	var trashed, bytes int64
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if err != nil {
+			c.Out.Print("trash-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+			continue
+		}
+		if info.IsDir() {
+			c.Out.Print("trash-error", Fields{"path": p, "error": "is a directory"}, "%s: is a directory\n", p)
+			continue
+		}
+
+		record := UndoRecord{Op: OpTrash, Path: p, Mode: info.Mode(), Mtime: info.ModTime(), Time: time.Now()}
+		record.Uid, record.Gid, record.HasOwner = fileOwner(info)
+
+		// The trash gets a link or a copy first, and the file only goes once
+		// the journal has it, so nothing is ever moved without a record
+		record.Trashed, err = c.trash(p, true)
+		if err != nil {
+			c.Out.Print("trash-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+			continue
+		}
+
+		line, err := json.Marshal(record)
+		if err == nil {
+			_, err = journal.Write(append(line, '\n'))
+		}
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			os.Remove(record.Trashed)
+			removeTrashInfo(record.Trashed)
+			c.Out.Print("trash-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+			continue
+		}
+
+		_, err = c.Db.Exec(`delete from files where path=?`, p)
+		if err != nil {
+			return err
+		}
+
+		c.Out.Verbosity("trash", Fields{"path": p, "trashed": record.Trashed}, "Trashed %s\n", p)
+		trashed++
+		bytes += info.Size()
+	}
+
+	c.Out.Print("trash-summary", Fields{"trashed": trashed, "bytes": bytes}, "Trashed %d files of %s\n", trashed, c.Out.Size(bytes))
+
+	if trashed < int64(len(paths)) {
+		return fmt.Errorf("%d files not trashed", int64(len(paths))-trashed)
+	}
+
+	return nil
+}
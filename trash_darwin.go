@@ -0,0 +1,16 @@
+package leibniz
+
+import (
+	"path/filepath"
+)
+
+// The Finder's trash, which has no info files
+func homeTrash() *trashCan {
+	return &trashCan{files: filepath.Join(homeDir(), ".Trash")}
+}
+
+// The Finder manages the trashes of other volumes itself, so files on them
+// are copied to the home trash
+func volumeTrash(top string) *trashCan {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !darwin
+// +build !darwin
+
+package leibniz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The freedesktop.org home trash that desktops on Linux and the BSDs share
+func homeTrash() *trashCan {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		data = filepath.Join(homeDir(), ".local", "share")
+	}
+
+	dir := filepath.Join(data, "Trash")
+	return &trashCan{files: filepath.Join(dir, "files"), info: filepath.Join(dir, "info")}
+}
+
+// The trash at the top of another filesystem, $top/.Trash-$uid
+func volumeTrash(top string) *trashCan {
+	dir := filepath.Join(top, fmt.Sprintf(".Trash-%d", os.Getuid()))
+	return &trashCan{files: filepath.Join(dir, "files"), info: filepath.Join(dir, "info"), top: top}
+}
@@ -0,0 +1,143 @@
+package leibniz
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashUndo(t *testing.T) {
+	root := t.TempDir()
+	kept, trashed := filepath.Join(root, "a"), filepath.Join(root, "b")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile(t, kept, "content", mtime)
+	writeFile(t, trashed, "content", mtime)
+
+	c := scannedCatalog(t, root)
+
+	var journal bytes.Buffer
+	err := c.Trash([]string{trashed, filepath.Join(root, "missing")}, &journal)
+	if err == nil {
+		t.Errorf("trashing a missing file didn't fail")
+	}
+	if _, err := os.Lstat(trashed); !os.IsNotExist(err) {
+		t.Fatalf("%s is still there after trashing it: %v", trashed, err)
+	}
+	if lines := strings.Count(journal.String(), "\n"); lines != 1 {
+		t.Errorf("journaled %d files, want 1", lines)
+	}
+
+	groups, err := c.Dupes()
+	if err != nil || len(groups) != 0 {
+		t.Errorf("trashing left %d duplicate sets in the catalog: %v", len(groups), err)
+	}
+
+	err = c.Undo(bytes.NewReader(journal.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(trashed)
+	if err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("undo didn't put %s back as it was: %v", trashed, err)
+	}
+	if same, err := SameContent(kept, trashed); !same || err != nil {
+		t.Errorf("undo put %s back with other content: %v", trashed, err)
+	}
+
+	// Undoing again finds the file back already
+	err = c.Undo(bytes.NewReader(journal.Bytes()))
+	if err != nil {
+		t.Errorf("undoing twice: %s", err)
+	}
+}
+
+func TestUndoEmptiedTrash(t *testing.T) {
+	root := t.TempDir()
+	canonical, copy := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeFile(t, canonical, "same content", time.Now())
+	writeFile(t, copy, "same content", time.Now())
+
+	c := scannedCatalog(t, root)
+	journal := filepath.Join(t.TempDir(), "dedup.log")
+	log, err := os.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Dedup(DedupHardlink, false, log)
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Emptying the trash takes the only copy of the original
+	trash := c.Opts.Trash
+	err = os.RemoveAll(trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.UndoJournal(journal)
+	if err == nil {
+		t.Errorf("undo found the copy put back though its original is gone")
+	}
+	if _, err := os.Stat(journal); err != nil {
+		t.Errorf("a failed undo put its journal away: %v", err)
+	}
+
+	a, errA := os.Stat(canonical)
+	b, errB := os.Stat(copy)
+	if errA != nil || errB != nil || !os.SameFile(a, b) {
+		t.Errorf("undo changed %s though it couldn't restore it", copy)
+	}
+}
+
+func TestUndoJournalOnce(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "a")
+	writeFile(t, p, "content", time.Now())
+
+	c := scannedCatalog(t, root)
+	journal := filepath.Join(t.TempDir(), "trash.log")
+	log, err := os.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Trash([]string{p}, log)
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.UndoJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("undo didn't put %s back: %v", p, err)
+	}
+	if _, err := os.Stat(journal + ".undone"); err != nil {
+		t.Errorf("undo didn't put its journal away: %v", err)
+	}
+
+	if err = c.UndoJournal(journal); err == nil {
+		t.Errorf("undid the same journal twice")
+	}
+}
+
+func TestNewOperationId(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := NewOperationId("dedup")
+		if seen[id] {
+			t.Fatalf("two operations got the id %s", id)
+		}
+		seen[id] = true
+
+		if !strings.HasPrefix(id, "dedup-") || strings.Count(id, "-") != 1 {
+			t.Errorf("operation id %q isn't the kind then a time", id)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package leibniz
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Sniffs the content type of a file from its first bytes, the way browsers
+// do, ignoring parameters like charset. Files it can't tell apart from random
+// bytes are application/octet-stream.
+func SniffType(r io.ReaderAt) (string, error) {
+	buf := make([]byte, 512)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	mime := http.DetectContentType(buf[:n])
+	if i := strings.IndexByte(mime, ';'); i >= 0 {
+		mime = mime[:i]
+	}
+
+	if mime == "application/octet-stream" {
+		if brand, ok := ftypBrand(buf[:n]); ok {
+			mime = brand
+		}
+	}
+
+	return mime, nil
+}
+
+// The types of ISO base media files by their major brand. The standard
+// library's sniffer only knows the mp4 brands, which leaves out most of what
+// phones and cameras write.
+var ftypBrands = map[string]string{
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"avc1": "video/mp4",
+	"M4V ": "video/mp4",
+	"M4A ": "audio/mp4",
+	"qt  ": "video/quicktime",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3g2a": "video/3gpp2",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"avif": "image/avif",
+}
+
+// The type of a file starting with an ftyp box, going by its major brand
+func ftypBrand(head []byte) (string, bool) {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return "", false
+	}
+
+	mime, ok := ftypBrands[string(head[8:12])]
+	return mime, ok
+}
+
+func sniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return SniffType(file)
+}
+
+// Checks that -type patterns are good shell patterns
+func validTypes(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(strings.TrimPrefix(p, "!"), ""); err != nil {
+			return fmt.Errorf("bad type pattern %q", p)
+		}
+	}
+
+	return nil
+}
+
+// Whether a file of the given content type passes -type. Patterns like image/*
+// include the types they match, and patterns starting with ! exclude them.
+// Exclusions win, and without any inclusions every other type is included.
+func (c *Catalog) typeWanted(mime string) bool {
+	var included, includes bool
+	for _, p := range c.Opts.Types {
+		if strings.HasPrefix(p, "!") {
+			if ok, _ := path.Match(p[1:], mime); ok {
+				return false
+			}
+			continue
+		}
+
+		includes = true
+		if ok, _ := path.Match(p, mime); ok {
+			included = true
+		}
+	}
+
+	return included || !includes
+}
+
+// Records the type of an unchanged file cataloged before types were sniffed
+func (c *Catalog) fillType(rootId int64, path, mime string) error {
+	_, err := c.queryer().Exec(`update files set mime=? where root_id=? and path=? and mime is null`, mime, rootId, path)
+	return err
+}
@@ -0,0 +1,198 @@
+package leibniz
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A file, an extension or a directory, and how much of the catalog it takes
+// up
+type UsageEntry struct {
+	Name  string
+	Files int64
+	Bytes int64
+}
+
+// What Usage found. Each list is largest first.
+type UsageReport struct {
+	Files   int64
+	Bytes   int64
+	Largest []*UsageEntry
+	ByExt   []*UsageEntry
+	ByDir   []*UsageEntry
+}
+
+// Files with no extension are summed up under this name
+const NoExtension = "(none)"
+
+// Sums up the space taken by the files currently cataloged under root, or
+// under every root if it is empty, from the catalog alone, like a du that
+// needn't walk anything. A file with several hard links takes up its space
+// once, and files inside archives none, since their archive already counts.
+// Directories are summed up to depth levels under their root, or at any
+// depth for zero. Each list is cut to its top n, or kept whole for zero.
+func (c *Catalog) Usage(root string, n, depth int) (*UsageReport, error) {
+	report := &UsageReport{}
+	exts := make(map[string]*UsageEntry)
+	dirs := make(map[string]*UsageEntry)
+	err := c.spaceTakers(root, func(fileRoot, p string, size int64, mtime time.Time) {
+		report.Files++
+		report.Bytes += size
+		report.Largest = append(report.Largest, &UsageEntry{Name: p, Files: 1, Bytes: size})
+
+		ext := strings.ToLower(path.Ext(path.Base(p)))
+		if ext == "" {
+			ext = NoExtension
+		}
+		addUsage(exts, ext, size)
+
+		for _, dir := range ancestors(fileRoot, p) {
+			if depth > 0 && dirDepth(fileRoot, dir) > depth {
+				continue
+			}
+			addUsage(dirs, dir, size)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Largest = topUsage(report.Largest, n)
+	report.ByExt = topUsage(usageList(exts), n)
+	report.ByDir = topUsage(usageList(dirs), n)
+
+	return report, nil
+}
+
+// Calls fn with the root, path, size and mtime of each file currently
+// cataloged under root, or under every root if it is empty, that takes up
+// space of its own: the first path of each set of hard links, and no files
+// inside archives
+func (c *Catalog) spaceTakers(root string, fn func(fileRoot, p string, size int64, mtime time.Time)) error {
+	rows, err := c.Db.Query(`
+		select r.root, f.path, f.size, f.mtime, f.dev, f.inode from files f
+		join roots r on r.id = f.root_id
+		where ? = '' or r.root = ?
+		order by f.path
+		`, root, root)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counted := make(map[inodeKey]bool)
+	for rows.Next() {
+		var fileRoot, p string
+		var mtime time.Time
+		var size, dev, inode sql.NullInt64
+		err = rows.Scan(&fileRoot, &p, &size, &mtime, &dev, &inode)
+		if err != nil {
+			return err
+		}
+
+		if _, _, ok := SplitArchivePath(p); ok {
+			continue
+		}
+
+		if dev.Valid && inode.Valid && inode.Int64 != 0 {
+			id := inodeKey{uint64(dev.Int64), uint64(inode.Int64)}
+			if counted[id] {
+				continue
+			}
+			counted[id] = true
+		}
+
+		fn(fileRoot, p, size.Int64, mtime)
+	}
+
+	return rows.Err()
+}
+
+func addUsage(entries map[string]*UsageEntry, name string, size int64) {
+	e, ok := entries[name]
+	if !ok {
+		e = &UsageEntry{Name: name}
+		entries[name] = e
+	}
+	e.Files++
+	e.Bytes += size
+}
+
+func usageList(entries map[string]*UsageEntry) []*UsageEntry {
+	list := make([]*UsageEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+
+	return list
+}
+
+// Sorts entries largest first, by name among equals, and keeps the first n
+func topUsage(entries []*UsageEntry, n int) []*UsageEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bytes != entries[j].Bytes {
+			return entries[i].Bytes > entries[j].Bytes
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+
+	return entries
+}
+
+// How many directories down from root dir is, with root itself at zero
+func dirDepth(root, dir string) int {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return 0
+	}
+
+	return strings.Count(filepath.ToSlash(rel), "/") + 1
+}
+
+// Prints the largest files, and the space taken by extension and by
+// directory
+func (c *Catalog) ReportUsage(report *UsageReport) {
+	sections := []struct {
+		event, title string
+		entries      []*UsageEntry
+	}{
+		{"usage-file", "Largest files", report.Largest},
+		{"usage-ext", "By extension", report.ByExt},
+		{"usage-dir", "By directory", report.ByDir},
+	}
+
+	// Sizes line up in a column, as plain numbers with -bytes
+	column := func(n int64) string {
+		if c.Out.Bytes {
+			return fmt.Sprintf("%14d", n)
+		}
+		return fmt.Sprintf("%10s", c.Out.Size(n))
+	}
+
+	for _, s := range sections {
+		if len(s.entries) == 0 {
+			continue
+		}
+
+		c.Out.Print("usage-section", Fields{"section": s.title}, "%s\n", s.title)
+		for _, e := range s.entries {
+			if s.event == "usage-file" {
+				c.Out.Print(s.event, Fields{"path": e.Name, "bytes": e.Bytes}, "  %s  %s\n", column(e.Bytes), e.Name)
+				continue
+			}
+
+			c.Out.Print(s.event, Fields{"name": e.Name, "files": e.Files, "bytes": e.Bytes}, "  %s  %8d files  %s\n", column(e.Bytes), e.Files, e.Name)
+		}
+	}
+
+	c.Out.Print("usage-summary", Fields{"files": report.Files, "bytes": report.Bytes}, "%d files, %s\n", report.Files, c.Out.Size(report.Bytes))
+}
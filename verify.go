@@ -0,0 +1,162 @@
+package leibniz
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// The outcome of rehashing a cataloged file
+type Verification struct {
+	Path        string
+	Algo        string
+	StoredHash  string
+	Hash        string
+	StoredMtime time.Time
+	Mtime       time.Time
+	Err         error
+}
+
+// A changed hash under an unchanged mtime means the content changed without
+// anything writing to the file, which is what bitrot looks like. Files
+// imported from a manifest have no mtime, so any change to them counts.
+func (v *Verification) Corrupt() bool {
+	return v.Err == nil && v.Hash != v.StoredHash && (v.Mtime.Equal(v.StoredMtime) || v.StoredMtime.IsZero())
+}
+
+func (v *Verification) Modified() bool {
+	return v.Err == nil && !v.Mtime.Equal(v.StoredMtime) && !v.StoredMtime.IsZero()
+}
+
+var verifyQuery string = `
+	select f.path, f.algo, f.hash, f.mtime from files f
+	join roots r on r.id = f.root_id
+	where (? = '' or r.root = ?)
+	order by f.path
+	`
+
+// Rehashes every file in the catalog, or only those under root if it is not
+// empty, calling fn with the result for each.
+func (c *Catalog) Verify(root string, fn func(*Verification) error) error {
+	rows, err := c.Db.Query(verifyQuery, root, root)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if c.stopped() {
+			return ErrInterrupted
+		}
+
+		v := &Verification{}
+		err = rows.Scan(&v.Path, &v.Algo, &v.StoredHash, &v.StoredMtime)
+		if err != nil {
+			return err
+		}
+
+		c.Out.Event("verifying", Fields{"path": v.Path, "algo": v.Algo})
+		v.Hash, v.Mtime, v.Err = c.rehash(v.Algo, v.Path)
+
+		err = fn(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (c *Catalog) rehash(algo, path string) (string, time.Time, error) {
+	if IsS3Root(path) {
+		return rehashObject(algo, path)
+	}
+
+	if archive, member, ok := SplitArchivePath(path); ok {
+		hash, info, err := rehashMember(algo, archive, member)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		return hash, info.ModTime(), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	hash, err := HashContent(algo, file, info)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return hash, info.ModTime(), nil
+}
+
+// Prints files that look corrupt, and with verbosity every other file too.
+// Returns an error if any file failed verification.
+func (c *Catalog) ReportVerify(root string) error {
+	var checked, corrupt, modified, failed int
+	err := c.Verify(root, func(v *Verification) error {
+		checked++
+
+		fields := Fields{
+			"path":         v.Path,
+			"algo":         v.Algo,
+			"stored_hash":  v.StoredHash,
+			"stored_mtime": v.StoredMtime,
+		}
+		if v.Err == nil {
+			fields["hash"] = v.Hash
+			fields["mtime"] = v.Mtime
+		}
+
+		switch {
+		case v.Err != nil:
+			failed++
+			fields["status"] = "error"
+			fields["error"] = v.Err
+			c.Out.Print("verify", fields, "ERROR %s: %s\n", v.Path, v.Err)
+		case v.Corrupt() && v.StoredMtime.IsZero():
+			corrupt++
+			fields["status"] = "corrupt"
+			c.Out.Print("verify", fields, "CORRUPT %s: manifest has %s, now %s\n", v.Path, v.StoredHash, v.Hash)
+		case v.Corrupt():
+			corrupt++
+			fields["status"] = "corrupt"
+			c.Out.Print("verify", fields, "CORRUPT %s: stored %s, now %s, mtime %s unchanged\n", v.Path, v.StoredHash, v.Hash, c.Out.Time(v.Mtime))
+		case v.Modified():
+			modified++
+			fields["status"] = "modified"
+			c.Out.Verbosity("verify", fields, "MODIFIED %s: stored %s at %s, now %s at %s\n", v.Path, v.StoredHash, c.Out.Time(v.StoredMtime), v.Hash, c.Out.Time(v.Mtime))
+		default:
+			fields["status"] = "ok"
+			c.Out.Verbosity("verify", fields, "OK %s: %s\n", v.Path, v.Hash)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Out.Print("verify-summary", Fields{
+		"checked":  checked,
+		"corrupt":  corrupt,
+		"modified": modified,
+		"errors":   failed,
+	}, "%d files checked, %d corrupt, %d modified, %d errors\n", checked, corrupt, modified, failed)
+
+	if corrupt > 0 {
+		return fmt.Errorf("%d files failed verification", corrupt)
+	}
+
+	return nil
+}
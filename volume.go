@@ -0,0 +1,236 @@
+package leibniz
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The file a scan with -mark-volume leaves at the top of a volume that has no
+// filesystem UUID to tell it by. Scans never catalog it.
+const VolumeMarker = ".leibniz-volume"
+
+// The filesystem a root is on, known by an id that stays the same wherever it
+// is mounted
+type Volume struct {
+	Id    string
+	Label string // The name of the directory it was mounted at
+	Mount string // Where it is mounted
+}
+
+// The directory path is on the volume of, found by climbing until the device
+// changes
+func mountPoint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	dev, _, _, ok := fileId(info)
+	if !ok {
+		return "", fmt.Errorf("can't tell which device %s is on", path)
+	}
+
+	for path != filepath.Dir(path) {
+		parent, err := os.Stat(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+
+		if pdev, _, _, _ := fileId(parent); pdev != dev {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	return path, nil
+}
+
+// The volume root is on: the id in its marker, or the UUID of its filesystem,
+// or when it has neither and mark is set, the id of a marker written for it.
+// Nil if it can't be told apart from other volumes.
+func findVolume(root string, mark bool) (*Volume, error) {
+	mount, err := mountPoint(root)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Volume{Label: filepath.Base(mount), Mount: mount}
+
+	marker := filepath.Join(mount, VolumeMarker)
+	data, err := ioutil.ReadFile(marker)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		v.Id = strings.TrimSpace(string(data))
+		return v, nil
+	}
+
+	if uuid, ok := filesystemUUID(mount); ok {
+		v.Id = uuid
+		return v, nil
+	}
+
+	if !mark {
+		return nil, nil
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// A volume that can't be written to, like a mounted disc, simply goes
+	// without
+	err = ioutil.WriteFile(marker, []byte(hex.EncodeToString(id)+"\n"), 0644)
+	if err != nil {
+		return nil, nil
+	}
+	v.Id = hex.EncodeToString(id)
+
+	return v, nil
+}
+
+// Records the volume root is on, writing it a marker if it has none and
+// -mark-volume is set. When the
+// same place on the same volume was cataloged before under another path that
+// is gone now, because the drive mounts somewhere else, that root is
+// re-pointed at root first, so its files aren't cataloged all over again.
+func (c *Catalog) trackVolume(root string) error {
+	v, err := findVolume(root, c.Opts.MarkVolume)
+	if err != nil || v == nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(v.Mount, root)
+	if err != nil {
+		return err
+	}
+
+	var old string
+	err = c.Db.QueryRow(`select root from roots where volume=? and volume_path=? and root != ?`, v.Id, rel, root).Scan(&old)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	default:
+		var taken int
+		err = c.Db.QueryRow(`select count(*) from roots where root=?`, root).Scan(&taken)
+		if err != nil {
+			return err
+		}
+
+		if _, statErr := os.Stat(old); os.IsNotExist(statErr) && taken == 0 {
+			moved, err := c.RenameRoot(old, root)
+			if err != nil {
+				return err
+			}
+			c.Out.Print("root-moved", Fields{"from": old, "to": root, "volume": v.Id, "files": moved},
+				"%s is on %s, which was cataloged at %s; re-pointed %d files\n", root, v.Label, old, moved)
+		}
+	}
+
+	rootId, err := c.EnsureRootId(root)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Db.Exec(`update roots set volume=?, volume_label=?, volume_path=? where id=?`, v.Id, v.Label, rel, rootId)
+
+	return err
+}
+
+// A cataloged root, the volume it is on and whether that is mounted where it
+// was last scanned
+type RootVolume struct {
+	Root   string
+	Volume string // Empty if it wasn't identified
+	Label  string
+	Online bool
+}
+
+// The volume of each cataloged root, by root
+func (c *Catalog) RootVolumes() (map[string]*RootVolume, error) {
+	rows, err := c.Db.Query(`select root, coalesce(volume, ''), coalesce(volume_label, '') from roots`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	volumes := make(map[string]*RootVolume)
+	for rows.Next() {
+		var rv RootVolume
+		err = rows.Scan(&rv.Root, &rv.Volume, &rv.Label)
+		if err != nil {
+			return nil, err
+		}
+		volumes[rv.Root] = &rv
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rv := range volumes {
+		rv.Online = rootOnline(rv)
+	}
+
+	return volumes, nil
+}
+
+// Whether a root is there to be read: its path exists and, if its volume is
+// known, is on that volume and not some other drive mounted in its place
+func rootOnline(rv *RootVolume) bool {
+	if IsS3Root(rv.Root) {
+		return true
+	}
+
+	if _, err := os.Stat(rv.Root); err != nil {
+		return false
+	}
+	if rv.Volume == "" {
+		return true
+	}
+
+	v, err := findVolume(rv.Root, false)
+
+	return err == nil && v != nil && v.Id == rv.Volume
+}
+
+// Prints each volume with its roots, and whether it is mounted
+func (c *Catalog) ReportVolumes() error {
+	volumes, err := c.RootVolumes()
+	if err != nil {
+		return err
+	}
+
+	roots, err := c.RootsStats()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range roots {
+		rv := volumes[r.Root]
+		if rv == nil {
+			continue
+		}
+
+		state := "offline"
+		if rv.Online {
+			state = "online"
+		}
+
+		volume := "unidentified volume"
+		if rv.Volume != "" {
+			volume = rv.Label + " (" + rv.Volume + ")"
+		}
+
+		c.Out.Print("volume", Fields{"root": r.Root, "volume": rv.Volume, "label": rv.Label, "online": rv.Online, "files": r.Files, "bytes": r.Bytes},
+			"%s: %s, %s, %d files, %s\n", r.Root, volume, state, r.Files, c.Out.Size(r.Bytes))
+	}
+
+	return nil
+}
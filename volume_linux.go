@@ -0,0 +1,40 @@
+package leibniz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The UUID of the filesystem mounted at mount, from the device nodes udev
+// links under /dev/disk/by-uuid
+func filesystemUUID(mount string) (string, bool) {
+	info, err := os.Stat(mount)
+	if err != nil {
+		return "", false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+
+	links, err := ioutil.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return "", false
+	}
+
+	for _, link := range links {
+		dev, err := os.Stat(filepath.Join("/dev/disk/by-uuid", link.Name()))
+		if err != nil {
+			continue
+		}
+
+		if dst, ok := dev.Sys().(*syscall.Stat_t); ok && dst.Rdev == st.Dev {
+			return link.Name(), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package leibniz
+
+// Filesystem UUIDs are only looked up on Linux; elsewhere volumes are told
+// apart by their markers
+func filesystemUUID(mount string) (string, bool) {
+	return "", false
+}
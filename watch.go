@@ -0,0 +1,208 @@
+package leibniz
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Catalogs Opts.Root and then keeps its catalog up to date until stop is
+// closed. A path is only looked at once it has gone settle without any
+// events, so files that are still being written aren't hashed half way.
+// New and modified files are hashed, and deleted files are removed.
+func (c *Catalog) Watch(settle time.Duration, stop <-chan struct{}) (err error) {
+	root := c.Opts.Root
+
+	// A watch never ends, so it has no total to stop at
+	if c.Opts.MaxFiles > 0 || c.Opts.MaxBytes > 0 || c.Opts.MaxDuration > 0 {
+		return fmt.Errorf("-max-files, -max-bytes and -max-duration don't apply to watch")
+	}
+
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if !rootInfo.IsDir() {
+		return fmt.Errorf("Root (%s) is not a directory.", root)
+	}
+
+	rootId, err := c.EnsureRootId(root)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	addWatch := func(dir string) error {
+		return watcher.Add(dir)
+	}
+
+	c.beNice()
+
+	// The initial walk is recorded as a scan, and files that change while
+	// watching are tagged with it too
+	err = c.startScan(rootId)
+	if err != nil {
+		return err
+	}
+
+	err = c.begin()
+	if err != nil {
+		return err
+	}
+
+	err = c.Walk(rootId, WalkerContext{rootInfo, filepath.Dir(root)}, addWatch)
+	commitErr := c.commit()
+	if err == ErrInterrupted && commitErr == nil {
+		commitErr = c.checkpoint()
+	}
+	if err != nil {
+		return err
+	}
+	if commitErr != nil {
+		return commitErr
+	}
+
+	err = c.finishScan()
+	if err != nil {
+		return err
+	}
+	c.ReportStats()
+
+	if c.Opts.Prune {
+		_, err = c.Prune(root, func(path string) {
+			c.Out.Verbosity("pruned", Fields{"path": path}, "Pruned %s\n", path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Out.Verbosity("watch", Fields{"root": root}, "Watching %s\n", root)
+
+	tick := settle / 2
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	pending := make(map[string]time.Time)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Op == fsnotify.Chmod || c.Opts.Excludes.Match(event.Name) {
+				continue
+			}
+
+			pending[event.Name] = time.Now()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			c.Out.Print("watch-error", Fields{"error": err}, "Watch error: %s\n", err)
+		case now := <-ticker.C:
+			settled := make([]string, 0)
+			for p, last := range pending {
+				if now.Sub(last) >= settle {
+					settled = append(settled, p)
+					delete(pending, p)
+				}
+			}
+
+			if len(settled) == 0 {
+				continue
+			}
+
+			err = c.applyChanges(rootId, settled, addWatch)
+			if err == ErrInterrupted {
+				return c.checkpoint()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Catalogs the paths that still exist before removing the ones that don't,
+// so that a file that was moved is seen as a move rather than a deletion
+// followed by a new file.
+func (c *Catalog) applyChanges(rootId int64, paths []string, onDir func(dir string) error) (err error) {
+	sort.Strings(paths)
+
+	err = c.begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		commitErr := c.commit()
+		if err == nil {
+			err = commitErr
+		}
+	}()
+
+	vanished := make([]string, 0)
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			vanished = append(vanished, p)
+			continue
+		}
+
+		if err == nil {
+			err = c.Walk(rootId, WalkerContext{info, filepath.Dir(p)}, onDir)
+		}
+
+		// The changes left are picked up by the next scan
+		if err == ErrInterrupted {
+			return err
+		}
+
+		// One bad file shouldn't stop the watch
+		if err != nil {
+			c.Out.Print("watch-error", Fields{"path": p, "error": err}, "%s: %s\n", p, err)
+		}
+	}
+
+	for _, p := range vanished {
+		removed, err := c.RemovePath(rootId, p)
+		if err != nil {
+			return err
+		}
+
+		if removed > 0 {
+			c.Out.Verbosity("removed", Fields{"path": p, "files": removed}, "Removed %s\n", p)
+		}
+	}
+
+	return nil
+}
+
+// Deletes the rows for path, and for everything under it if it was a
+// directory, returning the number of rows removed
+func (c *Catalog) RemovePath(rootId int64, p string) (int64, error) {
+	res, err := c.queryer().Exec(`delete from files where root_id=? and (path=? or substr(path, 1, ?)=?)`,
+		rootId, p, len(dirPrefix(p)), dirPrefix(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,100 @@
+package leibniz
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The copies of something on one volume, or under one root whose volume isn't
+// known
+type VolumeCopies struct {
+	RootVolume
+	Paths []string
+}
+
+// Looks up what, a hash or the path of a file, and gathers its copies by the
+// volume they are on, mounted or not, largest share first
+func (c *Catalog) Where(what string) ([]*VolumeCopies, error) {
+	hashes, _, err := c.lookupHashes(what)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, err := c.RootVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	byVolume := make(map[string]*VolumeCopies)
+	err = c.Lookup(hashes, func(r *Record) error {
+		rv := volumes[r.Root]
+		if rv == nil {
+			rv = &RootVolume{Root: r.Root}
+		}
+
+		key := rv.Volume
+		if key == "" {
+			key = "root:" + r.Root
+		}
+
+		vc := byVolume[key]
+		if vc == nil {
+			vc = &VolumeCopies{RootVolume: *rv}
+			byVolume[key] = vc
+		}
+		// A volume mounted anywhere is online, whichever of its roots
+		// is looked at
+		vc.Online = vc.Online || rv.Online
+		vc.Paths = append(vc.Paths, r.Path)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make([]*VolumeCopies, 0, len(byVolume))
+	for _, vc := range byVolume {
+		sort.Strings(vc.Paths)
+		copies = append(copies, vc)
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		if len(copies[i].Paths) != len(copies[j].Paths) {
+			return len(copies[i].Paths) > len(copies[j].Paths)
+		}
+		return copies[i].Paths[0] < copies[j].Paths[0]
+	})
+
+	return copies, nil
+}
+
+// Prints the volumes holding copies of what, each with its copies. Returns an
+// error if there are none, as lookup does.
+func (c *Catalog) ReportWhere(what string) error {
+	copies, err := c.Where(what)
+	if err != nil {
+		return err
+	}
+
+	for _, vc := range copies {
+		state := "offline"
+		if vc.Online {
+			state = "online"
+		}
+
+		name := vc.Label + " (" + vc.Volume + ")"
+		if vc.Volume == "" {
+			name = vc.Root + " (unidentified volume)"
+		}
+
+		c.Out.Print("where", Fields{"volume": vc.Volume, "label": vc.Label, "root": vc.Root, "online": vc.Online, "paths": vc.Paths},
+			"%s, %s: %d copies\n  %s\n", name, state, len(vc.Paths), strings.Join(vc.Paths, "\n  "))
+	}
+
+	if len(copies) == 0 {
+		return fmt.Errorf("%s isn't in the catalog", what)
+	}
+
+	return nil
+}
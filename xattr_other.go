@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package leibniz
+
+// Extended attributes are only read on Linux and macOS
+func ReadXattrs(path string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
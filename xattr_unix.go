@@ -0,0 +1,64 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package leibniz
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+// Reads the extended attributes of the file at path by name. Filesystems
+// without them give an empty map.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+
+	names, err := xattrCall(func(buf []byte) (int, error) {
+		return unix.Listxattr(path, buf)
+	})
+	if errors.Is(err, unix.ENOTSUP) {
+		return xattrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := xattrCall(func(buf []byte) (int, error) {
+			return unix.Getxattr(path, string(name), buf)
+		})
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+
+	return xattrs, nil
+}
+
+// Calls fn once with no buffer to learn the size it needs, then again to fill
+// one, retrying if the attributes grew in between
+func xattrCall(fn func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}